@@ -0,0 +1,551 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Run-once commands for ad-hoc inspection of fabrics.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/dswarbrick/fabricmon/config"
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer/influxdb"
+	nodenamemapwriter "github.com/dswarbrick/fabricmon/writer/nodenamemap"
+	"github.com/dswarbrick/fabricmon/writer/prometheus"
+)
+
+// A reset threshold of 100% never triggers a reset, since counters latch at their maximum value.
+// Ad-hoc inspection should not have side effects on the fabric.
+const inspectThreshold = 100
+
+type portView struct {
+	Port       int               `json:"port" yaml:"port"`
+	State      string            `json:"state" yaml:"state"`
+	PhysState  string            `json:"phys_state" yaml:"phys_state"`
+	LinkWidth  string            `json:"link_width,omitempty" yaml:"link_width,omitempty"`
+	LinkSpeed  string            `json:"link_speed,omitempty" yaml:"link_speed,omitempty"`
+	RemoteGUID string            `json:"remote_guid,omitempty" yaml:"remote_guid,omitempty"`
+	RemotePort int               `json:"remote_port,omitempty" yaml:"remote_port,omitempty"`
+	RemoteDesc string            `json:"remote_desc,omitempty" yaml:"remote_desc,omitempty"`
+	Counters   map[string]uint64 `json:"counters,omitempty" yaml:"counters,omitempty"`
+}
+
+type nodeView struct {
+	GUID       string     `json:"guid" yaml:"guid"`
+	SystemGUID string     `json:"system_guid" yaml:"system_guid"`
+	Type       string     `json:"type" yaml:"type"`
+	Desc       string     `json:"desc" yaml:"desc"`
+	VendorID   uint       `json:"vendor_id" yaml:"vendor_id"`
+	DeviceID   uint       `json:"device_id" yaml:"device_id"`
+	Ports      []portView `json:"ports,omitempty" yaml:"ports,omitempty"`
+}
+
+type fabricView struct {
+	Hostname   string     `json:"hostname" yaml:"hostname"`
+	CAName     string     `json:"ca" yaml:"ca"`
+	SourcePort int        `json:"source_port" yaml:"source_port"`
+	Timestamp  time.Time  `json:"timestamp" yaml:"timestamp"`
+	Incomplete bool       `json:"incomplete,omitempty" yaml:"incomplete,omitempty"`
+	Nodes      []nodeView `json:"nodes" yaml:"nodes"`
+}
+
+type smInfoView struct {
+	CAName        string `json:"ca" yaml:"ca"`
+	Port          int    `json:"port" yaml:"port"`
+	LID           int    `json:"sm_lid" yaml:"sm_lid"`
+	GUID          string `json:"sm_guid" yaml:"sm_guid"`
+	ActivityCount uint32 `json:"activity_count" yaml:"activity_count"`
+	Priority      uint8  `json:"priority" yaml:"priority"`
+	State         string `json:"state" yaml:"state"`
+	Error         string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+func guidString(guid uint64) string {
+	return fmt.Sprintf("%#016x", guid)
+}
+
+// namedCounters converts the valid counters of a port to a map keyed by counter name.
+func namedCounters(counters *infiniband.Counters) map[string]uint64 {
+	if counters.Empty() {
+		return nil
+	}
+
+	named := make(map[string]uint64, infiniband.NumCounters)
+
+	for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+		if v, ok := counters.Get(id); ok {
+			named[id.String()] = v
+		}
+	}
+
+	return named
+}
+
+func newNodeView(node infiniband.Node, withPorts bool) nodeView {
+	nv := nodeView{
+		GUID:       guidString(node.GUID),
+		SystemGUID: guidString(node.SystemGUID),
+		Type:       infiniband.NodeTypeToStr(node.NodeType),
+		Desc:       node.NodeDesc,
+		VendorID:   node.VendorID,
+		DeviceID:   node.DeviceID,
+	}
+
+	if !withPorts {
+		return nv
+	}
+
+	for portNum, port := range node.Ports {
+		// Unpopulated port (e.g., port zero of non-switch nodes).
+		if port.State == "" {
+			continue
+		}
+
+		pv := portView{
+			Port:      portNum,
+			State:     port.State,
+			PhysState: port.PhysState,
+			LinkWidth: port.LinkWidth,
+			LinkSpeed: port.LinkSpeed,
+			Counters:  namedCounters(&port.Counters),
+		}
+
+		if port.RemoteGUID != 0 {
+			pv.RemoteGUID = guidString(port.RemoteGUID)
+			pv.RemotePort = port.RemotePort
+			pv.RemoteDesc = port.RemoteNodeDesc
+		}
+
+		nv.Ports = append(nv.Ports, pv)
+	}
+
+	return nv
+}
+
+// encode writes v to w as JSON or YAML. It returns false if format is neither.
+func encode(w io.Writer, format string, v interface{}) (bool, error) {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return true, enc.Encode(v)
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		return true, enc.Encode(v)
+	}
+
+	return false, nil
+}
+
+// errNoFabrics is returned by sweep if no fabric was swept.
+var errNoFabrics = errors.New("no fabric swept")
+
+// sweep performs a single discovery of all fabrics of the source, returning the fabrics
+// discovered. Counters are reset according to resetThreshold. The returned error is that of the
+// sweep, or describes the fabrics which are incomplete, or errNoFabrics, so that commands do not
+// succeed with partial or empty output.
+func sweep(ctx context.Context, src infiniband.Source, conf *config.FabricmonConf, resetThreshold uint) ([]infiniband.Fabric, error) {
+	var fabrics []infiniband.Fabric
+
+	ctx, cancel := sweepContext(ctx, conf)
+	defer cancel()
+
+	c := make(chan infiniband.Fabric)
+	done := make(chan struct{})
+
+	go func() {
+		for fabric := range c {
+			fabrics = append(fabrics, fabric)
+		}
+		close(done)
+	}()
+
+	err := src.Sweep(ctx, c, sweepConfig(conf, resetThreshold), true)
+
+	close(c)
+	<-done
+
+	// Subnets are swept concurrently, so the fabrics arrive in no particular order.
+	sort.Slice(fabrics, func(i, j int) bool {
+		if fabrics[i].CAName != fabrics[j].CAName {
+			return fabrics[i].CAName < fabrics[j].CAName
+		}
+		return fabrics[i].SourcePort < fabrics[j].SourcePort
+	})
+
+	if err != nil {
+		return fabrics, err
+	}
+
+	if len(fabrics) == 0 {
+		return nil, errNoFabrics
+	}
+
+	// Sources need not return an error for an incomplete fabric.
+	var errs []error
+
+	for _, f := range fabrics {
+		if f.Incomplete {
+			errs = append(errs, fmt.Errorf("%s port %d: sweep incomplete", f.CAName, f.SourcePort))
+		}
+	}
+
+	return fabrics, errors.Join(errs...)
+}
+
+// exportTopology performs a single sweep of all fabrics of the source, and writes the topology of each fabric in the
+// specified format. The fabrics swept are written even if the sweep fails, whose error is returned.
+func exportTopology(ctx context.Context, src infiniband.Source, conf *config.FabricmonConf, format, outputDir string) error {
+	fabrics, err := sweep(ctx, src, conf, inspectThreshold)
+
+	splitter := make(chan infiniband.Fabric)
+	done := make(chan struct{})
+
+	go func() {
+		router(splitter, topologyWriters([]string{format}, outputDir), nil)
+		close(done)
+	}()
+
+	for _, fabric := range fabrics {
+		splitter <- fabric
+	}
+
+	close(splitter)
+	<-done
+
+	return err
+}
+
+// replay feeds the fabrics of a replay source through the router to the configured writers, until
+// all fabrics have been replayed. Snapshots are not recorded, since they would merely duplicate the
+// snapshot file.
+func replay(ctx context.Context, src infiniband.Source, conf *config.FabricmonConf) error {
+	c := *conf
+	c.Snapshot.Enabled = false
+
+	writers := configureWriters(&c)
+	if len(writers) == 0 {
+		return fmt.Errorf("no writers configured")
+	}
+
+	splitter := make(chan infiniband.Fabric)
+	done := make(chan struct{})
+
+	go func() {
+		router(splitter, writers, nil)
+		close(done)
+	}()
+
+	var (
+		n   int
+		err error
+	)
+
+	for {
+		if err = src.Sweep(ctx, splitter, infiniband.SweepConfig{}, true); err != nil {
+			break
+		}
+
+		n++
+	}
+
+	close(splitter)
+	<-done
+
+	slog.Info("replay finished", "fabrics", n)
+
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+// updateNodeNameMap performs a single sweep of all fabrics of the source, and adds entries for new
+// nodes to a node name map file, which defaults to that of the node name map writer. Unless write
+// is true, the file is left unchanged, and the updated map is printed instead. The added entries,
+// and entries whose nodes are missing from the fabrics, are logged.
+func updateNodeNameMap(ctx context.Context, w io.Writer, src infiniband.Source, conf *config.FabricmonConf, path string, write bool) error {
+	if path == "" {
+		path = conf.NodeNameMapWriter.File
+	}
+
+	if path == "" {
+		return errors.New("no node name map file specified")
+	}
+
+	fabrics, serr := sweep(ctx, src, conf, inspectThreshold)
+	tmpl := nameTemplates(conf)
+
+	var (
+		update *infiniband.NodeNameMapUpdate
+		err    error
+	)
+
+	if write {
+		update, err = nodenamemapwriter.UpdateFile(path, fabrics, tmpl)
+	} else {
+		var existing []byte
+
+		existing, err = os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		update, err = infiniband.UpdateNodeNameMap(bytes.NewReader(existing), w, fabrics, tmpl, time.Now())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Nodes of a fabric which could not be swept at all would appear to be missing.
+	if serr != nil {
+		update.Missing = nil
+	}
+
+	nodenamemapwriter.Log(path, update)
+
+	if update.Missing == nil {
+		slog.Warn("sweep incomplete, cannot check for nodes missing from fabric")
+	}
+
+	return serr
+}
+
+// printMetrics performs a single sweep and prints the counters of all fabrics in InfluxDB line
+// protocol or Prometheus text exposition format. Since this is intended to be run periodically by
+// a metrics collector, counters are reset according to the configured threshold, like the daemon.
+func printMetrics(ctx context.Context, w io.Writer, format string, src infiniband.Source, conf *config.FabricmonConf) error {
+	fabrics, err := sweep(ctx, src, conf, conf.ResetThreshold)
+
+	if format == "prometheus" {
+		return errors.Join(prometheus.WriteText(w, fabrics...), err)
+	}
+
+	for _, fabric := range fabrics {
+		if werr := influxdb.WriteLineProtocol(w, fabric); werr != nil {
+			return werr
+		}
+	}
+
+	return err
+}
+
+// printFabrics prints the links of each fabric.
+func printFabrics(w io.Writer, format string, fabrics []infiniband.Fabric) error {
+	views := make([]fabricView, 0, len(fabrics))
+
+	for _, fabric := range fabrics {
+		fv := fabricView{
+			Hostname:   fabric.Hostname,
+			CAName:     fabric.CAName,
+			SourcePort: fabric.SourcePort,
+			Timestamp:  fabric.Timestamp,
+			Incomplete: fabric.Incomplete,
+		}
+
+		for _, node := range fabric.Nodes {
+			fv.Nodes = append(fv.Nodes, newNodeView(node, true))
+		}
+
+		views = append(views, fv)
+	}
+
+	if ok, err := encode(w, format, views); ok {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	for i, fabric := range fabrics {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+
+		links := fabric.Links()
+		nodes := make(map[uint64]*infiniband.Node, len(fabric.Nodes))
+		for j := range fabric.Nodes {
+			nodes[fabric.Nodes[j].GUID] = &fabric.Nodes[j]
+		}
+
+		var incomplete string
+		if fabric.Incomplete {
+			incomplete = " (incomplete)"
+		}
+
+		fmt.Fprintf(tw, "# Fabric via %s port %d: %d nodes, %d links%s\n",
+			fabric.CAName, fabric.SourcePort, len(fabric.Nodes), len(links), incomplete)
+		fmt.Fprintln(tw, "GUID\tPORT\tDESC\tREMOTE GUID\tPORT\tREMOTE DESC\tWIDTH\tSPEED\tSTATE")
+
+		for _, link := range links {
+			local := nodes[link.LocalGUID]
+			port := local.Port(link.LocalPort)
+
+			remoteDesc := port.RemoteNodeDesc
+			if remote, ok := nodes[link.RemoteGUID]; ok {
+				remoteDesc = remote.NodeDesc
+			}
+
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+				guidString(link.LocalGUID), link.LocalPort, local.NodeDesc,
+				guidString(link.RemoteGUID), link.RemotePort, remoteDesc,
+				port.LinkWidth, port.LinkSpeed, port.State)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// printNodes prints the nodes of each fabric.
+func printNodes(w io.Writer, format string, fabrics []infiniband.Fabric) error {
+	var views []nodeView
+
+	for _, fabric := range fabrics {
+		for _, node := range fabric.Nodes {
+			views = append(views, newNodeView(node, false))
+		}
+	}
+
+	if ok, err := encode(w, format, views); ok {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "GUID\tTYPE\tVENDOR\tDEVICE\tDESC")
+
+	for _, nv := range views {
+		fmt.Fprintf(tw, "%s\t%s\t%#x\t%#x\t%s\n", nv.GUID, nv.Type, nv.VendorID, nv.DeviceID, nv.Desc)
+	}
+
+	return tw.Flush()
+}
+
+// printCounters prints the counters of one or all ports of the node with the specified GUID, which
+// is looked up in the fabrics attached to each HCA in turn.
+func printCounters(w io.Writer, format string, hcas []infiniband.HCA, conf *config.FabricmonConf, guidStr string, portNum int) error {
+	var (
+		counters map[int]infiniband.Counters
+		err      error
+	)
+
+	guid, err := strconv.ParseUint(guidStr, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid GUID: %s", guidStr)
+	}
+
+	for _, hca := range hcas {
+		if counters, err = hca.NodeCounters(guid, portNum, sweepConfig(conf, inspectThreshold)); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	views := make(map[int]map[string]uint64, len(counters))
+	for p, c := range counters {
+		views[p] = namedCounters(&c)
+	}
+
+	if ok, err := encode(w, format, views); ok {
+		return err
+	}
+
+	ports := make([]int, 0, len(views))
+	for p := range views {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PORT\tCOUNTER\tVALUE")
+
+	for _, p := range ports {
+		names := make([]string, 0, len(views[p]))
+		for name := range views[p] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(tw, "%d\t%s\t%d\n", p, name, views[p][name])
+		}
+	}
+
+	return tw.Flush()
+}
+
+// printSMInfo prints the subnet manager of the fabric attached to each InfiniBand port of each HCA.
+// Ports whose SM cannot be queried (e.g. because they are down) are listed with the error. An error
+// is only returned if no port could be queried.
+func printSMInfo(w io.Writer, format string, hcas []infiniband.HCA) error {
+	var (
+		views    []smInfoView
+		errs     []error
+		answered bool
+	)
+
+	for _, hca := range hcas {
+		for _, portNum := range hca.Ports() {
+			sm, err := hca.SMInfo(portNum)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s port %d: %w", hca.Name, portNum, err))
+				views = append(views, smInfoView{CAName: hca.Name, Port: portNum, Error: err.Error()})
+				continue
+			}
+
+			answered = true
+
+			views = append(views, smInfoView{
+				CAName:        hca.Name,
+				Port:          portNum,
+				LID:           sm.LID,
+				GUID:          guidString(sm.GUID),
+				ActivityCount: sm.ActivityCount,
+				Priority:      sm.Priority,
+				State:         sm.StateString(),
+			})
+		}
+	}
+
+	if !answered && len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	if ok, err := encode(w, format, views); ok {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CA\tPORT\tSM LID\tSM GUID\tPRIORITY\tSTATE\tACTIVITY\tERROR")
+
+	for _, v := range views {
+		if v.Error != "" {
+			fmt.Fprintf(tw, "%s\t%d\t-\t-\t-\t-\t-\t%s\n", v.CAName, v.Port, v.Error)
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\t%s\t%d\t\n",
+			v.CAName, v.Port, v.LID, v.GUID, v.Priority, v.State, v.ActivityCount)
+	}
+
+	return tw.Flush()
+}
@@ -5,9 +5,16 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -16,20 +23,68 @@ import (
 
 // FabricmonConf is the main configuration struct for FabricMon.
 type FabricmonConf struct {
-	PollInterval   time.Duration `yaml:"poll_interval"`
-	ResetThreshold uint          `yaml:"counter_reset_threshold"`
-	Mkey           uint64        `yaml:"m_key"`
-	InfluxDB       []InfluxDBConf
-	Logging        LoggingConf
-	Topology       TopologyConf
+	PollInterval         time.Duration `yaml:"poll_interval"`
+	PollJitter           time.Duration `yaml:"poll_jitter"`
+	MaxPollInterval      time.Duration `yaml:"max_poll_interval"`
+	TopologyPollInterval time.Duration `yaml:"topology_interval"`
+	SweepTimeout         time.Duration `yaml:"sweep_timeout"`
+	ResetThreshold       uint          `yaml:"counter_reset_threshold"`
+	Mkey                 uint64        `yaml:"m_key"`
+	MkeyFile             string        `yaml:"m_key_file"`
+	NodeNameMaps         []string      `yaml:"node_name_maps"`
+	NodeNameMapRefresh   time.Duration `yaml:"node_name_map_refresh"`
+	InfluxDB             []InfluxDBConf
+	Logging              LoggingConf
+	Topology             TopologyConf
+	Textfile             TextfileConf
+	Snapshot             SnapshotConf
+	NodeNameMapWriter    NodeNameMapWriterConf `yaml:"node_name_map_writer"`
+	Status               StatusConf
+	Collector            CollectorConf
+	Discovery            DiscoveryConf
+	Source               SourceConf
+}
+
+// TopologyInterval returns the interval between topology discoveries, which defaults to the poll
+// interval.
+func (conf *FabricmonConf) TopologyInterval() time.Duration {
+	if conf.TopologyPollInterval == 0 {
+		return conf.PollInterval
+	}
+
+	return conf.TopologyPollInterval
 }
 
 func (conf *FabricmonConf) validate() error {
+	if conf.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval must be greater than zero")
+	}
+
+	if conf.PollJitter < 0 || conf.PollJitter >= conf.PollInterval {
+		return fmt.Errorf("poll_jitter must be between zero and poll_interval")
+	}
+
+	if conf.MaxPollInterval != 0 && conf.MaxPollInterval < conf.PollInterval {
+		return fmt.Errorf("max_poll_interval must be zero (no backoff) or at least poll_interval")
+	}
+
+	if conf.TopologyPollInterval != 0 && conf.TopologyPollInterval < conf.PollInterval {
+		return fmt.Errorf("topology_interval must be zero (same as poll_interval) or at least poll_interval")
+	}
+
+	if conf.SweepTimeout < 0 {
+		return fmt.Errorf("sweep_timeout must not be negative")
+	}
+
 	if conf.ResetThreshold < 25 || conf.ResetThreshold > 100 {
 		return fmt.Errorf("counter_reset_threshold must be between 25 and 100")
 	}
 
-	return nil
+	if conf.NodeNameMapRefresh <= 0 {
+		return fmt.Errorf("node_name_map_refresh must be greater than zero")
+	}
+
+	return conf.Discovery.validate()
 }
 
 // InfluxDBConf holds the configuration values for a single InfluxDB instance.
@@ -38,17 +93,91 @@ type InfluxDBConf struct {
 	Database        string
 	Username        string
 	Password        string
+	PasswordFile    string `yaml:"password_file"`
 	RetentionPolicy string `yaml:"retention_policy"`
 	Timeout         time.Duration
 }
 
+// resolveSecrets reads secrets from the files referenced by *_file config keys. A secret and its
+// file are mutually exclusive.
+func (conf *FabricmonConf) resolveSecrets() error {
+	if conf.MkeyFile != "" {
+		if conf.Mkey != 0 {
+			return fmt.Errorf("m_key and m_key_file are mutually exclusive")
+		}
+
+		s, err := readSecretFile(conf.MkeyFile)
+		if err != nil {
+			return fmt.Errorf("m_key_file: %w", err)
+		}
+
+		if conf.Mkey, err = strconv.ParseUint(s, 0, 64); err != nil {
+			return fmt.Errorf("m_key_file: %w", err)
+		}
+	}
+
+	for i := range conf.Discovery.Ports {
+		p := &conf.Discovery.Ports[i]
+
+		if p.MkeyFile == "" {
+			continue
+		}
+
+		if p.Mkey != 0 {
+			return fmt.Errorf("discovery port %s: m_key and m_key_file are mutually exclusive", p)
+		}
+
+		s, err := readSecretFile(p.MkeyFile)
+		if err != nil {
+			return fmt.Errorf("discovery port %s: m_key_file: %w", p, err)
+		}
+
+		if p.Mkey, err = strconv.ParseUint(s, 0, 64); err != nil {
+			return fmt.Errorf("discovery port %s: m_key_file: %w", p, err)
+		}
+	}
+
+	for i := range conf.InfluxDB {
+		c := &conf.InfluxDB[i]
+
+		if c.PasswordFile == "" {
+			continue
+		}
+
+		if c.Password != "" {
+			return fmt.Errorf("influxdb %s: password and password_file are mutually exclusive", c.URL)
+		}
+
+		s, err := readSecretFile(c.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("influxdb %s: password_file: %w", c.URL, err)
+		}
+
+		c.Password = s
+	}
+
+	return nil
+}
+
+// readSecretFile returns the contents of a file containing a secret, without leading or trailing
+// whitespace (e.g., a trailing newline).
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
 type LoggingConf struct {
 	LogLevel slog.Level `yaml:"log_level"`
 }
 
 type TopologyConf struct {
 	Enabled   bool
-	OutputDir string `yaml:"output_dir"`
+	OutputDir string   `yaml:"output_dir"`
+	Formats   []string // json (d3.js force graph), dot (Graphviz), graphml, ibsim (ibsim.net)
 }
 
 func (conf *TopologyConf) validate() error {
@@ -58,20 +187,282 @@ func (conf *TopologyConf) validate() error {
 		}
 	}
 
+	for _, f := range conf.Formats {
+		switch f {
+		case "json", "dot", "graphml", "ibsim":
+		default:
+			return fmt.Errorf("unsupported topology format: %s", f)
+		}
+	}
+
+	return nil
+}
+
+// TextfileConf holds the configuration of the node_exporter textfile collector writer.
+type TextfileConf struct {
+	Enabled   bool
+	OutputDir string `yaml:"output_dir"`
+}
+
+func (conf *TextfileConf) validate() error {
+	if conf.Enabled {
+		if err := unix.Access(conf.OutputDir, unix.W_OK); err != nil {
+			return fmt.Errorf("textfile output directory: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// SnapshotConf holds the configuration of the snapshot writer, which records fabrics for replay.
+type SnapshotConf struct {
+	Enabled   bool
+	OutputDir string `yaml:"output_dir"`
+}
+
+func (conf *SnapshotConf) validate() error {
+	if conf.Enabled {
+		if err := unix.Access(conf.OutputDir, unix.W_OK); err != nil {
+			return fmt.Errorf("snapshot output directory: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// NodeNameMapWriterConf holds the configuration of the node name map writer, which adds entries for
+// newly discovered nodes to a node name map file, named by templates (see text/template) by their
+// topology role. Without templates, the default templates are used.
+type NodeNameMapWriterConf struct {
+	Enabled   bool
+	File      string
+	Templates map[string]string
+}
+
+func (conf *NodeNameMapWriterConf) validate() error {
+	if conf.Enabled && conf.File == "" {
+		return fmt.Errorf("node_name_map_writer requires a file")
+	}
+
+	// The writer writes the format of ibnetdiscover(8), whereas maps with these extensions are
+	// read as CSV or YAML.
+	switch ext := strings.ToLower(filepath.Ext(conf.File)); ext {
+	case ".csv", ".yaml", ".yml":
+		return fmt.Errorf("node_name_map_writer: cannot write %s file %q", ext, conf.File)
+	}
+
+	for role, text := range conf.Templates {
+		switch role {
+		case "leaf", "spine", "switch", "ca", "router":
+		default:
+			return fmt.Errorf("node_name_map_writer: unknown role %q", role)
+		}
+
+		if _, err := template.New(role).Parse(text); err != nil {
+			return fmt.Errorf("node_name_map_writer: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CollectorConf holds the configuration of counter collection.
+type CollectorConf struct {
+	Workers     int // workers collecting counters concurrently, each via its own MAD port
+	MaxInFlight int `yaml:"max_in_flight"` // maximum PerfMgt queries in flight, or zero for no limit
+}
+
+func (conf *CollectorConf) validate() error {
+	if conf.Workers < 1 {
+		return fmt.Errorf("collector workers must be at least 1")
+	}
+
+	if conf.MaxInFlight < 0 {
+		return fmt.Errorf("collector max_in_flight must not be negative")
+	}
+
+	return nil
+}
+
+// DiscoveryConf holds the configuration of fabric discovery. Zero values of the discovery
+// parameters select the defaults of libibnetdisc / libibmad.
+type DiscoveryConf struct {
+	Ports   []SourcePortConf // local ports to sweep from, or all InfiniBand ports if empty
+	MaxHops int              `yaml:"max_hops"`
+	MaxSMPs int              `yaml:"max_smps"` // maximum outstanding SMPs
+	Timeout time.Duration    // MAD timeout, for both discovery and PerfMgt queries
+	Retries int              // MAD retries, for both discovery and PerfMgt queries
+	MlxEPI  bool             `yaml:"mlx_epi"` // query Mellanox ExtendedPortInfo
+}
+
+// SourcePortConf selects a local HCA port to sweep from, and optionally the m_key of the subnet
+// attached to it, which overrides the global m_key.
+type SourcePortConf struct {
+	CA       string
+	Port     int    // port number, or zero for all ports of the CA
+	Mkey     uint64 `yaml:"m_key"`
+	MkeyFile string `yaml:"m_key_file"`
+}
+
+func (p SourcePortConf) String() string {
+	if p.Port == 0 {
+		return p.CA
+	}
+
+	return fmt.Sprintf("%s/%d", p.CA, p.Port)
+}
+
+func (conf *DiscoveryConf) validate() error {
+	seen := make(map[SourcePortConf]bool)
+
+	for _, p := range conf.Ports {
+		if p.CA == "" {
+			return fmt.Errorf("discovery ports must specify a ca")
+		}
+
+		// Switch ports are numbered up to 254, although HCAs seldom have more than two ports.
+		if p.Port < 0 || p.Port > 254 {
+			return fmt.Errorf("discovery port %s: port must be between 0 (all ports) and 254", p)
+		}
+
+		key := SourcePortConf{CA: p.CA, Port: p.Port}
+		if seen[key] {
+			return fmt.Errorf("discovery port %s: duplicate port", p)
+		}
+		seen[key] = true
+	}
+
+	// Directed route paths are limited to 64 hops.
+	if conf.MaxHops < 0 || conf.MaxHops > 63 {
+		return fmt.Errorf("discovery max_hops must be between 0 (unlimited) and 63")
+	}
+
+	if conf.MaxSMPs < 0 {
+		return fmt.Errorf("discovery max_smps must not be negative")
+	}
+
+	if conf.Timeout < 0 || (conf.Timeout > 0 && conf.Timeout < time.Millisecond) {
+		return fmt.Errorf("discovery timeout must be zero (default) or at least 1ms")
+	}
+
+	if conf.Retries < 0 {
+		return fmt.Errorf("discovery retries must not be negative")
+	}
+
+	return nil
+}
+
+// SourceConf selects the source of the fabrics, which cannot be changed by reloading the config.
+type SourceConf struct {
+	Type      string   // hca (sweep the fabrics attached to local HCAs), synthetic, ibsim, or ibnetdiscover
+	Synthetic string   // topology of synthetic fabrics, e.g. fattree:k=4
+	File      string   // ibsim network file, or ibnetdiscover output
+	Counters  []string // perfquery output files of the ibnetdiscover source
+}
+
+func (conf *SourceConf) validate() error {
+	switch conf.Type {
+	case "hca":
+	case "synthetic":
+		if conf.Synthetic == "" {
+			return fmt.Errorf("source synthetic must specify a topology")
+		}
+	case "ibsim", "ibnetdiscover":
+		if conf.File == "" {
+			return fmt.Errorf("source %s must specify a file", conf.Type)
+		}
+	default:
+		return fmt.Errorf("unsupported source type: %s", conf.Type)
+	}
+
+	return nil
+}
+
+// StatusConf holds the configuration of the HTTP status and health endpoints. The endpoints are
+// disabled if no listen address is configured.
+type StatusConf struct {
+	ListenAddress string `yaml:"listen_address"`
+
+	// Maximum age of the last successful sweep, as a multiple of poll_interval, before the
+	// health endpoints report failure.
+	MaxSweepAge uint `yaml:"max_sweep_age"`
+}
+
+func (conf *StatusConf) validate() error {
+	if conf.MaxSweepAge < 1 {
+		return fmt.Errorf("status max_sweep_age must be at least 1")
+	}
+
 	return nil
 }
 
 func ReadConfig(r io.Reader) (*FabricmonConf, error) {
 	// Defaults
 	conf := &FabricmonConf{
-		PollInterval: time.Second * 10,
+		PollInterval:       time.Second * 10,
+		NodeNameMaps:       []string{"/etc/opensm/ib-node-name-map"},
+		NodeNameMapRefresh: 5 * time.Minute,
 		Logging: LoggingConf{
 			LogLevel: slog.LevelInfo,
 		},
+		Topology: TopologyConf{
+			Formats: []string{"json"},
+		},
+		Status: StatusConf{
+			MaxSweepAge: 3,
+		},
+		Collector: CollectorConf{
+			Workers: 4,
+		},
+		Discovery: DiscoveryConf{
+			MlxEPI: true,
+		},
+		Source: SourceConf{
+			Type: "hca",
+		},
 	}
 
+	// Decode to a node tree first, so that environment variables can be expanded and applied,
+	// and unknown keys detected, before decoding to the config struct.
+	var doc yaml.Node
+
 	dec := yaml.NewDecoder(r)
-	if err := dec.Decode(conf); err != nil {
+	if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	if len(doc.Content) > 0 {
+		switch n := doc.Content[0]; {
+		case n.Kind == yaml.MappingNode:
+			root = n
+		case n.Kind == yaml.ScalarNode && n.Tag == "!!null":
+			// An empty document, e.g. only comments.
+		default:
+			return nil, fmt.Errorf("line %d: config must be a mapping of settings", n.Line)
+		}
+	}
+
+	t := reflect.TypeOf(*conf)
+
+	if err := expandEnv(root); err != nil {
+		return nil, err
+	}
+
+	if err := applyEnvOverrides(root, t, os.Environ()); err != nil {
+		return nil, err
+	}
+
+	if err := checkKeys(root, t, ""); err != nil {
+		return nil, err
+	}
+
+	if err := root.Decode(conf); err != nil {
+		return nil, err
+	}
+
+	if err := conf.resolveSecrets(); err != nil {
 		return nil, err
 	}
 
@@ -83,5 +474,77 @@ func ReadConfig(r io.Reader) (*FabricmonConf, error) {
 		return nil, err
 	}
 
+	if err := conf.Textfile.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := conf.Snapshot.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := conf.NodeNameMapWriter.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := conf.Status.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := conf.Collector.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := conf.Source.validate(); err != nil {
+		return nil, err
+	}
+
 	return conf, nil
 }
+
+// redactedKeys are the config keys whose values are secrets.
+var redactedKeys = map[string]bool{
+	"m_key":    true,
+	"password": true,
+}
+
+// redact replaces the non-empty values of secret keys in a node tree.
+func redact(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, n := range node.Content {
+			redact(n)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+
+			if redactedKeys[key.Value] && value.Kind == yaml.ScalarNode {
+				if value.Value != "" && value.Value != "0" {
+					*value = yaml.Node{Kind: yaml.ScalarNode, Value: "<redacted>"}
+				}
+			} else {
+				redact(value)
+			}
+		}
+	}
+}
+
+// WriteRedacted writes the effective config as YAML, with the values of secrets redacted.
+func WriteRedacted(w io.Writer, conf *FabricmonConf) error {
+	var node yaml.Node
+
+	if err := node.Encode(conf); err != nil {
+		return err
+	}
+
+	redact(&node)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(&node); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
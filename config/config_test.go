@@ -0,0 +1,96 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfigEnv(t *testing.T) {
+	dir := t.TempDir()
+	pwFile := filepath.Join(dir, "influx.pw")
+
+	if err := os.WriteFile(pwFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_INTERVAL", "1m")
+	t.Setenv("TEST_PW_FILE", pwFile)
+	t.Setenv("FABRICMON_COUNTER_RESET_THRESHOLD", "50")
+	t.Setenv("FABRICMON_M_KEY", "0x1234")
+	t.Setenv("FABRICMON_INFLUXDB_1_URL", "http://influx2:8086")
+	t.Setenv("FABRICMON_TOPOLOGY_FORMATS", "dot, graphml")
+
+	conf, err := ReadConfig(strings.NewReader(`
+poll_interval: ${TEST_INTERVAL}
+counter_reset_threshold: 80
+influxdb:
+- url: http://influx1:8086
+  password_file: ${TEST_PW_FILE}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.PollInterval != time.Minute {
+		t.Errorf("unexpected poll_interval: %v", conf.PollInterval)
+	}
+
+	if conf.ResetThreshold != 50 {
+		t.Errorf("unexpected counter_reset_threshold: %v", conf.ResetThreshold)
+	}
+
+	if conf.Mkey != 0x1234 {
+		t.Errorf("unexpected m_key: %#x", conf.Mkey)
+	}
+
+	if len(conf.InfluxDB) != 2 || conf.InfluxDB[0].Password != "s3cret" || conf.InfluxDB[1].URL != "http://influx2:8086" {
+		t.Errorf("unexpected influxdb: %+v", conf.InfluxDB)
+	}
+
+	if len(conf.Topology.Formats) != 2 || conf.Topology.Formats[1] != "graphml" {
+		t.Errorf("unexpected topology formats: %v", conf.Topology.Formats)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteRedacted(&buf, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), "s3cret") || strings.Count(buf.String(), "<redacted>") != 2 {
+		t.Errorf("secrets not redacted:\n%s", buf.String())
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	configs := map[string]string{
+		"unknown key":      "counter_reset_threshold: 80\ntopology:\n  output_directory: /tmp\n",
+		"undefined env":    "counter_reset_threshold: 80\nm_key: ${TEST_UNDEFINED_VAR}\n",
+		"invalid interval": "counter_reset_threshold: 80\npoll_interval: 0s\n",
+		"both secrets":     "counter_reset_threshold: 80\ninfluxdb:\n- password: a\n  password_file: /dev/null\n",
+		"duplicate port":   "counter_reset_threshold: 80\ndiscovery:\n  ports:\n  - ca: mlx5_0\n  - ca: mlx5_0\n",
+		"port without ca":  "counter_reset_threshold: 80\ndiscovery:\n  ports:\n  - port: 1\n",
+		"invalid max_hops": "counter_reset_threshold: 80\ndiscovery:\n  max_hops: 64\n",
+		"csv map writer":   "counter_reset_threshold: 80\nnode_name_map_writer:\n  enabled: true\n  file: /tmp/map.csv\n",
+		"scalar document":  "counter_reset_threshold\n",
+		"sequence":         "- counter_reset_threshold: 80\n",
+	}
+
+	for name, c := range configs {
+		if _, err := ReadConfig(strings.NewReader(c)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	t.Setenv("FABRICMON_BOGUS", "1")
+
+	if _, err := ReadConfig(strings.NewReader("counter_reset_threshold: 80\n")); err == nil {
+		t.Error("unknown environment override: expected error")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Environment variable expansion and overrides, and strict checking of config keys.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables which override config keys, e.g.
+// FABRICMON_POLL_INTERVAL overrides poll_interval, and FABRICMON_INFLUXDB_0_PASSWORD overrides the
+// password of the first InfluxDB instance.
+const EnvPrefix = "FABRICMON_"
+
+var (
+	envRefRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// yamlKey returns the key of a struct field, following the same rules as yaml.v3.
+func yamlKey(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("yaml"), ",")[0]; tag != "" {
+		return tag
+	}
+
+	return strings.ToLower(f.Name)
+}
+
+// isStruct returns true if t is a struct which is decoded from a YAML mapping.
+func isStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != durationType
+}
+
+// isStructSlice returns true if t is a slice of structs, decoded from a YAML sequence of mappings.
+func isStructSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && isStruct(t.Elem())
+}
+
+// mappingValue returns the value node of key in a mapping node, or nil if it does not exist.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// expandEnv replaces ${VAR} references in all scalar values with the value of the environment
+// variable VAR. Referencing an undefined variable is an error.
+func expandEnv(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		var err error
+
+		if !envRefRegexp.MatchString(node.Value) {
+			return nil
+		}
+
+		node.Value = envRefRegexp.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := envRefRegexp.FindStringSubmatch(ref)[1]
+
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("line %d: undefined environment variable %s", node.Line, name)
+			}
+
+			return value
+		})
+
+		// Unless quoted, the type of the expanded value must be resolved anew, e.g. "${MKEY}"
+		// may expand to an integer.
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) == 0 {
+			node.Tag = ""
+		}
+
+		return err
+	case yaml.MappingNode:
+		// Only expand values, not keys.
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandEnv(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, n := range node.Content {
+			if err := expandEnv(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// envPath resolves the remainder of an environment variable name (after EnvPrefix) to a path of
+// config keys and sequence indices in the config struct type t. It returns nil if the name does not
+// correspond to a config key.
+func envPath(t reflect.Type, name string) []string {
+	switch {
+	case isStruct(t):
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key := yamlKey(f)
+			upper := strings.ToUpper(key)
+
+			if name == upper && !isStruct(f.Type) && !isStructSlice(f.Type) {
+				return []string{key}
+			}
+
+			if rest, ok := strings.CutPrefix(name, upper+"_"); ok {
+				if path := envPath(f.Type, rest); path != nil {
+					return append([]string{key}, path...)
+				}
+			}
+		}
+	case isStructSlice(t):
+		idx, rest, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil
+		}
+
+		if _, err := strconv.ParseUint(idx, 10, 16); err != nil {
+			return nil
+		}
+
+		if path := envPath(t.Elem(), rest); path != nil {
+			return append([]string{idx}, path...)
+		}
+	}
+
+	return nil
+}
+
+// setPath sets the value at a path of keys and sequence indices in a mapping node, creating any
+// missing intermediate nodes. Values of string slices are given as comma-separated lists.
+func setPath(node *yaml.Node, t reflect.Type, path []string, value string) {
+	if len(path) == 0 {
+		if t.Kind() == reflect.Slice {
+			*node = yaml.Node{Kind: yaml.SequenceNode}
+			for _, v := range strings.Split(value, ",") {
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: strings.TrimSpace(v)})
+			}
+		} else {
+			*node = yaml.Node{Kind: yaml.ScalarNode, Value: value}
+		}
+
+		return
+	}
+
+	if isStructSlice(t) {
+		idx, _ := strconv.Atoi(path[0])
+
+		if node.Kind != yaml.SequenceNode {
+			*node = yaml.Node{Kind: yaml.SequenceNode}
+		}
+
+		for len(node.Content) <= idx {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.MappingNode})
+		}
+
+		setPath(node.Content[idx], t.Elem(), path[1:], value)
+		return
+	}
+
+	if node.Kind != yaml.MappingNode {
+		*node = yaml.Node{Kind: yaml.MappingNode}
+	}
+
+	f, _ := fieldByKey(t, path[0])
+
+	child := mappingValue(node, path[0])
+	if child == nil {
+		child = &yaml.Node{}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: path[0]}, child)
+	}
+
+	setPath(child, f.Type, path[1:], value)
+}
+
+// fieldByKey returns the struct field of t with the specified config key.
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if yamlKey(t.Field(i)) == key {
+			return t.Field(i), true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// applyEnvOverrides sets config keys in the mapping node from environment variables prefixed with
+// EnvPrefix. An environment variable with the prefix which does not correspond to a config key is
+// an error.
+func applyEnvOverrides(node *yaml.Node, t reflect.Type, environ []string) error {
+	for _, env := range environ {
+		name, value, _ := strings.Cut(env, "=")
+
+		rest, ok := strings.CutPrefix(name, EnvPrefix)
+		if !ok {
+			continue
+		}
+
+		path := envPath(t, rest)
+		if path == nil {
+			return fmt.Errorf("environment variable %s does not correspond to a config key", name)
+		}
+
+		setPath(node, t, path, value)
+	}
+
+	return nil
+}
+
+// checkKeys reports keys in the mapping node which do not correspond to fields of the config struct
+// type t, since these are most likely typos which would otherwise be silently ignored.
+func checkKeys(node *yaml.Node, t reflect.Type, path string) error {
+	switch {
+	case isStruct(t) && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+
+			f, ok := fieldByKey(t, key.Value)
+			if !ok {
+				return fmt.Errorf("line %d: unknown config key %s%s", key.Line, path, key.Value)
+			}
+
+			if err := checkKeys(node.Content[i+1], f.Type, path+key.Value+"."); err != nil {
+				return err
+			}
+		}
+	case isStructSlice(t) && node.Kind == yaml.SequenceNode:
+		for i, n := range node.Content {
+			if err := checkKeys(n, t.Elem(), fmt.Sprintf("%s%d.", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
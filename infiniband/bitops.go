@@ -8,21 +8,10 @@ package infiniband
 import (
 	"encoding/binary"
 	"math/bits"
-	"unsafe"
 )
 
-var nativeEndian binary.ByteOrder
-
-// Determine native endianness of system
-func init() {
-	i := uint32(1)
-	b := (*[4]byte)(unsafe.Pointer(&i))
-	if b[0] == 1 {
-		nativeEndian = binary.LittleEndian
-	} else {
-		nativeEndian = binary.BigEndian
-	}
-}
+// bigEndian is whether the native byte order of the system is big endian.
+var bigEndian = binary.NativeEndian.Uint16([]byte{0, 1}) == 1
 
 // MaxPow2Divisor calculates the highest power of two divisor shared by two non-negative integers.
 // This is useful for finding the highest bit enum shared by two values. If x and y do not share
@@ -37,7 +26,7 @@ func maxPow2Divisor(x, y uint) uint {
 
 // htons converts a uint16 from host byte order to network byte order
 func htons(x uint16) uint16 {
-	if nativeEndian != binary.BigEndian {
+	if !bigEndian {
 		return bits.ReverseBytes16(x)
 	}
 	return x
@@ -45,7 +34,7 @@ func htons(x uint16) uint16 {
 
 // htonl converts a uint32 from host byte order to network byte order
 func htonl(x uint32) uint32 {
-	if nativeEndian != binary.BigEndian {
+	if !bigEndian {
 		return bits.ReverseBytes32(x)
 	}
 	return x
@@ -53,7 +42,7 @@ func htonl(x uint32) uint32 {
 
 // htonll converts a uint64 from host byte order to network byte order
 func htonll(x uint64) uint64 {
-	if nativeEndian != binary.BigEndian {
+	if !bigEndian {
 		return bits.ReverseBytes64(x)
 	}
 	return x
@@ -61,7 +50,7 @@ func htonll(x uint64) uint64 {
 
 // ntohs converts a uint16 from network byte order to host byte order
 func ntohs(x uint16) uint16 {
-	if nativeEndian != binary.BigEndian {
+	if !bigEndian {
 		return bits.ReverseBytes16(x)
 	}
 	return x
@@ -69,7 +58,7 @@ func ntohs(x uint16) uint16 {
 
 // ntohll converts a uint32 from network byte order to host byte order
 func ntohl(x uint32) uint32 {
-	if nativeEndian != binary.BigEndian {
+	if !bigEndian {
 		return bits.ReverseBytes32(x)
 	}
 	return x
@@ -77,7 +66,7 @@ func ntohl(x uint32) uint32 {
 
 // ntohll converts a uint64 from network byte order to host byte order
 func ntohll(x uint64) uint64 {
-	if nativeEndian != binary.BigEndian {
+	if !bigEndian {
 		return bits.ReverseBytes64(x)
 	}
 	return x
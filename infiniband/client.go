@@ -0,0 +1,138 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package infiniband
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Client is a Source which sweeps the subnets attached to the InfiniBand ports of local HCAs, via
+// the backend selected at build time. It is configured by options, rather than by package state.
+type Client struct {
+	hcas  []HCA
+	nnMap atomic.Pointer[NodeNameMap]
+	log   *slog.Logger
+
+	// Defaults for zero fields of the SweepConfig of a sweep.
+	mkey    uint64
+	timeout time.Duration
+	retries int
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithNodeNameMap sets the node name map by which the node descriptions of swept fabrics are
+// remapped. Without a node name map, node descriptions are not remapped.
+func WithNodeNameMap(m *NodeNameMap) Option {
+	return func(c *Client) {
+		c.nnMap.Store(m)
+	}
+}
+
+// WithLogger sets the logger of the client's sweeps. The default (or if log is nil) is
+// slog.Default().
+func WithLogger(log *slog.Logger) Option {
+	return func(c *Client) {
+		c.log = log
+	}
+}
+
+// WithMkey sets the m_key used by sweeps whose SweepConfig does not specify one.
+func WithMkey(mkey uint64) Option {
+	return func(c *Client) {
+		c.mkey = mkey
+	}
+}
+
+// WithTimeout sets the timeout and retries of MADs of sweeps whose SweepConfig does not specify
+// them.
+func WithTimeout(timeout time.Duration, retries int) Option {
+	return func(c *Client) {
+		c.timeout, c.retries = timeout, retries
+	}
+}
+
+// NewClient returns a client which sweeps via the specified HCAs (see GetCAs).
+func NewClient(hcas []HCA, opts ...Option) *Client {
+	c := &Client{hcas: hcas}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.log == nil {
+		c.log = slog.Default()
+	}
+
+	return c
+}
+
+// HCAs returns the HCAs of the client.
+func (c *Client) HCAs() []HCA {
+	return c.hcas
+}
+
+// NodeNameMap returns the node name map of the client, or nil if it has none.
+func (c *Client) NodeNameMap() *NodeNameMap {
+	return c.nnMap.Load()
+}
+
+// SetNodeNameMap replaces the node name map of the client, returning the previous one, which the
+// caller may close. It is safe to call during a sweep.
+func (c *Client) SetNodeNameMap(m *NodeNameMap) *NodeNameMap {
+	return c.nnMap.Swap(m)
+}
+
+// Sweep sweeps the subnets attached to the HCAs, like NetDiscover or CollectCounters.
+func (c *Client) Sweep(ctx context.Context, output chan Fabric, cfg SweepConfig, rediscover bool) error {
+	return c.sweep(ctx, output, cfg, rediscover)
+}
+
+// NetDiscover discovers the fabric of each subnet attached to the InfiniBand ports of the HCAs,
+// collects the counters of all switch ports, and sends the resulting fabrics to output. Subnets
+// are swept concurrently. A subnet which is attached to several local ports is swept only once,
+// via the first of those ports, failing over to the next one if the fabric could not be swept via
+// a port. The returned error joins a *SweepError for each port via which a subnet could not be
+// (completely) swept.
+//
+// If the context is cancelled or its deadline expires, the sweep is stopped before the next node
+// or port, and the nodes walked so far are sent to output as a fabric marked incomplete. Counters
+// are only collected once all nodes have been walked. Note that with the libibnetdisc backend, the
+// discovery itself (i.e., ibnd_discover_fabric) cannot be interrupted.
+func (c *Client) NetDiscover(ctx context.Context, output chan Fabric, cfg SweepConfig) error {
+	return c.sweep(ctx, output, cfg, true)
+}
+
+// CollectCounters collects the counters of all switch ports of the fabric of each subnet attached
+// to the InfiniBand ports of the HCAs, and sends the resulting fabrics to output, like NetDiscover.
+// However, the topology (including port states) of the last discovery is reused, unless no fabric
+// has been discovered via a port yet.
+func (c *Client) CollectCounters(ctx context.Context, output chan Fabric, cfg SweepConfig) error {
+	return c.sweep(ctx, output, cfg, false)
+}
+
+// sweepConfig returns the configuration of a sweep, with the client's defaults for zero fields.
+func (c *Client) sweepConfig(cfg SweepConfig) SweepConfig {
+	if cfg.Mkey == 0 {
+		cfg.Mkey = c.mkey
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = c.timeout
+	}
+
+	if cfg.Retries == 0 {
+		cfg.Retries = c.retries
+	}
+
+	if cfg.log == nil {
+		cfg.log = c.log
+	}
+
+	return cfg
+}
@@ -0,0 +1,349 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package infiniband
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad"
+)
+
+var errNoMADPort = errors.New("unable to open MAD port")
+
+// SweepConfig holds the parameters of a sweep.
+type SweepConfig struct {
+	Mkey           uint64
+	ResetThreshold uint // percentage of a counter's maximum value at which it is reset
+
+	// Number of workers collecting counters concurrently, each via its own MAD port.
+	Workers int
+
+	// Limits the number of PerfMgt queries in flight, across all sweeps sharing the limiter. If
+	// nil, the number of queries in flight is only limited by the number of workers.
+	Limiter QueryLimiter
+
+	// Local ports to sweep from. If empty, all InfiniBand ports of all HCAs are swept from.
+	Ports []SourcePort
+
+	// Discovery parameters. Zero values select libibnetdisc's defaults.
+	MaxHops int
+	MaxSMPs int  // maximum outstanding SMPs
+	MlxEPI  bool // query Mellanox ExtendedPortInfo, e.g. for FDR10 link speed
+
+	// Timeout and retries of MADs, for both discovery and PerfMgt queries. Zero values select
+	// libibmad's defaults.
+	Timeout time.Duration
+	Retries int
+
+	// Logger of the sweep, set by the Client. If nil, the default logger is used.
+	log *slog.Logger
+}
+
+// logger returns the logger of the sweep.
+func (cfg SweepConfig) logger() *slog.Logger {
+	if cfg.log != nil {
+		return cfg.log
+	}
+
+	return slog.Default()
+}
+
+// SourcePort selects a local HCA port to sweep from.
+type SourcePort struct {
+	CA   string
+	Port int    // port number, or zero for all ports of the CA
+	Mkey uint64 // m_key of the subnet attached to the port, or zero for SweepConfig.Mkey
+}
+
+// sourcePort returns whether the specified local port is to be swept from, and the m_key to use.
+// An entry for the specific port takes precedence over an entry for all ports of the CA.
+func (cfg SweepConfig) sourcePort(caName string, portNum int) (uint64, bool) {
+	if len(cfg.Ports) == 0 {
+		return cfg.Mkey, true
+	}
+
+	var match *SourcePort
+
+	for i, p := range cfg.Ports {
+		if p.CA == caName && (p.Port == portNum || (p.Port == 0 && match == nil)) {
+			match = &cfg.Ports[i]
+		}
+	}
+
+	if match == nil {
+		return 0, false
+	}
+
+	if match.Mkey != 0 {
+		return match.Mkey, true
+	}
+
+	return cfg.Mkey, true
+}
+
+// QueryLimiter limits the number of MAD queries in flight.
+type QueryLimiter chan struct{}
+
+// NewQueryLimiter returns a QueryLimiter which allows n queries in flight, or nil (i.e., no limit)
+// if n is not positive.
+func NewQueryLimiter(n int) QueryLimiter {
+	if n <= 0 {
+		return nil
+	}
+
+	return make(QueryLimiter, n)
+}
+
+func (l QueryLimiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+func (l QueryLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// pmaTransport sends PerfMgt MADs via a local port. It is implemented by each backend, i.e., via
+// libibmad or via the kernel's umad interface in pure Go. Errors of queries which received no
+// response wrap unix.ETIMEDOUT.
+type pmaTransport interface {
+	// get performs a PerfMgt Get() of an attribute of the specified port of the node with the
+	// specified LID, and stores the attribute data in buf, which must hold at least mad.Size bytes.
+	get(lid uint16, portNum int, attrID uint16, buf []byte) error
+
+	// reset resets the PortCounters selected by selMask (CounterSelect in bits 0-15,
+	// CounterSelect2 in bits 16-23) of the specified port of the node with the specified LID.
+	reset(lid uint16, portNum int, selMask uint32) error
+
+	close()
+}
+
+// pmaClient performs PerfMgt queries via a transport, and records them in sweep statistics.
+type pmaClient struct {
+	transport pmaTransport
+	limiter   QueryLimiter // may be nil
+	stats     *SweepStats  // may be nil, if statistics are not required
+}
+
+// query performs a PerfMgt Get() query of the specified attribute of a port of the node with the
+// specified GUID. It returns false if the query failed.
+func (c *pmaClient) query(buf []byte, lid uint16, portNum int, attrID uint16, guid uint64) bool {
+	c.limiter.acquire()
+	err := c.transport.get(lid, portNum, attrID, buf)
+	c.limiter.release()
+
+	c.record(guid, err)
+
+	return err == nil
+}
+
+// reset resets the PortCounters selected by selMask of a port of the node with the specified GUID.
+// It returns false if the reset failed.
+func (c *pmaClient) reset(lid uint16, portNum int, selMask uint32, guid uint64) bool {
+	c.limiter.acquire()
+	err := c.transport.reset(lid, portNum, selMask)
+	c.limiter.release()
+
+	c.record(guid, err)
+
+	if err == nil && c.stats != nil {
+		c.stats.CounterResets++
+	}
+
+	return err == nil
+}
+
+// record records a PerfMgt query in the sweep statistics.
+func (c *pmaClient) record(guid uint64, err error) {
+	if c.stats == nil {
+		return
+	}
+
+	c.stats.PMAQueries++
+
+	if err != nil {
+		c.stats.addError(guid, errors.Is(err, unix.ETIMEDOUT))
+	}
+}
+
+// counterJob identifies a switch port whose counters are to be collected.
+type counterJob struct {
+	nodeIdx int    // index of node in the walked nodes
+	guid    uint64 // node GUID
+	lid     uint16 // LID of the switch management port (port zero)
+	portNum int
+	log     *slog.Logger
+}
+
+// merge adds the statistics in o to s.
+func (s *SweepStats) merge(o SweepStats) {
+	s.PMAQueries += o.PMAQueries
+	s.CounterResets += o.CounterResets
+
+	for guid, e := range o.NodeErrors {
+		if s.NodeErrors == nil {
+			s.NodeErrors = make(map[uint64]NodeErrors)
+		}
+
+		se := s.NodeErrors[guid]
+		se.Failures += e.Failures
+		se.Timeouts += e.Timeouts
+		s.NodeErrors[guid] = se
+	}
+}
+
+// collectCounters collects the counters of the ports identified by jobs, and stores them in nodes.
+// The jobs are distributed among cfg.Workers workers, each of which queries counters via its own
+// transport, as returned by open. If the context is done, the remaining jobs are abandoned (i.e.,
+// all of them, if it is already done), and the context's error is returned. errNoMADPort is
+// returned if no transport could be opened.
+func collectCounters(ctx context.Context, open func() (pmaTransport, error), nodes []Node, jobs []counterJob, cfg SweepConfig, stats *SweepStats) error {
+	if err := ctx.Err(); err != nil || len(jobs) == 0 {
+		return err
+	}
+
+	workers := min(max(cfg.Workers, 1), len(jobs))
+
+	// Open a transport per worker. Fewer workers are started if not all could be opened.
+	pmas := make([]*pmaClient, 0, workers)
+
+	for i := 0; i < workers; i++ {
+		t, err := open()
+		if err != nil {
+			break
+		}
+
+		pmas = append(pmas, &pmaClient{transport: t, limiter: cfg.Limiter, stats: &SweepStats{}})
+	}
+
+	if len(pmas) == 0 {
+		return errNoMADPort
+	}
+
+	var wg sync.WaitGroup
+
+	queue := make(chan counterJob)
+
+	for _, pma := range pmas {
+		wg.Add(1)
+
+		go func(pma *pmaClient) {
+			defer wg.Done()
+
+			for job := range queue {
+				// Each job writes a distinct port, so no locking is required.
+				counters := &nodes[job.nodeIdx].Ports[job.portNum].Counters
+
+				if err := readPortCounters(pma, job, cfg.ResetThreshold, counters); err != nil {
+					job.log.Error("cannot get counters for port", "port", job.portNum, "err", err)
+				}
+			}
+		}(pma)
+	}
+
+	err := func() error {
+		defer close(queue)
+
+		for _, job := range jobs {
+			select {
+			case queue <- job:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		return nil
+	}()
+
+	wg.Wait()
+
+	for _, pma := range pmas {
+		pma.transport.close()
+		stats.merge(*pma.stats)
+	}
+
+	return err
+}
+
+// readPortCounters reads all counters of the port identified by job into c, resetting those which
+// exceed resetThreshold percent of their maximum value.
+// Note: In PortCounters, PortCountersExtended, PortXmitDataSL, and PortRcvDataSL, components that
+// represent Data (e.g. PortXmitData and PortRcvData) indicate octets divided by 4 rather than just
+// octets.
+func readPortCounters(pma *pmaClient, job counterJob, resetThreshold uint, c *Counters) error {
+	var buf [1024]byte
+
+	lid, portNum, guid := job.lid, job.portNum, job.guid
+
+	// PerfMgt ClassPortInfo is a required attribute. See ClassPortInfo, IBTA spec v1.3, table 126.
+	if !pma.query(buf[:], lid, portNum, mad.AttrClassPortInfo, guid) {
+		return fmt.Errorf("CLASS_PORT_INFO query failed")
+	}
+
+	c.Timestamp = time.Now()
+
+	capMask := mad.ClassPortInfoCapabilityMask.Get(buf[:])
+
+	// Fetch standard (32 bit (or less)) counters
+	if pma.query(buf[:], lid, portNum, mad.AttrPortCounters, guid) {
+		var selMask uint32
+
+		for id := CounterID(0); id < NumCounters; id++ {
+			info := id.Info()
+			if info.Extended {
+				continue
+			}
+
+			if (id == PortXmitWait) && (capMask&mad.PMPortXmitWait == 0) {
+				continue // Counter not supported
+			}
+
+			v := counterFields[id].Get(buf[:])
+			c.Set(id, v)
+
+			if float64(v) > (float64(info.Max()) * float64(resetThreshold) / 100) {
+				job.log.Warn("counter exceeds threshold", "port", portNum, "counter", info.Name, "value", v)
+
+				selMask |= info.Select
+			}
+		}
+
+		if selMask > 0 {
+			resetLog := job.log.With("port", portNum, "select_mask", fmt.Sprintf("%#x", selMask))
+			resetLog.Warn("resetting counters")
+
+			if !pma.reset(lid, portNum, selMask, guid) {
+				resetLog.Error("counter reset failed")
+			}
+		}
+	}
+
+	if (capMask&mad.PMExtWidthSupported == 0) && (capMask&mad.PMExtWidthNoIETF == 0) {
+		// TODO: Fetch standard data / packet counters if extended counters are not supported
+		// (pre-QDR hardware).
+		job.log.Warn("port does not support extended counters", "port", portNum)
+		return nil
+	}
+
+	// Fetch extended (64 bit) counters
+	if pma.query(buf[:], lid, portNum, mad.AttrPortCountersExt, guid) {
+		for id := CounterID(0); id < NumCounters; id++ {
+			if id.Info().Extended {
+				c.Set(id, counterFields[id].Get(buf[:]))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,343 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package infiniband
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	l := NewQueryLimiter(3)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			l.acquire()
+			defer l.release()
+
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+		}()
+	}
+
+	wg.Wait()
+
+	if maxInFlight > 3 {
+		t.Fatalf("%d queries in flight, expected at most 3", maxInFlight)
+	}
+
+	// No limit
+	if NewQueryLimiter(0) != nil {
+		t.Fatal("expected nil limiter")
+	}
+}
+
+func TestSweepStatsMerge(t *testing.T) {
+	var s SweepStats
+
+	s.addError(1, true)
+	s.merge(SweepStats{PMAQueries: 5, CounterResets: 1, NodeErrors: map[uint64]NodeErrors{1: {1, 0}, 2: {2, 2}}})
+
+	expected := SweepStats{
+		PMAQueries:    5,
+		CounterResets: 1,
+		NodeErrors:    map[uint64]NodeErrors{1: {2, 1}, 2: {2, 2}},
+	}
+
+	if !reflect.DeepEqual(s, expected) {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
+
+func TestSourcePort(t *testing.T) {
+	cfg := SweepConfig{
+		Mkey: 1,
+		Ports: []SourcePort{
+			{CA: "mlx5_0"},
+			{CA: "mlx5_0", Port: 2, Mkey: 2},
+			{CA: "mlx5_1", Port: 1},
+		},
+	}
+
+	tests := []struct {
+		ca   string
+		port int
+		mkey uint64
+		ok   bool
+	}{
+		{"mlx5_0", 1, 1, true},
+		{"mlx5_0", 2, 2, true},
+		{"mlx5_1", 1, 1, true},
+		{"mlx5_1", 2, 0, false},
+		{"mlx5_2", 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		if mkey, ok := cfg.sourcePort(tt.ca, tt.port); mkey != tt.mkey || ok != tt.ok {
+			t.Errorf("%s port %d: got %d, %t, want %d, %t", tt.ca, tt.port, mkey, ok, tt.mkey, tt.ok)
+		}
+	}
+
+	if mkey, ok := (SweepConfig{Mkey: 1}).sourcePort("mlx5_0", 1); mkey != 1 || !ok {
+		t.Errorf("no source ports: got %d, %t, want 1, true", mkey, ok)
+	}
+}
+
+// fakePMA opens fake PerfMgt transports, which answer every query of a port with extended counters,
+// whose PortXmitData is LID * 100 + port number. It records the queries in flight and the
+// transports used.
+type fakePMA struct {
+	opens int // number of transports which can be opened, or -1 for no limit
+
+	// get, if non-nil, is called at the start of every query.
+	get func()
+
+	mu          sync.Mutex
+	opened      int
+	closed      int
+	used        map[*fakeTransport]bool
+	inFlight    int
+	maxInFlight int
+}
+
+func (p *fakePMA) open() (pmaTransport, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.opens >= 0 && p.opened == p.opens {
+		return nil, errors.New("no more MAD ports")
+	}
+
+	p.opened++
+
+	return &fakeTransport{pma: p}, nil
+}
+
+type fakeTransport struct {
+	pma *fakePMA
+}
+
+func (t *fakeTransport) get(lid uint16, portNum int, attrID uint16, buf []byte) error {
+	p := t.pma
+
+	if p.get != nil {
+		p.get()
+	}
+
+	p.mu.Lock()
+	if p.used == nil {
+		p.used = make(map[*fakeTransport]bool)
+	}
+
+	p.used[t] = true
+	p.inFlight++
+	p.maxInFlight = max(p.maxInFlight, p.inFlight)
+	p.mu.Unlock()
+
+	time.Sleep(100 * time.Microsecond)
+
+	clear(buf[:mad.Size])
+
+	switch attrID {
+	case mad.AttrClassPortInfo:
+		mad.ClassPortInfoCapabilityMask.Set(buf, mad.PMExtWidthSupported)
+	case mad.AttrPortCountersExt:
+		counterFields[PortXmitData].Set(buf, uint64(lid)*100+uint64(portNum))
+	}
+
+	p.mu.Lock()
+	p.inFlight--
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (t *fakeTransport) reset(lid uint16, portNum int, selMask uint32) error {
+	return nil
+}
+
+func (t *fakeTransport) close() {
+	t.pma.mu.Lock()
+	t.pma.closed++
+	t.pma.mu.Unlock()
+}
+
+// counterJobs returns n switches of 4 ports each, and a job for each of their ports.
+func counterJobs(n int) ([]Node, []counterJob) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var (
+		nodes []Node
+		jobs  []counterJob
+	)
+
+	for i := 0; i < n; i++ {
+		guid := uint64(i + 1)
+		nodes = append(nodes, Node{GUID: guid, NodeType: IB_NODE_SWITCH, Ports: make([]Port, 5)})
+
+		for portNum := 1; portNum <= 4; portNum++ {
+			jobs = append(jobs, counterJob{nodeIdx: i, guid: guid, lid: uint16(guid), portNum: portNum, log: log})
+		}
+	}
+
+	return nodes, jobs
+}
+
+func TestCollectCounters(t *testing.T) {
+	nodes, jobs := counterJobs(10)
+	pma := &fakePMA{opens: -1}
+	cfg := SweepConfig{Workers: 8, Limiter: NewQueryLimiter(2)}
+
+	var stats SweepStats
+
+	if err := collectCounters(context.Background(), pma.open, nodes, jobs, cfg, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range jobs {
+		c := &nodes[job.nodeIdx].Ports[job.portNum].Counters
+
+		if v, ok := c.Get(PortXmitData); !ok || v != uint64(job.lid)*100+uint64(job.portNum) || c.Timestamp.IsZero() {
+			t.Errorf("unexpected counters of node %d port %d: %+v", job.guid, job.portNum, c)
+		}
+	}
+
+	// Each port is queried for ClassPortInfo, PortCounters and PortCountersExtended.
+	if stats.PMAQueries != uint64(3*len(jobs)) {
+		t.Errorf("expected %d queries, got %d", 3*len(jobs), stats.PMAQueries)
+	}
+
+	if pma.maxInFlight > 2 {
+		t.Errorf("%d queries in flight, expected at most 2", pma.maxInFlight)
+	}
+
+	if pma.opened != 8 || pma.closed != 8 {
+		t.Errorf("expected 8 transports opened and closed, got %d and %d", pma.opened, pma.closed)
+	}
+}
+
+func TestCollectCountersCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nodes, jobs := counterJobs(25)
+
+	// The context is cancelled while the only worker queries the first port.
+	pma := &fakePMA{opens: -1, get: cancel}
+
+	var stats SweepStats
+
+	if err := collectCounters(ctx, pma.open, nodes, jobs, SweepConfig{Workers: 1}, &stats); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if stats.PMAQueries >= uint64(3*len(jobs)) {
+		t.Errorf("expected remaining jobs to be abandoned, got %d queries", stats.PMAQueries)
+	}
+
+	if pma.closed != pma.opened {
+		t.Errorf("%d transports opened, but %d closed", pma.opened, pma.closed)
+	}
+
+	// No counters are collected once the context is done.
+	pma = &fakePMA{opens: -1}
+
+	if err := collectCounters(ctx, pma.open, nodes, jobs, SweepConfig{Workers: 1}, &stats); !errors.Is(err, context.Canceled) || pma.opened != 0 {
+		t.Fatalf("expected context.Canceled without opening a transport, got %v, %d opened", err, pma.opened)
+	}
+}
+
+func TestCollectCountersOpenFailure(t *testing.T) {
+	nodes, jobs := counterJobs(10)
+
+	// Only two of four transports can be opened.
+	pma := &fakePMA{opens: 2}
+
+	var stats SweepStats
+
+	if err := collectCounters(context.Background(), pma.open, nodes, jobs, SweepConfig{Workers: 4}, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pma.used) > 2 || pma.closed != 2 {
+		t.Errorf("expected at most 2 workers, got %d transports used and %d closed", len(pma.used), pma.closed)
+	}
+
+	if stats.PMAQueries != uint64(3*len(jobs)) {
+		t.Errorf("expected %d queries, got %d", 3*len(jobs), stats.PMAQueries)
+	}
+
+	// No transport can be opened.
+	pma = &fakePMA{opens: 0}
+
+	if err := collectCounters(context.Background(), pma.open, nodes, jobs, SweepConfig{Workers: 4}, &stats); !errors.Is(err, errNoMADPort) {
+		t.Fatalf("expected errNoMADPort, got %v", err)
+	}
+}
+
+// BenchmarkCollectCounters benchmarks counter collection with varying numbers of workers. It
+// requires an HCA, e.g. simulated by ibsim:
+//
+//	LD_PRELOAD=/usr/lib/x86_64-linux-gnu/umad2sim/libumad2sim.so go test -run=^$ -bench=. ./infiniband
+func BenchmarkCollectCounters(b *testing.B) {
+	if UmadInit() < 0 {
+		b.Skip("cannot initialise umad library")
+	}
+
+	defer UmadDone()
+
+	hcas := GetCAs(nil)
+	if len(hcas) == 0 {
+		b.Skip("no HCAs found")
+	}
+
+	defer func() {
+		for _, hca := range hcas {
+			hca.Release()
+		}
+	}()
+
+	c := NewClient(hcas)
+
+	for _, workers := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			// Counters are never reset.
+			cfg := SweepConfig{ResetThreshold: 100, Workers: workers}
+
+			// Discover the topology once, so that only counter collection is measured.
+			c.NetDiscover(context.Background(), nil, cfg)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				c.CollectCounters(context.Background(), nil, cfg)
+			}
+		})
+	}
+}
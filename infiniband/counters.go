@@ -0,0 +1,165 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Port counters and their metadata.
+
+package infiniband
+
+import (
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad"
+)
+
+// CounterID identifies a port counter, and indexes Counters.Values.
+type CounterID int
+
+// Counters of PortCounters (IBTA spec v1.3, table 247), followed by those of PortCountersExtended
+// (table 260). Standard data / packet counters are superseded by their extended counterparts, and
+// not collected.
+const (
+	SymbolErrorCounter CounterID = iota
+	LinkErrorRecoveryCounter
+	LinkDownedCounter
+	PortRcvErrors
+	PortRcvRemotePhysicalErrors
+	PortRcvSwitchRelayErrors
+	PortXmitDiscards
+	PortXmitConstraintErrors
+	PortRcvConstraintErrors
+	LocalLinkIntegrityErrors
+	ExcessiveBufferOverrunErrors
+	VL15Dropped
+	PortXmitWait // requires cap mask IB_PM_PC_XMIT_WAIT_SUP
+
+	PortXmitData
+	PortRcvData
+	PortXmitPkts
+	PortRcvPkts
+	PortUnicastXmitPkts
+	PortUnicastRcvPkts
+	PortMulticastXmitPkts
+	PortMulticastRcvPkts
+
+	NumCounters // number of counters, not a counter itself
+)
+
+// CounterInfo holds the metadata of a counter.
+type CounterInfo struct {
+	Name        string
+	Width       uint   // width in bits; the counter latches at its maximum value
+	Unit        string // unit of the counter's value, multiplied by Scale
+	Scale       uint64 // e.g. data counters indicate octets divided by 4
+	Extended    bool   // counter of PortCountersExtended, rather than PortCounters
+	Select      uint32 // CounterSelect (bits 0-15), CounterSelect2 (bits 16-23) of PortCounters
+	Description string
+}
+
+// Max returns the maximum value of the counter, at which it latches.
+func (c CounterInfo) Max() uint64 {
+	return 1<<c.Width - 1
+}
+
+var counterInfo = [NumCounters]CounterInfo{
+	SymbolErrorCounter:           {"SymbolErrorCounter", 16, "errors", 1, false, 0x1, "Minor link errors detected on one or more physical lanes"},
+	LinkErrorRecoveryCounter:     {"LinkErrorRecoveryCounter", 8, "events", 1, false, 0x2, "Successful completions of the link error recovery process"},
+	LinkDownedCounter:            {"LinkDownedCounter", 8, "events", 1, false, 0x4, "Failed completions of the link error recovery process, which downed the link"},
+	PortRcvErrors:                {"PortRcvErrors", 16, "packets", 1, false, 0x8, "Packets containing an error received on the port"},
+	PortRcvRemotePhysicalErrors:  {"PortRcvRemotePhysicalErrors", 16, "packets", 1, false, 0x10, "Packets marked with the EBP delimiter received on the port"},
+	PortRcvSwitchRelayErrors:     {"PortRcvSwitchRelayErrors", 16, "packets", 1, false, 0x20, "Packets received on the port which were discarded because they could not be forwarded"},
+	PortXmitDiscards:             {"PortXmitDiscards", 16, "packets", 1, false, 0x40, "Outbound packets discarded because the port is down or congested"},
+	PortXmitConstraintErrors:     {"PortXmitConstraintErrors", 8, "packets", 1, false, 0x80, "Packets not transmitted due to outbound raw filtering or partition enforcement"},
+	PortRcvConstraintErrors:      {"PortRcvConstraintErrors", 8, "packets", 1, false, 0x100, "Packets received which were discarded due to inbound raw filtering or partition enforcement"},
+	LocalLinkIntegrityErrors:     {"LocalLinkIntegrityErrors", 4, "events", 1, false, 0x200, "Times that the local physical errors exceeded the LocalPhyErrors threshold"},
+	ExcessiveBufferOverrunErrors: {"ExcessiveBufferOverrunErrors", 4, "events", 1, false, 0x400, "Times that consecutive flow control update periods had buffer overruns"},
+	VL15Dropped:                  {"VL15Dropped", 16, "packets", 1, false, 0x800, "Incoming VL15 (subnet management) packets dropped due to resource limitations"},
+	PortXmitWait:                 {"PortXmitWait", 32, "ticks", 1, false, 0x10000, "Ticks during which the port had data to transmit, but no data was sent"},
+
+	PortXmitData:          {"PortXmitData", 64, "octets", 4, true, 0x1, "Data octets transmitted on the port, divided by 4"},
+	PortRcvData:           {"PortRcvData", 64, "octets", 4, true, 0x2, "Data octets received on the port, divided by 4"},
+	PortXmitPkts:          {"PortXmitPkts", 64, "packets", 1, true, 0x4, "Packets transmitted on the port"},
+	PortRcvPkts:           {"PortRcvPkts", 64, "packets", 1, true, 0x8, "Packets received on the port"},
+	PortUnicastXmitPkts:   {"PortUnicastXmitPkts", 64, "packets", 1, true, 0x10, "Unicast packets transmitted on the port"},
+	PortUnicastRcvPkts:    {"PortUnicastRcvPkts", 64, "packets", 1, true, 0x20, "Unicast packets received on the port"},
+	PortMulticastXmitPkts: {"PortMulticastXmitPkts", 64, "packets", 1, true, 0x40, "Multicast packets transmitted on the port"},
+	PortMulticastRcvPkts:  {"PortMulticastRcvPkts", 64, "packets", 1, true, 0x80, "Multicast packets received on the port"},
+}
+
+// counterFields maps counters to their fields in PortCounters or PortCountersExtended.
+var counterFields = [NumCounters]mad.Field{
+	SymbolErrorCounter:           mad.PortCountersSymbolErrorCounter,
+	LinkErrorRecoveryCounter:     mad.PortCountersLinkErrorRecoveryCounter,
+	LinkDownedCounter:            mad.PortCountersLinkDownedCounter,
+	PortRcvErrors:                mad.PortCountersPortRcvErrors,
+	PortRcvRemotePhysicalErrors:  mad.PortCountersPortRcvRemotePhysicalErrors,
+	PortRcvSwitchRelayErrors:     mad.PortCountersPortRcvSwitchRelayErrors,
+	PortXmitDiscards:             mad.PortCountersPortXmitDiscards,
+	PortXmitConstraintErrors:     mad.PortCountersPortXmitConstraintErrors,
+	PortRcvConstraintErrors:      mad.PortCountersPortRcvConstraintErrors,
+	LocalLinkIntegrityErrors:     mad.PortCountersLocalLinkIntegrityErrors,
+	ExcessiveBufferOverrunErrors: mad.PortCountersExcessiveBufferOverrunErrors,
+	VL15Dropped:                  mad.PortCountersVL15Dropped,
+	PortXmitWait:                 mad.PortCountersPortXmitWait,
+
+	PortXmitData:          mad.PortCountersExtPortXmitData,
+	PortRcvData:           mad.PortCountersExtPortRcvData,
+	PortXmitPkts:          mad.PortCountersExtPortXmitPkts,
+	PortRcvPkts:           mad.PortCountersExtPortRcvPkts,
+	PortUnicastXmitPkts:   mad.PortCountersExtPortUnicastXmitPkts,
+	PortUnicastRcvPkts:    mad.PortCountersExtPortUnicastRcvPkts,
+	PortMulticastXmitPkts: mad.PortCountersExtPortMulticastXmitPkts,
+	PortMulticastRcvPkts:  mad.PortCountersExtPortMulticastRcvPkts,
+}
+
+// Info returns the metadata of the counter.
+func (id CounterID) Info() CounterInfo {
+	return counterInfo[id]
+}
+
+func (id CounterID) String() string {
+	if id < 0 || id >= NumCounters {
+		return "unknown"
+	}
+
+	return counterInfo[id].Name
+}
+
+// CounterByName returns the ID of the counter with the specified name.
+func CounterByName(name string) (CounterID, bool) {
+	for id := CounterID(0); id < NumCounters; id++ {
+		if counterInfo[id].Name == name {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+// Counters holds the counters of a port. Only counters which were successfully read (and are
+// supported by the port) are valid.
+type Counters struct {
+	Values    [NumCounters]uint64
+	Valid     uint32    // bitmask of valid counters, indexed by CounterID
+	Timestamp time.Time // time at which the counters were read
+}
+
+// Get returns the value of a counter, and whether it is valid.
+func (c *Counters) Get(id CounterID) (uint64, bool) {
+	return c.Values[id], c.Has(id)
+}
+
+// Set sets the value of a counter, and marks it valid.
+func (c *Counters) Set(id CounterID, v uint64) {
+	c.Values[id] = v
+	c.Valid |= 1 << id
+}
+
+// Has returns whether a counter is valid.
+func (c *Counters) Has(id CounterID) bool {
+	return c.Valid&(1<<id) != 0
+}
+
+// Empty returns whether no counter is valid, e.g. because the port's counters were not collected.
+func (c *Counters) Empty() bool {
+	return c.Valid == 0
+}
@@ -0,0 +1,43 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package infiniband
+
+import (
+	"testing"
+)
+
+func TestCounterInfo(t *testing.T) {
+	var c Counters
+
+	// Counters.Valid must have a bit for each counter.
+	if NumCounters > 32 {
+		t.Fatalf("%d counters do not fit in Counters.Valid", NumCounters)
+	}
+
+	for id := CounterID(0); id < NumCounters; id++ {
+		info := id.Info()
+
+		if info.Name == "" || info.Width == 0 || info.Scale == 0 || info.Select == 0 {
+			t.Fatalf("incomplete metadata of counter %d: %+v", id, info)
+		}
+
+		if got, ok := CounterByName(info.Name); !ok || got != id {
+			t.Fatalf("CounterByName(%q) = %d, %t, want %d", info.Name, got, ok, id)
+		}
+
+		c.Set(id, info.Max())
+	}
+
+	if v, ok := c.Get(LinkDownedCounter); !ok || v != 0xff {
+		t.Fatalf("LinkDownedCounter: got %#x, %t, want 0xff, true", v, ok)
+	}
+
+	if v := PortXmitData.Info().Max(); v != 0xffffffffffffffff {
+		t.Fatalf("PortXmitData: got max %#x", v)
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { c.Set(PortRcvData, 1) }); allocs != 0 {
+		t.Fatalf("Set allocates %v times", allocs)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package diags builds fabrics from the output of infiniband-diags, i.e., the topology output of
+// ibnetdiscover(8) and the counters output by perfquery(8), so that fabrics whose hosts cannot run
+// FabricMon (e.g., without umad access) can be analysed from files collected by their admins.
+package diags
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/fake"
+	"github.com/dswarbrick/fabricmon/infiniband/ibsim"
+)
+
+var (
+	// Header of each port, e.g.: # Port extended counters: Lid 2 port 1 (CapMask: 0x5A00)
+	perfHeaderRe = regexp.MustCompile(`^# Port (extended )?counters: Lid (\d+) port (\d+)`)
+
+	// Counter, e.g.: PortXmitData:....................1234
+	perfCounterRe = regexp.MustCompile(`^(\w+):\.*\s*(0[xX][0-9a-fA-F]+|\d+)$`)
+)
+
+// PortCounters holds the counters of a port, as output by perfquery.
+type PortCounters struct {
+	LID      int
+	Port     int
+	Counters infiniband.Counters
+}
+
+// ReadPerfquery reads the output of one or more invocations of perfquery (with or without -x), and
+// returns the counters of each port, in order of their first appearance. The counters of a port
+// which appears repeatedly (e.g., in the output of both perfquery and perfquery -x) are merged.
+// Since perfquery does not output the time at which the counters were read, the counters have no
+// timestamp. Data and packet counters are only taken from extended counters, whereas the 32-bit
+// counters of perfquery without -x are ignored, as by FabricMon itself.
+func ReadPerfquery(r io.Reader) ([]PortCounters, error) {
+	var (
+		ports    []PortCounters
+		cur      *PortCounters
+		extended bool
+		lineNum  int
+	)
+
+	index := make(map[[2]int]int)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if m := perfHeaderRe.FindStringSubmatch(line); m != nil {
+			lid, _ := strconv.Atoi(m[2])
+			port, _ := strconv.Atoi(m[3])
+			extended = m[1] != ""
+
+			key := [2]int{lid, port}
+
+			i, ok := index[key]
+			if !ok {
+				i = len(ports)
+				index[key] = i
+				ports = append(ports, PortCounters{LID: lid, Port: port})
+			}
+
+			cur = &ports[i]
+
+			continue
+		}
+
+		m := perfCounterRe.FindStringSubmatch(line)
+		if m == nil || cur == nil {
+			// Other output, e.g. the error messages of perfquery.
+			continue
+		}
+
+		id, ok := infiniband.CounterByName(m[1])
+		if !ok || (id.Info().Extended && !extended) {
+			continue
+		}
+
+		v, err := strconv.ParseUint(m[2], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		cur.Counters.Set(id, v)
+	}
+
+	return ports, scanner.Err()
+}
+
+// Attach attaches counters output by perfquery to the ports of the switches with the respective
+// LIDs, and returns the number of ports which could not be attributed to a connected switch port
+// (e.g., ports of channel adapters, whose counters FabricMon does not collect, or the aggregate
+// counters output by perfquery -a).
+func Attach(nodes []infiniband.Node, switchLIDs map[int]uint64, counters []PortCounters) int {
+	index := make(map[uint64]*infiniband.Node, len(nodes))
+	for i := range nodes {
+		index[nodes[i].GUID] = &nodes[i]
+	}
+
+	var unattributed int
+
+	for _, pc := range counters {
+		node := index[switchLIDs[pc.LID]]
+		if node == nil {
+			unattributed++
+			continue
+		}
+
+		port := node.Port(pc.Port)
+		if pc.Port == 0 || port == nil || port.RemoteGUID == 0 {
+			unattributed++
+			continue
+		}
+
+		for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+			if v, ok := pc.Counters.Get(id); ok {
+				port.Counters.Set(id, v)
+			}
+		}
+	}
+
+	return unattributed
+}
+
+// NewSource returns a source which sweeps the fabric of an ibnetdiscover topology file, with the
+// counters of the specified perfquery output files, if any. The counters remain unchanged over
+// successive sweeps, and are timestamped with the time of each sweep.
+func NewSource(topologyFile string, perfqueryFiles []string) (*fake.Source, error) {
+	f, err := os.Open(topologyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	net, err := ibsim.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", topologyFile, err)
+	}
+
+	for _, path := range perfqueryFiles {
+		counters, err := readPerfqueryFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if n := Attach(net.Nodes, net.SwitchLIDs, counters); n > 0 {
+			slog.Warn("ignoring counters of ports which are not connected switch ports", "file", path, "ports", n)
+		}
+	}
+
+	src := fake.NewSource(&fake.Fabric{CAName: "ibnetdiscover", SourcePort: 1, Nodes: net.Nodes})
+	src.Hostname = "ibnetdiscover"
+
+	return src, nil
+}
+
+// readPerfqueryFile reads a perfquery output file.
+func readPerfqueryFile(path string) ([]PortCounters, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	counters, err := ReadPerfquery(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return counters, nil
+}
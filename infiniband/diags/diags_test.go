@@ -0,0 +1,80 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package diags
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+func TestReadPerfquery(t *testing.T) {
+	f, err := os.Open("testdata/perfquery.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	ports, err := ReadPerfquery(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ports) != 3 || ports[0].LID != 3 || ports[0].Port != 1 || ports[1].LID != 4 || ports[1].Port != 36 {
+		t.Fatalf("unexpected ports: %+v", ports)
+	}
+
+	c := ports[0].Counters
+
+	for id, want := range map[infiniband.CounterID]uint64{
+		infiniband.PortXmitData:       8246721938, // not the 32-bit counter of perfquery without -x
+		infiniband.SymbolErrorCounter: 12,
+		infiniband.PortXmitDiscards:   7,
+		infiniband.PortXmitWait:       123456,
+	} {
+		if v, ok := c.Get(id); !ok || v != want {
+			t.Errorf("%s: got %d, %v, want %d", id, v, ok, want)
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	src, err := NewSource("testdata/ibnetdiscover.out", []string{"testdata/perfquery.out"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan infiniband.Fabric, 1)
+
+	if err := src.Sweep(context.Background(), c, infiniband.SweepConfig{ResetThreshold: 100}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	fabric := <-c
+
+	if len(fabric.Nodes) != 5 || len(fabric.Links()) != 4 {
+		t.Fatalf("got %d nodes, %d links", len(fabric.Nodes), len(fabric.Links()))
+	}
+
+	sw := fabric.Nodes[0]
+	if sw.NodeDesc != "MF0;switch-3b1c:MSB7700/U1" || sw.DeviceID != 0xcf08 {
+		t.Errorf("unexpected switch: %+v", sw)
+	}
+
+	if v, ok := sw.Ports[1].Counters.Get(infiniband.PortRcvData); !ok || v != 7519312244 {
+		t.Errorf("unexpected PortRcvData: %d, %v", v, ok)
+	}
+
+	if v, ok := fabric.Nodes[1].Ports[36].Counters.Get(infiniband.PortRcvData); !ok || v != 2000 {
+		t.Errorf("unexpected PortRcvData: %d, %v", v, ok)
+	}
+
+	// Ports without counters are not collected.
+	if !sw.Ports[2].Counters.Empty() {
+		t.Errorf("unexpected counters: %+v", sw.Ports[2].Counters)
+	}
+}
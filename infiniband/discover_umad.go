@@ -0,0 +1,386 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !cgo || umad
+
+// Fabric discovery via directed route SMPs, in pure Go, analogous to libibnetdisc.
+
+package infiniband
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad"
+)
+
+const (
+	defaultMaxSMPs = 2 // maximum outstanding SMPs, as libibnetdisc
+
+	vendorMellanox = 0x02c9
+)
+
+// topology is a fabric discovered via directed route SMPs.
+type topology struct {
+	nodes []*drNode // in order of discovery
+	guids map[uint64]*drNode
+}
+
+// drNode is a node of a topology.
+type drNode struct {
+	info  []byte    // NodeInfo, as received when the node was first discovered
+	desc  string    // NodeDescription
+	path  []uint8   // directed route from the local port
+	ports []*drPort // indexed by port number; nil if the port was not discovered
+
+	explored bool
+}
+
+func (n *drNode) guid() uint64 {
+	return mad.NodeInfoNodeGUID.Get(n.info)
+}
+
+func (n *drNode) isSwitch() bool {
+	return mad.NodeInfoNodeType.Get(n.info) == IB_NODE_SWITCH
+}
+
+// lid returns the LID via which the PerfMgt agent of a port of the node is addressed, i.e., that of
+// the switch management port (port zero) for switches.
+func (n *drNode) lid(portNum int) uint16 {
+	if n.isSwitch() {
+		portNum = 0
+	}
+
+	if p := n.ports[portNum]; p != nil && p.info != nil {
+		return uint16(mad.PortInfoLID.Get(p.info))
+	}
+
+	return 0
+}
+
+// drPort is a port of a topology node.
+type drPort struct {
+	node    *drNode
+	num     int
+	guid    uint64
+	info    []byte // PortInfo, or nil if it could not be queried
+	extInfo []byte // Mellanox ExtendedPortInfo, or nil if not queried
+	remote  *drPort
+}
+
+// probe is the result of querying NodeInfo via a port of a node, i.e., of the node at its far end.
+type probe struct {
+	portNum int
+	info    []byte
+	err     error
+}
+
+// discover discovers the fabric attached to the local port of the client's umad device, walking it
+// breadth first. If the context is done, the nodes discovered so far are returned, along with the
+// context's error.
+func discover(ctx context.Context, c *smpClient, cfg SweepConfig) (*topology, error) {
+	maxHops := cfg.MaxHops
+	if maxHops <= 0 || maxHops > mad.MaxHops {
+		maxHops = mad.MaxHops
+	}
+
+	info, err := c.query(ctx, mad.AttrNodeInfo, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("local NodeInfo query failed: %w", err)
+	}
+
+	t := &topology{guids: make(map[uint64]*drNode)}
+	queue := []*drNode{t.addNode(info, nil)}
+
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return t, err
+		}
+
+		n := queue[0]
+		queue = queue[1:]
+
+		queue = append(queue, t.explore(ctx, c, n, cfg, maxHops)...)
+	}
+
+	return t, nil
+}
+
+// addNode adds a node with the specified NodeInfo, discovered via the specified path, as well as
+// the port via which it was entered.
+func (t *topology) addNode(info []byte, path []uint8) *drNode {
+	n := &drNode{
+		info:  info,
+		path:  path,
+		ports: make([]*drPort, mad.NodeInfoNumPorts.Get(info)+1),
+	}
+
+	t.nodes = append(t.nodes, n)
+	t.guids[n.guid()] = n
+
+	n.addPort(info)
+
+	return n
+}
+
+// addPort adds the port via which the node was entered, given the NodeInfo received via that port,
+// unless already added.
+func (n *drNode) addPort(info []byte) *drPort {
+	portNum := int(mad.NodeInfoLocalPortNum.Get(info))
+	if portNum >= len(n.ports) {
+		return nil
+	}
+
+	if n.ports[portNum] == nil {
+		n.ports[portNum] = &drPort{node: n, num: portNum, guid: mad.NodeInfoPortGUID.Get(info)}
+	}
+
+	return n.ports[portNum]
+}
+
+// explore queries the node description and port info of a node, and probes the nodes attached to
+// its ports. It returns the newly discovered nodes. Failed queries are logged, and leave the
+// affected attributes / links unknown.
+func (t *topology) explore(ctx context.Context, c *smpClient, n *drNode, cfg SweepConfig, maxHops int) []*drNode {
+	nodeLog := cfg.logger().With("node_guid", fmt.Sprintf("%#016x", n.guid()), "path", n.path)
+
+	n.explored = true
+
+	if desc, err := c.query(ctx, mad.AttrNodeDesc, 0, n.path); err != nil {
+		nodeLog.Debug("NodeDescription query failed", "err", err)
+	} else {
+		n.desc = string(bytes.TrimRight(desc, "\x00"))
+	}
+
+	// The port info of all ports of a switch is queried, whereas that of other nodes is only
+	// queried for the ports via which they were entered.
+	if n.isSwitch() {
+		for portNum := range n.ports {
+			if n.ports[portNum] == nil {
+				n.ports[portNum] = &drPort{node: n, num: portNum, guid: mad.NodeInfoPortGUID.Get(n.info)}
+			}
+		}
+	}
+
+	var ports []*drPort
+
+	for _, p := range n.ports {
+		if p != nil {
+			ports = append(ports, p)
+		}
+	}
+
+	limit := cfg.MaxSMPs
+	if limit <= 0 {
+		limit = defaultMaxSMPs
+	}
+
+	mellanox := cfg.MlxEPI && mad.NodeInfoVendorID.Get(n.info) == vendorMellanox
+
+	parallel(len(ports), limit, func(i int) {
+		ports[i].query(ctx, c, n.path, mellanox)
+	})
+
+	// Probe the nodes attached to the ports of a switch, except the port via which it was
+	// entered. Other nodes are only traversed if they are the local node.
+	var probes []probe
+
+	if len(n.path) < maxHops && (n.isSwitch() || len(n.path) == 0) {
+		entry := int(mad.NodeInfoLocalPortNum.Get(n.info))
+
+		for _, p := range ports {
+			if p.num == 0 || (p.num == entry && len(n.path) > 0) || p.info == nil ||
+				mad.PortInfoPortState.Get(p.info) <= portStateDown {
+				continue
+			}
+
+			probes = append(probes, probe{portNum: p.num})
+		}
+	}
+
+	parallel(len(probes), limit, func(i int) {
+		probes[i].info, probes[i].err = c.query(ctx, mad.AttrNodeInfo, 0, appendPath(n.path, probes[i].portNum))
+	})
+
+	var discovered []*drNode
+
+	for _, pr := range probes {
+		if pr.err != nil {
+			nodeLog.Debug("NodeInfo query failed", "port", pr.portNum, "err", pr.err)
+			continue
+		}
+
+		path := appendPath(n.path, pr.portNum)
+
+		m, known := t.guids[mad.NodeInfoNodeGUID.Get(pr.info)]
+		if !known {
+			m = t.addNode(pr.info, path)
+			discovered = append(discovered, m)
+		}
+
+		rp := m.addPort(pr.info)
+		if rp == nil {
+			continue
+		}
+
+		// The port info of an explored non-switch node, entered via another of its ports, has not
+		// been queried yet.
+		if m.explored && rp.info == nil && !m.isSwitch() {
+			rp.query(ctx, c, path, cfg.MlxEPI && mad.NodeInfoVendorID.Get(m.info) == vendorMellanox)
+		}
+
+		lp := n.ports[pr.portNum]
+		lp.remote, rp.remote = rp, lp
+	}
+
+	return discovered
+}
+
+// query queries the PortInfo (and optionally the Mellanox ExtendedPortInfo) of the port, whose
+// node is at the end of the path.
+func (p *drPort) query(ctx context.Context, c *smpClient, path []uint8, mlxEPI bool) {
+	info, err := c.query(ctx, mad.AttrPortInfo, uint32(p.num), path)
+	if err != nil {
+		c.log.Debug("PortInfo query failed", "node_guid", fmt.Sprintf("%#016x", p.node.guid()),
+			"port", p.num, "err", err)
+		return
+	}
+
+	p.info = info
+
+	if mlxEPI && p.num > 0 && mad.PortInfoPortState.Get(info) > portStateDown {
+		// Not all Mellanox devices support ExtendedPortInfo.
+		if extInfo, err := c.query(ctx, mad.AttrMlnxExtPortInfo, uint32(p.num), path); err == nil {
+			p.extInfo = extInfo
+		}
+	}
+}
+
+// appendPath returns a new directed route, extending the path by a port.
+func appendPath(path []uint8, portNum int) []uint8 {
+	return append(path[:len(path):len(path)], uint8(portNum))
+}
+
+// parallel calls f for each i in [0, n), with at most limit calls in flight.
+func parallel(n, limit int, f func(i int)) {
+	var wg sync.WaitGroup
+
+	sem := make(chan struct{}, limit)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			f(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// walkTopology returns the nodes of a topology, including the ports of switches, and a counter job
+// for each switch port whose counters are to be collected. No MADs are sent. If the context is
+// done, the nodes walked so far are returned, along with the context's error.
+func walkTopology(ctx context.Context, t *topology, log *slog.Logger) ([]Node, []counterJob, error) {
+	var jobs []counterJob
+
+	nodes := make([]Node, 0, len(t.nodes))
+
+	for _, n := range t.nodes {
+		if err := ctx.Err(); err != nil {
+			return nodes, jobs, err
+		}
+
+		myNode := newNode(n.info, n.desc)
+
+		if n.isSwitch() {
+			var (
+				portJobs []counterJob
+				err      error
+			)
+
+			nodeLog := log.With("node_desc", myNode.NodeDesc, "node_guid", fmt.Sprintf("%#016x", myNode.GUID))
+
+			// A partially walked switch is still included.
+			myNode.Ports, portJobs, err = n.walkPorts(ctx, len(nodes), nodeLog)
+			jobs = append(jobs, portJobs...)
+
+			if err != nil {
+				return append(nodes, myNode), jobs, err
+			}
+		}
+
+		nodes = append(nodes, myNode)
+	}
+
+	return nodes, jobs, nil
+}
+
+// walkPorts returns the ports of a switch, and a counter job for each port whose counters are to
+// be collected. If the context is done, the ports walked so far are returned, along with the
+// context's error.
+func (n *drNode) walkPorts(ctx context.Context, nodeIdx int, nodeLog *slog.Logger) ([]Port, []counterJob, error) {
+	var jobs []counterJob
+
+	ports := make([]Port, len(n.ports))
+
+	// The capability mask of switch ports is that of the switch management port (port zero).
+	capInfo := make([]byte, mad.SMPDataSize)
+	if p := n.ports[0]; p != nil && p.info != nil {
+		capInfo = p.info
+	}
+
+	for portNum, p := range n.ports {
+		if err := ctx.Err(); err != nil {
+			return ports[:portNum], jobs, err
+		}
+
+		if p == nil || p.info == nil {
+			continue
+		}
+
+		portLog := nodeLog.With("port", portNum)
+
+		myPort := newPort(p.guid, p.info, capInfo, p.extInfo)
+
+		portLog.Debug("port info",
+			"port_state", myPort.State,
+			"phys_state", myPort.PhysState,
+			"link_width", myPort.LinkWidth,
+			"link_speed", myPort.LinkSpeed)
+
+		if rp := p.remote; rp != nil {
+			myPort.RemoteGUID = rp.node.guid()
+			myPort.RemoteNodeDesc = rp.node.desc
+			myPort.RemotePort = rp.num
+
+			// Port counters will only be fetched if port is ACTIVE + LINKUP
+			if portUp(p.info) {
+				if rp.info != nil && linkWidthDegraded(p.info, rp.info) {
+					portLog.Warn("link width is not the max width supported by both ports")
+				}
+
+				jobs = append(jobs, counterJob{
+					nodeIdx: nodeIdx,
+					guid:    n.guid(),
+					lid:     n.lid(0),
+					portNum: portNum,
+					log:     nodeLog,
+				})
+			}
+		}
+
+		ports[portNum] = myPort
+	}
+
+	return ports, jobs, nil
+}
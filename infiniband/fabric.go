@@ -0,0 +1,54 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Fabric helper functions.
+
+package infiniband
+
+// Link represents a cable between two ports in a fabric.
+type Link struct {
+	LocalGUID  uint64
+	LocalPort  int
+	RemoteGUID uint64
+	RemotePort int
+}
+
+// reverse returns the same link, as seen from the remote end.
+func (l Link) reverse() Link {
+	return Link{l.RemoteGUID, l.RemotePort, l.LocalGUID, l.LocalPort}
+}
+
+// Links returns the links in the fabric, in the order in which they were discovered. A link
+// between two nodes whose ports were both walked (e.g., two switches) is only returned once.
+func (f *Fabric) Links() []Link {
+	var links []Link
+
+	seen := make(map[Link]bool)
+
+	for _, node := range f.Nodes {
+		for portNum, port := range node.Ports {
+			if port.RemoteGUID == 0 {
+				continue
+			}
+
+			link := Link{node.GUID, portNum, port.RemoteGUID, port.RemotePort}
+			if seen[link.reverse()] {
+				continue
+			}
+
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+
+	return links
+}
+
+// Port returns a pointer to the specified port of the node, or nil if the port was not walked.
+func (n *Node) Port(portNum int) *Port {
+	if portNum < 0 || portNum >= len(n.Ports) {
+		return nil
+	}
+
+	return &n.Ports[portNum]
+}
@@ -0,0 +1,28 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package infiniband
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFabricLinks(t *testing.T) {
+	fabric := Fabric{
+		Nodes: []Node{
+			{GUID: 1, NodeType: IB_NODE_SWITCH, Ports: []Port{{}, {RemoteGUID: 2, RemotePort: 8}, {RemoteGUID: 3, RemotePort: 1}}},
+			{GUID: 2, NodeType: IB_NODE_SWITCH, Ports: []Port{{}, {}, {}, {}, {}, {}, {}, {}, {RemoteGUID: 1, RemotePort: 1}}},
+			{GUID: 3, NodeType: IB_NODE_CA},
+		},
+	}
+
+	expected := []Link{
+		{1, 1, 2, 8},
+		{1, 2, 3, 1},
+	}
+
+	if links := fabric.Links(); !reflect.DeepEqual(links, expected) {
+		t.Fatalf("unexpected links: %v", links)
+	}
+}
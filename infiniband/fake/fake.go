@@ -0,0 +1,396 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package fake provides an in-memory infiniband.Source, whose fabrics are scripted, so that
+// everything downstream of fabric discovery (e.g., the router, writers, counter rate computation
+// and health tracking) can be tested without InfiniBand hardware or ibsim.
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+// ErrIncomplete is the error of an incomplete sweep, whose step does not specify an error.
+var ErrIncomplete = errors.New("sweep incomplete")
+
+// Source is an infiniband.Source which sweeps scripted fabrics. It is safe for concurrent use,
+// although the fabrics must not be modified other than by their scripts once sweeping has started.
+type Source struct {
+	Hostname string
+
+	// Now returns the time of each sweep, which is used as the timestamp of the fabrics and their
+	// counters. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	fabrics []*Fabric
+	sweeps  int
+}
+
+// NewSource returns a source which sweeps the specified fabrics, in order.
+func NewSource(fabrics ...*Fabric) *Source {
+	return &Source{Hostname: "fake", fabrics: fabrics}
+}
+
+// Sweeps returns the number of sweeps performed so far, excluding sweeps which were cancelled
+// before they started.
+func (s *Source) Sweeps() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sweeps
+}
+
+// Sweep applies the next step of each fabric's script, and sends the resulting fabrics to output
+// (unless nil). The counters of ports are reset according to cfg.ResetThreshold, like those of a
+// real fabric. All other sweep parameters are ignored.
+func (s *Source) Sweep(ctx context.Context, output chan infiniband.Fabric, cfg infiniband.SweepConfig, rediscover bool) error {
+	var (
+		fabrics []infiniband.Fabric
+		errs    []error
+	)
+
+	s.mu.Lock()
+
+	if err := ctx.Err(); err != nil {
+		s.mu.Unlock()
+
+		for _, f := range s.fabrics {
+			errs = append(errs, f.sweepError(fmt.Errorf("sweep cancelled: %w", err)))
+		}
+
+		return errors.Join(errs...)
+	}
+
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+
+	ts := now()
+
+	for _, f := range s.fabrics {
+		fabric, err := f.sweep(s.sweeps, ts, cfg.ResetThreshold, rediscover)
+		if err != nil {
+			errs = append(errs, f.sweepError(err))
+		}
+
+		if fabric != nil {
+			fabric.Hostname = s.Hostname
+			fabrics = append(fabrics, *fabric)
+		}
+	}
+
+	s.sweeps++
+	s.mu.Unlock()
+
+	// Fabrics are sent without holding the lock, since receivers may block.
+	if output != nil {
+		for _, fabric := range fabrics {
+			output <- fabric
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Fabric is a scripted fabric, swept via a local HCA port. Its nodes hold its current topology and
+// counters, which the steps of its script modify over successive sweeps. As with a real fabric,
+// only the ports of switches are walked, and counters are only collected from switch ports which
+// are active and connected.
+type Fabric struct {
+	CAName     string
+	SourcePort int
+	Nodes      []infiniband.Node
+
+	// Script holds the step of each sweep, i.e., Script[i] is applied in the i-th sweep of the
+	// source (counting from zero). Once the script is exhausted, the fabric is swept unchanged.
+	Script []Step
+
+	// Tick, if non-nil, is called before every sweep (after the Update of its step, if any) with
+	// the time of the sweep, e.g., to advance counters continuously.
+	Tick func(f *Fabric, now time.Time)
+
+	topology []infiniband.Node // as of the last discovery, reused by sweeps without rediscovery
+}
+
+// Step scripts a sweep of a fabric.
+type Step struct {
+	// Update, if non-nil, modifies the fabric before it is swept, e.g., by advancing counters or
+	// changing the topology.
+	Update func(f *Fabric)
+
+	// Err, if non-nil, fails the sweep, in which case no fabric is produced, unless the sweep is
+	// incomplete.
+	Err error
+
+	// Incomplete marks the sweep as incomplete, in which case a fabric holding only the first
+	// Walked nodes is produced, and the sweep fails with Err, or ErrIncomplete if Err is nil.
+	Incomplete bool
+	Walked     int
+
+	// Unreachable holds the GUIDs of nodes whose counters cannot be read in this sweep, since
+	// their performance management queries time out.
+	Unreachable []uint64
+}
+
+// Switch returns a switch node with the specified number of (disconnected) external ports, plus
+// the switch management port (port zero).
+func Switch(guid uint64, desc string, numPorts int) infiniband.Node {
+	node := infiniband.Node{
+		GUID:       guid,
+		SystemGUID: guid,
+		NodeType:   infiniband.IB_NODE_SWITCH,
+		NodeDesc:   desc,
+		Ports:      make([]infiniband.Port, numPorts+1),
+	}
+
+	node.Ports[0] = infiniband.Port{GUID: guid, State: "Active", PhysState: "LinkUp"}
+
+	for i := 1; i <= numPorts; i++ {
+		node.Ports[i] = infiniband.Port{GUID: guid, State: "Down", PhysState: "Polling"}
+	}
+
+	return node
+}
+
+// CA returns a channel adapter node. Since only the ports of switches are walked, it has no ports.
+func CA(guid uint64, desc string) infiniband.Node {
+	return infiniband.Node{
+		GUID:       guid,
+		SystemGUID: guid,
+		NodeType:   infiniband.IB_NODE_CA,
+		NodeDesc:   desc,
+	}
+}
+
+// Node returns the node with the specified GUID, or nil if there is none.
+func (f *Fabric) Node(guid uint64) *infiniband.Node {
+	for i := range f.Nodes {
+		if f.Nodes[i].GUID == guid {
+			return &f.Nodes[i]
+		}
+	}
+
+	return nil
+}
+
+// Port returns the specified port of the node with the specified GUID, or nil if there is none.
+func (f *Fabric) Port(guid uint64, portNum int) *infiniband.Port {
+	if node := f.Node(guid); node != nil {
+		return node.Port(portNum)
+	}
+
+	return nil
+}
+
+// Connect links two ports with an active 4X EDR link. Ports which are not walked (i.e., those of
+// channel adapters) are left unchanged.
+func (f *Fabric) Connect(guidA uint64, portA int, guidB uint64, portB int) {
+	a, b := f.Node(guidA), f.Node(guidB)
+	if a == nil || b == nil {
+		panic(fmt.Sprintf("fake: no such node: %#016x or %#016x", guidA, guidB))
+	}
+
+	connect := func(local *infiniband.Node, localPort int, remote *infiniband.Node, remotePort int) {
+		if p := local.Port(localPort); p != nil {
+			p.RemoteGUID = remote.GUID
+			p.RemoteNodeDesc = remote.NodeDesc
+			p.RemotePort = remotePort
+			p.State, p.PhysState = "Active", "LinkUp"
+			p.LinkWidth, p.LinkSpeed = "4X", "EDR"
+		}
+	}
+
+	connect(a, portA, b, portB)
+	connect(b, portB, a, portA)
+}
+
+// Disconnect takes down the link of a port, at both ends. The counters of the ports are retained.
+func (f *Fabric) Disconnect(guid uint64, portNum int) {
+	p := f.Port(guid, portNum)
+	if p == nil || p.RemoteGUID == 0 {
+		return
+	}
+
+	disconnect := func(p *infiniband.Port) {
+		p.RemoteGUID, p.RemoteNodeDesc, p.RemotePort = 0, "", 0
+		p.State, p.PhysState = "Down", "Polling"
+		p.LinkWidth, p.LinkSpeed = "", ""
+	}
+
+	if remote := f.Port(p.RemoteGUID, p.RemotePort); remote != nil {
+		disconnect(remote)
+	}
+
+	disconnect(p)
+}
+
+// AddCounter advances a counter of the specified port by delta, like Advance.
+func (f *Fabric) AddCounter(guid uint64, portNum int, id infiniband.CounterID, delta uint64) {
+	p := f.Port(guid, portNum)
+	if p == nil {
+		panic(fmt.Sprintf("fake: no such port: %#016x port %d", guid, portNum))
+	}
+
+	Advance(&p.Counters, id, delta)
+}
+
+// Advance advances a counter by delta, latching at the counter's maximum value, like a real
+// counter, and marks it valid.
+func Advance(c *infiniband.Counters, id infiniband.CounterID, delta uint64) {
+	v, _ := c.Get(id)
+	maxValue := id.Info().Max()
+
+	if delta > maxValue-v {
+		v = maxValue
+	} else {
+		v += delta
+	}
+
+	c.Set(id, v)
+}
+
+func (f *Fabric) sweepError(err error) error {
+	return &infiniband.SweepError{CAName: f.CAName, Port: f.SourcePort, Err: err}
+}
+
+// sweep applies the step of the n-th sweep, and returns the resulting fabric, or nil if the sweep
+// fails.
+func (f *Fabric) sweep(n int, ts time.Time, resetThreshold uint, rediscover bool) (*infiniband.Fabric, error) {
+	var step Step
+	if n < len(f.Script) {
+		step = f.Script[n]
+	}
+
+	if step.Update != nil {
+		step.Update(f)
+	}
+
+	if f.Tick != nil {
+		f.Tick(f, ts)
+	}
+
+	if step.Err != nil && !step.Incomplete {
+		return nil, step.Err
+	}
+
+	if rediscover || f.topology == nil {
+		f.topology = cloneNodes(f.Nodes)
+	}
+
+	fabric := &infiniband.Fabric{
+		CAName:     f.CAName,
+		SourcePort: f.SourcePort,
+		Timestamp:  ts,
+		Nodes:      cloneNodes(f.topology),
+	}
+
+	unreachable := make(map[uint64]bool, len(step.Unreachable))
+	for _, guid := range step.Unreachable {
+		unreachable[guid] = true
+	}
+
+	current := make(map[uint64]*infiniband.Node, len(f.Nodes))
+	for i := range f.Nodes {
+		current[f.Nodes[i].GUID] = &f.Nodes[i]
+	}
+
+	for i := range fabric.Nodes {
+		node := &fabric.Nodes[i]
+
+		for portNum := range node.Ports {
+			var cur *infiniband.Port
+			if n := current[node.GUID]; n != nil {
+				cur = n.Port(portNum)
+			}
+
+			if collect(&fabric.Stats, node, portNum, cur, resetThreshold, unreachable[node.GUID]) {
+				node.Ports[portNum].Counters.Timestamp = ts
+			}
+		}
+	}
+
+	if !step.Incomplete {
+		return fabric, nil
+	}
+
+	fabric.Incomplete = true
+	fabric.Nodes = fabric.Nodes[:min(max(step.Walked, 0), len(fabric.Nodes))]
+
+	if step.Err != nil {
+		return fabric, step.Err
+	}
+
+	return fabric, ErrIncomplete
+}
+
+// collect collects the counters of a port of a swept node from the current state of the port
+// (cur), if the port was active and connected when the topology was discovered. It returns whether
+// the counters were collected.
+func collect(stats *infiniband.SweepStats, node *infiniband.Node, portNum int, cur *infiniband.Port, resetThreshold uint, unreachable bool) bool {
+	port := &node.Ports[portNum]
+	port.Counters = infiniband.Counters{}
+
+	if portNum == 0 || port.State != "Active" || port.RemoteGUID == 0 || cur == nil {
+		return false
+	}
+
+	if unreachable {
+		if stats.NodeErrors == nil {
+			stats.NodeErrors = make(map[uint64]infiniband.NodeErrors)
+		}
+
+		e := stats.NodeErrors[node.GUID]
+		e.Failures++
+		e.Timeouts++
+		stats.NodeErrors[node.GUID] = e
+		stats.PMAQueries++
+
+		return false
+	}
+
+	// ClassPortInfo, PortCounters and PortCountersExtended.
+	stats.PMAQueries += 3
+
+	port.Counters = cur.Counters
+
+	var reset bool
+
+	for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+		info := id.Info()
+		v, ok := cur.Counters.Get(id)
+
+		if !ok || info.Extended || float64(v) <= float64(info.Max())*float64(resetThreshold)/100 {
+			continue
+		}
+
+		cur.Counters.Set(id, 0)
+		reset = true
+	}
+
+	if reset {
+		stats.PMAQueries++
+		stats.CounterResets++
+	}
+
+	return true
+}
+
+// cloneNodes returns a deep copy of nodes.
+func cloneNodes(nodes []infiniband.Node) []infiniband.Node {
+	clone := make([]infiniband.Node, len(nodes))
+
+	for i, node := range nodes {
+		clone[i] = node
+		clone[i].Ports = append([]infiniband.Port(nil), node.Ports...)
+	}
+
+	return clone
+}
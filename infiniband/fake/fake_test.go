@@ -0,0 +1,130 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package fake
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+// sweepOnce sweeps the source, and returns the fabrics produced.
+func sweepOnce(src *Source, cfg infiniband.SweepConfig, rediscover bool) ([]infiniband.Fabric, error) {
+	var fabrics []infiniband.Fabric
+
+	c := make(chan infiniband.Fabric)
+	done := make(chan struct{})
+
+	go func() {
+		for fabric := range c {
+			fabrics = append(fabrics, fabric)
+		}
+		close(done)
+	}()
+
+	err := src.Sweep(context.Background(), c, cfg, rediscover)
+
+	close(c)
+	<-done
+
+	return fabrics, err
+}
+
+func TestSourceScript(t *testing.T) {
+	errDown := errors.New("unable to open MAD port")
+
+	f := &Fabric{
+		CAName:     "mlx5_0",
+		SourcePort: 1,
+		Nodes:      []infiniband.Node{Switch(1, "switch", 4), CA(2, "host")},
+	}
+
+	f.Connect(1, 1, 2, 1)
+
+	advance := func(f *Fabric) { f.AddCounter(1, 1, infiniband.PortXmitData, 1000) }
+
+	f.Script = []Step{
+		{Update: advance},
+		{Update: advance, Unreachable: []uint64{1}},
+		{Err: errDown},
+		{Update: func(f *Fabric) {
+			f.AddCounter(1, 1, infiniband.SymbolErrorCounter, 1<<20) // latches at 0xffff
+			f.Disconnect(1, 1)
+		}},
+		{Incomplete: true},
+	}
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	src := NewSource(f)
+	src.Now = func() time.Time { return start.Add(time.Duration(src.sweeps) * time.Minute) }
+
+	cfg := infiniband.SweepConfig{ResetThreshold: 100}
+
+	// Sweep 0: counters collected.
+	fabrics, err := sweepOnce(src, cfg, true)
+	if err != nil || len(fabrics) != 1 {
+		t.Fatalf("sweep 0: got %d fabrics, %v", len(fabrics), err)
+	}
+
+	port := fabrics[0].Nodes[0].Ports[1]
+	if v, _ := port.Counters.Get(infiniband.PortXmitData); v != 1000 || !port.Counters.Timestamp.Equal(start) {
+		t.Fatalf("sweep 0: unexpected counters: %+v", port.Counters)
+	}
+
+	if fabrics[0].Hostname != "fake" || fabrics[0].Nodes[1].Ports != nil {
+		t.Fatalf("sweep 0: unexpected fabric: %+v", fabrics[0])
+	}
+
+	// Sweep 1: switch unreachable.
+	fabrics, _ = sweepOnce(src, cfg, false)
+	if !fabrics[0].Nodes[0].Ports[1].Counters.Empty() ||
+		fabrics[0].Stats.NodeErrors[1] != (infiniband.NodeErrors{Failures: 1, Timeouts: 1}) {
+		t.Fatalf("sweep 1: unexpected fabric: %+v", fabrics[0])
+	}
+
+	// Sweep 2: sweep fails.
+	fabrics, err = sweepOnce(src, cfg, false)
+
+	var serr *infiniband.SweepError
+	if len(fabrics) != 0 || !errors.As(err, &serr) || serr.CAName != "mlx5_0" || !errors.Is(err, errDown) {
+		t.Fatalf("sweep 2: got %d fabrics, %v", len(fabrics), err)
+	}
+
+	// Sweep 3: the link is down, but is only seen to be after rediscovery. The latched counter is
+	// reset.
+	fabrics, _ = sweepOnce(src, infiniband.SweepConfig{ResetThreshold: 50}, false)
+	port = fabrics[0].Nodes[0].Ports[1]
+
+	if v, _ := port.Counters.Get(infiniband.SymbolErrorCounter); port.State != "Active" || v != 0xffff {
+		t.Fatalf("sweep 3: unexpected port: %+v", port)
+	}
+
+	if fabrics[0].Stats.CounterResets != 1 {
+		t.Fatalf("sweep 3: unexpected stats: %+v", fabrics[0].Stats)
+	}
+
+	// Sweep 4: incomplete, with no nodes walked.
+	fabrics, err = sweepOnce(src, cfg, true)
+	if len(fabrics) != 1 || !fabrics[0].Incomplete || len(fabrics[0].Nodes) != 0 || !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("sweep 4: got %+v, %v", fabrics, err)
+	}
+
+	// Sweep 5: script exhausted, link down.
+	fabrics, err = sweepOnce(src, cfg, true)
+	if err != nil || fabrics[0].Nodes[0].Ports[1].State != "Down" || !fabrics[0].Nodes[0].Ports[1].Counters.Empty() {
+		t.Fatalf("sweep 5: got %+v, %v", fabrics, err)
+	}
+
+	// Cancelled sweeps fail without sweeping.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := src.Sweep(ctx, nil, cfg, true); !errors.Is(err, context.Canceled) || src.Sweeps() != 6 {
+		t.Fatalf("cancelled sweep: %v, %d sweeps", err, src.Sweeps())
+	}
+}
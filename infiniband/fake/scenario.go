@@ -0,0 +1,44 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package fake
+
+import (
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+// TwoFabrics returns a source of two small fabrics on host "fmhost", whose sweeps all take place
+// at the same fixed time, e.g. for golden file tests of writers:
+//
+//   - mlx5_0 port 1: switch leaf01, linked to host1 HCA-1 via port 1, whose PortXmitData and
+//     SymbolErrorCounter are non-zero.
+//   - mlx5_1 port 2: switch leaf "02" (whose description needs escaping in most output formats),
+//     linked to spine01 via port 2, whose PortXmitData is non-zero. The counters of spine01 cannot
+//     be read in the first sweep.
+func TwoFabrics() *Source {
+	a := &Fabric{
+		CAName:     "mlx5_0",
+		SourcePort: 1,
+		Nodes:      []infiniband.Node{Switch(0x10, "leaf01", 2), CA(0x11, "host1 HCA-1")},
+	}
+	a.Connect(0x10, 1, 0x11, 1)
+	a.AddCounter(0x10, 1, infiniband.PortXmitData, 1000)
+	a.AddCounter(0x10, 1, infiniband.SymbolErrorCounter, 3)
+
+	b := &Fabric{
+		CAName:     "mlx5_1",
+		SourcePort: 2,
+		Nodes:      []infiniband.Node{Switch(0x20, `leaf "02"`, 2), Switch(0x21, "spine01", 1)},
+		Script:     []Step{{Unreachable: []uint64{0x21}}},
+	}
+	b.Connect(0x20, 2, 0x21, 1)
+	b.AddCounter(0x20, 2, infiniband.PortXmitData, 2000)
+
+	src := NewSource(a, b)
+	src.Hostname = "fmhost"
+	src.Now = func() time.Time { return time.Unix(1600000000, 0) }
+
+	return src
+}
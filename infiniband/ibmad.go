@@ -0,0 +1,195 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build cgo && !umad
+
+// MAD queries via libibmad, and libibnetdisc / libibmad configuration.
+
+package infiniband
+
+// #cgo CFLAGS: -I/usr/include/infiniband
+// #cgo LDFLAGS: -libmad -libumad
+// #include <mad.h>
+// #include <umad.h>
+// #include <ibnetdisc.h>
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// ibndConfig returns the libibnetdisc config for discovering a fabric with the specified m_key.
+func (cfg SweepConfig) ibndConfig(mkey uint64) C.ibnd_config_t {
+	config := C.ibnd_config_t{
+		max_smps:   C.uint(cfg.MaxSMPs),
+		max_hops:   C.uint(cfg.MaxHops),
+		timeout_ms: C.uint(cfg.Timeout.Milliseconds()),
+		retries:    C.uint(cfg.Retries),
+		mkey:       C.uint64_t(mkey),
+	}
+
+	if cfg.MlxEPI {
+		config.flags |= C.IBND_CONFIG_MLX_EPI
+	}
+
+	return config
+}
+
+// setMADDefaults sets the default timeout and retries of MADs sent via a MAD port.
+func (cfg SweepConfig) setMADDefaults(mad_port *C.struct_ibmad_port) {
+	if cfg.Timeout > 0 {
+		C.mad_rpc_set_timeout(mad_port, C.int(cfg.Timeout.Milliseconds()))
+	}
+
+	if cfg.Retries > 0 {
+		C.mad_rpc_set_retries(mad_port, C.int(cfg.Retries))
+	}
+}
+
+// ibmadTransport sends PerfMgt MADs via a libibmad MAD port.
+type ibmadTransport struct {
+	madPort *C.struct_ibmad_port
+}
+
+// openIbmadTransport opens a MAD port of the specified local HCA port.
+func openIbmadTransport(caName *C.char, portNum int, cfg SweepConfig) (pmaTransport, error) {
+	mgmt_classes := [...]C.int{C.IB_SMI_CLASS, C.IB_SA_CLASS, C.IB_PERFORMANCE_CLASS}
+
+	// struct ibmad_port *mad_rpc_open_port(char *dev_name, int dev_port, int *mgmt_classes, int num_classes)
+	mad_port := C.mad_rpc_open_port(caName, C.int(portNum), &mgmt_classes[0], C.int(len(mgmt_classes)))
+	if mad_port == nil {
+		return nil, errNoMADPort
+	}
+
+	cfg.setMADDefaults(mad_port)
+
+	return &ibmadTransport{madPort: mad_port}, nil
+}
+
+func (t *ibmadTransport) get(lid uint16, portNum int, attrID uint16, buf []byte) error {
+	var portid C.ib_portid_t
+	C.ib_portid_set(&portid, C.int(lid), 0, 0)
+
+	res, err := C.pma_query_via(unsafe.Pointer(&buf[0]), &portid, C.int(portNum), PMA_TIMEOUT, C.uint(attrID), t.madPort)
+
+	return ibmadError(res, err)
+}
+
+func (t *ibmadTransport) reset(lid uint16, portNum int, selMask uint32) error {
+	var (
+		portid C.ib_portid_t
+		buf    [1024]byte
+	)
+
+	C.ib_portid_set(&portid, C.int(lid), 0, 0)
+
+	res, err := C.performance_reset_via(unsafe.Pointer(&buf), &portid, C.int(portNum), C.uint(selMask), PMA_TIMEOUT, C.IB_GSI_PORT_COUNTERS, t.madPort)
+
+	return ibmadError(res, err)
+}
+
+func (t *ibmadTransport) close() {
+	C.mad_rpc_close_port(t.madPort)
+}
+
+// ibmadError returns the error of a libibmad query, which returns nil on failure, in which case
+// libibmad sets errno to ETIMEDOUT if no response was received.
+func ibmadError(res *C.uint8_t, errno error) error {
+	if res != nil {
+		return nil
+	}
+
+	if errno == nil {
+		return errors.New("query failed")
+	}
+
+	return errno
+}
+
+// portSubnet identifies the subnet attached to the specified port of the HCA. errPortNotActive is
+// returned if the port is not active.
+func (h *HCA) portSubnet(portNum int) (subnetID, error) {
+	var port C.umad_port_t
+
+	// The port state in h.umad_ca is that at startup, so the port is queried afresh.
+	if C.umad_get_port(&h.umad_ca.ca_name[0], C.int(portNum), &port) < 0 {
+		return subnetID{}, fmt.Errorf("umad_get_port failed")
+	}
+
+	state := port.state
+	prefix := ntohll(uint64(port.gid_prefix))
+	C.umad_release_port(&port)
+
+	if state != C.IB_LINK_ACTIVE {
+		return subnetID{}, errPortNotActive
+	}
+
+	sminfo, err := h.SMInfo(portNum)
+	if err != nil {
+		return subnetID{}, err
+	}
+
+	return subnetID{prefix: prefix, smGUID: sminfo.GUID}, nil
+}
+
+// SMInfo queries the SMInfo attribute of the subnet manager of the fabric attached to the specified
+// port of the HCA.
+func (h *HCA) SMInfo(portNum int) (SMInfo, error) {
+	var (
+		sminfo [1024]C.uint8_t
+		portid C.ib_portid_t
+		port   C.umad_port_t
+
+		// mad_encode_field / mad_decode_field operate on uint32_t for fields up to 32 bits wide.
+		guid             uint64
+		act, prio, state uint32
+	)
+
+	mgmt_classes := [3]C.int{C.IB_SMI_CLASS, C.IB_SMI_DIRECT_CLASS, C.IB_SA_CLASS}
+
+	ibd_ca := C.CString(h.Name)
+	defer C.free(unsafe.Pointer(ibd_ca))
+
+	ibd_ca_port := C.int(portNum)
+
+	if C.umad_get_port(ibd_ca, ibd_ca_port, &port) < 0 {
+		return SMInfo{}, fmt.Errorf("umad_get_port failed")
+	}
+
+	portid.lid = C.int(port.sm_lid)
+	portid.sl = C.uchar(port.sm_sl)
+	C.umad_release_port(&port)
+
+	// struct ibmad_port *mad_rpc_open_port(char *dev_name, int dev_port, int *mgmt_classes, int num_classes)
+	srcport := C.mad_rpc_open_port(ibd_ca, ibd_ca_port, &mgmt_classes[0], 3)
+	if srcport == nil {
+		return SMInfo{}, fmt.Errorf("unable to open MAD port")
+	}
+
+	defer C.mad_rpc_close_port(srcport)
+
+	prio = uint32(SMINFO_STANDBY)
+	state = uint32(SMINFO_STANDBY)
+
+	C.mad_encode_field(&sminfo[0], C.IB_SMINFO_PRIO_F, unsafe.Pointer(&prio))
+	C.mad_encode_field(&sminfo[0], C.IB_SMINFO_STATE_F, unsafe.Pointer(&state))
+
+	if C.smp_query_via(unsafe.Pointer(&sminfo), &portid, C.IB_ATTR_SMINFO, 0, 0, srcport) == nil {
+		return SMInfo{}, fmt.Errorf("SMINFO query to LID %d failed", portid.lid)
+	}
+
+	C.mad_decode_field(&sminfo[0], C.IB_SMINFO_GUID_F, unsafe.Pointer(&guid))
+	C.mad_decode_field(&sminfo[0], C.IB_SMINFO_ACT_F, unsafe.Pointer(&act))
+	C.mad_decode_field(&sminfo[0], C.IB_SMINFO_PRIO_F, unsafe.Pointer(&prio))
+	C.mad_decode_field(&sminfo[0], C.IB_SMINFO_STATE_F, unsafe.Pointer(&state))
+
+	return SMInfo{
+		LID:           int(portid.lid),
+		GUID:          guid,
+		ActivityCount: act,
+		Priority:      uint8(prio),
+		State:         uint8(state),
+	}, nil
+}
@@ -0,0 +1,464 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package ibsim reads and writes fabric topologies in the network file format of ibsim (i.e., the
+// topology format of ibnetdiscover(8)), so that topologies can be used offline, without a running
+// ibsim, and discovered fabrics can be reproduced in ibsim. The output of ibnetdiscover can be read
+// likewise.
+package ibsim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/fake"
+)
+
+// Link width and speed of ports which do not specify them, as ibsim.
+const (
+	defaultWidth = "4X"
+	defaultSpeed = "SDR"
+)
+
+var (
+	// Node, e.g.: Switch	8 "S-003048ffff5812fc"		# "sw2" base port 0 lid 2 lmc 0
+	nodeRe = regexp.MustCompile(`^(Switch|Ca|Rt)\s+(\d+)\s+"([^"]*)"(.*)$`)
+
+	// Port, e.g.: [1](3048ffff9493f2) 	"S-003048ffff5812fc"[2]		# lid 22 lmc 0 "sw2" ...
+	// ibnetdiscover follows the port number of split ports with their external port, e.g. [1][ext 1].
+	portRe = regexp.MustCompile(`^\[(\d+)\](?:\[ext \d+\])?(?:\(([0-9a-fA-F]+)\))?\s*"([^"]*)"\[(\d+)\](?:\[ext \d+\])?(?:\(([0-9a-fA-F]+)\))?(.*)$`)
+
+	// Attribute of the following node, e.g.: switchguid=0x3048ffff5812fc(3048ffff5812fc)
+	attrRe = regexp.MustCompile(`^(vendid|devid|sysimgguid|switchguid|caguid|routerguid)\s*=\s*(0[xX][0-9a-fA-F]+|\d+)`)
+
+	descRe      = regexp.MustCompile(`#\s*"([^"]*)"`)
+	lidRe       = regexp.MustCompile(`\blid (\d+)\b`)
+	linkRe      = regexp.MustCompile(`\b(\d+)x(SDR|DDR|QDR|FDR10|FDR|EDR|HDR|NDR)\b`)
+	linkOptRe   = regexp.MustCompile(`\b([wse])=(\d+)\b`)
+	descEscaper = strings.NewReplacer(`"`, `'`, "\n", " ")
+)
+
+// node is a node of a network file, whose links are resolved once the whole file has been read.
+type node struct {
+	infiniband.Node
+	id       string
+	numPorts int
+	lid      int
+	links    []link
+}
+
+// link is a link of a port of a node, to a port of a remote node.
+type link struct {
+	port         int
+	remoteID     string
+	remotePort   int
+	width, speed string
+	line         int
+}
+
+// Network is the fabric of a network file.
+type Network struct {
+	Nodes []infiniband.Node
+
+	// SwitchLIDs maps the base LIDs of switches to their GUIDs, if given by the comments of the
+	// file (as output by ibnetdiscover), e.g. to attribute the output of perfquery to switches.
+	SwitchLIDs map[int]uint64
+}
+
+// Read reads a network file, and returns its nodes, as discovered by FabricMon. That is, switches
+// with all of their ports, and channel adapters and routers without ports, whose links are only
+// recorded by the ports of the switches at the other end. Nodes without a GUID are assigned one
+// sequentially.
+func Read(r io.Reader) ([]infiniband.Node, error) {
+	n, err := Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.Nodes, nil
+}
+
+// Parse reads a network file like Read, and returns its nodes, and the LIDs of its switches.
+func Parse(r io.Reader) (*Network, error) {
+	var (
+		nodes   []*node
+		cur     *node
+		attrs   = make(map[string]uint64)
+		lineNum int
+	)
+
+	ids := make(map[string]*node)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			// A blank line ends the port lines of a node.
+			if line == "" {
+				cur = nil
+			}
+		case attrRe.MatchString(line):
+			m := attrRe.FindStringSubmatch(line)
+			v, err := strconv.ParseUint(m[2], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+
+			attrs[m[1]] = v
+		case nodeRe.MatchString(line):
+			m := nodeRe.FindStringSubmatch(line)
+			numPorts, _ := strconv.Atoi(m[2])
+
+			if ids[m[3]] != nil {
+				return nil, fmt.Errorf("line %d: duplicate node %q", lineNum, m[3])
+			}
+
+			cur = newNode(m[1], m[3], numPorts, m[4], attrs)
+			nodes = append(nodes, cur)
+			ids[cur.id] = cur
+			attrs = make(map[string]uint64)
+		case strings.HasPrefix(line, "["):
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: port outside of node", lineNum)
+			}
+
+			m := portRe.FindStringSubmatch(line)
+			if m == nil {
+				// Unconnected port.
+				continue
+			}
+
+			l := link{remoteID: m[3], line: lineNum}
+			l.port, _ = strconv.Atoi(m[1])
+			l.remotePort, _ = strconv.Atoi(m[4])
+			l.width, l.speed = linkWidthSpeed(m[6])
+
+			if l.port < 1 || l.port > cur.numPorts {
+				return nil, fmt.Errorf("line %d: port %d of %d-port node %q", lineNum, l.port, cur.numPorts, cur.id)
+			}
+
+			cur.links = append(cur.links, l)
+		default:
+			return nil, fmt.Errorf("line %d: unrecognised line: %q", lineNum, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Assign GUIDs to nodes without one, avoiding those of other nodes.
+	guids := make(map[uint64]bool, len(nodes))
+	for _, n := range nodes {
+		guids[n.GUID] = true
+	}
+
+	next := uint64(1)
+
+	for _, n := range nodes {
+		if n.GUID == 0 {
+			for guids[next] {
+				next++
+			}
+
+			n.GUID = next
+			guids[next] = true
+		}
+
+		if n.SystemGUID == 0 {
+			n.SystemGUID = n.GUID
+		}
+
+		for i := range n.Ports {
+			n.Ports[i].GUID = n.GUID
+		}
+	}
+
+	// Links may be specified at either or both ends, so both ends are connected.
+	for _, n := range nodes {
+		for _, l := range n.links {
+			remote := ids[l.remoteID]
+			if remote == nil {
+				return nil, fmt.Errorf("line %d: link to unknown node %q", l.line, l.remoteID)
+			}
+
+			if l.remotePort < 1 || l.remotePort > remote.numPorts {
+				return nil, fmt.Errorf("line %d: link to port %d of %d-port node %q", l.line, l.remotePort, remote.numPorts, remote.id)
+			}
+
+			connect(n, l.port, remote, l.remotePort, l)
+			connect(remote, l.remotePort, n, l.port, l)
+		}
+	}
+
+	result := &Network{Nodes: make([]infiniband.Node, len(nodes)), SwitchLIDs: make(map[int]uint64)}
+
+	for i, n := range nodes {
+		result.Nodes[i] = n.Node
+
+		if n.lid > 0 && n.NodeType == infiniband.IB_NODE_SWITCH {
+			result.SwitchLIDs[n.lid] = n.GUID
+		}
+	}
+
+	return result, nil
+}
+
+// newNode returns a node with the specified type, ID and number of ports, and the attributes which
+// preceded it. Its description is taken from the comment, if any, or else its ID.
+func newNode(typ, id string, numPorts int, comment string, attrs map[string]uint64) *node {
+	n := &node{id: id, numPorts: numPorts}
+
+	n.NodeDesc = id
+	if m := descRe.FindStringSubmatch(comment); m != nil {
+		n.NodeDesc = m[1]
+	}
+
+	if m := lidRe.FindStringSubmatch(descRe.ReplaceAllString(comment, "")); m != nil {
+		n.lid, _ = strconv.Atoi(m[1])
+	}
+
+	n.VendorID = uint(attrs["vendid"])
+	n.DeviceID = uint(attrs["devid"])
+	n.SystemGUID = attrs["sysimgguid"]
+
+	switch typ {
+	case "Switch":
+		n.NodeType = infiniband.IB_NODE_SWITCH
+		n.GUID = attrs["switchguid"]
+		n.Ports = make([]infiniband.Port, numPorts+1)
+		n.Ports[0].State, n.Ports[0].PhysState = "Active", "LinkUp"
+
+		for i := 1; i <= numPorts; i++ {
+			n.Ports[i].State, n.Ports[i].PhysState = "Down", "Polling"
+		}
+	case "Ca":
+		n.NodeType = infiniband.IB_NODE_CA
+		n.GUID = attrs["caguid"]
+	case "Rt":
+		n.NodeType = infiniband.IB_NODE_ROUTER
+		n.GUID = attrs["routerguid"]
+	}
+
+	return n
+}
+
+// connect connects a port of a local node to a port of a remote node, unless the local node is not
+// a switch, whose ports are not walked.
+func connect(local *node, localPort int, remote *node, remotePort int, l link) {
+	if local.NodeType != infiniband.IB_NODE_SWITCH {
+		return
+	}
+
+	p := &local.Ports[localPort]
+	p.RemoteGUID = remote.GUID
+	p.RemoteNodeDesc = remote.NodeDesc
+	p.RemotePort = remotePort
+	p.State, p.PhysState = "Active", "LinkUp"
+	p.LinkWidth, p.LinkSpeed = l.width, l.speed
+}
+
+// linkWidthSpeed returns the link width and speed of a port line, given by a token such as 4xQDR,
+// or else by the ibsim options w=, s= and e= (extended speed), or else the defaults of ibsim.
+func linkWidthSpeed(s string) (string, string) {
+	if m := linkRe.FindStringSubmatch(s); m != nil {
+		return m[1] + "X", m[2]
+	}
+
+	width, speed := defaultWidth, defaultSpeed
+
+	var ext bool
+
+	for _, m := range linkOptRe.FindAllStringSubmatch(s, -1) {
+		v, _ := strconv.ParseUint(m[2], 10, 8)
+
+		switch {
+		case m[1] == "w":
+			width = infiniband.LinkWidthToStr(uint(v))
+		case m[1] == "s" && !ext:
+			speed = infiniband.LinkSpeedToStr(uint(v))
+		case m[1] == "e" && v > 0:
+			speed = infiniband.LinkSpeedExtToStr(uint(v))
+			ext = true
+		}
+	}
+
+	return width, speed
+}
+
+// nodeID returns the ID of a node in a network file, as assigned by ibnetdiscover.
+func nodeID(n *infiniband.Node) string {
+	switch n.NodeType {
+	case infiniband.IB_NODE_SWITCH:
+		return fmt.Sprintf("S-%016x", n.GUID)
+	case infiniband.IB_NODE_ROUTER:
+		return fmt.Sprintf("R-%016x", n.GUID)
+	default:
+		return fmt.Sprintf("H-%016x", n.GUID)
+	}
+}
+
+// linkOptions returns the token and ibsim options of the link width and speed of a port, or an
+// empty string if they are unknown.
+func linkOptions(p *infiniband.Port) string {
+	if p.LinkWidth == "" || p.LinkSpeed == "" {
+		return ""
+	}
+
+	opts := []string{strings.TrimSuffix(p.LinkWidth, "X") + "x" + p.LinkSpeed}
+
+	// Enums of the IBTA spec, cf. the *ToStr functions of package infiniband.
+	for _, e := range []struct {
+		opt  string
+		max  uint
+		val  string
+		conv func(uint) string
+	}{
+		{"s", 4, p.LinkSpeed, infiniband.LinkSpeedToStr},
+		{"e", 2, p.LinkSpeed, infiniband.LinkSpeedExtToStr},
+		{"w", 8, p.LinkWidth, infiniband.LinkWidthToStr},
+	} {
+		for v := uint(1); v <= e.max; v++ {
+			if e.conv(v) == e.val {
+				opts = append(opts, fmt.Sprintf("%s=%d", e.opt, v))
+			}
+		}
+	}
+
+	return strings.Join(opts, " ")
+}
+
+// Write writes the topology of a fabric as a network file. The links of channel adapters and
+// routers are taken from the switch ports at the other end, since their own ports are not walked.
+// Links to nodes which are not part of the fabric are omitted.
+func Write(w io.Writer, fabric infiniband.Fabric) error {
+	bw := bufio.NewWriter(w)
+
+	nodes := make(map[uint64]*infiniband.Node, len(fabric.Nodes))
+	for i := range fabric.Nodes {
+		nodes[fabric.Nodes[i].GUID] = &fabric.Nodes[i]
+	}
+
+	// Ports of non-switch nodes, as seen from the switch ports connected to them.
+	type peer struct {
+		sw   *infiniband.Node
+		port int
+	}
+
+	peers := make(map[uint64]map[int]peer)
+
+	for i := range fabric.Nodes {
+		sw := &fabric.Nodes[i]
+		if sw.NodeType != infiniband.IB_NODE_SWITCH {
+			continue
+		}
+
+		for portNum, p := range sw.Ports {
+			if remote := nodes[p.RemoteGUID]; remote != nil && remote.NodeType != infiniband.IB_NODE_SWITCH {
+				if peers[remote.GUID] == nil {
+					peers[remote.GUID] = make(map[int]peer)
+				}
+
+				peers[remote.GUID][p.RemotePort] = peer{sw, portNum}
+			}
+		}
+	}
+
+	fmt.Fprintln(bw, "#")
+	fmt.Fprintf(bw, "# Topology file: generated by FabricMon from %s %s port %d, discovered %s\n",
+		fabric.Hostname, fabric.CAName, fabric.SourcePort, fabric.Timestamp.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintln(bw, "#")
+
+	for i := range fabric.Nodes {
+		n := &fabric.Nodes[i]
+		desc := descEscaper.Replace(n.NodeDesc)
+
+		fmt.Fprintf(bw, "\nvendid=%#x\ndevid=%#x\nsysimgguid=%#x\n", n.VendorID, n.DeviceID, n.SystemGUID)
+
+		switch n.NodeType {
+		case infiniband.IB_NODE_SWITCH:
+			fmt.Fprintf(bw, "switchguid=%#x(%x)\n", n.GUID, n.GUID)
+			fmt.Fprintf(bw, "Switch\t%d \"%s\"\t\t# \"%s\" base port 0\n", max(len(n.Ports)-1, 0), nodeID(n), desc)
+
+			for portNum := 1; portNum < len(n.Ports); portNum++ {
+				p := &n.Ports[portNum]
+
+				remote := nodes[p.RemoteGUID]
+				if remote == nil {
+					continue
+				}
+
+				fmt.Fprintf(bw, "[%d]\t\"%s\"[%d]\t\t# \"%s\" %s\n", portNum, nodeID(remote), p.RemotePort,
+					descEscaper.Replace(remote.NodeDesc), linkOptions(p))
+			}
+		default:
+			typ, key := "Ca", "caguid"
+			if n.NodeType == infiniband.IB_NODE_ROUTER {
+				typ, key = "Rt", "routerguid"
+			}
+
+			// The number of ports is unknown, but must include those which are connected.
+			numPorts := 1
+			for portNum := range peers[n.GUID] {
+				numPorts = max(numPorts, portNum)
+			}
+
+			fmt.Fprintf(bw, "%s=%#x\n", key, n.GUID)
+			fmt.Fprintf(bw, "%s\t%d \"%s\"\t\t# \"%s\"\n", typ, numPorts, nodeID(n), desc)
+
+			for portNum := 1; portNum <= numPorts; portNum++ {
+				peer, ok := peers[n.GUID][portNum]
+				if !ok {
+					continue
+				}
+
+				p := &peer.sw.Ports[peer.port]
+
+				fmt.Fprintf(bw, "[%d]\t\"%s\"[%d]\t\t# \"%s\" %s\n", portNum, nodeID(peer.sw), peer.port,
+					descEscaper.Replace(peer.sw.NodeDesc), linkOptions(p))
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// NewSource returns a source which sweeps the fabric of a network file, without a running ibsim.
+// The counters of connected switch ports are all zero, as with an idle ibsim.
+func NewSource(path string) (*fake.Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	nodes, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i := range nodes {
+		for portNum := range nodes[i].Ports {
+			if p := &nodes[i].Ports[portNum]; portNum > 0 && p.RemoteGUID != 0 {
+				for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+					p.Counters.Set(id, 0)
+				}
+			}
+		}
+	}
+
+	src := fake.NewSource(&fake.Fabric{CAName: "ibsim", SourcePort: 1, Nodes: nodes})
+	src.Hostname = "ibsim"
+
+	return src, nil
+}
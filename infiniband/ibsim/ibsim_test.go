@@ -0,0 +1,146 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package ibsim
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+func TestRead(t *testing.T) {
+	f, err := os.Open("../../ibsim.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	nodes, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fabric := infiniband.Fabric{Nodes: nodes}
+
+	var switches, cas int
+
+	for _, node := range nodes {
+		switch node.NodeType {
+		case infiniband.IB_NODE_SWITCH:
+			switches++
+		case infiniband.IB_NODE_CA:
+			cas++
+		}
+	}
+
+	if switches != 2 || cas != 7 || len(fabric.Links()) != 8 {
+		t.Fatalf("got %d switches, %d CAs, %d links", switches, cas, len(fabric.Links()))
+	}
+
+	sw2 := nodes[0]
+	want := infiniband.Port{
+		GUID:           0x3048ffff5812fc,
+		RemoteGUID:     0x3048ffff95fd1a,
+		RemoteNodeDesc: "sw1",
+		RemotePort:     8,
+		State:          "Active",
+		PhysState:      "LinkUp",
+		LinkWidth:      "4X",
+		LinkSpeed:      "QDR",
+	}
+
+	if sw2.NodeDesc != "sw2" || sw2.GUID != 0x3048ffff5812fc || len(sw2.Ports) != 9 {
+		t.Fatalf("unexpected switch: %+v", sw2)
+	}
+
+	if !reflect.DeepEqual(sw2.Ports[8], want) {
+		t.Errorf("unexpected port:\n%+v\nwant:\n%+v", sw2.Ports[8], want)
+	}
+
+	if p := sw2.Ports[3]; p.State != "Down" || p.RemoteGUID != 0 {
+		t.Errorf("unexpected unconnected port: %+v", p)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, s := range []string{
+		"[1]\t\"S-1\"[1]\n",
+		"Switch\t2 \"S-1\"\n[3]\t\"S-1\"[1]\n",
+		"Switch\t2 \"S-1\"\n[1]\t\"S-2\"[1]\n",
+		"Switch\t2 \"S-1\"\nSwitch\t2 \"S-1\"\n",
+		"Hub\t2 \"X-1\"\n",
+	} {
+		if _, err := Read(strings.NewReader(s)); err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Links specified at one end only, without GUIDs, and with ibsim options.
+	net := `
+Switch	4 "S-a"		# "spine"
+[1]	"S-b"[4]	w=8 e=2
+[2]	"H-c"[1]
+
+Switch	4 "S-b"
+[1]	"H-d"[2]	# "n2 HCA-1" 4xFDR
+
+Ca	1 "H-c"		# "n1 HCA-1"
+Ca	2 "H-d"		# "n2 HCA-1"
+`
+
+	nodes, err := Read(strings.NewReader(net))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := nodes[1].Ports[4]; p.RemoteGUID != nodes[0].GUID || p.LinkWidth != "12X" || p.LinkSpeed != "EDR" {
+		t.Fatalf("unexpected port: %+v", p)
+	}
+
+	if p := nodes[0].Ports[2]; p.RemoteNodeDesc != "n1 HCA-1" || p.LinkWidth != "4X" || p.LinkSpeed != "SDR" {
+		t.Fatalf("unexpected port: %+v", p)
+	}
+
+	var buf bytes.Buffer
+
+	if err := Write(&buf, infiniband.Fabric{Nodes: nodes}); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf.String())
+	}
+
+	if !reflect.DeepEqual(nodes, again) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", nodes, again)
+	}
+}
+
+func TestSource(t *testing.T) {
+	src, err := NewSource("../../ibsim.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan infiniband.Fabric, 1)
+
+	if err := src.Sweep(context.Background(), c, infiniband.SweepConfig{}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	fabric := <-c
+
+	if v, ok := fabric.Nodes[0].Ports[8].Counters.Get(infiniband.PortXmitData); !ok || v != 0 {
+		t.Errorf("unexpected PortXmitData: %d, %v", v, ok)
+	}
+}
@@ -1,6 +1,8 @@
 // Copyright 2017-20 Daniel Swarbrick. All rights reserved.
 // SPDX-License-Identifier: GPL-3.0-or-later
 
+//go:build cgo && !umad
+
 // Functions analogous to libibumad.
 // Note: When running in an ibsim environment, the libumad2sim.so LD_PRELOAD hijacks libc syscall
 // wrappers such as scandir(3), which libibumad uses to enumerate HCAs found in sysfs. Other libc
@@ -7,83 +7,161 @@
 // handles the fabric discovery and performance counter querying functionality of FabricMon.
 package infiniband
 
-// #cgo CFLAGS: -I/usr/include/infiniband
-// #include <mad.h>
-// #include <umad.h>
-import "C"
-
 import (
 	"fmt"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad"
 )
 
 const (
-	PMA_TIMEOUT = 0
+	PMA_TIMEOUT = 0 // use the MAD port's default timeout
+
+	// Node types (cf. NodeInfo, table 150)
+	IB_NODE_CA     = 1
+	IB_NODE_SWITCH = 2
+	IB_NODE_ROUTER = 3
+)
 
-	IB_NODE_SWITCH = C.IB_NODE_SWITCH
+// Port states and physical port states (cf. PortInfo, table 155)
+const (
+	portStateDown   = 1
+	portStateActive = 4
+	physStateLinkUp = 5
 )
 
 type Fabric struct {
 	Hostname   string
 	CAName     string
 	SourcePort int
+	Timestamp  time.Time // time at which the fabric discovery completed
 	Nodes      []Node
+	Incomplete bool // sweep was cancelled or timed out, and Nodes holds only the nodes walked so far
+	Stats      SweepStats
+}
+
+// SweepStats holds statistics about the sweep which produced a fabric, for monitoring FabricMon
+// itself.
+type SweepStats struct {
+	Duration      time.Duration // duration of discovery and counter collection
+	SMPs          uint64        // subnet management packets sent during discovery (estimated)
+	PMAQueries    uint64        // performance management queries, including counter resets
+	CounterResets uint64        // counter resets issued
+	NodeErrors    map[uint64]NodeErrors
+}
+
+// NodeErrors holds the number of failed performance management queries of a node, keyed by node
+// GUID in SweepStats. Timeouts are a subset of failures.
+type NodeErrors struct {
+	Failures uint64
+	Timeouts uint64
+}
+
+// addError records a failed query of a node.
+func (s *SweepStats) addError(guid uint64, timeout bool) {
+	if s.NodeErrors == nil {
+		s.NodeErrors = make(map[uint64]NodeErrors)
+	}
+
+	e := s.NodeErrors[guid]
+	e.Failures++
+	if timeout {
+		e.Timeouts++
+	}
+	s.NodeErrors[guid] = e
 }
 
 type Node struct {
-	GUID     uint64
-	NodeType int
-	NodeDesc string
-	VendorID uint
-	DeviceID uint
-	Ports    []Port
+	GUID       uint64
+	SystemGUID uint64 // system image GUID, shared by all nodes in the same chassis
+	NodeType   int
+	NodeDesc   string
+	VendorID   uint
+	DeviceID   uint
+	Ports      []Port
 }
 
 type Port struct {
 	GUID           uint64
 	RemoteGUID     uint64
 	RemoteNodeDesc string
+	RemotePort     int    // port number on remote node, or zero if not connected
+	State          string // port state, e.g., Down, Initialize, Armed, Active
+	PhysState      string // physical port state, e.g., Polling, LinkUp
 	LinkWidth      string // link width, e.g., 1X, 4X, 8X, 12X
 	LinkSpeed      string // link speed, e.g., SDR, DDR, QDR, FDR, FDR10, EDR
-	Counters       map[uint32]interface{}
-}
-
-type Counter struct {
-	Name   string
-	Limit  uint64
-	Select uint32 // CounterSelect (bits 0-15), CounterSelect2 (bits 16-23)
-}
-
-// Standard (32-bit) counters and their display names.
-// Counter lengths and field selects defined in IBTA spec v1.3, table 247 (PortCounters).
-// Note: Standard data counters are absent from this map (e.g. PortXmitData, PortRcvData,
-// PortXmitPkts, PortRcvPkts).
-var StdCounterMap = map[uint32]Counter{
-	C.IB_PC_ERR_SYM_F:        {"SymbolErrorCounter", 0xffff, 0x1},
-	C.IB_PC_LINK_RECOVERS_F:  {"LinkErrorRecoveryCounter", 0xff, 0x2},
-	C.IB_PC_LINK_DOWNED_F:    {"LinkDownedCounter", 0xff, 0x4},
-	C.IB_PC_ERR_RCV_F:        {"PortRcvErrors", 0xffff, 0x8},
-	C.IB_PC_ERR_PHYSRCV_F:    {"PortRcvRemotePhysicalErrors", 0xffff, 0x10},
-	C.IB_PC_ERR_SWITCH_REL_F: {"PortRcvSwitchRelayErrors", 0xffff, 0x20},
-	C.IB_PC_XMT_DISCARDS_F:   {"PortXmitDiscards", 0xffff, 0x40},
-	C.IB_PC_ERR_XMTCONSTR_F:  {"PortXmitConstraintErrors", 0xff, 0x80},
-	C.IB_PC_ERR_RCVCONSTR_F:  {"PortRcvConstraintErrors", 0xff, 0x100},
-	C.IB_PC_ERR_LOCALINTEG_F: {"LocalLinkIntegrityErrors", 0xf, 0x200},
-	C.IB_PC_ERR_EXCESS_OVR_F: {"ExcessiveBufferOverrunErrors", 0xf, 0x400},
-	C.IB_PC_VL15_DROPPED_F:   {"VL15Dropped", 0xffff, 0x800},
-	C.IB_PC_XMT_WAIT_F:       {"PortXmitWait", 0xffffffff, 0x10000}, // Requires cap mask IB_PM_PC_XMIT_WAIT_SUP
-}
-
-// Extended (64-bit) counters and their display names.
-// Counter lengths and field selects defined in IBTA spec v1.3, table 260 (PortCountersExtended).
-var ExtCounterMap = map[uint32]Counter{
-	C.IB_PC_EXT_XMT_BYTES_F: {"PortXmitData", 0xffffffffffffffff, 0x1},
-	C.IB_PC_EXT_RCV_BYTES_F: {"PortRcvData", 0xffffffffffffffff, 0x2},
-	C.IB_PC_EXT_XMT_PKTS_F:  {"PortXmitPkts", 0xffffffffffffffff, 0x4},
-	C.IB_PC_EXT_RCV_PKTS_F:  {"PortRcvPkts", 0xffffffffffffffff, 0x8},
-	C.IB_PC_EXT_XMT_UPKTS_F: {"PortUnicastXmitPkts", 0xffffffffffffffff, 0x10},
-	C.IB_PC_EXT_RCV_UPKTS_F: {"PortUnicastRcvPkts", 0xffffffffffffffff, 0x20},
-	C.IB_PC_EXT_XMT_MPKTS_F: {"PortMulticastXmitPkts", 0xffffffffffffffff, 0x40},
-	C.IB_PC_EXT_RCV_MPKTS_F: {"PortMulticastRcvPkts", 0xffffffffffffffff, 0x80},
+	Counters       Counters
+}
+
+// newNode decodes a node from its NodeInfo.
+func newNode(info []byte, nodeDesc string) Node {
+	return Node{
+		GUID:       mad.NodeInfoNodeGUID.Get(info),
+		SystemGUID: mad.NodeInfoSystemImageGUID.Get(info),
+		NodeType:   int(mad.NodeInfoNodeType.Get(info)),
+		NodeDesc:   nodeDesc,
+		VendorID:   uint(mad.NodeInfoVendorID.Get(info)),
+		DeviceID:   uint(mad.NodeInfoDeviceID.Get(info)),
+	}
+}
+
+// newPort decodes a port from its PortInfo, the PortInfo holding its capability mask (i.e., that of
+// port zero, for switch ports), and its Mellanox ExtendedPortInfo (nil if not queried).
+func newPort(guid uint64, info, capInfo, extInfo []byte) Port {
+	var linkSpeedExt uint
+
+	portState := mad.PortInfoPortState.Get(info)
+	physState := mad.PortInfoPortPhysicalState.Get(info)
+
+	port := Port{
+		GUID:      guid,
+		State:     PortStateToStr(uint(portState)),
+		PhysState: PortPhysStateToStr(uint(physState)),
+	}
+
+	// C14-24.2.1 states that a down port allows for invalid data to be returned for all
+	// PortInfo components except PortState and PortPhysicalState.
+	if portState == portStateDown {
+		return port
+	}
+
+	port.LinkWidth = LinkWidthToStr(uint(mad.PortInfoLinkWidthActive.Get(info)))
+
+	// Check for extended speed support
+	if mad.PortInfoCapabilityMask.Get(capInfo)&mad.PortCapHasExtSpeeds != 0 {
+		linkSpeedExt = uint(mad.PortInfoLinkSpeedExtActive.Get(info))
+	}
+
+	if linkSpeedExt > 0 {
+		port.LinkSpeed = LinkSpeedExtToStr(linkSpeedExt)
+	} else if extInfo != nil && mad.MlnxExtPortLinkSpeedActive.Get(extInfo)&mad.MlnxLinkSpeedFDR10 != 0 {
+		port.LinkSpeed = "FDR10"
+	} else {
+		port.LinkSpeed = LinkSpeedToStr(uint(mad.PortInfoLinkSpeedActive.Get(info)))
+	}
+
+	return port
+}
+
+// portUp returns whether a port is active with its physical link up, given its PortInfo, i.e.,
+// whether its counters can be collected.
+func portUp(info []byte) bool {
+	return mad.PortInfoPortState.Get(info) == portStateActive &&
+		mad.PortInfoPortPhysicalState.Get(info) == physStateLinkUp
+}
+
+// linkWidthDegraded returns whether the active link width of a port is not the maximum width
+// supported by both ends of the link, given the PortInfo of both ports.
+func linkWidthDegraded(info, remoteInfo []byte) bool {
+	maxWidth := maxPow2Divisor(
+		uint(mad.PortInfoLinkWidthSupported.Get(info)),
+		uint(mad.PortInfoLinkWidthSupported.Get(remoteInfo)))
+
+	// TODO: Likewise determine max speed supported by both ends, checking for possible FDR10
+	// support (mad.MlnxExtPortLinkSpeedSupported) and extended speeds
+	// (mad.PortInfoLinkSpeedExtSupported).
+
+	return uint(mad.PortInfoLinkWidthActive.Get(info)) != maxWidth
 }
 
 // cf. PortInfo, table 155
@@ -107,6 +185,31 @@ var portPhysStates = [...]string{
 	"Phy Test",
 }
 
+// Effective data rate per lane in bits per second, i.e., after accounting for line encoding
+// overhead (8b/10b for SDR through QDR, 64b/66b for FDR10 and later).
+var laneDataRates = map[string]uint64{
+	"SDR":   2000000000,
+	"DDR":   4000000000,
+	"QDR":   8000000000,
+	"FDR10": 10000000000,
+	"FDR":   13636363636,
+	"EDR":   25000000000,
+}
+
+var linkWidthLanes = map[string]uint64{
+	"1X":  1,
+	"4X":  4,
+	"8X":  8,
+	"12X": 12,
+}
+
+// LinkDataRate returns the effective data rate in bits per second of a link with the specified
+// width and speed strings, as returned by LinkWidthToStr and LinkSpeedToStr / LinkSpeedExtToStr.
+// If either the width or the speed is unknown, zero is returned.
+func LinkDataRate(width, speed string) uint64 {
+	return linkWidthLanes[width] * laneDataRates[speed]
+}
+
 // LinkSpeedToStr converts an InfiniBand link speed enum to a human-readable string.
 // cf. IBTA spec v1.3, PortInfo, table 155.
 func LinkSpeedToStr(speed uint) string {
@@ -156,6 +259,20 @@ func LinkWidthToStr(width uint) string {
 	}
 }
 
+// NodeTypeToStr converts an InfiniBand node type enum to a human-readable string.
+func NodeTypeToStr(nodeType int) string {
+	switch nodeType {
+	case IB_NODE_CA:
+		return "HCA"
+	case IB_NODE_SWITCH:
+		return "Switch"
+	case IB_NODE_ROUTER:
+		return "Router"
+	default:
+		return fmt.Sprintf("undefined (%d)", nodeType)
+	}
+}
+
 // PortStateToStr converts an InfiniBand port state enum to a human-readable string.
 func PortStateToStr(state uint) string {
 	if state < uint(len(portStates)) {
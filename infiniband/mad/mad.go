@@ -0,0 +1,206 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package mad decodes the fields of management datagram (MAD) attributes in pure Go, avoiding the
+// overhead of a cgo call to libibmad's mad_get_field() per field. The fields are laid out as in
+// the IBTA spec v1.3 (and libibmad's field table), and are decoded from the attribute data, i.e.,
+// the data portion of the MAD, as returned by libibmad's smp_query_via() and pma_query_via().
+package mad
+
+import "encoding/binary"
+
+// Field is a field of a MAD attribute. Bits are numbered from the most significant bit of the
+// first byte, as in the IBTA spec. Fields wider than 32 bits are byte aligned.
+type Field struct {
+	Offset uint // bit offset
+	Width  uint // bit width
+}
+
+// Get decodes the field from the attribute data in buf.
+func (f Field) Get(buf []byte) uint64 {
+	if f.Offset%8 == 0 {
+		b := buf[f.Offset/8:]
+
+		switch f.Width {
+		case 8:
+			return uint64(b[0])
+		case 16:
+			return uint64(binary.BigEndian.Uint16(b))
+		case 32:
+			return uint64(binary.BigEndian.Uint32(b))
+		case 64:
+			return binary.BigEndian.Uint64(b)
+		}
+	}
+
+	// Fields which are not byte aligned are at most 32 bits wide, and span at most five bytes.
+	var v uint64
+
+	first, last := f.Offset/8, (f.Offset+f.Width-1)/8
+	for _, b := range buf[first : last+1] {
+		v = v<<8 | uint64(b)
+	}
+
+	v >>= 7 - (f.Offset+f.Width-1)%8
+
+	return v & (1<<f.Width - 1)
+}
+
+// Set encodes v into the field in buf. Bits of v beyond the field's width are ignored.
+func (f Field) Set(buf []byte, v uint64) {
+	if f.Offset%8 == 0 {
+		b := buf[f.Offset/8:]
+
+		switch f.Width {
+		case 8:
+			b[0] = byte(v)
+			return
+		case 16:
+			binary.BigEndian.PutUint16(b, uint16(v))
+			return
+		case 32:
+			binary.BigEndian.PutUint32(b, uint32(v))
+			return
+		case 64:
+			binary.BigEndian.PutUint64(b, v)
+			return
+		}
+	}
+
+	var old uint64
+
+	first, last := f.Offset/8, (f.Offset+f.Width-1)/8
+	for _, b := range buf[first : last+1] {
+		old = old<<8 | uint64(b)
+	}
+
+	shift := 7 - (f.Offset+f.Width-1)%8
+	mask := uint64(1<<f.Width-1) << shift
+	word := old&^mask | (v<<shift)&mask
+
+	for i := int(last); i >= int(first); i-- {
+		buf[i] = byte(word)
+		word >>= 8
+	}
+}
+
+// NodeInfo fields (IBTA spec v1.3, table 150).
+var (
+	NodeInfoBaseVersion     = Field{0, 8}
+	NodeInfoClassVersion    = Field{8, 8}
+	NodeInfoNodeType        = Field{16, 8}
+	NodeInfoNumPorts        = Field{24, 8}
+	NodeInfoSystemImageGUID = Field{32, 64}
+	NodeInfoNodeGUID        = Field{96, 64}
+	NodeInfoPortGUID        = Field{160, 64}
+	NodeInfoPartitionCap    = Field{224, 16}
+	NodeInfoDeviceID        = Field{240, 16}
+	NodeInfoRevision        = Field{256, 32}
+	NodeInfoLocalPortNum    = Field{288, 8}
+	NodeInfoVendorID        = Field{296, 24}
+)
+
+// PortInfo fields (IBTA spec v1.3, table 155). Fields which FabricMon has no use for are omitted.
+var (
+	PortInfoMkey                  = Field{0, 64}
+	PortInfoGIDPrefix             = Field{64, 64}
+	PortInfoLID                   = Field{128, 16}
+	PortInfoMasterSMLID           = Field{144, 16}
+	PortInfoCapabilityMask        = Field{160, 32}
+	PortInfoLocalPortNum          = Field{224, 8}
+	PortInfoLinkWidthEnabled      = Field{232, 8}
+	PortInfoLinkWidthSupported    = Field{240, 8}
+	PortInfoLinkWidthActive       = Field{248, 8}
+	PortInfoLinkSpeedSupported    = Field{256, 4}
+	PortInfoPortState             = Field{260, 4}
+	PortInfoPortPhysicalState     = Field{264, 4}
+	PortInfoLinkDownDefaultState  = Field{268, 4}
+	PortInfoLMC                   = Field{277, 3}
+	PortInfoLinkSpeedActive       = Field{280, 4}
+	PortInfoLinkSpeedEnabled      = Field{284, 4}
+	PortInfoNeighborMTU           = Field{288, 4}
+	PortInfoMasterSMSL            = Field{292, 4}
+	PortInfoCapabilityMask2       = Field{480, 16}
+	PortInfoLinkSpeedExtActive    = Field{496, 4}
+	PortInfoLinkSpeedExtSupported = Field{500, 4}
+	PortInfoLinkSpeedExtEnabled   = Field{507, 5}
+)
+
+// PortInfo CapabilityMask bits.
+const (
+	PortCapIsSM         = 1 << 1
+	PortCapHasExtSpeeds = 1 << 14
+	PortCapHasCapMask2  = 1 << 15
+)
+
+// SMInfo fields (IBTA spec v1.3, table 181).
+var (
+	SMInfoGUID          = Field{0, 64}
+	SMInfoSMKey         = Field{64, 64}
+	SMInfoActivityCount = Field{128, 32}
+	SMInfoPriority      = Field{160, 4}
+	SMInfoSMState       = Field{164, 4}
+)
+
+// Mellanox ExtendedPortInfo fields (vendor-specific attribute 0xff90).
+var (
+	MlnxExtPortLinkSpeedSupported = Field{56, 8}
+	MlnxExtPortLinkSpeedEnabled   = Field{88, 8}
+	MlnxExtPortLinkSpeedActive    = Field{120, 8}
+)
+
+// MlnxLinkSpeedFDR10 is the FDR10 bit of the Mellanox ExtendedPortInfo link speed fields.
+const MlnxLinkSpeedFDR10 = 1
+
+// ClassPortInfo fields (IBTA spec v1.3, table 126).
+var (
+	ClassPortInfoBaseVersion     = Field{0, 8}
+	ClassPortInfoClassVersion    = Field{8, 8}
+	ClassPortInfoCapabilityMask  = Field{16, 16}
+	ClassPortInfoCapabilityMask2 = Field{32, 27}
+	ClassPortInfoRespTimeValue   = Field{59, 5}
+)
+
+// PerfMgt ClassPortInfo CapabilityMask bits (cf. IB_PM_* in ib_types.h).
+const (
+	PMAllPortSelect     = 1 << 8
+	PMExtWidthSupported = 1 << 9
+	PMExtWidthNoIETF    = 1 << 10
+	PMSamplesOnly       = 1 << 11
+	PMPortXmitWait      = 1 << 12
+)
+
+// PortCounters fields (IBTA spec v1.3, table 247). The 32-bit data / packet counters are omitted,
+// since they are superseded by those of PortCountersExtended.
+var (
+	PortCountersPortSelect                   = Field{8, 8}
+	PortCountersCounterSelect                = Field{16, 16}
+	PortCountersSymbolErrorCounter           = Field{32, 16}
+	PortCountersLinkErrorRecoveryCounter     = Field{48, 8}
+	PortCountersLinkDownedCounter            = Field{56, 8}
+	PortCountersPortRcvErrors                = Field{64, 16}
+	PortCountersPortRcvRemotePhysicalErrors  = Field{80, 16}
+	PortCountersPortRcvSwitchRelayErrors     = Field{96, 16}
+	PortCountersPortXmitDiscards             = Field{112, 16}
+	PortCountersPortXmitConstraintErrors     = Field{128, 8}
+	PortCountersPortRcvConstraintErrors      = Field{136, 8}
+	PortCountersCounterSelect2               = Field{144, 8}
+	PortCountersLocalLinkIntegrityErrors     = Field{152, 4}
+	PortCountersExcessiveBufferOverrunErrors = Field{156, 4}
+	PortCountersVL15Dropped                  = Field{176, 16}
+	PortCountersPortXmitWait                 = Field{320, 32}
+)
+
+// PortCountersExtended fields (IBTA spec v1.3, table 260).
+var (
+	PortCountersExtPortSelect            = Field{8, 8}
+	PortCountersExtCounterSelect         = Field{16, 16}
+	PortCountersExtPortXmitData          = Field{64, 64}
+	PortCountersExtPortRcvData           = Field{128, 64}
+	PortCountersExtPortXmitPkts          = Field{192, 64}
+	PortCountersExtPortRcvPkts           = Field{256, 64}
+	PortCountersExtPortUnicastXmitPkts   = Field{320, 64}
+	PortCountersExtPortUnicastRcvPkts    = Field{384, 64}
+	PortCountersExtPortMulticastXmitPkts = Field{448, 64}
+	PortCountersExtPortMulticastRcvPkts  = Field{512, 64}
+)
@@ -0,0 +1,109 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package mad
+
+import (
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad/madtest"
+)
+
+type fieldTest struct {
+	field Field
+	want  uint64
+}
+
+func TestFieldGet(t *testing.T) {
+	tests := []struct {
+		file   string
+		fields map[string]fieldTest
+	}{
+		{"nodeinfo.hex", map[string]fieldTest{
+			"BaseVersion":     {NodeInfoBaseVersion, 1},
+			"NodeType":        {NodeInfoNodeType, 2},
+			"NumPorts":        {NodeInfoNumPorts, 36},
+			"SystemImageGUID": {NodeInfoSystemImageGUID, 0x7cfe900300a1b2c3},
+			"NodeGUID":        {NodeInfoNodeGUID, 0x7cfe900300a1b2c3},
+			"PartitionCap":    {NodeInfoPartitionCap, 8},
+			"DeviceID":        {NodeInfoDeviceID, 0xcf08},
+			"Revision":        {NodeInfoRevision, 0xa2},
+			"LocalPortNum":    {NodeInfoLocalPortNum, 1},
+			"VendorID":        {NodeInfoVendorID, 0x02c9},
+		}},
+		{"portinfo.hex", map[string]fieldTest{
+			"GIDPrefix":             {PortInfoGIDPrefix, 0xfe80000000000000},
+			"LID":                   {PortInfoLID, 5},
+			"MasterSMLID":           {PortInfoMasterSMLID, 1},
+			"CapabilityMask":        {PortInfoCapabilityMask, 0x0251484a},
+			"LinkWidthEnabled":      {PortInfoLinkWidthEnabled, 3},
+			"LinkWidthSupported":    {PortInfoLinkWidthSupported, 3},
+			"LinkWidthActive":       {PortInfoLinkWidthActive, 2},
+			"LinkSpeedSupported":    {PortInfoLinkSpeedSupported, 7},
+			"PortState":             {PortInfoPortState, 4},
+			"PortPhysicalState":     {PortInfoPortPhysicalState, 5},
+			"LinkDownDefaultState":  {PortInfoLinkDownDefaultState, 2},
+			"LMC":                   {PortInfoLMC, 3},
+			"LinkSpeedActive":       {PortInfoLinkSpeedActive, 1},
+			"LinkSpeedEnabled":      {PortInfoLinkSpeedEnabled, 7},
+			"NeighborMTU":           {PortInfoNeighborMTU, 5},
+			"CapabilityMask2":       {PortInfoCapabilityMask2, 4},
+			"LinkSpeedExtActive":    {PortInfoLinkSpeedExtActive, 2},
+			"LinkSpeedExtSupported": {PortInfoLinkSpeedExtSupported, 3},
+			"LinkSpeedExtEnabled":   {PortInfoLinkSpeedExtEnabled, 3},
+		}},
+		{"mlnx_extportinfo.hex", map[string]fieldTest{
+			"LinkSpeedSupported": {MlnxExtPortLinkSpeedSupported, MlnxLinkSpeedFDR10},
+			"LinkSpeedActive":    {MlnxExtPortLinkSpeedActive, MlnxLinkSpeedFDR10},
+		}},
+		{"classportinfo.hex", map[string]fieldTest{
+			"CapabilityMask": {ClassPortInfoCapabilityMask, PMExtWidthSupported | PMExtWidthNoIETF | PMPortXmitWait},
+			"RespTimeValue":  {ClassPortInfoRespTimeValue, 0x12},
+		}},
+		{"portcounters.hex", map[string]fieldTest{
+			"PortSelect":                   {PortCountersPortSelect, 1},
+			"CounterSelect":                {PortCountersCounterSelect, 0xffff},
+			"SymbolErrorCounter":           {PortCountersSymbolErrorCounter, 12},
+			"LinkErrorRecoveryCounter":     {PortCountersLinkErrorRecoveryCounter, 3},
+			"LinkDownedCounter":            {PortCountersLinkDownedCounter, 1},
+			"PortRcvErrors":                {PortCountersPortRcvErrors, 7},
+			"PortRcvSwitchRelayErrors":     {PortCountersPortRcvSwitchRelayErrors, 2},
+			"PortXmitDiscards":             {PortCountersPortXmitDiscards, 256},
+			"PortRcvConstraintErrors":      {PortCountersPortRcvConstraintErrors, 4},
+			"LocalLinkIntegrityErrors":     {PortCountersLocalLinkIntegrityErrors, 2},
+			"ExcessiveBufferOverrunErrors": {PortCountersExcessiveBufferOverrunErrors, 1},
+			"VL15Dropped":                  {PortCountersVL15Dropped, 9},
+			"PortXmitWait":                 {PortCountersPortXmitWait, 0x10000},
+		}},
+		{"portcountersext.hex", map[string]fieldTest{
+			"PortXmitData":          {PortCountersExtPortXmitData, 1 << 32},
+			"PortRcvData":           {PortCountersExtPortRcvData, 0x12345678},
+			"PortXmitPkts":          {PortCountersExtPortXmitPkts, 1000000},
+			"PortRcvPkts":           {PortCountersExtPortRcvPkts, 0xffffffffffffffff},
+			"PortUnicastXmitPkts":   {PortCountersExtPortUnicastXmitPkts, 42},
+			"PortUnicastRcvPkts":    {PortCountersExtPortUnicastRcvPkts, 256},
+			"PortMulticastXmitPkts": {PortCountersExtPortMulticastXmitPkts, 3},
+			"PortMulticastRcvPkts":  {PortCountersExtPortMulticastRcvPkts, 4},
+		}},
+	}
+
+	for _, tt := range tests {
+		buf := madtest.ReadHex(t, "testdata/"+tt.file)
+
+		for name, f := range tt.fields {
+			if got := f.field.Get(buf); got != f.want {
+				t.Errorf("%s: %s: got %#x, want %#x", tt.file, name, got, f.want)
+			}
+		}
+	}
+}
+
+func BenchmarkFieldGet(b *testing.B) {
+	buf := madtest.ReadHex(b, "testdata/portinfo.hex")
+
+	for i := 0; i < b.N; i++ {
+		PortInfoPortState.Get(buf)
+		PortInfoLinkWidthActive.Get(buf)
+		PortInfoCapabilityMask.Get(buf)
+	}
+}
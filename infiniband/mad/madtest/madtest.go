@@ -0,0 +1,36 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package madtest provides helpers for tests of MAD encoding and decoding.
+package madtest
+
+import (
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+// ReadHex reads attribute data from a hex dump, ignoring whitespace and comments.
+func ReadHex(tb testing.TB, path string) []byte {
+	tb.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var s strings.Builder
+
+	for _, line := range strings.Split(string(b), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		s.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+
+	buf, err := hex.DecodeString(s.String())
+	if err != nil {
+		tb.Fatalf("%s: %v", path, err)
+	}
+
+	return buf
+}
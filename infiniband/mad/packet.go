@@ -0,0 +1,282 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Encoding of subnet management packets (SMPs) and performance management MADs.
+
+package mad
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	Size = 256 // size of a MAD, excluding any RMPP segments
+
+	BaseVersion = 1
+
+	// Management classes (IBTA spec v1.3, table 115)
+	ClassSubnLID           = 0x01 // LID routed subnet management
+	ClassPerfMgt           = 0x04
+	ClassSubnDirectedRoute = 0x81 // directed route subnet management
+
+	// Methods
+	MethodGet     = 0x01
+	MethodSet     = 0x02
+	MethodGetResp = 0x81
+
+	// Subnet management attributes (table 145)
+	AttrNodeDesc        = 0x0010
+	AttrNodeInfo        = 0x0011
+	AttrSwitchInfo      = 0x0012
+	AttrPortInfo        = 0x0015
+	AttrSMInfo          = 0x0020
+	AttrMlnxExtPortInfo = 0xff90 // Mellanox ExtendedPortInfo
+
+	// Performance management attributes (table 242)
+	AttrClassPortInfo   = 0x0001
+	AttrPortCounters    = 0x0012
+	AttrPortCountersExt = 0x001d
+
+	SMPDataOffset     = 64
+	SMPDataSize       = 64
+	PerfMgtDataOffset = 64
+	PerfMgtDataSize   = 192
+
+	PermissiveLID = 0xffff
+
+	// MaxHops is the maximum number of hops of a directed route, limited by the size of the
+	// InitialPath field, whose first byte is unused.
+	MaxHops = 63
+
+	directionBit = 0x8000 // D bit of the status field of directed route SMPs
+)
+
+// Header is the common MAD header (IBTA spec v1.3, section 13.4.3).
+type Header struct {
+	BaseVersion   uint8
+	MgmtClass     uint8
+	ClassVersion  uint8
+	Method        uint8
+	Status        uint16 // for directed route SMPs, includes the D bit
+	ClassSpecific uint16 // for directed route SMPs, hop pointer and hop count
+	TransactionID uint64
+	AttrID        uint16
+	AttrModifier  uint32
+}
+
+func (h *Header) marshal(b []byte) {
+	b[0] = h.BaseVersion
+	b[1] = h.MgmtClass
+	b[2] = h.ClassVersion
+	b[3] = h.Method
+	binary.BigEndian.PutUint16(b[4:], h.Status)
+	binary.BigEndian.PutUint16(b[6:], h.ClassSpecific)
+	binary.BigEndian.PutUint64(b[8:], h.TransactionID)
+	binary.BigEndian.PutUint16(b[16:], h.AttrID)
+	binary.BigEndian.PutUint32(b[20:], h.AttrModifier)
+}
+
+func (h *Header) unmarshal(b []byte) {
+	h.BaseVersion = b[0]
+	h.MgmtClass = b[1]
+	h.ClassVersion = b[2]
+	h.Method = b[3]
+	h.Status = binary.BigEndian.Uint16(b[4:])
+	h.ClassSpecific = binary.BigEndian.Uint16(b[6:])
+	h.TransactionID = binary.BigEndian.Uint64(b[8:])
+	h.AttrID = binary.BigEndian.Uint16(b[16:])
+	h.AttrModifier = binary.BigEndian.Uint32(b[20:])
+}
+
+// Err returns a *StatusError if the MAD's status indicates an error, otherwise nil.
+func (h *Header) Err() error {
+	status := h.Status
+	if h.MgmtClass == ClassSubnDirectedRoute {
+		status &^= directionBit
+	}
+
+	if status != 0 {
+		return &StatusError{Status: status}
+	}
+
+	return nil
+}
+
+// StatusError is an error status returned in a response MAD (IBTA spec v1.3, table 113).
+type StatusError struct {
+	Status uint16
+}
+
+func (e *StatusError) Error() string {
+	var reason string
+
+	switch (e.Status >> 2) & 0x7 {
+	case 0:
+		switch {
+		case e.Status&0x1 != 0:
+			reason = "busy"
+		case e.Status&0x2 != 0:
+			reason = "redirect required"
+		}
+	case 1:
+		reason = "bad version"
+	case 2:
+		reason = "method not supported"
+	case 3:
+		reason = "method / attribute combination not supported"
+	case 7:
+		reason = "invalid attribute or attribute modifier"
+	}
+
+	if reason == "" {
+		return fmt.Sprintf("MAD status %#04x", e.Status)
+	}
+
+	return fmt.Sprintf("MAD status %#04x (%s)", e.Status, reason)
+}
+
+// SMP is a subnet management packet (IBTA spec v1.3, section 14.2.1). The M_Key and directed
+// route fields are laid out the same in LID routed SMPs, where the directed route fields are
+// reserved.
+type SMP struct {
+	Header
+	Mkey        uint64
+	DrSLID      uint16
+	DrDLID      uint16
+	Data        [SMPDataSize]byte
+	InitialPath [64]byte
+	ReturnPath  [64]byte
+}
+
+// NewDirectedRouteSMP returns a directed route SMP, addressed to the node at the end of the path,
+// which holds the number of the port via which to leave each node along the route, beginning with
+// the local node. An empty path addresses the local node.
+func NewDirectedRouteSMP(method uint8, attrID uint16, attrMod uint32, mkey uint64, path []uint8) (*SMP, error) {
+	if len(path) > MaxHops {
+		return nil, fmt.Errorf("directed route of %d hops exceeds %d hops", len(path), MaxHops)
+	}
+
+	s := &SMP{
+		Header: Header{
+			BaseVersion:   BaseVersion,
+			MgmtClass:     ClassSubnDirectedRoute,
+			ClassVersion:  1,
+			Method:        method,
+			ClassSpecific: uint16(len(path)), // hop pointer 0, hop count
+			AttrID:        attrID,
+			AttrModifier:  attrMod,
+		},
+		Mkey:   mkey,
+		DrSLID: PermissiveLID,
+		DrDLID: PermissiveLID,
+	}
+
+	copy(s.InitialPath[1:], path)
+
+	return s, nil
+}
+
+// NewLIDRoutedSMP returns a LID routed SMP.
+func NewLIDRoutedSMP(method uint8, attrID uint16, attrMod uint32, mkey uint64) *SMP {
+	return &SMP{
+		Header: Header{
+			BaseVersion:  BaseVersion,
+			MgmtClass:    ClassSubnLID,
+			ClassVersion: 1,
+			Method:       method,
+			AttrID:       attrID,
+			AttrModifier: attrMod,
+		},
+		Mkey: mkey,
+	}
+}
+
+// HopPointer returns the hop pointer of a directed route SMP.
+func (s *SMP) HopPointer() uint8 {
+	return uint8(s.ClassSpecific >> 8)
+}
+
+// HopCount returns the hop count of a directed route SMP.
+func (s *SMP) HopCount() uint8 {
+	return uint8(s.ClassSpecific)
+}
+
+// Returning returns whether the D bit of a directed route SMP is set, i.e., whether the SMP is
+// returning from the node to which it was addressed.
+func (s *SMP) Returning() bool {
+	return s.MgmtClass == ClassSubnDirectedRoute && s.Status&directionBit != 0
+}
+
+// MarshalBinary encodes the SMP as a MAD.
+func (s *SMP) MarshalBinary() ([]byte, error) {
+	b := make([]byte, Size)
+
+	s.Header.marshal(b)
+	binary.BigEndian.PutUint64(b[24:], s.Mkey)
+	binary.BigEndian.PutUint16(b[32:], s.DrSLID)
+	binary.BigEndian.PutUint16(b[34:], s.DrDLID)
+	copy(b[SMPDataOffset:], s.Data[:])
+	copy(b[128:], s.InitialPath[:])
+	copy(b[192:], s.ReturnPath[:])
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes the SMP from a MAD.
+func (s *SMP) UnmarshalBinary(b []byte) error {
+	if len(b) < Size {
+		return fmt.Errorf("SMP too short: %d bytes", len(b))
+	}
+
+	s.Header.unmarshal(b)
+	s.Mkey = binary.BigEndian.Uint64(b[24:])
+	s.DrSLID = binary.BigEndian.Uint16(b[32:])
+	s.DrDLID = binary.BigEndian.Uint16(b[34:])
+	copy(s.Data[:], b[SMPDataOffset:])
+	copy(s.InitialPath[:], b[128:])
+	copy(s.ReturnPath[:], b[192:])
+
+	return nil
+}
+
+// PerfMgt is a performance management MAD (IBTA spec v1.3, section 16.1.1).
+type PerfMgt struct {
+	Header
+	Data [PerfMgtDataSize]byte
+}
+
+// NewPerfMgt returns a performance management MAD.
+func NewPerfMgt(method uint8, attrID uint16) *PerfMgt {
+	return &PerfMgt{
+		Header: Header{
+			BaseVersion:  BaseVersion,
+			MgmtClass:    ClassPerfMgt,
+			ClassVersion: 1,
+			Method:       method,
+			AttrID:       attrID,
+		},
+	}
+}
+
+// MarshalBinary encodes the performance management MAD.
+func (p *PerfMgt) MarshalBinary() ([]byte, error) {
+	b := make([]byte, Size)
+
+	p.Header.marshal(b)
+	copy(b[PerfMgtDataOffset:], p.Data[:])
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes the performance management MAD.
+func (p *PerfMgt) UnmarshalBinary(b []byte) error {
+	if len(b) < Size {
+		return fmt.Errorf("PerfMgt MAD too short: %d bytes", len(b))
+	}
+
+	p.Header.unmarshal(b)
+	copy(p.Data[:], b[PerfMgtDataOffset:])
+
+	return nil
+}
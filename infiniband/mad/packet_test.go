@@ -0,0 +1,137 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package mad
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad/madtest"
+)
+
+func TestSMPMarshal(t *testing.T) {
+	want := madtest.ReadHex(t, "testdata/smp_dr_nodeinfo_get.hex")
+
+	s, err := NewDirectedRouteSMP(MethodGet, AttrNodeInfo, 0, 0x1122334455667788, []uint8{1, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.TransactionID = 0x0000000100000001
+
+	got, _ := s.MarshalBinary()
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got\n%x\nwant\n%x", got, want)
+	}
+
+	if _, err := NewDirectedRouteSMP(MethodGet, AttrNodeInfo, 0, 0, make([]uint8, MaxHops+1)); err == nil {
+		t.Fatal("no error for directed route exceeding maximum hops")
+	}
+}
+
+func TestSMPUnmarshal(t *testing.T) {
+	buf := madtest.ReadHex(t, "testdata/smp_dr_nodeinfo_resp.hex")
+
+	var s SMP
+	if err := s.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Method != MethodGetResp || s.AttrID != AttrNodeInfo || !s.Returning() || s.Err() != nil {
+		t.Fatalf("unexpected header: %+v", s.Header)
+	}
+
+	if s.HopPointer() != 2 || s.HopCount() != 2 || s.InitialPath[1] != 1 || s.InitialPath[2] != 3 {
+		t.Fatalf("unexpected route: hop pointer %d, hop count %d, path %v",
+			s.HopPointer(), s.HopCount(), s.InitialPath[:3])
+	}
+
+	if guid := NodeInfoNodeGUID.Get(s.Data[:]); guid != 0x7cfe900300a1b2c3 {
+		t.Fatalf("NodeGUID: got %#x", guid)
+	}
+
+	// The response must marshal back to the same bytes.
+	if got, _ := s.MarshalBinary(); !bytes.Equal(got, buf) {
+		t.Fatalf("got\n%x\nwant\n%x", got, buf)
+	}
+}
+
+func TestPerfMgtMarshal(t *testing.T) {
+	tests := []struct {
+		file string
+		mad  func() *PerfMgt
+	}{
+		{"pma_portcounters_get.hex", func() *PerfMgt {
+			p := NewPerfMgt(MethodGet, AttrPortCounters)
+			p.TransactionID = 0x0000000200000007
+			PortCountersPortSelect.Set(p.Data[:], 5)
+			return p
+		}},
+		{"pma_portcounters_set.hex", func() *PerfMgt {
+			p := NewPerfMgt(MethodSet, AttrPortCounters)
+			p.TransactionID = 0x0000000200000008
+			PortCountersPortSelect.Set(p.Data[:], 5)
+			PortCountersCounterSelect.Set(p.Data[:], 0x1ffff)
+			PortCountersCounterSelect2.Set(p.Data[:], 0x1ffff>>16)
+			return p
+		}},
+	}
+
+	for _, tt := range tests {
+		want := madtest.ReadHex(t, "testdata/"+tt.file)
+
+		got, _ := tt.mad().MarshalBinary()
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got\n%x\nwant\n%x", tt.file, got, want)
+		}
+
+		var p PerfMgt
+		if err := p.UnmarshalBinary(want); err != nil {
+			t.Fatal(err)
+		}
+
+		if p.MgmtClass != ClassPerfMgt || PortCountersPortSelect.Get(p.Data[:]) != 5 {
+			t.Errorf("%s: unexpected MAD: %+v", tt.file, p.Header)
+		}
+	}
+}
+
+func TestFieldSet(t *testing.T) {
+	fields := []Field{
+		PortInfoLID, PortInfoPortState, PortInfoLMC, PortInfoLinkSpeedExtEnabled,
+		ClassPortInfoCapabilityMask2, ClassPortInfoRespTimeValue, NodeInfoVendorID, SMInfoGUID,
+	}
+
+	for _, f := range fields {
+		buf := bytes.Repeat([]byte{0xa5}, 64)
+		orig := append([]byte(nil), buf...)
+
+		want := uint64(0x123456789abcdef) & (1<<f.Width - 1)
+		f.Set(buf, want)
+
+		if got := f.Get(buf); got != want {
+			t.Errorf("%+v: got %#x, want %#x", f, got, want)
+		}
+
+		// Bits outside the field must be preserved.
+		f.Set(buf, f.Get(orig))
+		if !bytes.Equal(buf, orig) {
+			t.Errorf("%+v: bits outside field modified", f)
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	h := Header{MgmtClass: ClassSubnDirectedRoute, Status: directionBit | 0x1c}
+
+	var serr *StatusError
+	if err := h.Err(); !errors.As(err, &serr) || serr.Status != 0x1c {
+		t.Fatalf("got %v", err)
+	}
+
+	if got := h.Err().Error(); got != "MAD status 0x001c (invalid attribute or attribute modifier)" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !cgo || umad
+
+// MAD queries via the kernel's umad interface, in pure Go.
+
+package infiniband
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad"
+	"github.com/dswarbrick/fabricmon/infiniband/umad"
+)
+
+// smpClient performs directed route SMP queries via a umad device, counting the SMPs sent.
+type smpClient struct {
+	dev  *umad.Device
+	mkey uint64
+	log  *slog.Logger
+	smps atomic.Uint64
+}
+
+// query performs a directed route SMP Get() of an attribute of the node at the end of the path,
+// and returns the attribute data.
+func (c *smpClient) query(ctx context.Context, attrID uint16, attrMod uint32, path []uint8) ([]byte, error) {
+	req, err := mad.NewDirectedRouteSMP(mad.MethodGet, attrID, attrMod, c.mkey, path)
+	if err != nil {
+		return nil, err
+	}
+
+	b, _ := req.MarshalBinary()
+
+	c.smps.Add(1)
+
+	resp, err := c.dev.Do(ctx, b, umad.Addr{LID: mad.PermissiveLID})
+	if err != nil {
+		return nil, err
+	}
+
+	var s mad.SMP
+	if err := s.UnmarshalBinary(resp); err != nil {
+		return nil, err
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.Data[:], nil
+}
+
+// umadTransport sends PerfMgt MADs via a umad device.
+type umadTransport struct {
+	dev *umad.Device
+}
+
+// openUmadTransport opens the umad device of the specified local HCA port for PerfMgt queries.
+func openUmadTransport(caName string, portNum int, cfg SweepConfig) (pmaTransport, error) {
+	dev, err := umad.Open(caName, portNum, mad.ClassPerfMgt)
+	if err != nil {
+		return nil, err
+	}
+
+	dev.Timeout, dev.Retries = cfg.Timeout, cfg.Retries
+
+	return &umadTransport{dev: dev}, nil
+}
+
+func (t *umadTransport) get(lid uint16, portNum int, attrID uint16, buf []byte) error {
+	req := mad.NewPerfMgt(mad.MethodGet, attrID)
+
+	// Like libibmad, PortSelect is set regardless of the attribute.
+	mad.PortCountersPortSelect.Set(req.Data[:], uint64(portNum))
+
+	resp, err := t.do(req, lid)
+	if err != nil {
+		return err
+	}
+
+	copy(buf, resp.Data[:])
+
+	return nil
+}
+
+func (t *umadTransport) reset(lid uint16, portNum int, selMask uint32) error {
+	req := mad.NewPerfMgt(mad.MethodSet, mad.AttrPortCounters)
+
+	mad.PortCountersPortSelect.Set(req.Data[:], uint64(portNum))
+	mad.PortCountersCounterSelect.Set(req.Data[:], uint64(selMask))
+	mad.PortCountersCounterSelect2.Set(req.Data[:], uint64(selMask>>16))
+
+	_, err := t.do(req, lid)
+
+	return err
+}
+
+func (t *umadTransport) do(req *mad.PerfMgt, lid uint16) (*mad.PerfMgt, error) {
+	b, _ := req.MarshalBinary()
+
+	// The umad device enforces the timeout and retries of each query.
+	b, err := t.dev.Do(context.Background(), b, umad.Addr{LID: lid, QPN: 1, QKey: umad.QKeyGSI})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp mad.PerfMgt
+	if err := resp.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+
+	return &resp, resp.Err()
+}
+
+func (t *umadTransport) close() {
+	t.dev.Close()
+}
+
+// SMInfo queries the SMInfo attribute of the subnet manager of the fabric attached to the specified
+// port of the HCA.
+func (h *HCA) SMInfo(portNum int) (SMInfo, error) {
+	port, err := umad.GetPort(h.Name, portNum)
+	if err != nil {
+		return SMInfo{}, err
+	}
+
+	dev, err := umad.Open(h.Name, portNum, mad.ClassSubnLID)
+	if err != nil {
+		return SMInfo{}, fmt.Errorf("unable to open MAD port: %w", err)
+	}
+
+	defer dev.Close()
+
+	req, _ := mad.NewLIDRoutedSMP(mad.MethodGet, mad.AttrSMInfo, 0, 0).MarshalBinary()
+
+	b, err := dev.Do(context.Background(), req, umad.Addr{LID: port.SMLID, SL: port.SMSL})
+	if err != nil {
+		return SMInfo{}, fmt.Errorf("SMINFO query to LID %d failed: %w", port.SMLID, err)
+	}
+
+	var resp mad.SMP
+	if err := resp.UnmarshalBinary(b); err != nil {
+		return SMInfo{}, err
+	}
+
+	if err := resp.Err(); err != nil {
+		return SMInfo{}, fmt.Errorf("SMINFO query to LID %d failed: %w", port.SMLID, err)
+	}
+
+	return SMInfo{
+		LID:           int(port.SMLID),
+		GUID:          mad.SMInfoGUID.Get(resp.Data[:]),
+		ActivityCount: uint32(mad.SMInfoActivityCount.Get(resp.Data[:])),
+		Priority:      uint8(mad.SMInfoPriority.Get(resp.Data[:])),
+		State:         uint8(mad.SMInfoSMState.Get(resp.Data[:])),
+	}, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build cgo && !umad && libibmad
+
+// Cross-reference of the pure-Go MAD field decoder against libibmad, which is only built with the
+// libibmad tag, like the test which checks it.
+
+package infiniband
+
+// #cgo CFLAGS: -I/usr/include/infiniband
+// #cgo LDFLAGS: -libmad
+// #include <mad.h>
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad"
+)
+
+// madFieldRef pairs a field of package mad with the equivalent libibmad field.
+type madFieldRef struct {
+	name  string
+	field mad.Field
+	enum  uint32 // enum MAD_FIELDS
+}
+
+// madFieldRefs maps the sample attribute data in mad/testdata to the fields decoded from it.
+var madFieldRefs = map[string][]madFieldRef{
+	"nodeinfo.hex": {
+		{"BaseVersion", mad.NodeInfoBaseVersion, C.IB_NODE_BASE_VERS_F},
+		{"ClassVersion", mad.NodeInfoClassVersion, C.IB_NODE_CLASS_VERS_F},
+		{"NodeType", mad.NodeInfoNodeType, C.IB_NODE_TYPE_F},
+		{"NumPorts", mad.NodeInfoNumPorts, C.IB_NODE_NPORTS_F},
+		{"SystemImageGUID", mad.NodeInfoSystemImageGUID, C.IB_NODE_SYSTEM_GUID_F},
+		{"NodeGUID", mad.NodeInfoNodeGUID, C.IB_NODE_GUID_F},
+		{"PortGUID", mad.NodeInfoPortGUID, C.IB_NODE_PORT_GUID_F},
+		{"PartitionCap", mad.NodeInfoPartitionCap, C.IB_NODE_PARTITION_CAP_F},
+		{"DeviceID", mad.NodeInfoDeviceID, C.IB_NODE_DEVID_F},
+		{"Revision", mad.NodeInfoRevision, C.IB_NODE_REVISION_F},
+		{"LocalPortNum", mad.NodeInfoLocalPortNum, C.IB_NODE_LOCAL_PORT_F},
+		{"VendorID", mad.NodeInfoVendorID, C.IB_NODE_VENDORID_F},
+	},
+	"portinfo.hex": {
+		{"Mkey", mad.PortInfoMkey, C.IB_PORT_MKEY_F},
+		{"GIDPrefix", mad.PortInfoGIDPrefix, C.IB_PORT_GID_PREFIX_F},
+		{"LID", mad.PortInfoLID, C.IB_PORT_LID_F},
+		{"MasterSMLID", mad.PortInfoMasterSMLID, C.IB_PORT_SMLID_F},
+		{"CapabilityMask", mad.PortInfoCapabilityMask, C.IB_PORT_CAPMASK_F},
+		{"LocalPortNum", mad.PortInfoLocalPortNum, C.IB_PORT_LOCAL_PORT_F},
+		{"LinkWidthEnabled", mad.PortInfoLinkWidthEnabled, C.IB_PORT_LINK_WIDTH_ENABLED_F},
+		{"LinkWidthSupported", mad.PortInfoLinkWidthSupported, C.IB_PORT_LINK_WIDTH_SUPPORTED_F},
+		{"LinkWidthActive", mad.PortInfoLinkWidthActive, C.IB_PORT_LINK_WIDTH_ACTIVE_F},
+		{"LinkSpeedSupported", mad.PortInfoLinkSpeedSupported, C.IB_PORT_LINK_SPEED_SUPPORTED_F},
+		{"PortState", mad.PortInfoPortState, C.IB_PORT_STATE_F},
+		{"PortPhysicalState", mad.PortInfoPortPhysicalState, C.IB_PORT_PHYS_STATE_F},
+		{"LinkDownDefaultState", mad.PortInfoLinkDownDefaultState, C.IB_PORT_LINK_DOWN_DEF_F},
+		{"LMC", mad.PortInfoLMC, C.IB_PORT_LMC_F},
+		{"LinkSpeedActive", mad.PortInfoLinkSpeedActive, C.IB_PORT_LINK_SPEED_ACTIVE_F},
+		{"LinkSpeedEnabled", mad.PortInfoLinkSpeedEnabled, C.IB_PORT_LINK_SPEED_ENABLED_F},
+		{"NeighborMTU", mad.PortInfoNeighborMTU, C.IB_PORT_NEIGHBOR_MTU_F},
+		{"MasterSMSL", mad.PortInfoMasterSMSL, C.IB_PORT_SMSL_F},
+		{"LinkSpeedExtActive", mad.PortInfoLinkSpeedExtActive, C.IB_PORT_LINK_SPEED_EXT_ACTIVE_F},
+		{"LinkSpeedExtSupported", mad.PortInfoLinkSpeedExtSupported, C.IB_PORT_LINK_SPEED_EXT_SUPPORTED_F},
+		{"LinkSpeedExtEnabled", mad.PortInfoLinkSpeedExtEnabled, C.IB_PORT_LINK_SPEED_EXT_ENABLED_F},
+	},
+	"mlnx_extportinfo.hex": {
+		{"LinkSpeedSupported", mad.MlnxExtPortLinkSpeedSupported, C.IB_MLNX_EXT_PORT_LINK_SPEED_SUPPORTED_F},
+		{"LinkSpeedEnabled", mad.MlnxExtPortLinkSpeedEnabled, C.IB_MLNX_EXT_PORT_LINK_SPEED_ENABLED_F},
+		{"LinkSpeedActive", mad.MlnxExtPortLinkSpeedActive, C.IB_MLNX_EXT_PORT_LINK_SPEED_ACTIVE_F},
+	},
+	"classportinfo.hex": {
+		{"BaseVersion", mad.ClassPortInfoBaseVersion, C.IB_CPI_BASEVER_F},
+		{"ClassVersion", mad.ClassPortInfoClassVersion, C.IB_CPI_CLASSVER_F},
+		{"CapabilityMask", mad.ClassPortInfoCapabilityMask, C.IB_CPI_CAPMASK_F},
+		{"CapabilityMask2", mad.ClassPortInfoCapabilityMask2, C.IB_CPI_CAPMASK2_F},
+		{"RespTimeValue", mad.ClassPortInfoRespTimeValue, C.IB_CPI_RESP_TIME_VALUE_F},
+	},
+	"portcounters.hex": {
+		{"PortSelect", mad.PortCountersPortSelect, C.IB_PC_PORT_SELECT_F},
+		{"CounterSelect", mad.PortCountersCounterSelect, C.IB_PC_COUNTER_SELECT_F},
+		{"SymbolErrorCounter", mad.PortCountersSymbolErrorCounter, C.IB_PC_ERR_SYM_F},
+		{"LinkErrorRecoveryCounter", mad.PortCountersLinkErrorRecoveryCounter, C.IB_PC_LINK_RECOVERS_F},
+		{"LinkDownedCounter", mad.PortCountersLinkDownedCounter, C.IB_PC_LINK_DOWNED_F},
+		{"PortRcvErrors", mad.PortCountersPortRcvErrors, C.IB_PC_ERR_RCV_F},
+		{"PortRcvRemotePhysicalErrors", mad.PortCountersPortRcvRemotePhysicalErrors, C.IB_PC_ERR_PHYSRCV_F},
+		{"PortRcvSwitchRelayErrors", mad.PortCountersPortRcvSwitchRelayErrors, C.IB_PC_ERR_SWITCH_REL_F},
+		{"PortXmitDiscards", mad.PortCountersPortXmitDiscards, C.IB_PC_XMT_DISCARDS_F},
+		{"PortXmitConstraintErrors", mad.PortCountersPortXmitConstraintErrors, C.IB_PC_ERR_XMTCONSTR_F},
+		{"PortRcvConstraintErrors", mad.PortCountersPortRcvConstraintErrors, C.IB_PC_ERR_RCVCONSTR_F},
+		{"CounterSelect2", mad.PortCountersCounterSelect2, C.IB_PC_COUNTER_SELECT2_F},
+		{"LocalLinkIntegrityErrors", mad.PortCountersLocalLinkIntegrityErrors, C.IB_PC_ERR_LOCALINTEG_F},
+		{"ExcessiveBufferOverrunErrors", mad.PortCountersExcessiveBufferOverrunErrors, C.IB_PC_ERR_EXCESS_OVR_F},
+		{"VL15Dropped", mad.PortCountersVL15Dropped, C.IB_PC_VL15_DROPPED_F},
+		{"PortXmitWait", mad.PortCountersPortXmitWait, C.IB_PC_XMT_WAIT_F},
+	},
+	"portcountersext.hex": {
+		{"PortSelect", mad.PortCountersExtPortSelect, C.IB_PC_EXT_PORT_SELECT_F},
+		{"CounterSelect", mad.PortCountersExtCounterSelect, C.IB_PC_EXT_COUNTER_SELECT_F},
+		{"PortXmitData", mad.PortCountersExtPortXmitData, C.IB_PC_EXT_XMT_BYTES_F},
+		{"PortRcvData", mad.PortCountersExtPortRcvData, C.IB_PC_EXT_RCV_BYTES_F},
+		{"PortXmitPkts", mad.PortCountersExtPortXmitPkts, C.IB_PC_EXT_XMT_PKTS_F},
+		{"PortRcvPkts", mad.PortCountersExtPortRcvPkts, C.IB_PC_EXT_RCV_PKTS_F},
+		{"PortUnicastXmitPkts", mad.PortCountersExtPortUnicastXmitPkts, C.IB_PC_EXT_XMT_UPKTS_F},
+		{"PortUnicastRcvPkts", mad.PortCountersExtPortUnicastRcvPkts, C.IB_PC_EXT_RCV_UPKTS_F},
+		{"PortMulticastXmitPkts", mad.PortCountersExtPortMulticastXmitPkts, C.IB_PC_EXT_XMT_MPKTS_F},
+		{"PortMulticastRcvPkts", mad.PortCountersExtPortMulticastRcvPkts, C.IB_PC_EXT_RCV_MPKTS_F},
+	},
+}
+
+// libibmadGetField decodes a field from attribute data with libibmad. Fields wider than 32 bits
+// must be decoded with mad_get_field64().
+func libibmadGetField(buf []byte, enum uint32, width uint) uint64 {
+	// Pad the data, in case libibmad reads whole words beyond the end of the field.
+	data := make([]byte, len(buf)+8)
+	copy(data, buf)
+
+	p := unsafe.Pointer(&data[0])
+
+	if width > 32 {
+		return uint64(C.mad_get_field64(p, 0, C.enum_MAD_FIELDS(enum)))
+	}
+
+	return uint64(C.mad_get_field(p, 0, C.enum_MAD_FIELDS(enum)))
+}
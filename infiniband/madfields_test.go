@@ -0,0 +1,31 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build cgo && !umad && libibmad
+
+package infiniband
+
+import (
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad/madtest"
+)
+
+// TestMADFieldsLibibmad cross-checks the pure-Go field decoder against libibmad. It requires a
+// real libibmad, and is only built with the libibmad tag:
+//
+//	go test -tags libibmad -run MADFieldsLibibmad ./infiniband
+func TestMADFieldsLibibmad(t *testing.T) {
+	for file, refs := range madFieldRefs {
+		buf := madtest.ReadHex(t, "mad/testdata/"+file)
+
+		for _, ref := range refs {
+			got := ref.field.Get(buf)
+			want := libibmadGetField(buf, ref.enum, ref.field.Width)
+
+			if got != want {
+				t.Errorf("%s: %s: got %#x, libibmad decodes %#x", file, ref.name, got, want)
+			}
+		}
+	}
+}
@@ -1,6 +1,11 @@
 // Copyright 2017-20 Daniel Swarbrick. All rights reserved.
 // SPDX-License-Identifier: GPL-3.0-or-later
 
+//go:build cgo && !umad
+
+// Fabric discovery via libibnetdisc, and counter collection via libibmad. This backend is the
+// default, unless FabricMon is built without cgo or with the umad build tag.
+
 package infiniband
 
 // #cgo CFLAGS: -I/usr/include/infiniband
@@ -11,9 +16,10 @@ package infiniband
 import "C"
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
 	"time"
 	"unsafe"
 )
@@ -24,90 +30,220 @@ type HCA struct {
 	// umad_ca_t contains an array of pointers - associated memory must be freed with
 	// umad_release_ca(umad_ca_t *ca)
 	umad_ca *C.umad_ca_t
+
+	// Fabrics discovered via each port, keyed by port number, for collecting counters without
+	// rediscovering the topology. The map is populated by GetCAs and not modified afterwards, so
+	// that ports can be swept concurrently.
+	fabrics map[int]*cachedFabric
+
+	log *slog.Logger // as passed to GetCAs
+}
+
+// cachedFabric holds the fabric last discovered via a port, if any. Fabrics must be freed with
+// ibnd_destroy_fabric().
+type cachedFabric struct {
+	fabric *C.struct_ibnd_fabric
 }
 
-func (h *HCA) NetDiscover(output chan Fabric, mkey uint64, resetThreshold uint) {
-	var (
-		totalNodes, totalPorts int
-	)
+// sweep sweeps the fabric attached to the local port. If no fabric could be swept, a nil fabric is
+// returned along with the error. If the sweep is incomplete, the fabric is returned along with the
+// error.
+func (p localPort) sweep(ctx context.Context, cfg SweepConfig, rediscover bool) (*Fabric, error) {
+	h := p.hca
+	portNum := p.portNum()
+	portLog := cfg.logger().With("ca", h.Name, "port", portNum)
+
+	if err := ctx.Err(); err != nil {
+		portLog.Warn("sweep cancelled", "err", err)
+		return nil, fmt.Errorf("sweep cancelled: %w", err)
+	}
+
+	portLog.Debug("polling port", "rediscover", rediscover)
 
-	mgmt_classes := [...]C.int{C.IB_SMI_CLASS, C.IB_SA_CLASS, C.IB_PERFORMANCE_CLASS}
+	var stats SweepStats
 
-	hostname, _ := os.Hostname()
 	start := time.Now()
+	cache := h.fabrics[portNum]
 
-	// Iterate over CA's umad_port array
-	for _, umad_port := range h.umad_ca.ports {
-		// umad_ca.ports may contain noncontiguous umad_port pointers
-		if umad_port == nil {
-			continue
+	if rediscover || cache.fabric == nil {
+		h.destroyFabric(portNum)
+
+		config := cfg.ibndConfig(p.mkey)
+
+		// NOTE: Under ibsim, this will fail after a certain number of iterations with a
+		// mad_rpc_open_port() error (presumably due to a resource leak in ibsim).
+		// ibnd_fabric_t *ibnd_discover_fabric(char *ca_name, int ca_port, ib_portid_t *from, ibnd_config_t *config)
+		fabric, err := C.ibnd_discover_fabric(&h.umad_ca.ca_name[0], C.int(portNum), nil, &config)
+		if err != nil {
+			portLog.Error("unable to discover fabric", "err", err)
+			return nil, fmt.Errorf("unable to discover fabric: %w", err)
 		}
 
-		portNum := int(umad_port.portnum)
-		linkLayer := C.GoString(&umad_port.link_layer[0])
-		portLog := slog.With("ca", h.Name, "port", portNum)
+		cache.fabric = fabric
+		stats.SMPs = discoverySMPs(fabric)
+	}
 
-		if linkLayer != "InfiniBand" && linkLayer != "IB" {
-			portLog.Debug("skipping port with unsupported link layer", "link_layer", linkLayer)
+	nodes, jobs, err := walkFabric(ctx, cache.fabric, cfg.logger())
+
+	// If the walk was cut short because the context is done, no counters are collected, so the
+	// partially walked fabric has none.
+	open := func() (pmaTransport, error) {
+		return openIbmadTransport(&h.umad_ca.ca_name[0], portNum, cfg)
+	}
+
+	if cerr := collectCounters(ctx, open, nodes, jobs, cfg, &stats); cerr != nil {
+		if errors.Is(cerr, errNoMADPort) {
+			portLog.Error("unable to open MAD port")
+			return nil, cerr
+		}
+
+		err = cerr
+	}
+
+	if err != nil {
+		portLog.Warn("sweep incomplete", "err", err, "nodes", len(nodes))
+		err = fmt.Errorf("sweep incomplete: %w", err)
+	}
+
+	stats.Duration = time.Since(start)
+
+	return &Fabric{
+		CAName:     h.Name,
+		SourcePort: portNum,
+		Timestamp:  time.Now(),
+		Nodes:      nodes,
+		Incomplete: err != nil,
+		Stats:      stats,
+	}, err
+}
+
+// destroyFabric frees the fabric discovered via the specified port, if any.
+func (h *HCA) destroyFabric(portNum int) {
+	if cache := h.fabrics[portNum]; cache != nil && cache.fabric != nil {
+		C.ibnd_destroy_fabric(cache.fabric)
+		cache.fabric = nil
+	}
+}
+
+// NodeCounters discovers the fabric attached to each InfiniBand source port (see
+// SweepConfig.Ports) of the HCA in turn, until a node with the specified GUID is found, and returns
+// the counters of the specified port of that node, or of all of its ports if portNum is negative.
+// Counters are never reset, regardless of cfg.ResetThreshold.
+func (h *HCA) NodeCounters(guid uint64, portNum int, cfg SweepConfig) (map[int]Counters, error) {
+	for _, umad_port := range h.umad_ca.ports {
+		if umad_port == nil || !isIBPort(umad_port) {
 			continue
 		}
 
-		portLog.Debug("polling port")
+		mkey, ok := cfg.sourcePort(h.Name, int(umad_port.portnum))
+		if !ok {
+			continue
+		}
 
-		// ibnd_config_t specifies max hops, timeout, max SMPs etc
-		config := C.ibnd_config_t{flags: C.IBND_CONFIG_MLX_EPI, mkey: C.uint64_t(mkey)}
+		config := cfg.ibndConfig(mkey)
 
-		// NOTE: Under ibsim, this will fail after a certain number of iterations with a
-		// mad_rpc_open_port() error (presumably due to a resource leak in ibsim).
-		// ibnd_fabric_t *ibnd_discover_fabric(char *ca_name, int ca_port, ib_portid_t *from, ibnd_config_t *config)
 		fabric, err := C.ibnd_discover_fabric(&h.umad_ca.ca_name[0], umad_port.portnum, nil, &config)
-
 		if err != nil {
-			portLog.Error("unable to discover fabric", "err", err)
+			cfg.logger().Error("unable to discover fabric", "ca", h.Name, "port", umad_port.portnum, "err", err)
+			continue
+		}
+
+		node := C.ibnd_find_node_guid(fabric, C.uint64_t(guid))
+		if node == nil {
+			C.ibnd_destroy_fabric(fabric)
 			continue
 		}
 
-		// Open MAD port, which is needed for getting port counters.
-		// struct ibmad_port *mad_rpc_open_port(char *dev_name, int dev_port, int *mgmt_classes, int num_classes)
-		mad_port := C.mad_rpc_open_port(&h.umad_ca.ca_name[0], umad_port.portnum, &mgmt_classes[0], C.int(len(mgmt_classes)))
+		defer C.ibnd_destroy_fabric(fabric)
 
-		if mad_port != nil {
-			nodes := walkFabric(fabric, mad_port, resetThreshold)
-			C.mad_rpc_close_port(mad_port)
+		transport, err := openIbmadTransport(&h.umad_ca.ca_name[0], int(umad_port.portnum), cfg)
+		if err != nil {
+			return nil, err
+		}
 
-			totalNodes += len(nodes)
+		defer transport.close()
+
+		n := ibndNode{ibnd_node: node}
+		n.slog = cfg.logger().With("node_desc", n.nodeDesc(), "node_guid", n.guidString())
 
-			for _, n := range nodes {
-				totalPorts += len(n.Ports)
+		counters := make(map[int]Counters)
+
+		for i := 0; i <= int(node.numports); i++ {
+			if portNum >= 0 && i != portNum {
+				continue
 			}
 
-			if output != nil {
-				output <- Fabric{
-					Hostname:   hostname,
-					CAName:     h.Name,
-					SourcePort: portNum,
-					Nodes:      nodes,
-				}
+			pp := n.port(i)
+			if pp == nil {
+				continue
 			}
-		} else {
-			portLog.Error("unable to open MAD port")
+
+			// Switch ports are addressed by the LID of the switch management port (port zero),
+			// whereas each CA / router port has its own LID.
+			lid := uint16(pp.base_lid)
+			if node._type == C.IB_NODE_SWITCH {
+				lid = uint16(node.smalid)
+			}
+
+			job := counterJob{guid: guid, lid: lid, portNum: i, log: n.slog}
+
+			// A reset threshold of 100% never triggers a reset, since counters latch at their
+			// maximum value.
+			var c Counters
+
+			if err := readPortCounters(&pmaClient{transport: transport}, job, 100, &c); err != nil {
+				return counters, fmt.Errorf("port %d: %w", i, err)
+			}
+
+			counters[i] = c
+		}
+
+		if len(counters) == 0 {
+			return nil, fmt.Errorf("node %#016x has no port %d", guid, portNum)
 		}
 
-		C.ibnd_destroy_fabric(fabric)
+		return counters, nil
 	}
 
-	slog.Info("netdiscover complete",
-		"duration", time.Since(start), "nodes", totalNodes, "ports", totalPorts)
+	return nil, fmt.Errorf("node %#016x not found in any fabric attached to %s", guid, h.Name)
+}
+
+// Ports returns the numbers of the HCA's ports with InfiniBand link layer.
+func (h *HCA) Ports() []int {
+	var ports []int
+
+	for _, umad_port := range h.umad_ca.ports {
+		if umad_port != nil && isIBPort(umad_port) {
+			ports = append(ports, int(umad_port.portnum))
+		}
+	}
+
+	return ports
 }
 
 func (h *HCA) Release() {
+	for portNum := range h.fabrics {
+		h.destroyFabric(portNum)
+	}
+
 	// Free associated memory from pointers in umad_ca_t.ports
 	if C.umad_release_ca(h.umad_ca) < 0 {
-		slog.Error("umad_release_ca", "umad_ca", h.umad_ca)
+		h.log.Error("umad_release_ca", "umad_ca", h.umad_ca)
 	}
 }
 
-func GetCAs() []HCA {
+// isIBPort returns true if the port has InfiniBand link layer (as opposed to e.g. Ethernet).
+func isIBPort(umad_port *C.umad_port_t) bool {
+	linkLayer := C.GoString(&umad_port.link_layer[0])
+	return linkLayer == "InfiniBand" || linkLayer == "IB"
+}
+
+// GetCAs returns the local HCAs, logging them to log. If log is nil, slog.Default() is used.
+func GetCAs(log *slog.Logger) []HCA {
+	if log == nil {
+		log = slog.Default()
+	}
+
 	caNames := umadGetCADeviceList()
 	hcas := make([]HCA, len(caNames))
 
@@ -118,7 +254,7 @@ func GetCAs() []HCA {
 		C.umad_get_ca(ca_name, &ca)
 		C.free(unsafe.Pointer(ca_name))
 
-		slog.Info("found HCA",
+		log.Info("found HCA",
 			"ca", C.GoString(&ca.ca_name[0]),
 			"type", C.GoString(&ca.ca_type[0]),
 			"ports", ca.numports,
@@ -130,6 +266,14 @@ func GetCAs() []HCA {
 		hcas[i] = HCA{
 			Name:    caName,
 			umad_ca: &ca,
+			fabrics: make(map[int]*cachedFabric),
+			log:     log,
+		}
+
+		for _, umad_port := range ca.ports {
+			if umad_port != nil {
+				hcas[i].fabrics[int(umad_port.portnum)] = &cachedFabric{}
+			}
 		}
 	}
 
@@ -141,78 +285,6 @@ type ibndNode struct {
 	slog      *slog.Logger
 }
 
-// getPortCounters retrieves all counters for a specific port.
-// Note: In PortCounters, PortCountersExtended, PortXmitDataSL, and PortRcvDataSL, components that
-// represent Data (e.g. PortXmitData and PortRcvData) indicate octets divided by 4 rather than just
-// octets.
-func (n *ibndNode) getPortCounters(portId *C.ib_portid_t, portNum int, ibmadPort *C.struct_ibmad_port, resetThreshold uint) (map[uint32]interface{}, error) {
-	var buf [1024]byte
-
-	counters := make(map[uint32]interface{})
-	portLog := n.slog.With("port", portNum)
-
-	// PerfMgt ClassPortInfo is a required attribute. See ClassPortInfo, IBTA spec v1.3, table 126.
-	pmaBuf := C.pma_query_via(unsafe.Pointer(&buf), portId, C.int(portNum), PMA_TIMEOUT, C.CLASS_PORT_INFO, ibmadPort)
-
-	if pmaBuf == nil {
-		return counters, fmt.Errorf("CLASS_PORT_INFO query failed")
-	}
-
-	// Keep capMask in network byte order for easier bitwise operations with capabilities contants.
-	capMask := htons(uint16(C.mad_get_field(unsafe.Pointer(&buf), 0, C.IB_CPI_CAPMASK_F)))
-
-	// Fetch standard (32 bit (or less)) counters
-	pmaBuf = C.pma_query_via(unsafe.Pointer(&buf), portId, C.int(portNum), PMA_TIMEOUT, C.IB_GSI_PORT_COUNTERS, ibmadPort)
-
-	if pmaBuf != nil {
-		var selMask uint32
-
-		// Iterate over standard counters
-		for field, counter := range StdCounterMap {
-			if (field == C.IB_PC_XMT_WAIT_F) && (capMask&C.IB_PM_PC_XMIT_WAIT_SUP == 0) {
-				continue // Counter not supported
-			}
-
-			counters[field] = uint32(C.mad_get_field(unsafe.Pointer(&buf), 0, field))
-
-			if float64(counters[field].(uint32)) > (float64(counter.Limit) * float64(resetThreshold) / 100) {
-				portLog.Warn("counter exceeds threshold", "counter", counter.Name, "value", counters[field])
-
-				selMask |= counter.Select
-			}
-		}
-
-		if selMask > 0 {
-			var pc [1024]byte
-
-			resetLog := portLog.With("select_mask", fmt.Sprintf("%#x", selMask))
-			resetLog.Warn("resetting counters")
-
-			if C.performance_reset_via(unsafe.Pointer(&pc), portId, C.int(portNum), C.uint(selMask), PMA_TIMEOUT, C.IB_GSI_PORT_COUNTERS, ibmadPort) == nil {
-				resetLog.Error("performance_reset_via failed")
-			}
-		}
-	}
-
-	if (capMask&C.IB_PM_EXT_WIDTH_SUPPORTED == 0) && (capMask&C.IB_PM_EXT_WIDTH_NOIETF_SUP == 0) {
-		// TODO: Fetch standard data / packet counters if extended counters are not supported
-		// (pre-QDR hardware).
-		portLog.Warn("port does not support extended counters")
-		return counters, nil
-	}
-
-	// Fetch extended (64 bit) counters
-	pmaBuf = C.pma_query_via(unsafe.Pointer(&buf), portId, C.int(portNum), PMA_TIMEOUT, C.IB_GSI_PORT_COUNTERS_EXT, ibmadPort)
-
-	if pmaBuf != nil {
-		for field := range ExtCounterMap {
-			counters[field] = uint64(C.mad_get_field64(unsafe.Pointer(&buf), 0, field))
-		}
-	}
-
-	return counters, nil
-}
-
 func (n *ibndNode) guid() uint64 {
 	return uint64(n.ibnd_node.guid)
 }
@@ -232,26 +304,41 @@ func (n *ibndNode) simpleNode() Node {
 		return Node{}
 	}
 
-	node := Node{
-		GUID:     n.guid(),
-		NodeType: int(n.ibnd_node._type),
-		NodeDesc: nnMap.RemapNodeName(n.guid(), n.nodeDesc()),
-		VendorID: uint(C.mad_get_field(unsafe.Pointer(&n.ibnd_node.info), 0, C.IB_NODE_VENDORID_F)),
-		DeviceID: uint(C.mad_get_field(unsafe.Pointer(&n.ibnd_node.info), 0, C.IB_NODE_DEVID_F)),
-	}
-
-	return node
+	return newNode(smpData(&n.ibnd_node.info), n.nodeDesc())
 }
 
-func (n *ibndNode) walkPorts(mad_port *C.struct_ibmad_port, resetThreshold uint) []Port {
-	var portid C.ib_portid_t
+// discoverySMPs estimates the number of SMPs which libibnetdisc sent to discover a fabric, since
+// libibnetdisc does not count them: NodeInfo and NodeDescription of every node, SwitchInfo of
+// switches, and PortInfo (plus Mellanox ExtendedPortInfo) of every discovered port.
+func discoverySMPs(fabric *C.struct_ibnd_fabric) uint64 {
+	var smps uint64
 
-	n.slog.Debug("walking ports for node", "node_type", n.ibnd_node._type, "num_ports", n.ibnd_node.numports)
+	for node := fabric.nodes; node != nil; node = node.next {
+		n := ibndNode{ibnd_node: node}
+		smps += 2
 
-	ports := make([]Port, n.ibnd_node.numports+1)
+		if node._type == C.IB_NODE_SWITCH {
+			smps++
+		}
+
+		for portNum := 0; portNum <= int(node.numports); portNum++ {
+			if n.port(portNum) != nil {
+				smps += 2
+			}
+		}
+	}
 
-	C.ib_portid_set(&portid, C.int(n.ibnd_node.smalid), 0, 0)
+	return smps
+}
+
+// smpData returns SMP attribute data held by libibnetdisc (e.g., NodeInfo or PortInfo) as a byte
+// slice, without copying, for decoding with package mad.
+func smpData(data *[C.IB_SMP_DATA_SIZE]C.uchar) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(&data[0])), len(data))
+}
 
+// port returns the port struct of the specified port number, which may be nil.
+func (n *ibndNode) port(portNum int) *C.ibnd_port_t {
 	// node.ports is an array of ports, indexed by port number:
 	//   ports[1] == port 1,
 	//   ports[2] == port 2,
@@ -260,63 +347,41 @@ func (n *ibndNode) walkPorts(mad_port *C.struct_ibmad_port, resetThreshold uint)
 	// ports[0] == nil for those nodes!
 	arrayPtr := uintptr(unsafe.Pointer(n.ibnd_node.ports))
 
-	for portNum := 0; portNum <= int(n.ibnd_node.numports); portNum++ {
-		var (
-			info         *[C.IB_SMP_DATA_SIZE]C.uchar
-			linkSpeedExt uint
-		)
+	return *(**C.ibnd_port_t)(unsafe.Pointer(arrayPtr + unsafe.Sizeof(arrayPtr)*uintptr(portNum)))
+}
 
-		portLog := n.slog.With("port", portNum)
+// walkPorts returns the ports of a switch, and a counter job for each port whose counters are to
+// be collected. If the context is done, the ports walked so far are returned, along with the
+// context's error.
+func (n *ibndNode) walkPorts(ctx context.Context, nodeIdx int) ([]Port, []counterJob, error) {
+	var jobs []counterJob
 
-		// Get pointer to port struct at portNum array offset
-		pp := *(**C.ibnd_port_t)(unsafe.Pointer(arrayPtr + unsafe.Sizeof(arrayPtr)*uintptr(portNum)))
-		if pp == nil {
-			continue
-		}
+	n.slog.Debug("walking ports for node", "node_type", n.ibnd_node._type, "num_ports", n.ibnd_node.numports)
 
-		myPort := Port{GUID: uint64(pp.guid)}
+	ports := make([]Port, n.ibnd_node.numports+1)
 
-		portState := C.mad_get_field(unsafe.Pointer(&pp.info), 0, C.IB_PORT_STATE_F)
-		physState := C.mad_get_field(unsafe.Pointer(&pp.info), 0, C.IB_PORT_PHYS_STATE_F)
+	// The capability mask of switch ports is that of the switch management port (port zero).
+	capInfo := smpData(&n.port(0).info)
 
-		// C14-24.2.1 states that a down port allows for invalid data to be returned for all
-		// PortInfo components except PortState and PortPhysicalState.
-		if portState == C.IB_LINK_DOWN {
-			ports[portNum] = myPort
-			continue
+	for portNum := 0; portNum <= int(n.ibnd_node.numports); portNum++ {
+		if err := ctx.Err(); err != nil {
+			return ports[:portNum], jobs, err
 		}
 
-		linkWidth := C.mad_get_field(unsafe.Pointer(&pp.info), 0, C.IB_PORT_LINK_WIDTH_ACTIVE_F)
-		myPort.LinkWidth = LinkWidthToStr(uint(linkWidth))
-
-		// Check for extended speed support
-		if n.ibnd_node._type == C.IB_NODE_SWITCH {
-			info = &(*(**C.ibnd_port_t)(unsafe.Pointer(arrayPtr))).info
-		} else {
-			info = &pp.info
-		}
+		portLog := n.slog.With("port", portNum)
 
-		capMask := htonl(uint32(C.mad_get_field(unsafe.Pointer(info), 0, C.IB_PORT_CAPMASK_F)))
-		if capMask&C.IB_PORT_CAP_HAS_EXT_SPEEDS != 0 {
-			linkSpeedExt = uint(C.mad_get_field(unsafe.Pointer(&pp.info), 0, C.IB_PORT_LINK_SPEED_EXT_ACTIVE_F))
+		pp := n.port(portNum)
+		if pp == nil {
+			continue
 		}
 
-		if linkSpeedExt > 0 {
-			myPort.LinkSpeed = LinkSpeedExtToStr(linkSpeedExt)
-		} else {
-			fdr10 := C.mad_get_field(unsafe.Pointer(&pp.ext_info), 0, C.IB_MLNX_EXT_PORT_LINK_SPEED_ACTIVE_F) & C.FDR10
+		info := smpData(&pp.info)
 
-			if fdr10 != 0 {
-				myPort.LinkSpeed = "FDR10"
-			} else {
-				linkSpeed := C.mad_get_field(unsafe.Pointer(&pp.info), 0, C.IB_PORT_LINK_SPEED_ACTIVE_F)
-				myPort.LinkSpeed = LinkSpeedToStr(uint(linkSpeed))
-			}
-		}
+		myPort := newPort(uint64(pp.guid), info, capInfo, smpData(&pp.ext_info))
 
 		portLog.Debug("port info",
-			"port_state", PortStateToStr(uint(portState)),
-			"phys_state", PortPhysStateToStr(uint(physState)),
+			"port_state", myPort.State,
+			"phys_state", myPort.PhysState,
 			"link_width", myPort.LinkWidth,
 			"link_speed", myPort.LinkSpeed)
 
@@ -326,64 +391,70 @@ func (n *ibndNode) walkPorts(mad_port *C.struct_ibmad_port, resetThreshold uint)
 		if rp != nil {
 			myPort.RemoteGUID = uint64(rp.node.guid)
 			myPort.RemoteNodeDesc = C.GoString(&rp.node.nodedesc[0])
+			myPort.RemotePort = int(rp.portnum)
 
 			// Port counters will only be fetched if port is ACTIVE + LINKUP
-			if (portState == C.IB_LINK_ACTIVE) && (physState == C.IB_PORT_PHYS_STATE_LINKUP) {
-				// Determine max width supported by both ends
-				maxWidth := maxPow2Divisor(
-					uint(C.mad_get_field(unsafe.Pointer(&pp.info), 0, C.IB_PORT_LINK_WIDTH_SUPPORTED_F)),
-					uint(C.mad_get_field(unsafe.Pointer(&rp.info), 0, C.IB_PORT_LINK_WIDTH_SUPPORTED_F)))
-
-				if uint(linkWidth) != maxWidth {
+			if portUp(info) {
+				if linkWidthDegraded(info, smpData(&rp.info)) {
 					portLog.Warn("link width is not the max width supported by both ports")
 				}
 
-				// Determine max speed supported by both ends
-				// TODO: Check for possible FDR10 support (ext_info IB_MLNX_EXT_PORT_LINK_SPEED_SUPPORTED_F)
-				// TODO: Check for possible extended speed (info IB_PORT_LINK_SPEED_EXT_SUPPORTED_F)
-				/*
-					maxSpeed := maxPow2Divisor(
-						uint(C.mad_get_field(unsafe.Pointer(&pp.info), 0, C.IB_PORT_LINK_SPEED_SUPPORTED_F)),
-						uint(C.mad_get_field(unsafe.Pointer(&rp.info), 0, C.IB_PORT_LINK_SPEED_SUPPORTED_F)))
-
-					if uint(linkSpeed) != maxSpeed {
-						log.Warnf("Port %d link speed is not the max speed supported by both ports",
-							portNum)
-					}
-				*/
-
-				if counters, err := n.getPortCounters(&portid, portNum, mad_port, resetThreshold); err == nil {
-					myPort.Counters = counters
-				} else {
-					portLog.Error("cannot get counters for port", "err", err)
-				}
+				jobs = append(jobs, counterJob{
+					nodeIdx: nodeIdx,
+					guid:    n.guid(),
+					lid:     uint16(n.ibnd_node.smalid),
+					portNum: portNum,
+					log:     n.slog,
+				})
 			}
 		}
 
 		ports[portNum] = myPort
 	}
 
-	return ports
+	return ports, jobs, nil
 }
 
-func walkFabric(fabric *C.struct_ibnd_fabric, mad_port *C.struct_ibmad_port, resetThreshold uint) []Node {
+// walkFabric returns the nodes of a fabric, including the ports of switches, and a counter job for
+// each switch port whose counters are to be collected. No MADs are sent, since the node and port
+// info was obtained during discovery. If the context is done, the nodes walked so far are returned,
+// along with the context's error.
+func walkFabric(ctx context.Context, fabric *C.struct_ibnd_fabric, log *slog.Logger) ([]Node, []counterJob, error) {
+	var jobs []counterJob
+
 	nodes := make([]Node, 0)
 
 	for node := fabric.nodes; node != nil; node = node.next {
-		n := ibndNode{ibnd_node: node}
-		n.slog = slog.With(
-			"node_desc", nnMap.RemapNodeName(n.guid(), n.nodeDesc()),
+		if err := ctx.Err(); err != nil {
+			return nodes, jobs, err
+		}
+
+		n := &ibndNode{ibnd_node: node}
+
+		n.slog = log.With(
+			"node_desc", n.nodeDesc(),
 			"node_guid", n.guidString(),
 		)
 
 		myNode := n.simpleNode()
 
 		if n.ibnd_node._type == C.IB_NODE_SWITCH {
-			myNode.Ports = n.walkPorts(mad_port, resetThreshold)
+			var (
+				portJobs []counterJob
+				err      error
+			)
+
+			// A partially walked switch is still included.
+			myNode.Ports, portJobs, err = n.walkPorts(ctx, len(nodes))
+			jobs = append(jobs, portJobs...)
+
+			if err != nil {
+				return append(nodes, myNode), jobs, err
+			}
 		}
 
 		nodes = append(nodes, myNode)
 	}
 
-	return nodes
+	return nodes, jobs, nil
 }
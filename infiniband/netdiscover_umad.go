@@ -0,0 +1,297 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !cgo || umad
+
+// Fabric discovery and counter collection via the kernel's umad interface, in pure Go. This
+// backend is selected by building FabricMon without cgo (CGO_ENABLED=0) or with the umad build
+// tag, and requires none of the libibumad, libibmad or libibnetdisc libraries.
+
+package infiniband
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband/mad"
+	"github.com/dswarbrick/fabricmon/infiniband/umad"
+)
+
+type HCA struct {
+	Name string
+
+	ca umad.CA
+
+	// Topologies discovered via each port, keyed by port number, for collecting counters without
+	// rediscovering the topology. The map is populated by GetCAs and not modified afterwards, so
+	// that ports can be swept concurrently.
+	fabrics map[int]*cachedFabric
+
+	log *slog.Logger // as passed to GetCAs
+}
+
+// cachedFabric holds the topology last discovered via a port, if any.
+type cachedFabric struct {
+	topology *topology
+}
+
+// sweep sweeps the fabric attached to the local port. If no fabric could be swept, a nil fabric is
+// returned along with the error. If the sweep is incomplete, the fabric is returned along with the
+// error.
+func (p localPort) sweep(ctx context.Context, cfg SweepConfig, rediscover bool) (*Fabric, error) {
+	h := p.hca
+	portNum := p.portNum()
+	portLog := cfg.logger().With("ca", h.Name, "port", portNum)
+
+	if err := ctx.Err(); err != nil {
+		portLog.Warn("sweep cancelled", "err", err)
+		return nil, fmt.Errorf("sweep cancelled: %w", err)
+	}
+
+	portLog.Debug("polling port", "rediscover", rediscover)
+
+	var (
+		stats SweepStats
+		err   error
+	)
+
+	start := time.Now()
+	cache := h.fabrics[portNum]
+	topo := cache.topology
+
+	if rediscover || topo == nil {
+		h.destroyFabric(portNum)
+
+		// Unlike with libibnetdisc, the discovery itself is interrupted if the context is done,
+		// in which case the partially discovered topology is walked, but not cached.
+		topo, err = h.discover(ctx, portNum, p.mkey, cfg, &stats)
+		if topo == nil {
+			portLog.Error("unable to discover fabric", "err", err)
+			return nil, fmt.Errorf("unable to discover fabric: %w", err)
+		}
+
+		if err == nil {
+			cache.topology = topo
+		}
+	}
+
+	nodes, jobs, werr := walkTopology(ctx, topo, cfg.logger())
+	if err == nil {
+		err = werr
+	}
+
+	open := func() (pmaTransport, error) {
+		return openUmadTransport(h.Name, portNum, cfg)
+	}
+
+	// If the walk was cut short because the context is done, no counters are collected, so the
+	// partially walked fabric has none.
+	if cerr := collectCounters(ctx, open, nodes, jobs, cfg, &stats); cerr != nil {
+		if errors.Is(cerr, errNoMADPort) {
+			portLog.Error("unable to open MAD port")
+			return nil, cerr
+		}
+
+		err = cerr
+	}
+
+	if err != nil {
+		portLog.Warn("sweep incomplete", "err", err, "nodes", len(nodes))
+		err = fmt.Errorf("sweep incomplete: %w", err)
+	}
+
+	stats.Duration = time.Since(start)
+
+	return &Fabric{
+		CAName:     h.Name,
+		SourcePort: portNum,
+		Timestamp:  time.Now(),
+		Nodes:      nodes,
+		Incomplete: err != nil,
+		Stats:      stats,
+	}, err
+}
+
+// discover discovers the fabric attached to the specified port of the HCA, counting the SMPs sent
+// in stats.
+func (h *HCA) discover(ctx context.Context, portNum int, mkey uint64, cfg SweepConfig, stats *SweepStats) (*topology, error) {
+	dev, err := umad.Open(h.Name, portNum, mad.ClassSubnDirectedRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	defer dev.Close()
+
+	dev.Timeout, dev.Retries = cfg.Timeout, cfg.Retries
+
+	c := &smpClient{dev: dev, mkey: mkey, log: cfg.logger()}
+	t, err := discover(ctx, c, cfg)
+	stats.SMPs = c.smps.Load()
+
+	return t, err
+}
+
+// destroyFabric discards the topology discovered via the specified port, if any.
+func (h *HCA) destroyFabric(portNum int) {
+	if cache := h.fabrics[portNum]; cache != nil {
+		cache.topology = nil
+	}
+}
+
+// NodeCounters discovers the fabric attached to each InfiniBand source port (see
+// SweepConfig.Ports) of the HCA in turn, until a node with the specified GUID is found, and returns
+// the counters of the specified port of that node, or of all of its ports if portNum is negative.
+// Counters are never reset, regardless of cfg.ResetThreshold.
+func (h *HCA) NodeCounters(guid uint64, portNum int, cfg SweepConfig) (map[int]Counters, error) {
+	for _, localPort := range h.Ports() {
+		mkey, ok := cfg.sourcePort(h.Name, localPort)
+		if !ok {
+			continue
+		}
+
+		var stats SweepStats
+
+		t, err := h.discover(context.Background(), localPort, mkey, cfg, &stats)
+		if err != nil {
+			cfg.logger().Error("unable to discover fabric", "ca", h.Name, "port", localPort, "err", err)
+			continue
+		}
+
+		node := t.guids[guid]
+		if node == nil {
+			continue
+		}
+
+		transport, err := openUmadTransport(h.Name, localPort, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open MAD port: %w", err)
+		}
+
+		defer transport.close()
+
+		nodeLog := cfg.logger().With("node_desc", node.desc, "node_guid", fmt.Sprintf("%#016x", guid))
+
+		counters := make(map[int]Counters)
+
+		for i, p := range node.ports {
+			if (portNum >= 0 && i != portNum) || p == nil {
+				continue
+			}
+
+			job := counterJob{guid: guid, lid: node.lid(i), portNum: i, log: nodeLog}
+
+			// A reset threshold of 100% never triggers a reset, since counters latch at their
+			// maximum value.
+			var c Counters
+
+			if err := readPortCounters(&pmaClient{transport: transport}, job, 100, &c); err != nil {
+				return counters, fmt.Errorf("port %d: %w", i, err)
+			}
+
+			counters[i] = c
+		}
+
+		if len(counters) == 0 {
+			return nil, fmt.Errorf("node %#016x has no port %d", guid, portNum)
+		}
+
+		return counters, nil
+	}
+
+	return nil, fmt.Errorf("node %#016x not found in any fabric attached to %s", guid, h.Name)
+}
+
+// Ports returns the numbers of the HCA's ports with InfiniBand link layer.
+func (h *HCA) Ports() []int {
+	var ports []int
+
+	for _, port := range h.ca.Ports {
+		if port.LinkLayer == "InfiniBand" || port.LinkLayer == "IB" {
+			ports = append(ports, port.Num)
+		}
+	}
+
+	return ports
+}
+
+// portSubnet identifies the subnet attached to the specified port of the HCA. errPortNotActive is
+// returned if the port is not active.
+func (h *HCA) portSubnet(portNum int) (subnetID, error) {
+	// The port state in h.ca is that at startup, so the port is queried afresh.
+	port, err := umad.GetPort(h.Name, portNum)
+	if err != nil {
+		return subnetID{}, err
+	}
+
+	if port.State != portStateActive {
+		return subnetID{}, errPortNotActive
+	}
+
+	sminfo, err := h.SMInfo(portNum)
+	if err != nil {
+		return subnetID{}, err
+	}
+
+	return subnetID{prefix: port.GIDPrefix, smGUID: sminfo.GUID}, nil
+}
+
+func (h *HCA) Release() {
+	for portNum := range h.fabrics {
+		h.destroyFabric(portNum)
+	}
+}
+
+// GetCAs returns the local HCAs, logging them to log. If log is nil, slog.Default() is used.
+func GetCAs(log *slog.Logger) []HCA {
+	if log == nil {
+		log = slog.Default()
+	}
+
+	cas, err := umad.GetCAs()
+	if err != nil {
+		log.Error("unable to enumerate HCAs", "err", err)
+	}
+
+	hcas := make([]HCA, len(cas))
+
+	for i, ca := range cas {
+		log.Info("found HCA",
+			"ca", ca.Name,
+			"type", ca.Type,
+			"ports", len(ca.Ports),
+			"firmware", ca.FWVersion,
+			"hardware", ca.HWVersion,
+			"node_guid", fmt.Sprintf("%#016x", ca.NodeGUID),
+			"system_guid", fmt.Sprintf("%#016x", ca.SystemGUID))
+
+		hcas[i] = HCA{
+			Name:    ca.Name,
+			ca:      ca,
+			fabrics: make(map[int]*cachedFabric),
+			log:     log,
+		}
+
+		for _, port := range ca.Ports {
+			hcas[i].fabrics[port.Num] = &cachedFabric{}
+		}
+	}
+
+	return hcas
+}
+
+// UmadDone has no effect, and exists for compatibility with the libibumad backend.
+//
+// Deprecated.
+func UmadDone() int {
+	return 0
+}
+
+// UmadInit has no effect, and exists for compatibility with the libibumad backend.
+//
+// Deprecated.
+func UmadInit() int {
+	return 0
+}
@@ -6,156 +6,526 @@
 package infiniband
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"io/fs"
 	"log/slog"
+	"net/http"
 	"os"
-	"strconv"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
-	"unicode"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-const DEFAULT_NODE_NAME_MAP = "/etc/opensm/ib-node-name-map"
+const (
+	DEFAULT_NODE_NAME_MAP = "/etc/opensm/ib-node-name-map"
 
-var nnMap *NodeNameMap
+	// Default interval at which node name maps are refetched from URLs.
+	DefaultNodeNameMapRefresh = 5 * time.Minute
+)
+
+// NodeNameMapConfig holds the parameters of a node name map.
+type NodeNameMapConfig struct {
+	// Sources of the map, each a file, a directory (whose files are read in lexical order), or an
+	// http(s) URL. The format of a file is selected by its extension: ".csv" for CSV, ".yaml" or
+	// ".yml" for YAML, and otherwise the format of ibnetdiscover(8). The format of a URL is
+	// selected by the extension of its path, or else by the content type of the response.
+	Sources []string
+
+	// Interval at which URLs are refetched (with a conditional GET). Zero selects
+	// DefaultNodeNameMapRefresh.
+	Refresh time.Duration
+
+	// HTTP client for fetching URLs. If nil, a client with a 30 second timeout is used.
+	HTTPClient *http.Client
+
+	// Logger of reloads and their errors. If nil, slog.Default() is used.
+	Logger *slog.Logger
+}
+
+// NodeEntry holds the name of a node in a node name map, along with its optional attributes, e.g.
+// from extra CSV columns.
+type NodeEntry struct {
+	Name     string
+	Rack     string
+	Role     string
+	Hostname string
+	Labels   map[string]string
+}
+
+// merge merges another entry for the same GUID into the entry. Non-empty fields and labels of the
+// other entry take precedence.
+func (e *NodeEntry) merge(o NodeEntry) {
+	for _, f := range []struct{ dst, src *string }{
+		{&e.Name, &o.Name}, {&e.Rack, &o.Rack}, {&e.Role, &o.Role}, {&e.Hostname, &o.Hostname},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+
+	if len(o.Labels) > 0 {
+		labels := make(map[string]string, len(e.Labels)+len(o.Labels))
+
+		for k, v := range e.Labels {
+			labels[k] = v
+		}
+
+		for k, v := range o.Labels {
+			labels[k] = v
+		}
+
+		e.Labels = labels
+	}
+}
+
+// nameRule names nodes whose original node description matches a regular expression. The name is
+// a template, which may refer to submatches as $1, ${name} etc. (see regexp.Regexp.Expand).
+type nameRule struct {
+	re   *regexp.Regexp
+	name string
+}
+
+// nodeNameData holds the entries and rules read from the sources of a node name map.
+type nodeNameData struct {
+	entries map[uint64]NodeEntry
+	rules   []nameRule
+}
+
+// merge merges the data of a later source, which takes precedence.
+func (d *nodeNameData) merge(o *nodeNameData) {
+	for guid, e := range o.entries {
+		merged := d.entries[guid]
+		merged.merge(e)
+		d.entries[guid] = merged
+	}
+
+	d.rules = append(slices.Clone(o.rules), d.rules...)
+}
 
 // The NodeNameMap type holds a mapping of a 64-bit GUID to an InfiniBand node name / description.
+//
+// The entries of the sources of the map are merged with the following precedence: for each GUID,
+// the non-empty fields of entries of later sources (and later files of a directory) take precedence
+// over those of earlier ones. Nodes without a named entry are named by the first rule whose regular
+// expression matches their original node description, trying the rules of later sources first.
+// Nodes which are neither have their node description returned unmodified.
+//
+// If a file or URL cannot be read or parsed on reload (e.g., while a file is being replaced), its
+// last successfully loaded entries are retained.
 type NodeNameMap struct {
-	filePath string
-	nodes    map[uint64]string
-	lock     sync.RWMutex
-	watcher  *fsnotify.Watcher
+	cfg     NodeNameMapConfig
+	urls    map[string]*urlSource
+	data    *nodeNameData
+	lock    sync.RWMutex
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	close   sync.Once
+
+	reloadMu sync.Mutex
+	files    map[string][]string      // files of each file or directory source, as last listed
+	loaded   map[string]*nodeNameData // last data successfully loaded from each file and URL
 }
 
-// NewNodeNameMap opens and parses the SM node name map, returning a NodeNameMap of GUIDs and their
-// node descriptions. The format of the node name map file is described in man page
-// ibnetdiscover(8).
-func NewNodeNameMap(filePath string) (*NodeNameMap, error) {
-	n := &NodeNameMap{filePath: filePath}
+// NewNodeNameMap opens and parses one or more SM node name map files, returning a NodeNameMap of
+// GUIDs and their node descriptions. It is equivalent to LoadNodeNameMap with the file paths as
+// sources.
+func NewNodeNameMap(filePaths ...string) (*NodeNameMap, error) {
+	return LoadNodeNameMap(NodeNameMapConfig{Sources: filePaths})
+}
+
+// LoadNodeNameMap loads a node name map from its sources. The format of ibnetdiscover node name
+// map files is described in man page ibnetdiscover(8).
+//
+// Files and directories are watched, and the map is reloaded whenever one of them changes, and
+// URLs are refetched periodically, until the map is closed. If a source cannot be read, the map is
+// returned along with the error, holding the entries of the other sources. On reload, the last
+// successfully loaded entries of sources which cannot be read are retained.
+func LoadNodeNameMap(cfg NodeNameMapConfig) (*NodeNameMap, error) {
+	if cfg.Refresh == 0 {
+		cfg.Refresh = DefaultNodeNameMapRefresh
+	}
+
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
 
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	// Watch events name files relative to the cleaned path of their directory.
+	cfg.Sources = slices.Clone(cfg.Sources)
+	for i, src := range cfg.Sources {
+		if !isURL(src) {
+			cfg.Sources[i] = filepath.Clean(src)
+		}
+	}
+
+	n := &NodeNameMap{
+		cfg:  cfg,
+		urls: make(map[string]*urlSource),
+		done: make(chan struct{}),
+	}
+
+	var (
+		errs  []error
+		paths []string
+	)
+
+	for _, src := range cfg.Sources {
+		if !isURL(src) {
+			paths = append(paths, src)
+			continue
+		}
+
+		u := &urlSource{url: src}
+		n.urls[src] = u
+
+		if _, err := u.fetch(context.Background(), cfg.HTTPClient); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Sources which could not be fetched have already been reported.
 	if err := n.reload(); err != nil {
-		return n, err
+		errs = append(errs, err)
 	}
 
-	if watcher, err := fsnotify.NewWatcher(); err == nil {
-		n.watcher = watcher
-		if err := n.watcher.Add(n.filePath); err != nil {
-			slog.Error("cannot add fsnotify watch for node name map", "err", err)
+	if len(n.urls) > 0 {
+		go n.refresh()
+	}
+
+	if len(paths) == 0 {
+		return n, errors.Join(errs...)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		cfg.Logger.Error("cannot create fsnotify watcher", "err", err)
+		return n, errors.Join(append(errs, err)...)
+	}
+
+	n.watcher = watcher
+
+	// Files are watched via their directory, since a file which is replaced (e.g., renamed over by
+	// an editor) would no longer be watched itself, and so that a file which does not exist yet is
+	// loaded once it is created. Directory sources are watched themselves.
+	for _, path := range paths {
+		for _, dir := range []string{filepath.Dir(path), path} {
+			if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+				continue
+			}
+
+			if err := n.watcher.Add(dir); err != nil {
+				cfg.Logger.Error("cannot add fsnotify watch for node name map", "path", dir, "err", err)
+			}
 		}
-	} else {
-		slog.Error("cannot create fsnotify watcher", "err", err)
-		return n, err
 	}
 
-	go func() {
-		for {
-			select {
-			case event := <-n.watcher.Events:
-				// Ignore chmod, everything else requires a reload
-				if event.Op^fsnotify.Chmod == 0 {
-					break
-				}
-
-				slog.Info("node name map watcher event", "event", event.Op)
-
-				if event.Op == fsnotify.Remove {
-					if err := n.watcher.Add(n.filePath); err != nil {
-						slog.Error("cannot re-add fsnotify watcher for node name map", "err", err)
-					}
-				} else {
-					if err := n.reload(); err != nil {
-						slog.Error("failed to reload node name map", "err", err)
-					} else {
-						slog.Info("node name map reloaded")
-					}
-				}
-
-			case err := <-n.watcher.Errors:
-				if err != nil {
-					slog.Error("error watching node name map", "err", err)
-				}
+	go n.watch()
+
+	return n, errors.Join(errs...)
+}
+
+// watch reloads the map upon changes of its files and directories, until the watcher is closed.
+func (n *NodeNameMap) watch() {
+	for {
+		select {
+		case event, ok := <-n.watcher.Events:
+			if !ok {
+				return
+			}
+
+			// Ignore chmod, and other files of the directories of file sources, everything else
+			// requires a reload
+			if event.Op^fsnotify.Chmod == 0 || !n.isSourceFile(event.Name) {
+				break
+			}
+
+			n.cfg.Logger.Info("node name map watcher event", "event", event.Op, "path", event.Name)
+
+			if err := n.reload(); err != nil {
+				n.cfg.Logger.Error("failed to reload node name map", "err", err)
+			} else {
+				n.cfg.Logger.Info("node name map reloaded")
+			}
+
+		case err, ok := <-n.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			if err != nil {
+				n.cfg.Logger.Error("error watching node name map", "err", err)
 			}
 		}
+	}
+}
+
+// isSourceFile returns whether a path is that of a file or directory source, or of a file of a
+// directory source.
+func (n *NodeNameMap) isSourceFile(path string) bool {
+	for _, src := range n.cfg.Sources {
+		if path == src || (filepath.Dir(path) == src && !ignoredFile(filepath.Base(path))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ignoredFile returns whether a file of a directory source is ignored, i.e., a hidden file (such as
+// the temporary files of FabricMon's writers) or an editor backup.
+func ignoredFile(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~")
+}
+
+// refresh periodically refetches the URLs of the map, and reloads it if any of them changed,
+// until the map is closed.
+func (n *NodeNameMap) refresh() {
+	ticker := time.NewTicker(n.cfg.Refresh)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-n.done
+		cancel()
 	}()
 
-	return n, nil
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+
+		changed := false
+
+		for _, u := range n.urls {
+			c, err := u.fetch(ctx, n.cfg.HTTPClient)
+			if err != nil {
+				n.cfg.Logger.Error("cannot refresh node name map", "err", err)
+			}
+
+			changed = changed || c
+		}
+
+		if !changed {
+			continue
+		}
+
+		if err := n.reload(); err != nil {
+			n.cfg.Logger.Error("failed to reload node name map", "err", err)
+		} else {
+			n.cfg.Logger.Info("node name map reloaded")
+		}
+	}
+}
+
+// Close stops watching and refetching the sources of the map. The map remains usable, but is no
+// longer reloaded.
+func (n *NodeNameMap) Close() error {
+	if n == nil {
+		return nil
+	}
+
+	var err error
+
+	n.close.Do(func() {
+		close(n.done)
+
+		if n.watcher != nil {
+			err = n.watcher.Close()
+		}
+	})
+
+	return err
+}
+
+// Sources returns the sources of the map.
+func (n *NodeNameMap) Sources() []string {
+	if n == nil {
+		return nil
+	}
+
+	return n.cfg.Sources
+}
+
+// Lookup returns the entry of the specified GUID, if any. Note that nodes named by rules have no
+// entry.
+func (n *NodeNameMap) Lookup(guid uint64) (NodeEntry, bool) {
+	if n == nil {
+		return NodeEntry{}, false
+	}
+
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	e, ok := n.data.entries[guid]
+
+	return e, ok
 }
 
 // RemapNodeName attempts to map the specified GUID to a node description from the NodeNameMap. If
-// the GUID is not found in the map, the supplied node description is simply returned unmodified.
+// the GUID is not found in the map, and no rule matches, the supplied node description is simply
+// returned unmodified.
 func (n *NodeNameMap) RemapNodeName(guid uint64, nodeDesc string) string {
+	if n == nil {
+		return nodeDesc
+	}
+
 	n.lock.RLock()
 	defer n.lock.RUnlock()
 
-	if mapDesc, ok := n.nodes[guid]; ok {
-		return mapDesc
+	return n.remap(guid, nodeDesc)
+}
+
+// RemapFabric remaps the node descriptions of the nodes of a fabric, and those of the remote nodes
+// of their ports, by RemapNodeName.
+func (n *NodeNameMap) RemapFabric(f *Fabric) {
+	if n == nil {
+		return
+	}
+
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	for i := range f.Nodes {
+		node := &f.Nodes[i]
+		node.NodeDesc = n.remap(node.GUID, node.NodeDesc)
+
+		for j := range node.Ports {
+			if p := &node.Ports[j]; p.RemoteGUID != 0 {
+				p.RemoteNodeDesc = n.remap(p.RemoteGUID, p.RemoteNodeDesc)
+			}
+		}
 	}
-	return nodeDesc
 }
 
-func (n *NodeNameMap) reload() error {
-	nodes := make(map[uint64]string)
+// remap remaps a node description. The caller must hold the lock.
+func (n *NodeNameMap) remap(guid uint64, nodeDesc string) string {
+	if e, ok := n.data.entries[guid]; ok && e.Name != "" {
+		return e.Name
+	}
 
-	file, err := os.Open(n.filePath)
-	if err != nil {
-		return err
+	for _, r := range n.data.rules {
+		if m := r.re.FindStringSubmatchIndex(nodeDesc); m != nil {
+			return string(r.re.ExpandString(nil, r.name, nodeDesc, m))
+		}
 	}
 
-	defer file.Close()
+	return nodeDesc
+}
 
-	scanner := bufio.NewScanner(file)
+// reload reloads the map from its sources, using the last fetched content of URLs. If a file or URL
+// cannot be read or parsed, its last successfully loaded data is retained, and the error returned.
+func (n *NodeNameMap) reload() error {
+	n.reloadMu.Lock()
+	defer n.reloadMu.Unlock()
 
-	// Tokenize line, honouring quoted strings
-	lastQuote := rune(0)
-	f := func(c rune) bool {
-		switch {
-		case c == lastQuote:
-			lastQuote = rune(0)
-			return false
-		case lastQuote != rune(0):
-			return false
-		case unicode.In(c, unicode.Quotation_Mark):
-			lastQuote = c
-			return false
-		default:
-			return unicode.IsSpace(c)
+	var errs []error
+
+	data := &nodeNameData{entries: make(map[uint64]NodeEntry)}
+	files := make(map[string][]string)
+	loaded := make(map[string]*nodeNameData)
+
+	// load merges the data loaded from a file or URL, or else its last loaded data.
+	load := func(key string, d *nodeNameData, err error) {
+		if err != nil {
+			errs = append(errs, err)
+			d = n.loaded[key]
 		}
-	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "#") {
-			continue
+		if d != nil {
+			loaded[key] = d
+			data.merge(d)
 		}
+	}
 
-		fields := strings.FieldsFunc(line, f)
-		if len(fields) < 2 || strings.HasPrefix(fields[1], "#") {
+	for _, src := range n.cfg.Sources {
+		if u := n.urls[src]; u != nil {
+			d, err := u.parse()
+			load(src, d, err)
 			continue
 		}
 
-		guid, err := strconv.ParseUint(fields[0], 0, 64)
+		paths, err := listFiles(src)
 		if err != nil {
-			continue
+			// E.g., a file which is briefly missing while it is being replaced.
+			errs = append(errs, err)
+			paths = n.files[src]
+
+			for _, path := range paths {
+				load(path, n.loaded[path], nil)
+			}
+		} else {
+			for _, path := range paths {
+				d, err := readFile(path)
+				load(path, d, err)
+			}
 		}
 
-		nodes[guid] = fields[1]
+		files[src] = paths
 	}
 
+	n.files, n.loaded = files, loaded
+
 	n.lock.Lock()
-	n.nodes = nodes
+	n.data = data
 	n.lock.Unlock()
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func init() {
-	var err error
+// listFiles returns the node name map files of a source, i.e., the source itself if it is a file,
+// or else the files of the directory in lexical order, except for ignored files.
+func listFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
 
-	if nnMap, err = NewNodeNameMap(DEFAULT_NODE_NAME_MAP); err != nil {
-		// FIXME: since init() functions are called before main(), this can result in
-		// inconsistent log formatting, as the default logger is not yet initialised.
-		slog.Error("cannot load node name map", "err", err)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+
+	for _, e := range entries {
+		if !e.IsDir() && !ignoredFile(e.Name()) {
+			files = append(files, filepath.Join(path, e.Name()))
+		}
 	}
+
+	return files, nil
+}
+
+// readFile reads a node name map file.
+func readFile(path string) (*nodeNameData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	d, err := parseNodeNameMap(f, formatOf(path))
+	if err != nil {
+		return nil, &fs.PathError{Op: "parse", Path: path, Err: err}
+	}
+
+	return d, nil
 }
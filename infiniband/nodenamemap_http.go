@@ -0,0 +1,135 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Node name maps fetched via HTTP.
+
+package infiniband
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Maximum size of a node name map fetched via HTTP.
+const maxNodeNameMapSize = 64 << 20
+
+// isURL returns whether a node name map source is an http(s) URL.
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// urlSource is a node name map fetched from a URL. Its content is cached, and refetched with a
+// conditional GET, so that an unchanged map is neither transferred nor reparsed.
+type urlSource struct {
+	url string
+
+	mu           sync.Mutex
+	body         []byte
+	format       string
+	etag         string
+	lastModified string
+}
+
+// fetch fetches the map, unless it has not changed since the last fetch, and returns whether it
+// has changed.
+func (u *urlSource) fetch(ctx context.Context, client *http.Client) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	u.mu.Lock()
+	if u.etag != "" {
+		req.Header.Set("If-None-Match", u.etag)
+	}
+
+	if u.lastModified != "" {
+		req.Header.Set("If-Modified-Since", u.lastModified)
+	}
+	u.mu.Unlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s: %s", u.url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxNodeNameMapSize+1))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", u.url, err)
+	}
+
+	if len(body) > maxNodeNameMapSize {
+		return false, fmt.Errorf("%s: node name map exceeds %d bytes", u.url, maxNodeNameMapSize)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	changed := !bytes.Equal(body, u.body)
+
+	u.body = body
+	u.format = urlFormat(u.url, resp.Header.Get("Content-Type"))
+	u.etag = resp.Header.Get("ETag")
+	u.lastModified = resp.Header.Get("Last-Modified")
+
+	return changed, nil
+}
+
+// parse parses the last fetched content of the map.
+func (u *urlSource) parse() (*nodeNameData, error) {
+	u.mu.Lock()
+	body, format := u.body, u.format
+	u.mu.Unlock()
+
+	if body == nil {
+		return nil, fmt.Errorf("%s: not fetched", u.url)
+	}
+
+	d, err := parseNodeNameMap(bytes.NewReader(body), format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.url, err)
+	}
+
+	return d, nil
+}
+
+// urlFormat returns the node name map format of a URL, by the extension of its path, or else by
+// the content type of the response.
+func urlFormat(rawURL, contentType string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		if format := formatOf(u.Path); format != formatIbnetdiscover {
+			return format
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return formatIbnetdiscover
+	}
+
+	switch {
+	case mediaType == "text/csv":
+		return formatCSV
+	case strings.HasSuffix(mediaType, "yaml"):
+		return formatYAML
+	default:
+		return formatIbnetdiscover
+	}
+}
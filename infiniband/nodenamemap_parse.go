@@ -0,0 +1,244 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Parsers of the node name map formats.
+
+package infiniband
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Node name map formats.
+const (
+	formatIbnetdiscover = ""
+	formatCSV           = "csv"
+	formatYAML          = "yaml"
+)
+
+// formatOf returns the node name map format of a file, by its extension.
+func formatOf(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".csv":
+		return formatCSV
+	case ".yaml", ".yml":
+		return formatYAML
+	default:
+		return formatIbnetdiscover
+	}
+}
+
+// parseNodeNameMap parses a node name map of the specified format.
+func parseNodeNameMap(r io.Reader, format string) (*nodeNameData, error) {
+	data := &nodeNameData{entries: make(map[uint64]NodeEntry)}
+
+	var err error
+
+	switch format {
+	case formatCSV:
+		err = parseCSVMap(r, data)
+	case formatYAML:
+		err = parseYAMLMap(r, data)
+	default:
+		err = parseIbnetdiscoverMap(r, data)
+	}
+
+	return data, err
+}
+
+// parseIbnetdiscoverMap parses a node name map in the format of ibnetdiscover(8), i.e., lines of a
+// GUID and a (possibly quoted) name. Invalid lines are ignored, as by ibnetdiscover.
+func parseIbnetdiscoverMap(r io.Reader, data *nodeNameData) error {
+	scanner := bufio.NewScanner(r)
+
+	// Tokenize line, honouring quoted strings
+	lastQuote := rune(0)
+	f := func(c rune) bool {
+		switch {
+		case c == lastQuote:
+			lastQuote = rune(0)
+			return false
+		case lastQuote != rune(0):
+			return false
+		case unicode.In(c, unicode.Quotation_Mark):
+			lastQuote = c
+			return false
+		default:
+			return unicode.IsSpace(c)
+		}
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, f)
+		if len(fields) < 2 || strings.HasPrefix(fields[1], "#") {
+			continue
+		}
+
+		guid, err := strconv.ParseUint(fields[0], 0, 64)
+		if err != nil {
+			continue
+		}
+
+		data.entries[guid] = NodeEntry{Name: fields[1]}
+	}
+
+	return scanner.Err()
+}
+
+// parseCSVMap parses a node name map in CSV format, whose header names the columns. The guid
+// column is required. The name, rack, role and hostname columns set the respective fields of the
+// entries, and any other columns set labels. Lines starting with # are ignored.
+func parseCSVMap(r io.Reader, data *nodeNameData) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		return err
+	}
+
+	guidCol := -1
+
+	for i, col := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(col))
+		if header[i] == "guid" {
+			guidCol = i
+		}
+	}
+
+	if guidCol < 0 {
+		return errors.New("no guid column")
+	}
+
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		line, _ := cr.FieldPos(guidCol)
+
+		guid, err := strconv.ParseUint(strings.TrimSpace(record[guidCol]), 0, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid GUID %q", line, record[guidCol])
+		}
+
+		var e NodeEntry
+
+		for i, v := range record {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+
+			switch header[i] {
+			case "guid":
+			case "name":
+				e.Name = v
+			case "rack":
+				e.Rack = v
+			case "role":
+				e.Role = v
+			case "hostname":
+				e.Hostname = v
+			default:
+				if e.Labels == nil {
+					e.Labels = make(map[string]string)
+				}
+
+				e.Labels[header[i]] = v
+			}
+		}
+
+		merged := data.entries[guid]
+		merged.merge(e)
+		data.entries[guid] = merged
+	}
+}
+
+// yamlNodeNameMap is the YAML format of a node name map, e.g.:
+//
+//	nodes:
+//	  - guid: 0x7cfe900300a1b2c3
+//	    name: leaf01
+//	    rack: A01
+//	    role: leaf
+//	    labels: {row: "3"}
+//	rules:
+//	  - match: '^MF0;switch-([0-9a-f]+):'
+//	    name: unnamed-switch-$1
+type yamlNodeNameMap struct {
+	Nodes []struct {
+		GUID     string            `yaml:"guid"`
+		Name     string            `yaml:"name"`
+		Rack     string            `yaml:"rack"`
+		Role     string            `yaml:"role"`
+		Hostname string            `yaml:"hostname"`
+		Labels   map[string]string `yaml:"labels"`
+	} `yaml:"nodes"`
+	Rules []struct {
+		Match string `yaml:"match"`
+		Name  string `yaml:"name"`
+	} `yaml:"rules"`
+}
+
+// parseYAMLMap parses a node name map in YAML format (see yamlNodeNameMap). Rules are tried in
+// order.
+func parseYAMLMap(r io.Reader, data *nodeNameData) error {
+	var m yamlNodeNameMap
+
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	for _, n := range m.Nodes {
+		guid, err := strconv.ParseUint(n.GUID, 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid GUID %q", n.GUID)
+		}
+
+		merged := data.entries[guid]
+		merged.merge(NodeEntry{Name: n.Name, Rack: n.Rack, Role: n.Role, Hostname: n.Hostname, Labels: n.Labels})
+		data.entries[guid] = merged
+	}
+
+	for _, rule := range m.Rules {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Match, err)
+		}
+
+		if rule.Name == "" {
+			return fmt.Errorf("rule %q: no name", rule.Match)
+		}
+
+		data.rules = append(data.rules, nameRule{re: re, name: rule.Name})
+	}
+
+	return nil
+}
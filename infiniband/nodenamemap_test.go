@@ -4,8 +4,15 @@
 package infiniband
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var (
@@ -24,7 +31,14 @@ func TestRemapNodeName(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !reflect.DeepEqual(nnMap.nodes, nodes) {
+	defer nnMap.Close()
+
+	names := make(map[uint64]string)
+	for guid, e := range nnMap.data.entries {
+		names[guid] = e.Name
+	}
+
+	if !reflect.DeepEqual(names, nodes) {
 		t.Fatal("Parsed map does not match expected")
 	}
 
@@ -40,3 +54,193 @@ func TestRemapNodeName(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestNodeNameMapPrecedence(t *testing.T) {
+	nnMap, err := NewNodeNameMap("testdata/ib-node-name-map", "testdata/non-existent", "testdata/ib-node-name-map.local")
+	if err == nil {
+		t.Error("expected error for missing file")
+	}
+
+	defer nnMap.Close()
+
+	if got := nnMap.RemapNodeName(0xa31de6b2f83b0a91, ""); got != "ibsw2-spare" {
+		t.Errorf("got %q, want entry of later file", got)
+	}
+
+	if got := nnMap.RemapNodeName(0xb7c31c3b29d0c791, ""); got != "ibsw1(root-sw)" {
+		t.Errorf("got %q, want entry of earlier file", got)
+	}
+
+	fabric := Fabric{
+		Nodes: []Node{
+			{GUID: 0xb7c31c3b29d0c791, NodeDesc: "MF0;switch-1", Ports: []Port{{}, {RemoteGUID: 0x7cfe900300a1b2c3, RemoteNodeDesc: "mlx5_0"}}},
+			{GUID: 0x123, NodeDesc: "non-existent"},
+		},
+	}
+
+	nnMap.RemapFabric(&fabric)
+
+	if fabric.Nodes[0].NodeDesc != "ibsw1(root-sw)" || fabric.Nodes[0].Ports[1].RemoteNodeDesc != "n001" ||
+		fabric.Nodes[1].NodeDesc != "non-existent" {
+		t.Errorf("unexpected fabric: %+v", fabric.Nodes)
+	}
+
+	// A nil map remaps nothing.
+	var none *NodeNameMap
+
+	if none.RemapNodeName(0xb7c31c3b29d0c791, "foo") != "foo" {
+		t.Error("nil map remapped node name")
+	}
+}
+
+func TestNodeNameMapFormats(t *testing.T) {
+	nnMap, err := NewNodeNameMap("testdata/ib-node-name-map", "testdata/nodenamemap.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nnMap.Close()
+
+	e, _ := nnMap.Lookup(0xb7c31c3b29d0c791)
+	if want := (NodeEntry{Name: "core01", Rack: "A01", Role: "spine", Labels: map[string]string{"row": "3"}}); !reflect.DeepEqual(e, want) {
+		t.Errorf("got %+v, want %+v", e, want)
+	}
+
+	e, _ = nnMap.Lookup(0x7cfe900300a1b2c3)
+	if want := (NodeEntry{Name: "leaf01", Rack: "A02", Role: "leaf", Labels: map[string]string{"row": "4", "pod": "p1"}}); !reflect.DeepEqual(e, want) {
+		t.Errorf("got %+v, want %+v", e, want)
+	}
+
+	for _, tc := range []struct {
+		guid uint64
+		desc string
+		want string
+	}{
+		{0xa31de6b2f83b0a91, "", "ibsw2"},
+		{0x123, "MF0;switch-3b1c:SX6036/U1", "new-switch-3b1c"},
+		{0x123, "n002 HCA-1", "n002-hca1"},
+		{0xf452140300d4e5f6, "n001 HCA-1", "n001-hca1"}, // entry without name
+		{0x123, "non-existent", "non-existent"},
+	} {
+		if got := nnMap.RemapNodeName(tc.guid, tc.desc); got != tc.want {
+			t.Errorf("%#x %q: got %q, want %q", tc.guid, tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestNodeNameMapURL(t *testing.T) {
+	var requests, notModified int
+
+	body := "guid,name\n0x7cfe900300a1b2c3,leaf01\n"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		etag := fmt.Sprintf("%q", fmt.Sprint(len(body)))
+
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+
+	defer srv.Close()
+
+	nnMap, err := LoadNodeNameMap(NodeNameMapConfig{Sources: []string{srv.URL + "/map"}, Refresh: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nnMap.Close()
+
+	if got := nnMap.RemapNodeName(0x7cfe900300a1b2c3, ""); got != "leaf01" {
+		t.Errorf("got %q", got)
+	}
+
+	u := nnMap.urls[srv.URL+"/map"]
+
+	if changed, err := u.fetch(context.Background(), http.DefaultClient); changed || err != nil || notModified != 1 {
+		t.Errorf("unexpected refetch: %v, %v, %d", changed, err, notModified)
+	}
+
+	body = "guid,name\n0x7cfe900300a1b2c3,leaf01-spare\n"
+
+	if changed, err := u.fetch(context.Background(), http.DefaultClient); !changed || err != nil {
+		t.Fatalf("unexpected refetch: %v, %v", changed, err)
+	}
+
+	nnMap.reload()
+
+	if got := nnMap.RemapNodeName(0x7cfe900300a1b2c3, ""); got != "leaf01-spare" || requests != 3 {
+		t.Errorf("got %q after %d requests", got, requests)
+	}
+}
+
+func TestNodeNameMapReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "map.csv")
+
+	write := func(content string) {
+		// Replace the file by renaming over it, as editors do.
+		tmp := filepath.Join(dir, ".map.csv.tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("guid,name\n0x7cfe900300a1b2c3,leaf01\n")
+
+	nnMap, err := NewNodeNameMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer nnMap.Close()
+
+	// The last good data is retained while the file is invalid or missing.
+	write("guid,name\nbogus,leaf02\n")
+
+	if err := nnMap.reload(); err == nil {
+		t.Error("invalid map reloaded without error")
+	}
+
+	if got := nnMap.RemapNodeName(0x7cfe900300a1b2c3, ""); got != "leaf01" {
+		t.Errorf("got %q after invalid map", got)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nnMap.reload(); err == nil {
+		t.Error("missing map reloaded without error")
+	}
+
+	if got := nnMap.RemapNodeName(0x7cfe900300a1b2c3, ""); got != "leaf01" {
+		t.Errorf("got %q after missing map", got)
+	}
+
+	// The file remains watched after it has been replaced.
+	write("guid,name\n0x7cfe900300a1b2c3,leaf03\n")
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		got := nnMap.RemapNodeName(0x7cfe900300a1b2c3, "")
+		if got == "leaf03" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, replaced map not reloaded", got)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Generation of node name map entries for discovered nodes, named by templates according to their
+// position in the topology.
+
+package infiniband
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Topology roles of nodes, by which naming templates are selected.
+const (
+	RoleLeaf   = "leaf"   // switch attached to CAs
+	RoleSpine  = "spine"  // switch attached only to other switches
+	RoleSwitch = "switch" // switch from which no CA is reachable
+	RoleCA     = "ca"
+	RoleRouter = "router"
+)
+
+// DefaultNameTemplates are the naming templates used if none are configured. Nodes of other roles
+// (i.e., CAs and routers) are not named by default, since their node descriptions are typically
+// set by their hosts.
+var DefaultNameTemplates = map[string]string{
+	RoleLeaf:   `leaf{{printf "%02d" .Index}}`,
+	RoleSpine:  `spine{{printf "%02d" .Index}}`,
+	RoleSwitch: `switch{{printf "%02d" .Index}}`,
+}
+
+// NodePosition describes the position of a node in the topology, as passed to naming templates.
+type NodePosition struct {
+	GUID     string   // e.g., 0x7cfe900300a1b2c3
+	NodeDesc string   // node description, as discovered
+	Role     string   // topology role, e.g. RoleLeaf
+	Level    int      // hops from the nearest CA, or -1 if no CA is reachable
+	Index    int      // 1-based index among the nodes of the same role
+	Hosts    []string // hostnames of the attached CAs (i.e., the first word of their node descriptions)
+}
+
+// FirstHost returns the first hostname of the attached CAs, or an empty string if there are none.
+func (p NodePosition) FirstHost() string {
+	if len(p.Hosts) == 0 {
+		return ""
+	}
+
+	return p.Hosts[0]
+}
+
+// LastHost returns the last hostname of the attached CAs, or an empty string if there are none.
+func (p NodePosition) LastHost() string {
+	if len(p.Hosts) == 0 {
+		return ""
+	}
+
+	return p.Hosts[len(p.Hosts)-1]
+}
+
+// NodePositions returns the position of each node of the fabrics, by GUID. The nodes of each role
+// are indexed in order of the hostnames of their attached CAs (so that e.g. the leaf switch of the
+// first hosts is the first leaf), and then by GUID.
+func NodePositions(fabrics ...Fabric) map[uint64]NodePosition {
+	nodes := make(map[uint64]Node)
+	neighbours := make(map[uint64][]uint64)
+
+	for _, f := range fabrics {
+		for _, node := range f.Nodes {
+			nodes[node.GUID] = node
+		}
+
+		for _, link := range f.Links() {
+			neighbours[link.LocalGUID] = append(neighbours[link.LocalGUID], link.RemoteGUID)
+			neighbours[link.RemoteGUID] = append(neighbours[link.RemoteGUID], link.LocalGUID)
+		}
+	}
+
+	// Breadth-first search from all CAs.
+	levels := make(map[uint64]int)
+
+	var queue []uint64
+
+	for guid, node := range nodes {
+		if node.NodeType == IB_NODE_CA {
+			levels[guid] = 0
+			queue = append(queue, guid)
+		}
+	}
+
+	for len(queue) > 0 {
+		guid := queue[0]
+		queue = queue[1:]
+
+		for _, n := range neighbours[guid] {
+			if _, ok := levels[n]; !ok {
+				levels[n] = levels[guid] + 1
+				queue = append(queue, n)
+			}
+		}
+	}
+
+	positions := make(map[uint64]NodePosition, len(nodes))
+	byRole := make(map[string][]uint64)
+
+	for guid, node := range nodes {
+		pos := NodePosition{GUID: fmt.Sprintf("%#016x", guid), NodeDesc: node.NodeDesc, Level: -1}
+
+		if level, ok := levels[guid]; ok {
+			pos.Level = level
+		}
+
+		for _, n := range neighbours[guid] {
+			if remote, ok := nodes[n]; ok && remote.NodeType == IB_NODE_CA {
+				if host, _, _ := strings.Cut(remote.NodeDesc, " "); host != "" {
+					pos.Hosts = append(pos.Hosts, host)
+				}
+			}
+		}
+
+		sort.Strings(pos.Hosts)
+		pos.Hosts = compactStrings(pos.Hosts)
+
+		switch {
+		case node.NodeType == IB_NODE_CA:
+			pos.Role = RoleCA
+		case node.NodeType == IB_NODE_ROUTER:
+			pos.Role = RoleRouter
+		case pos.Level == 1:
+			pos.Role = RoleLeaf
+		case pos.Level > 1:
+			pos.Role = RoleSpine
+		default:
+			pos.Role = RoleSwitch
+		}
+
+		positions[guid] = pos
+		byRole[pos.Role] = append(byRole[pos.Role], guid)
+	}
+
+	for _, guids := range byRole {
+		sort.Slice(guids, func(i, j int) bool {
+			a, b := positions[guids[i]].FirstHost(), positions[guids[j]].FirstHost()
+			if a != b {
+				// Nodes without hosts come last.
+				return b == "" || (a != "" && a < b)
+			}
+
+			return guids[i] < guids[j]
+		})
+
+		for i, guid := range guids {
+			pos := positions[guid]
+			pos.Index = i + 1
+			positions[guid] = pos
+		}
+	}
+
+	return positions
+}
+
+// compactStrings removes consecutive duplicates from a sorted slice.
+func compactStrings(s []string) []string {
+	var out []string
+
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+// NameTemplates holds the naming templates of nodes, by topology role. Templates are executed with
+// the NodePosition of a node.
+type NameTemplates map[string]*template.Template
+
+// ParseNameTemplates parses naming templates (see text/template), by topology role.
+func ParseNameTemplates(templates map[string]string) (NameTemplates, error) {
+	t := make(NameTemplates, len(templates))
+
+	for role, text := range templates {
+		switch role {
+		case RoleLeaf, RoleSpine, RoleSwitch, RoleCA, RoleRouter:
+		default:
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+
+		tmpl, err := template.New(role).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+
+		t[role] = tmpl
+	}
+
+	return t, nil
+}
+
+// ProposedName is a node name map entry proposed for a discovered node.
+type ProposedName struct {
+	GUID     uint64
+	Name     string
+	NodeDesc string // node description, as discovered
+	Role     string
+}
+
+// NodeNameMapUpdate is the result of updating a node name map from discovered fabrics.
+type NodeNameMapUpdate struct {
+	// Entries added for nodes which the map lacked, in order of GUID.
+	Added []ProposedName
+
+	// GUIDs of entries of the map whose nodes are in none of the fabrics, in order of their
+	// entries. If there are no fabrics, or any of them is incomplete, nodes cannot be known to be
+	// missing, and Missing is nil.
+	Missing []uint64
+}
+
+// UpdateNodeNameMap reads a node name map in the format of ibnetdiscover(8) from r, and writes it
+// to w, with an entry appended for each node of the fabrics which it lacks, and whose role has a
+// naming template. The existing content, including comments, is preserved verbatim. Proposed names
+// which would duplicate a name of the map are suffixed with -2, -3 etc. Each added entry is
+// commented with the discovered node description, and the block of added entries with the time of
+// the update.
+func UpdateNodeNameMap(r io.Reader, w io.Writer, fabrics []Fabric, tmpl NameTemplates, now time.Time) (*NodeNameMapUpdate, error) {
+	existing, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &nodeNameData{entries: make(map[uint64]NodeEntry)}
+	if err := parseIbnetdiscoverMap(bytes.NewReader(existing), data); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(data.entries))
+	for _, e := range data.entries {
+		names[unquote(e.Name)] = true
+	}
+
+	positions := NodePositions(fabrics...)
+
+	guids := make([]uint64, 0, len(positions))
+	for guid := range positions {
+		guids = append(guids, guid)
+	}
+
+	sort.Slice(guids, func(i, j int) bool { return guids[i] < guids[j] })
+
+	update := &NodeNameMapUpdate{}
+
+	for _, guid := range guids {
+		pos := positions[guid]
+
+		t := tmpl[pos.Role]
+		if _, ok := data.entries[guid]; ok || t == nil {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, pos); err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSpace(buf.String())
+		if name == "" {
+			continue
+		}
+
+		unique := name
+		for i := 2; names[unique]; i++ {
+			unique = name + "-" + strconv.Itoa(i)
+		}
+
+		names[unique] = true
+		update.Added = append(update.Added, ProposedName{GUID: guid, Name: unique, NodeDesc: pos.NodeDesc, Role: pos.Role})
+	}
+
+	if complete(fabrics) {
+		update.Missing = missingGUIDs(existing, positions)
+	}
+
+	if _, err := w.Write(existing); err != nil {
+		return nil, err
+	}
+
+	if len(update.Added) == 0 {
+		return update, nil
+	}
+
+	var buf bytes.Buffer
+
+	if len(existing) > 0 {
+		if !bytes.HasSuffix(existing, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+
+		buf.WriteByte('\n')
+	}
+
+	fmt.Fprintf(&buf, "# Added by FabricMon on %s\n", now.UTC().Format(time.RFC3339))
+
+	for _, p := range update.Added {
+		fmt.Fprintf(&buf, "%#016x\t%s\t# %s\n", p.GUID, quoteName(p.Name), p.NodeDesc)
+	}
+
+	_, err = w.Write(buf.Bytes())
+
+	return update, err
+}
+
+// complete returns whether all of the fabrics are complete. No fabrics (e.g., of a failed sweep)
+// are not complete.
+func complete(fabrics []Fabric) bool {
+	if len(fabrics) == 0 {
+		return false
+	}
+
+	for _, f := range fabrics {
+		if f.Incomplete {
+			return false
+		}
+	}
+
+	return true
+}
+
+// missingGUIDs returns the GUIDs of the entries of a node name map which have no position, in
+// order of their entries.
+func missingGUIDs(nodeNameMap []byte, positions map[uint64]NodePosition) []uint64 {
+	missing := []uint64{}
+	seen := make(map[uint64]bool)
+
+	for _, line := range strings.Split(string(nodeNameMap), "\n") {
+		data := &nodeNameData{entries: make(map[uint64]NodeEntry)}
+		parseIbnetdiscoverMap(strings.NewReader(line), data)
+
+		for guid := range data.entries {
+			if _, ok := positions[guid]; !ok && !seen[guid] {
+				seen[guid] = true
+				missing = append(missing, guid)
+			}
+		}
+	}
+
+	return missing
+}
+
+// quoteName quotes a name which would otherwise not be read as a single field.
+func quoteName(name string) string {
+	if strings.ContainsAny(name, " \t#") {
+		return `"` + name + `"`
+	}
+
+	return name
+}
+
+// unquote removes the quotes of a quoted name.
+func unquote(name string) string {
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		return name[1 : len(name)-1]
+	}
+
+	return name
+}
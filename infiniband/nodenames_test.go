@@ -0,0 +1,128 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package infiniband
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// namingFabric returns a fabric of a spine switch, two leaf switches with two hosts each, and an
+// unconnected switch.
+func namingFabric() Fabric {
+	sw := func(guid uint64, desc string, remotes ...uint64) Node {
+		n := Node{GUID: guid, NodeType: IB_NODE_SWITCH, NodeDesc: desc, Ports: make([]Port, len(remotes)+1)}
+		for i, r := range remotes {
+			n.Ports[i+1] = Port{RemoteGUID: r, RemotePort: 1}
+		}
+		return n
+	}
+
+	ca := func(guid uint64, desc string) Node {
+		return Node{GUID: guid, NodeType: IB_NODE_CA, NodeDesc: desc}
+	}
+
+	return Fabric{
+		Nodes: []Node{
+			sw(0x30, "MF0;switch-0030:SX6036/U1", 0x10, 0x20),
+			sw(0x10, "MF0;switch-0010:SX6036/U1", 0x30, 0x101, 0x102),
+			sw(0x20, "MF0;switch-0020:SX6036/U1", 0x30, 0x201, 0x202),
+			sw(0x40, "MF0;switch-0040:SX6036/U1"),
+			ca(0x101, "n003 HCA-1"),
+			ca(0x102, "n004 HCA-1"),
+			ca(0x201, "n001 HCA-1"),
+			ca(0x202, "n002 HCA-1"),
+		},
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	pos := NodePositions(namingFabric())
+
+	// The leaf of the first hosts is the first leaf, regardless of its GUID.
+	if p := pos[0x20]; p.Role != RoleLeaf || p.Level != 1 || p.Index != 1 || !reflect.DeepEqual(p.Hosts, []string{"n001", "n002"}) {
+		t.Errorf("unexpected position: %+v", p)
+	}
+
+	if p := pos[0x10]; p.Role != RoleLeaf || p.Index != 2 || p.FirstHost() != "n003" || p.LastHost() != "n004" {
+		t.Errorf("unexpected position: %+v", p)
+	}
+
+	if p := pos[0x30]; p.Role != RoleSpine || p.Level != 2 || p.Index != 1 {
+		t.Errorf("unexpected position: %+v", p)
+	}
+
+	if p := pos[0x40]; p.Role != RoleSwitch || p.Level != -1 {
+		t.Errorf("unexpected position: %+v", p)
+	}
+
+	if p := pos[0x201]; p.Role != RoleCA || p.Level != 0 {
+		t.Errorf("unexpected position: %+v", p)
+	}
+}
+
+func TestUpdateNodeNameMap(t *testing.T) {
+	tmpl, err := ParseNameTemplates(map[string]string{
+		RoleLeaf:  `leaf-{{.FirstHost}}-{{.LastHost}}`,
+		RoleSpine: `spine{{printf "%02d" .Index}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing := "# Site map\n0x10\tleaf-old # keep me\n0x99\t\"gone switch\"\n0x777\tspine01"
+
+	var buf bytes.Buffer
+
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	update, err := UpdateNodeNameMap(strings.NewReader(existing), &buf, []Fabric{namingFabric()}, tmpl, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := existing + "\n\n# Added by FabricMon on 2020-03-01T12:00:00Z\n" +
+		"0x0000000000000020\tleaf-n001-n002\t# MF0;switch-0020:SX6036/U1\n" +
+		"0x0000000000000030\tspine01-2\t# MF0;switch-0030:SX6036/U1\n"
+
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	if !reflect.DeepEqual(update.Missing, []uint64{0x99, 0x777}) {
+		t.Errorf("unexpected missing nodes: %#x", update.Missing)
+	}
+
+	// The updated map is unchanged by another update.
+	var again bytes.Buffer
+
+	update, err = UpdateNodeNameMap(bytes.NewReader(buf.Bytes()), &again, []Fabric{namingFabric()}, tmpl, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(update.Added) != 0 || again.String() != buf.String() {
+		t.Errorf("unexpected update: %+v", update.Added)
+	}
+
+	// Nodes cannot be known to be missing from an incomplete fabric.
+	f := namingFabric()
+	f.Incomplete = true
+
+	if update, _ = UpdateNodeNameMap(strings.NewReader(existing), &again, []Fabric{f}, tmpl, now); update.Missing != nil {
+		t.Errorf("unexpected missing nodes: %#x", update.Missing)
+	}
+
+	// Nor from a failed sweep.
+	if update, _ = UpdateNodeNameMap(strings.NewReader(existing), &again, nil, tmpl, now); update.Missing != nil {
+		t.Errorf("unexpected missing nodes: %#x", update.Missing)
+	}
+
+	if _, err := ParseNameTemplates(map[string]string{"core": "x"}); err == nil {
+		t.Error("expected error for unknown role")
+	}
+}
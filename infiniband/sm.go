@@ -5,16 +5,7 @@
 
 package infiniband
 
-// #cgo CFLAGS: -I/usr/include/infiniband
-// #cgo LDFLAGS: -libmad -libumad
-// #include <mad.h>
-// #include <umad.h>
-import "C"
-
-import (
-	"log/slog"
-	"unsafe"
-)
+import "fmt"
 
 const (
 	SMINFO_NOTACT uint8 = iota
@@ -30,52 +21,20 @@ var smStateMap = [...]string{
 	"SMINFO_MASTER",
 }
 
-// smInfo is a proof of concept function to get the SM info for a CA & port.
-func smInfo(caName string, portNum int) {
-	var (
-		sminfo [1024]C.uint8_t
-		guid   uint64
-		act    uint16
-	)
-
-	mgmt_classes := [3]C.int{C.IB_SMI_CLASS, C.IB_SMI_DIRECT_CLASS, C.IB_SA_CLASS}
-
-	ibd_ca := C.CString(caName)
-	defer C.free(unsafe.Pointer(ibd_ca))
-
-	ibd_ca_port := C.int(portNum)
-
-	// struct ibmad_port *mad_rpc_open_port(char *dev_name, int dev_port, int *mgmt_classes, int num_classes)
-	srcport := C.mad_rpc_open_port(ibd_ca, ibd_ca_port, &mgmt_classes[0], 3)
-
-	prio := SMINFO_STANDBY
-	state := SMINFO_STANDBY
-
-	var portid C.ib_portid_t
-
-	//C.resolve_sm_portid(ibd_ca, ibd_ca_port, &portid)
-	var port C.umad_port_t
-
-	C.umad_get_port(ibd_ca, ibd_ca_port, &port)
-	portid.lid = C.int(port.sm_lid)
-	portid.sl = C.uchar(port.sm_sl)
-	C.umad_release_port(&port)
-
-	C.mad_encode_field(&sminfo[0], C.IB_SMINFO_PRIO_F, unsafe.Pointer(&prio))
-	C.mad_encode_field(&sminfo[0], C.IB_SMINFO_STATE_F, unsafe.Pointer(&state))
-
-	C.smp_query_via(unsafe.Pointer(&sminfo), &portid, C.IB_ATTR_SMINFO, 0, 0, srcport)
+// SMInfo holds the SMInfo attribute of the subnet manager, as seen from a local HCA port.
+type SMInfo struct {
+	LID           int
+	GUID          uint64
+	ActivityCount uint32
+	Priority      uint8
+	State         uint8
+}
 
-	C.mad_decode_field(&sminfo[0], C.IB_SMINFO_GUID_F, unsafe.Pointer(&guid))
-	C.mad_decode_field(&sminfo[0], C.IB_SMINFO_ACT_F, unsafe.Pointer(&act))
-	C.mad_decode_field(&sminfo[0], C.IB_SMINFO_PRIO_F, unsafe.Pointer(&prio))
-	C.mad_decode_field(&sminfo[0], C.IB_SMINFO_STATE_F, unsafe.Pointer(&state))
+// StateString returns the human-readable state of the subnet manager.
+func (s SMInfo) StateString() string {
+	if int(s.State) < len(smStateMap) {
+		return smStateMap[s.State]
+	}
 
-	slog.Info("sminfo",
-		"sm_lid", portid.lid,
-		"sm_guid", guid,
-		"activity_count", act,
-		"priority", prio,
-		"state", state,
-		"state_text", smStateMap[state])
+	return fmt.Sprintf("undefined (%d)", s.State)
 }
@@ -0,0 +1,109 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+// Replay is an infiniband.Source which replays the fabrics of a snapshot file, one per sweep, with
+// their original timestamps. Each sweep waits until its fabric is due, i.e., until the time elapsed
+// since the first sweep, multiplied by the speed, reaches the time elapsed between the recording of
+// the first fabric and that of the fabric. The sweep parameters are ignored.
+type Replay struct {
+	// Now and Sleep return the current time, and wait for a duration or until the context is done.
+	// They default to time.Now and a timer, and may be replaced, e.g. in tests.
+	Now   func() time.Time
+	Sleep func(ctx context.Context, d time.Duration) error
+
+	mu    sync.Mutex
+	file  *os.File
+	dec   *Decoder
+	speed float64 // zero to replay as fast as possible
+
+	start, first time.Time // time of the first sweep, and of the first fabric recorded
+}
+
+// NewReplay returns a source which replays the snapshot file at path, at the specified speed,
+// e.g. 1 for the original speed, 10 for ten times faster, or 0 for as fast as possible.
+func NewReplay(path string, speed float64) (*Replay, error) {
+	if speed < 0 {
+		return nil, fmt.Errorf("invalid replay speed: %g", speed)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := NewDecoder(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &Replay{Now: time.Now, Sleep: sleep, file: f, dec: dec, speed: speed}, nil
+}
+
+// Sweep sends the next fabric of the snapshot file to output (unless nil), once it is due. It
+// returns io.EOF once all fabrics have been replayed, including if the file is truncated.
+func (r *Replay) Sweep(ctx context.Context, output chan infiniband.Fabric, _ infiniband.SweepConfig, _ bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fabric, err := r.dec.Decode()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if r.start.IsZero() {
+		r.start, r.first = r.Now(), fabric.Timestamp
+	} else if r.speed > 0 {
+		due := r.start.Add(time.Duration(float64(fabric.Timestamp.Sub(r.first)) / r.speed))
+
+		if err := r.Sleep(ctx, due.Sub(r.Now())); err != nil {
+			return &infiniband.SweepError{CAName: fabric.CAName, Port: fabric.SourcePort, Err: fmt.Errorf("replay cancelled: %w", err)}
+		}
+	}
+
+	if output != nil {
+		output <- fabric
+	}
+
+	return nil
+}
+
+// Close closes the snapshot file.
+func (r *Replay) Close() error {
+	return r.file.Close()
+}
+
+// sleep waits for a duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package snapshot records fabrics exactly as FabricMon saw them, in a compact, versioned and
+// compressed file format, and replays them, e.g. to reproduce an incident against writers or new
+// versions of FabricMon.
+//
+// A snapshot file consists of a magic string and a version byte, followed by a gzip-compressed
+// gob stream of a header and the recorded fabrics. Counters are recorded by name (as listed in the
+// header), and only if valid, so that files remain readable when counters are added or reordered.
+package snapshot
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+// Version is the version of the snapshot file format written by Encoder.
+const Version = 1
+
+// FileExt is the conventional file extension of snapshot files.
+const FileExt = "fmsnap"
+
+var magic = []byte("FMSNAP")
+
+// ErrFormat is the error of a file which is not a snapshot file, or of an unsupported version.
+var ErrFormat = errors.New("not a FabricMon snapshot file")
+
+// header is the first record of a snapshot file.
+type header struct {
+	Created  time.Time
+	Counters []string // names of the counters, indexed by the bits of port.Valid
+}
+
+// fabric, node and port are the records of the fabrics in a snapshot file.
+type fabric struct {
+	Hostname   string
+	CAName     string
+	SourcePort int
+	Timestamp  time.Time
+	Incomplete bool
+	Stats      infiniband.SweepStats
+	Nodes      []node
+}
+
+type node struct {
+	GUID       uint64
+	SystemGUID uint64
+	NodeType   int
+	NodeDesc   string
+	VendorID   uint
+	DeviceID   uint
+	Ports      []port
+}
+
+type port struct {
+	GUID           uint64
+	RemoteGUID     uint64
+	RemoteNodeDesc string
+	RemotePort     int
+	State          string
+	PhysState      string
+	LinkWidth      string
+	LinkSpeed      string
+	Valid          uint64   // bitmask of the valid counters, indexed as header.Counters
+	Values         []uint64 // values of the valid counters, in order
+	Timestamp      time.Time
+}
+
+// Encoder writes fabrics to a snapshot file.
+type Encoder struct {
+	zw  *gzip.Writer
+	enc *gob.Encoder
+}
+
+// NewEncoder writes the header of a snapshot file to w, and returns an encoder of its fabrics.
+func NewEncoder(w io.Writer) (*Encoder, error) {
+	if _, err := w.Write(append(magic, Version)); err != nil {
+		return nil, err
+	}
+
+	e := &Encoder{zw: gzip.NewWriter(w)}
+	e.enc = gob.NewEncoder(e.zw)
+
+	h := header{Created: time.Now(), Counters: make([]string, infiniband.NumCounters)}
+	for id := range h.Counters {
+		h.Counters[id] = infiniband.CounterID(id).String()
+	}
+
+	if err := e.enc.Encode(&h); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Encode writes a fabric.
+func (e *Encoder) Encode(f infiniband.Fabric) error {
+	rec := fabric{
+		Hostname:   f.Hostname,
+		CAName:     f.CAName,
+		SourcePort: f.SourcePort,
+		Timestamp:  f.Timestamp,
+		Incomplete: f.Incomplete,
+		Stats:      f.Stats,
+		Nodes:      make([]node, len(f.Nodes)),
+	}
+
+	for i, n := range f.Nodes {
+		rec.Nodes[i] = node{
+			GUID:       n.GUID,
+			SystemGUID: n.SystemGUID,
+			NodeType:   n.NodeType,
+			NodeDesc:   n.NodeDesc,
+			VendorID:   n.VendorID,
+			DeviceID:   n.DeviceID,
+			Ports:      make([]port, len(n.Ports)),
+		}
+
+		for j, p := range n.Ports {
+			rp := port{
+				GUID:           p.GUID,
+				RemoteGUID:     p.RemoteGUID,
+				RemoteNodeDesc: p.RemoteNodeDesc,
+				RemotePort:     p.RemotePort,
+				State:          p.State,
+				PhysState:      p.PhysState,
+				LinkWidth:      p.LinkWidth,
+				LinkSpeed:      p.LinkSpeed,
+				Valid:          uint64(p.Counters.Valid),
+				Timestamp:      p.Counters.Timestamp,
+			}
+
+			for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+				if v, ok := p.Counters.Get(id); ok {
+					rp.Values = append(rp.Values, v)
+				}
+			}
+
+			rec.Nodes[i].Ports[j] = rp
+		}
+	}
+
+	return e.enc.Encode(&rec)
+}
+
+// Flush flushes the fabrics written so far to the underlying writer, so that they can be read even
+// if the encoder is not closed (e.g., because FabricMon crashes).
+func (e *Encoder) Flush() error {
+	return e.zw.Flush()
+}
+
+// Close flushes the fabrics written so far, and completes the file. It does not close the
+// underlying writer.
+func (e *Encoder) Close() error {
+	return e.zw.Close()
+}
+
+// Decoder reads fabrics from a snapshot file.
+type Decoder struct {
+	dec *gob.Decoder
+	ids []infiniband.CounterID // IDs of the counters of the file, or -1 if unknown
+}
+
+// NewDecoder reads the header of a snapshot file from r, and returns a decoder of its fabrics.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	br := bufio.NewReader(r)
+
+	buf := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrFormat
+		}
+
+		return nil, err
+	}
+
+	if string(buf[:len(magic)]) != string(magic) {
+		return nil, ErrFormat
+	}
+
+	if v := buf[len(magic)]; v != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrFormat, v)
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Decoder{dec: gob.NewDecoder(zr)}
+
+	var h header
+	if err := d.dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("cannot read snapshot header: %w", err)
+	}
+
+	if len(h.Counters) > 64 {
+		return nil, fmt.Errorf("%w: too many counters", ErrFormat)
+	}
+
+	d.ids = make([]infiniband.CounterID, len(h.Counters))
+	for i, name := range h.Counters {
+		id, ok := infiniband.CounterByName(name)
+		if !ok {
+			id = -1
+		}
+
+		d.ids[i] = id
+	}
+
+	return d, nil
+}
+
+// Decode reads the next fabric. It returns io.EOF once all fabrics have been read, or
+// io.ErrUnexpectedEOF if the file is truncated, e.g. because it is still being written.
+func (d *Decoder) Decode() (infiniband.Fabric, error) {
+	var rec fabric
+
+	if err := d.dec.Decode(&rec); err != nil {
+		return infiniband.Fabric{}, err
+	}
+
+	f := infiniband.Fabric{
+		Hostname:   rec.Hostname,
+		CAName:     rec.CAName,
+		SourcePort: rec.SourcePort,
+		Timestamp:  rec.Timestamp,
+		Incomplete: rec.Incomplete,
+		Stats:      rec.Stats,
+		Nodes:      make([]infiniband.Node, len(rec.Nodes)),
+	}
+
+	for i, n := range rec.Nodes {
+		f.Nodes[i] = infiniband.Node{
+			GUID:       n.GUID,
+			SystemGUID: n.SystemGUID,
+			NodeType:   n.NodeType,
+			NodeDesc:   n.NodeDesc,
+			VendorID:   n.VendorID,
+			DeviceID:   n.DeviceID,
+		}
+
+		if len(n.Ports) > 0 {
+			f.Nodes[i].Ports = make([]infiniband.Port, len(n.Ports))
+		}
+
+		for j, p := range n.Ports {
+			fp := infiniband.Port{
+				GUID:           p.GUID,
+				RemoteGUID:     p.RemoteGUID,
+				RemoteNodeDesc: p.RemoteNodeDesc,
+				RemotePort:     p.RemotePort,
+				State:          p.State,
+				PhysState:      p.PhysState,
+				LinkWidth:      p.LinkWidth,
+				LinkSpeed:      p.LinkSpeed,
+			}
+
+			values := p.Values
+
+			for bit, id := range d.ids {
+				if p.Valid&(1<<bit) == 0 {
+					continue
+				}
+
+				if len(values) == 0 {
+					return infiniband.Fabric{}, fmt.Errorf("%w: missing counter values", ErrFormat)
+				}
+
+				if id >= 0 {
+					fp.Counters.Set(id, values[0])
+				}
+
+				values = values[1:]
+			}
+
+			fp.Counters.Timestamp = p.Timestamp
+			f.Nodes[i].Ports[j] = fp
+		}
+	}
+
+	return f, nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+func testFabric(ts time.Time, xmitData uint64) infiniband.Fabric {
+	sw := infiniband.Node{
+		GUID:       0x7cfe900300a1b2c3,
+		SystemGUID: 0x7cfe900300a1b2c3,
+		NodeType:   infiniband.IB_NODE_SWITCH,
+		NodeDesc:   "sw1",
+		VendorID:   0x02c9,
+		DeviceID:   0xcf08,
+		Ports: []infiniband.Port{
+			{GUID: 0x7cfe900300a1b2c3, State: "Active", PhysState: "LinkUp"},
+			{
+				GUID:           0x7cfe900300a1b2c3,
+				RemoteGUID:     0xf452140300d4e5f6,
+				RemoteNodeDesc: "n001 HCA-1",
+				RemotePort:     1,
+				State:          "Active",
+				PhysState:      "LinkUp",
+				LinkWidth:      "4X",
+				LinkSpeed:      "EDR",
+			},
+		},
+	}
+
+	sw.Ports[1].Counters.Set(infiniband.SymbolErrorCounter, 3)
+	sw.Ports[1].Counters.Set(infiniband.PortXmitData, xmitData)
+	sw.Ports[1].Counters.Timestamp = ts
+
+	return infiniband.Fabric{
+		Hostname:   "host1",
+		CAName:     "mlx5_0",
+		SourcePort: 1,
+		Timestamp:  ts,
+		Nodes: []infiniband.Node{
+			sw,
+			{GUID: 0xf452140300d4e5f6, SystemGUID: 0xf452140300d4e5f6, NodeType: infiniband.IB_NODE_CA, NodeDesc: "n001 HCA-1"},
+		},
+		Stats: infiniband.SweepStats{
+			Duration:   time.Second,
+			PMAQueries: 3,
+			NodeErrors: map[uint64]infiniband.NodeErrors{0xf452140300d4e5f6: {Failures: 1, Timeouts: 1}},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	fabrics := []infiniband.Fabric{testFabric(start, 100), testFabric(start.Add(time.Minute), 200)}
+	fabrics[1].Incomplete = true
+
+	var buf bytes.Buffer
+
+	enc, err := NewEncoder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fabrics {
+		if err := enc.Encode(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dec, err := NewDecoder(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range fabrics {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("fabric %d:\n%+v\nwant:\n%+v", i, got, want)
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Version mismatch.
+	b := append([]byte(nil), buf.Bytes()...)
+	b[len(magic)] = Version + 1
+
+	if _, err := NewDecoder(bytes.NewReader(b)); !errors.Is(err, ErrFormat) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := NewDecoder(bytes.NewReader([]byte("# ibsim.net"))); !errors.Is(err, ErrFormat) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "test."+FileExt)
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := NewEncoder(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		enc.Encode(testFabric(start.Add(time.Duration(i)*time.Minute), uint64(i)))
+	}
+
+	// The encoder is only flushed, as if FabricMon were still recording.
+	enc.Flush()
+	f.Close()
+
+	r, err := NewReplay(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	now := time.Unix(0, 0)
+	r.Now = func() time.Time { return now }
+
+	var slept []time.Duration
+	r.Sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	c := make(chan infiniband.Fabric, 3)
+
+	for i := 0; i < 3; i++ {
+		if err := r.Sweep(context.Background(), c, infiniband.SweepConfig{}, true); err != nil {
+			t.Fatal(err)
+		}
+
+		// Processing the fabric takes a while.
+		now = now.Add(time.Second)
+	}
+
+	if err := r.Sweep(context.Background(), c, infiniband.SweepConfig{}, true); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := []time.Duration{5 * time.Second, 5 * time.Second}; !reflect.DeepEqual(slept, want) {
+		t.Errorf("unexpected sleeps: %v", slept)
+	}
+
+	for i := 0; i < 3; i++ {
+		if f := <-c; !f.Timestamp.Equal(start.Add(time.Duration(i) * time.Minute)) {
+			t.Errorf("unexpected timestamp: %s", f.Timestamp)
+		}
+	}
+}
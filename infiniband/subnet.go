@@ -0,0 +1,102 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Identification of the subnets attached to local HCA ports.
+
+package infiniband
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errPortNotActive = errors.New("port not active")
+
+// subnetID identifies an InfiniBand subnet by the subnet prefix of a local port's GID and the port
+// GUID of the subnet's master SM. Since most subnets use the default subnet prefix, the prefix
+// alone does not suffice. The zero value denotes an unknown subnet.
+type subnetID struct {
+	prefix uint64
+	smGUID uint64
+}
+
+func (s subnetID) String() string {
+	if s == (subnetID{}) {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("%#016x/%#016x", s.prefix, s.smGUID)
+}
+
+// localPort is a local HCA port, via which a subnet can be swept.
+type localPort struct {
+	hca    *HCA
+	num    int
+	mkey   uint64
+	subnet subnetID
+}
+
+func (p localPort) portNum() int {
+	return p.num
+}
+
+// localPorts returns the active InfiniBand ports of the HCAs selected by cfg, in order, along with
+// the subnets attached to them. The topology cached via inactive ports is discarded. Ports whose
+// subnet cannot be identified are included, with an unknown subnet.
+func localPorts(hcas []HCA, cfg SweepConfig) []localPort {
+	var ports []localPort
+
+	for i := range hcas {
+		h := &hcas[i]
+
+		for _, portNum := range h.Ports() {
+			portLog := cfg.logger().With("ca", h.Name, "port", portNum)
+
+			mkey, ok := cfg.sourcePort(h.Name, portNum)
+			if !ok {
+				portLog.Debug("skipping port not configured as source port")
+				h.destroyFabric(portNum)
+				continue
+			}
+
+			subnet, err := h.portSubnet(portNum)
+			if errors.Is(err, errPortNotActive) {
+				portLog.Debug("skipping inactive port")
+				h.destroyFabric(portNum)
+				continue
+			} else if err != nil {
+				portLog.Warn("unable to identify subnet", "err", err)
+			}
+
+			ports = append(ports, localPort{hca: h, num: portNum, mkey: mkey, subnet: subnet})
+		}
+	}
+
+	return ports
+}
+
+// groupSubnets groups local ports by the subnet attached to them, preserving the order of the
+// ports, both within and across groups. Each port whose subnet is unknown forms a group of its own,
+// since it cannot be ruled out that its subnet is a different one.
+func groupSubnets(ports []localPort) [][]localPort {
+	var groups [][]localPort
+
+	index := make(map[subnetID]int)
+
+	for _, p := range ports {
+		if p.subnet == (subnetID{}) {
+			groups = append(groups, []localPort{p})
+			continue
+		}
+
+		if i, ok := index[p.subnet]; ok {
+			groups[i] = append(groups[i], p)
+			continue
+		}
+
+		index[p.subnet] = len(groups)
+		groups = append(groups, []localPort{p})
+	}
+
+	return groups
+}
@@ -0,0 +1,49 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package infiniband
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestGroupSubnets(t *testing.T) {
+	var (
+		hca0 = &HCA{Name: "mlx5_0"}
+		hca1 = &HCA{Name: "mlx5_1"}
+
+		subnetA = subnetID{prefix: 0xfe80000000000000, smGUID: 0x0002c90300000001}
+		subnetB = subnetID{prefix: 0xfe80000000000000, smGUID: 0x0002c90300000002}
+	)
+
+	ports := []localPort{
+		{hca: hca0, num: 1, subnet: subnetA},
+		{hca: hca0, num: 2, subnet: subnetB},
+		{hca: hca1, num: 1},
+		{hca: hca1, num: 2, subnet: subnetA},
+		{hca: hca1, num: 3},
+	}
+
+	var got [][]string
+
+	for _, group := range groupSubnets(ports) {
+		var names []string
+		for _, p := range group {
+			names = append(names, fmt.Sprintf("%s/%d/%s", p.hca.Name, p.portNum(), p.subnet))
+		}
+		got = append(got, names)
+	}
+
+	want := [][]string{
+		{"mlx5_0/1/" + subnetA.String(), "mlx5_1/2/" + subnetA.String()},
+		{"mlx5_0/2/" + subnetB.String()},
+		{"mlx5_1/1/unknown"},
+		{"mlx5_1/3/unknown"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
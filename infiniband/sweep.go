@@ -0,0 +1,129 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Sweeps of the subnets attached to local HCA ports, independent of the backend which discovers
+// the fabric of a subnet.
+
+package infiniband
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Source produces fabrics, e.g., by sweeping the subnets attached to local HCAs.
+type Source interface {
+	// Sweep sweeps each fabric of the source, and sends it to output (unless nil). Unless
+	// rediscover is true, the topology of the previous sweep of a fabric is reused, and only its
+	// counters are collected. The returned error joins a *SweepError for each fabric which could
+	// not be (completely) swept.
+	Sweep(ctx context.Context, output chan Fabric, cfg SweepConfig, rediscover bool) error
+}
+
+// SweepError is an error sweeping a subnet via a local HCA port.
+type SweepError struct {
+	CAName string
+	Port   int
+	Err    error
+}
+
+func (e *SweepError) Error() string {
+	return fmt.Sprintf("%s port %d: %v", e.CAName, e.Port, e.Err)
+}
+
+func (e *SweepError) Unwrap() error {
+	return e.Err
+}
+
+// sweep sweeps the subnets attached to the client's HCAs. The node descriptions of each fabric are
+// remapped by the client's node name map before the fabric is sent to output.
+func (c *Client) sweep(ctx context.Context, output chan Fabric, cfg SweepConfig, rediscover bool) error {
+	var (
+		wg                     sync.WaitGroup
+		mu                     sync.Mutex
+		totalNodes, totalPorts int
+		errs                   []error
+	)
+
+	hostname, _ := os.Hostname()
+	start := time.Now()
+
+	cfg = c.sweepConfig(cfg)
+	subnets := groupSubnets(localPorts(c.hcas, cfg))
+
+	for _, ports := range subnets {
+		wg.Add(1)
+
+		go func(ports []localPort) {
+			defer wg.Done()
+
+			fabric, err := sweepSubnet(ctx, ports, cfg, rediscover)
+
+			mu.Lock()
+			if err != nil {
+				errs = append(errs, err)
+			}
+
+			if fabric != nil {
+				totalNodes += len(fabric.Nodes)
+
+				for _, n := range fabric.Nodes {
+					totalPorts += len(n.Ports)
+				}
+			}
+			mu.Unlock()
+
+			if fabric != nil && output != nil {
+				fabric.Hostname = hostname
+				c.NodeNameMap().RemapFabric(fabric)
+				output <- *fabric
+			}
+		}(ports)
+	}
+
+	wg.Wait()
+
+	cfg.logger().Info("netdiscover complete", "rediscover", rediscover, "subnets", len(subnets),
+		"duration", time.Since(start), "nodes", totalNodes, "ports", totalPorts)
+
+	return errors.Join(errs...)
+}
+
+// sweepSubnet sweeps a subnet via the first of its local ports, failing over to the next port if
+// the fabric could not be swept via a port. The topology cached via the other ports is discarded,
+// since it would be stale by the time that the subnet is swept via one of them again.
+func sweepSubnet(ctx context.Context, ports []localPort, cfg SweepConfig, rediscover bool) (*Fabric, error) {
+	var errs []error
+
+	for i, p := range ports {
+		if i > 0 {
+			cfg.logger().Warn("failing over to next port of subnet", "subnet", p.subnet,
+				"ca", p.hca.Name, "port", p.portNum())
+		}
+
+		fabric, err := p.sweep(ctx, cfg, rediscover)
+		if err != nil {
+			errs = append(errs, &SweepError{CAName: p.hca.Name, Port: p.portNum(), Err: err})
+		}
+
+		if fabric != nil {
+			for _, other := range ports {
+				if other != p {
+					other.hca.destroyFabric(other.portNum())
+				}
+			}
+
+			return fabric, errors.Join(errs...)
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,271 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package synth generates synthetic fabrics of parameterised topologies (e.g., a k-ary fat tree),
+// with plausible node descriptions, GUIDs and link speeds, and traffic and error counters which
+// evolve over time, for demos and for load testing FabricMon and its downstream consumers without
+// a fabric of that size.
+package synth
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/fake"
+)
+
+const (
+	vendorMellanox = 0x02c9
+
+	// OUIs of the node GUIDs of switches and hosts.
+	switchOUI = 0x7cfe90
+	hostOUI   = 0xf45214
+
+	// Fraction of links which are flaky, i.e., accumulate errors.
+	flakyLinks = 0.01
+
+	// Mean packet size in octets, for deriving packet counters from data counters.
+	meanPacketSize = 2048
+)
+
+// devices maps link speeds to the device IDs of plausible switches and HCAs. Other speeds use the
+// devices of EDR.
+var devices = map[string][2]uint{
+	"EDR": {0xcf08, 0x1017}, // Switch-IB 2, ConnectX-5
+	"FDR": {0xc738, 0x1013}, // SwitchX-2, ConnectX-4
+}
+
+// builder builds the nodes of a synthetic fabric.
+type builder struct {
+	spec    Spec
+	devices [2]uint // device IDs of switches and HCAs
+	rnd     *rand.Rand
+	nodes   []infiniband.Node
+	guids   map[uint64]bool
+	hosts   int
+}
+
+// guid returns a random, unique GUID with the specified OUI.
+func (b *builder) guid(oui uint64) uint64 {
+	for {
+		guid := oui<<40 | 0x03<<32 | uint64(b.rnd.Intn(1<<24))
+
+		if !b.guids[guid] {
+			b.guids[guid] = true
+			return guid
+		}
+	}
+}
+
+// addSwitch adds a switch with the specified number of external ports, and returns its index.
+func (b *builder) addSwitch(desc string, numPorts int) int {
+	node := fake.Switch(b.guid(switchOUI), desc, numPorts)
+	node.VendorID = vendorMellanox
+	node.DeviceID = b.devices[0]
+
+	b.nodes = append(b.nodes, node)
+
+	return len(b.nodes) - 1
+}
+
+// addHost adds a host (i.e., a single-port HCA), and returns its index.
+func (b *builder) addHost() int {
+	b.hosts++
+
+	node := fake.CA(b.guid(hostOUI), fmt.Sprintf("n%05d HCA-1", b.hosts))
+	node.VendorID = vendorMellanox
+	node.DeviceID = b.devices[1]
+
+	b.nodes = append(b.nodes, node)
+
+	return len(b.nodes) - 1
+}
+
+// link connects two ports of the nodes with the specified indices. Only the ports of switches are
+// populated.
+func (b *builder) link(i, portA, j, portB int) {
+	connect := func(local *infiniband.Node, localPort int, remote *infiniband.Node, remotePort int) {
+		if local.NodeType != infiniband.IB_NODE_SWITCH {
+			return
+		}
+
+		p := &local.Ports[localPort]
+		p.RemoteGUID = remote.GUID
+		p.RemoteNodeDesc = remote.NodeDesc
+		p.RemotePort = remotePort
+		p.State, p.PhysState = "Active", "LinkUp"
+		p.LinkWidth, p.LinkSpeed = b.spec.Width, b.spec.Speed
+	}
+
+	connect(&b.nodes[i], portA, &b.nodes[j], portB)
+	connect(&b.nodes[j], portB, &b.nodes[i], portA)
+}
+
+// Generate generates a fabric of the specified topology, whose counters evolve over successive
+// sweeps. The fabric is deterministic for a given spec, except that the counters evolve according
+// to the time elapsed between sweeps.
+func Generate(spec Spec) (*fake.Fabric, error) {
+	sh, ok := shapes[spec.Shape]
+	if !ok {
+		return nil, fmt.Errorf("unknown synthetic topology: %q", spec.Shape)
+	}
+
+	params := make(map[string]int, len(sh.params))
+	for k, v := range sh.params {
+		params[k] = v
+	}
+
+	for k, v := range spec.Params {
+		params[k] = v
+	}
+
+	b := &builder{spec: spec, rnd: rand.New(rand.NewSource(spec.Seed)), guids: make(map[uint64]bool)}
+
+	if b.devices, ok = devices[spec.Speed]; !ok {
+		b.devices = devices["EDR"]
+	}
+
+	if err := sh.build(b, params); err != nil {
+		return nil, fmt.Errorf("%s topology: %w", spec.Shape, err)
+	}
+
+	t := newTraffic(b.rnd, b.nodes)
+
+	return &fake.Fabric{
+		CAName:     "synth0",
+		SourcePort: 1,
+		Nodes:      b.nodes,
+		Tick:       t.tick,
+	}, nil
+}
+
+// NewSource returns a source which sweeps a generated fabric of the specified topology.
+func NewSource(spec Spec) (*fake.Source, error) {
+	f, err := Generate(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	src := fake.NewSource(f)
+	src.Hostname = "synthetic"
+
+	return src, nil
+}
+
+// portLoad is the traffic pattern of a switch port.
+type portLoad struct {
+	node, port int
+	xmit, rcv  float64 // mean utilisation of the link in each direction
+	flaky      bool    // the link accumulates errors
+}
+
+// traffic advances the counters of the connected switch ports of a fabric.
+type traffic struct {
+	rnd   *rand.Rand
+	ports []portLoad
+	last  time.Time
+}
+
+// newTraffic assigns a traffic pattern to each connected switch port, and initialises its
+// counters, as if the fabric had been running for a while.
+func newTraffic(rnd *rand.Rand, nodes []infiniband.Node) *traffic {
+	t := &traffic{rnd: rnd}
+
+	for i := range nodes {
+		for portNum := range nodes[i].Ports {
+			port := &nodes[i].Ports[portNum]
+			if portNum == 0 || port.RemoteGUID == 0 {
+				continue
+			}
+
+			load := portLoad{
+				node:  i,
+				port:  portNum,
+				xmit:  rnd.Float64() * 0.6,
+				rcv:   rnd.Float64() * 0.6,
+				flaky: rnd.Float64() < flakyLinks,
+			}
+
+			for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+				port.Counters.Set(id, 0)
+			}
+
+			t.ports = append(t.ports, load)
+			t.advance(&port.Counters, load, infiniband.LinkDataRate(port.LinkWidth, port.LinkSpeed), time.Hour)
+		}
+	}
+
+	return t
+}
+
+// tick advances the counters by the time elapsed since the previous tick.
+func (t *traffic) tick(f *fake.Fabric, now time.Time) {
+	elapsed := now.Sub(t.last)
+	if t.last.IsZero() || elapsed <= 0 {
+		t.last = now
+		return
+	}
+
+	t.last = now
+
+	for _, load := range t.ports {
+		port := f.Nodes[load.node].Port(load.port)
+		if port == nil || port.State != "Active" {
+			continue
+		}
+
+		t.advance(&port.Counters, load, infiniband.LinkDataRate(port.LinkWidth, port.LinkSpeed), elapsed)
+	}
+}
+
+// advance advances the counters of a port, with the specified load and data rate, by a duration.
+func (t *traffic) advance(c *infiniband.Counters, load portLoad, rate uint64, d time.Duration) {
+	seconds := d.Seconds()
+
+	// Utilisation fluctuates around the mean.
+	jitter := func(mean float64) float64 {
+		return math.Max(0, math.Min(1, mean*(0.75+t.rnd.Float64()/2)))
+	}
+
+	xmit, rcv := jitter(load.xmit), jitter(load.rcv)
+
+	xmitOctets := uint64(xmit * float64(rate) / 8 * seconds)
+	rcvOctets := uint64(rcv * float64(rate) / 8 * seconds)
+	xmitPkts, rcvPkts := xmitOctets/meanPacketSize, rcvOctets/meanPacketSize
+
+	fake.Advance(c, infiniband.PortXmitData, xmitOctets/4)
+	fake.Advance(c, infiniband.PortRcvData, rcvOctets/4)
+	fake.Advance(c, infiniband.PortXmitPkts, xmitPkts)
+	fake.Advance(c, infiniband.PortRcvPkts, rcvPkts)
+	fake.Advance(c, infiniband.PortUnicastXmitPkts, xmitPkts-xmitPkts/100)
+	fake.Advance(c, infiniband.PortUnicastRcvPkts, rcvPkts-rcvPkts/100)
+	fake.Advance(c, infiniband.PortMulticastXmitPkts, xmitPkts/100)
+	fake.Advance(c, infiniband.PortMulticastRcvPkts, rcvPkts/100)
+
+	// Congestion rises steeply with utilisation.
+	fake.Advance(c, infiniband.PortXmitWait, uint64(math.Pow(xmit, 4)*seconds*1e6))
+
+	if xmit > 0.9 {
+		fake.Advance(c, infiniband.PortXmitDiscards, uint64(t.rnd.Intn(10)))
+	}
+
+	if !load.flaky {
+		return
+	}
+
+	// Flaky links accumulate symbol errors, occasionally recovering from (and rarely being downed
+	// by) link errors.
+	fake.Advance(c, infiniband.SymbolErrorCounter, uint64(t.rnd.Float64()*seconds))
+	fake.Advance(c, infiniband.PortRcvErrors, uint64(t.rnd.Float64()*seconds/10))
+
+	if t.rnd.Float64() < 0.1 {
+		fake.Advance(c, infiniband.LinkErrorRecoveryCounter, 1)
+	}
+
+	if t.rnd.Float64() < 0.01 {
+		fake.Advance(c, infiniband.LinkDownedCounter, 1)
+	}
+}
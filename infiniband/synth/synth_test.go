@@ -0,0 +1,133 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package synth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		spec                   string
+		switches, hosts, links int
+	}{
+		{"fattree", 20, 16, 48},
+		{"fattree:k=34", 1445, 9826, 29478},
+		{"dragonfly", 36, 72, 72 + 9*6 + 36},
+		{"torus:x=3,y=2,hosts=1", 6, 6, 18},
+		{"ring:switches=2", 2, 8, 9},
+		{"ring", 3, 12, 15},
+		{"tree", 4, 12, 15},
+	}
+
+	for _, tt := range tests {
+		spec, err := ParseSpec(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := Generate(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+
+		fabric := infiniband.Fabric{Nodes: f.Nodes}
+
+		var switches, hosts int
+
+		guids := make(map[uint64]*infiniband.Node)
+
+		for i, node := range f.Nodes {
+			if node.NodeType == infiniband.IB_NODE_SWITCH {
+				switches++
+			} else {
+				hosts++
+			}
+
+			guids[node.GUID] = &f.Nodes[i]
+		}
+
+		links := fabric.Links()
+
+		if switches != tt.switches || hosts != tt.hosts || len(links) != tt.links || len(guids) != len(f.Nodes) {
+			t.Errorf("%s: got %d switches, %d hosts, %d links, %d GUIDs", tt.spec, switches, hosts, len(links), len(guids))
+		}
+
+		// Links between switches must be consistent at both ends.
+		for _, link := range links {
+			remote := guids[link.RemoteGUID]
+			if remote == nil {
+				t.Fatalf("%s: link to unknown node: %+v", tt.spec, link)
+			}
+
+			if remote.NodeType != infiniband.IB_NODE_SWITCH {
+				continue
+			}
+
+			if p := remote.Port(link.RemotePort); p == nil || p.RemoteGUID != link.LocalGUID || p.RemotePort != link.LocalPort {
+				t.Fatalf("%s: inconsistent link: %+v", tt.spec, link)
+			}
+		}
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec("torus:y=8,speed=FDR,seed=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := spec.String(); s != "torus:hosts=2,x=4,y=8,width=4X,speed=FDR,seed=7" {
+		t.Errorf("unexpected spec: %s", s)
+	}
+
+	for _, s := range []string{"mesh", "fattree:q=1", "fattree:k", "fattree:k=-2", "ring:speed=XDR"} {
+		if _, err := ParseSpec(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+
+	if _, err := Generate(Spec{Shape: "fattree", Params: map[string]int{"k": 3}}); err == nil {
+		t.Error("no error for odd k")
+	}
+}
+
+func TestSourceCounters(t *testing.T) {
+	spec, _ := ParseSpec("ring:switches=2,hosts=1")
+
+	src, err := NewSource(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	now := start
+	src.Now = func() time.Time { return now }
+
+	c := make(chan infiniband.Fabric, 2)
+	cfg := infiniband.SweepConfig{ResetThreshold: 100}
+
+	src.Sweep(context.Background(), c, cfg, true)
+
+	now = start.Add(10 * time.Second)
+	src.Sweep(context.Background(), c, cfg, false)
+
+	first, second := <-c, <-c
+
+	a, _ := first.Nodes[0].Ports[1].Counters.Get(infiniband.PortXmitData)
+	b, _ := second.Nodes[0].Ports[1].Counters.Get(infiniband.PortXmitData)
+
+	// At most 100 Gb/s for 10 seconds, in units of four octets.
+	if b <= a || b-a > 100e9/8*10/4 {
+		t.Fatalf("unexpected PortXmitData: %d, %d", a, b)
+	}
+
+	if second.Hostname != "synthetic" || !second.Nodes[0].Ports[1].Counters.Timestamp.Equal(now) {
+		t.Fatalf("unexpected fabric: %+v", second)
+	}
+}
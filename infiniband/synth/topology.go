@@ -0,0 +1,316 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Parameterised topologies of synthetic fabrics.
+
+package synth
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+// shape builds a topology of a fabric, given its parameters.
+type shape struct {
+	params map[string]int // parameters, with their defaults
+	build  func(b *builder, p map[string]int) error
+}
+
+// shapes are the supported topologies. ring and tree also reproduce the sample topologies of the
+// web UI, i.e., ring:switches=2 (2-switch), ring:switches=3 (3-switch) and tree:leaves=3 (fat-tree).
+var shapes = map[string]shape{
+	"fattree":   {map[string]int{"k": 4}, buildFatTree},
+	"dragonfly": {map[string]int{"a": 4, "p": 2, "h": 2}, buildDragonfly},
+	"torus":     {map[string]int{"x": 4, "y": 4, "hosts": 2}, buildTorus},
+	"ring":      {map[string]int{"switches": 3, "hosts": 4}, buildRing},
+	"tree":      {map[string]int{"leaves": 3, "hosts": 4}, buildTree},
+}
+
+// Spec specifies a synthetic fabric.
+type Spec struct {
+	Shape  string         // fattree, dragonfly, torus, ring or tree
+	Params map[string]int // parameters of the shape; missing parameters take their defaults
+	Width  string         // link width, e.g., 4X
+	Speed  string         // link speed, e.g., EDR
+	Seed   int64          // seed of the pseudo-random GUIDs and counters
+}
+
+// ParseSpec parses a spec of the form shape[:key=value,...], e.g., "fattree:k=8,speed=FDR".
+// Besides the parameters of the shape, the keys width, speed and seed are accepted.
+//
+// The shapes and their parameters are:
+//
+//	fattree    k-ary three-level fat tree, with k^3/4 hosts (k: even switch radix)
+//	dragonfly  a*h+1 fully connected groups of a routers, each with p hosts and h global links
+//	torus      x*y two-dimensional torus of switches, each with the specified number of hosts
+//	ring       ring of switches, each with the specified number of hosts
+//	tree       root switch with the specified number of leaf switches, each with hosts
+func ParseSpec(s string) (Spec, error) {
+	name, args, _ := strings.Cut(s, ":")
+
+	sh, ok := shapes[name]
+	if !ok {
+		return Spec{}, fmt.Errorf("unknown synthetic topology: %q", name)
+	}
+
+	spec := Spec{Shape: name, Params: make(map[string]int), Width: "4X", Speed: "EDR", Seed: 1}
+
+	for k, v := range sh.params {
+		spec.Params[k] = v
+	}
+
+	if args != "" {
+		for _, arg := range strings.Split(args, ",") {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return Spec{}, fmt.Errorf("invalid synthetic topology parameter: %q", arg)
+			}
+
+			switch key {
+			case "width":
+				spec.Width = value
+			case "speed":
+				spec.Speed = value
+			case "seed":
+				seed, err := strconv.ParseInt(value, 0, 64)
+				if err != nil {
+					return Spec{}, fmt.Errorf("invalid seed: %w", err)
+				}
+
+				spec.Seed = seed
+			default:
+				if _, ok := sh.params[key]; !ok {
+					return Spec{}, fmt.Errorf("unknown parameter of %s topology: %q", name, key)
+				}
+
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return Spec{}, fmt.Errorf("invalid %s: %q", key, value)
+				}
+
+				spec.Params[key] = n
+			}
+		}
+	}
+
+	if infiniband.LinkDataRate(spec.Width, spec.Speed) == 0 {
+		return Spec{}, fmt.Errorf("unsupported link width / speed: %s %s", spec.Width, spec.Speed)
+	}
+
+	return spec, nil
+}
+
+func (s Spec) String() string {
+	keys := make([]string, 0, len(s.Params))
+	for k := range s.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, len(keys)+3)
+
+	for _, k := range keys {
+		args = append(args, fmt.Sprintf("%s=%d", k, s.Params[k]))
+	}
+
+	args = append(args, "width="+s.Width, "speed="+s.Speed, fmt.Sprintf("seed=%d", s.Seed))
+
+	return s.Shape + ":" + strings.Join(args, ",")
+}
+
+// buildFatTree builds a k-ary three-level fat tree: k pods of k/2 edge and k/2 aggregation
+// switches each, and (k/2)^2 core switches, all with k ports. Each edge switch connects k/2 hosts.
+func buildFatTree(b *builder, p map[string]int) error {
+	k := p["k"]
+	if k < 2 || k%2 != 0 {
+		return fmt.Errorf("k must be even and at least 2")
+	}
+
+	half := k / 2
+
+	core := make([]int, half*half)
+	for i := range core {
+		core[i] = b.addSwitch(fmt.Sprintf("core-sw%0*d", digits(len(core)), i+1), k)
+	}
+
+	for pod := 0; pod < k; pod++ {
+		edge := make([]int, half)
+		agg := make([]int, half)
+
+		for i := 0; i < half; i++ {
+			edge[i] = b.addSwitch(fmt.Sprintf("pod%0*d-edge-sw%0*d", digits(k), pod+1, digits(half), i+1), k)
+			agg[i] = b.addSwitch(fmt.Sprintf("pod%0*d-agg-sw%0*d", digits(k), pod+1, digits(half), i+1), k)
+		}
+
+		for e := 0; e < half; e++ {
+			for h := 0; h < half; h++ {
+				b.link(edge[e], h+1, b.addHost(), 1)
+			}
+
+			for a := 0; a < half; a++ {
+				b.link(edge[e], half+a+1, agg[a], e+1)
+			}
+		}
+
+		for a := 0; a < half; a++ {
+			for j := 0; j < half; j++ {
+				b.link(agg[a], half+j+1, core[a*half+j], pod+1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildDragonfly builds a dragonfly of a*h+1 groups of a routers. The routers of a group are fully
+// connected, and each group is connected to every other group by a global link. Each router has
+// p host ports, a-1 local ports and h global ports.
+func buildDragonfly(b *builder, p map[string]int) error {
+	a, hosts, h := p["a"], p["p"], p["h"]
+	if a < 1 || h < 1 {
+		return fmt.Errorf("a and h must be at least 1")
+	}
+
+	groups := a*h + 1
+	numPorts := hosts + a - 1 + h
+
+	routers := make([][]int, groups)
+
+	for g := range routers {
+		routers[g] = make([]int, a)
+
+		for r := range routers[g] {
+			routers[g][r] = b.addSwitch(fmt.Sprintf("g%0*d-sw%0*d", digits(groups), g+1, digits(a), r+1), numPorts)
+
+			for i := 0; i < hosts; i++ {
+				b.link(routers[g][r], i+1, b.addHost(), 1)
+			}
+		}
+
+		// Local port of router r towards router s.
+		localPort := func(r, s int) int {
+			if s > r {
+				s--
+			}
+
+			return hosts + s + 1
+		}
+
+		for r := 0; r < a; r++ {
+			for s := r + 1; s < a; s++ {
+				b.link(routers[g][r], localPort(r, s), routers[g][s], localPort(s, r))
+			}
+		}
+	}
+
+	// Global link l (0 <= l < a*h) of group g is on router l/h, and leads to group l (or l+1, to
+	// skip group g itself).
+	global := func(g, l int) (int, int) {
+		return routers[g][l/h], hosts + a + l%h
+	}
+
+	for g := 0; g < groups; g++ {
+		for t := g + 1; t < groups; t++ {
+			src, srcPort := global(g, t-1)
+			dst, dstPort := global(t, g)
+			b.link(src, srcPort, dst, dstPort)
+		}
+	}
+
+	return nil
+}
+
+// buildTorus builds a two-dimensional torus of x*y switches, each connected to its four
+// neighbours, with the wraparound links, and to the specified number of hosts.
+func buildTorus(b *builder, p map[string]int) error {
+	x, y, hosts := p["x"], p["y"], p["hosts"]
+	if x < 2 || y < 2 {
+		return fmt.Errorf("x and y must be at least 2")
+	}
+
+	// Host ports, followed by the east, west, north and south ports.
+	east, west, north, south := hosts+1, hosts+2, hosts+3, hosts+4
+
+	grid := make([]int, x*y)
+
+	for j := 0; j < y; j++ {
+		for i := 0; i < x; i++ {
+			sw := b.addSwitch(fmt.Sprintf("sw-%0*d-%0*d", digits(x), i+1, digits(y), j+1), hosts+4)
+			grid[j*x+i] = sw
+
+			for h := 0; h < hosts; h++ {
+				b.link(sw, h+1, b.addHost(), 1)
+			}
+		}
+	}
+
+	for j := 0; j < y; j++ {
+		for i := 0; i < x; i++ {
+			b.link(grid[j*x+i], east, grid[j*x+(i+1)%x], west)
+			b.link(grid[j*x+i], north, grid[((j+1)%y)*x+i], south)
+		}
+	}
+
+	return nil
+}
+
+// buildRing builds a ring of switches, each connected to the specified number of hosts. Two
+// switches are connected by a single link.
+func buildRing(b *builder, p map[string]int) error {
+	n, hosts := p["switches"], p["hosts"]
+	if n < 1 {
+		return fmt.Errorf("switches must be at least 1")
+	}
+
+	ring := make([]int, n)
+
+	for i := range ring {
+		ring[i] = b.addSwitch(fmt.Sprintf("sw%d", i+1), hosts+2)
+
+		for h := 0; h < hosts; h++ {
+			b.link(ring[i], h+1, b.addHost(), 1)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		if n == 1 || (n == 2 && i == 1) {
+			break
+		}
+
+		b.link(ring[i], hosts+1, ring[(i+1)%n], hosts+2)
+	}
+
+	return nil
+}
+
+// buildTree builds a root switch with the specified number of leaf switches, each connected to the
+// specified number of hosts.
+func buildTree(b *builder, p map[string]int) error {
+	leaves, hosts := p["leaves"], p["hosts"]
+	if leaves < 1 {
+		return fmt.Errorf("leaves must be at least 1")
+	}
+
+	root := b.addSwitch("root-sw1", leaves)
+
+	for i := 0; i < leaves; i++ {
+		leaf := b.addSwitch(fmt.Sprintf("leaf-sw%d", i+1), hosts+1)
+
+		for h := 0; h < hosts; h++ {
+			b.link(leaf, h+1, b.addHost(), 1)
+		}
+
+		b.link(leaf, hosts+1, root, i+1)
+	}
+
+	return nil
+}
+
+// digits returns the number of decimal digits of n, for zero-padding names numbered up to n.
+func digits(n int) int {
+	return len(strconv.Itoa(n))
+}
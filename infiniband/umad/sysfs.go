@@ -0,0 +1,201 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Enumeration of local CAs and their ports via sysfs, analogous to libibumad's umad_get_ca() and
+// umad_get_port().
+
+package umad
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	classInfiniband = "class/infiniband"
+	classUmad       = "class/infiniband_mad"
+)
+
+// sysfs is the root of sysfs. It is a variable so that it can be replaced in tests.
+var sysfs fs.FS = os.DirFS("/sys")
+
+// CA is a local channel adapter.
+type CA struct {
+	Name       string
+	Type       string // node type, e.g., "1: CA"
+	NodeGUID   uint64
+	SystemGUID uint64
+	FWVersion  string
+	HWVersion  string
+	Ports      []Port // ports of the CA, in order of port number
+}
+
+// Port is a port of a local channel adapter.
+type Port struct {
+	Num       int
+	State     int    // port state, e.g., 4 (Active)
+	PhysState int    // physical port state, e.g., 5 (LinkUp)
+	LinkLayer string // e.g., "InfiniBand" or "Ethernet"
+	LID       uint16
+	SMLID     uint16
+	SMSL      uint8
+	CapMask   uint32
+	GIDPrefix uint64
+	PortGUID  uint64
+}
+
+// GetCAs returns the local CAs, in order of name.
+func GetCAs() ([]CA, error) {
+	entries, err := fs.ReadDir(sysfs, classInfiniband)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	cas := make([]CA, 0, len(entries))
+
+	for _, e := range entries {
+		ca, err := GetCA(e.Name())
+		if err != nil {
+			return cas, err
+		}
+
+		cas = append(cas, ca)
+	}
+
+	return cas, nil
+}
+
+// GetCA returns the local CA with the specified name.
+func GetCA(name string) (CA, error) {
+	dir := path.Join(classInfiniband, name)
+
+	ca := CA{
+		Name:      name,
+		Type:      readString(dir, "node_type"),
+		FWVersion: readString(dir, "fw_ver"),
+		HWVersion: readString(dir, "hw_rev"),
+	}
+
+	var err error
+
+	if ca.NodeGUID, err = parseGUID(readString(dir, "node_guid")); err != nil {
+		return ca, fmt.Errorf("%s: node_guid: %w", name, err)
+	}
+
+	if ca.SystemGUID, err = parseGUID(readString(dir, "sys_image_guid")); err != nil {
+		return ca, fmt.Errorf("%s: sys_image_guid: %w", name, err)
+	}
+
+	entries, err := fs.ReadDir(sysfs, path.Join(dir, "ports"))
+	if err != nil {
+		return ca, err
+	}
+
+	for _, e := range entries {
+		portNum, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+
+		port, err := GetPort(name, portNum)
+		if err != nil {
+			return ca, err
+		}
+
+		ca.Ports = append(ca.Ports, port)
+	}
+
+	sort.Slice(ca.Ports, func(i, j int) bool { return ca.Ports[i].Num < ca.Ports[j].Num })
+
+	return ca, nil
+}
+
+// GetPort returns the current attributes of the specified port of a local CA.
+func GetPort(caName string, portNum int) (Port, error) {
+	dir := path.Join(classInfiniband, caName, "ports", strconv.Itoa(portNum))
+
+	if _, err := fs.Stat(sysfs, dir); err != nil {
+		return Port{}, fmt.Errorf("%s port %d: %w", caName, portNum, err)
+	}
+
+	port := Port{
+		Num:       portNum,
+		State:     parseEnum(readString(dir, "state")),
+		PhysState: parseEnum(readString(dir, "phys_state")),
+		LinkLayer: readString(dir, "link_layer"),
+		LID:       uint16(parseUint(readString(dir, "lid"), 16)),
+		SMLID:     uint16(parseUint(readString(dir, "sm_lid"), 16)),
+		SMSL:      uint8(parseUint(readString(dir, "sm_sl"), 8)),
+		CapMask:   uint32(parseUint(readString(dir, "cap_mask"), 32)),
+	}
+
+	// The first GID of a port is its subnet prefix, followed by its port GUID.
+	if gid := readString(dir, "gids/0"); len(gid) == 39 {
+		port.GIDPrefix, _ = parseGUID(gid[:19])
+		port.PortGUID, _ = parseGUID(gid[20:])
+	}
+
+	return port, nil
+}
+
+// devicePath returns the path of the umad device of the specified port of a local CA.
+func devicePath(caName string, portNum int) (string, error) {
+	entries, err := fs.ReadDir(sysfs, classUmad)
+	if err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "umad") {
+			continue
+		}
+
+		dir := path.Join(classUmad, e.Name())
+
+		if readString(dir, "ibdev") == caName && readString(dir, "port") == strconv.Itoa(portNum) {
+			return "/dev/infiniband/" + e.Name(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no umad device found for %s port %d", caName, portNum)
+}
+
+// readString returns the trimmed contents of a sysfs attribute, or an empty string if it cannot be
+// read, since not every attribute is present for every kind of CA / port.
+func readString(dir, name string) string {
+	b, err := fs.ReadFile(sysfs, path.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// parseGUID parses a GUID in the colon-separated format of sysfs, e.g., "7cfe:9003:00a1:b2c3".
+func parseGUID(s string) (uint64, error) {
+	return strconv.ParseUint(strings.ReplaceAll(s, ":", ""), 16, 64)
+}
+
+// parseEnum parses the numeric value of an enumerated attribute, e.g., "4: ACTIVE".
+func parseEnum(s string) int {
+	n, _, _ := strings.Cut(s, ":")
+	v, _ := strconv.Atoi(n)
+
+	return v
+}
+
+// parseUint parses an attribute in decimal or (0x prefixed) hexadecimal notation, returning zero
+// if the attribute is absent or malformed.
+func parseUint(s string, bitSize int) uint64 {
+	v, _ := strconv.ParseUint(s, 0, bitSize)
+	return v
+}
@@ -0,0 +1,326 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package umad sends and receives MADs via the Linux kernel's user MAD interface (i.e.,
+// /dev/infiniband/umadN devices) in pure Go, without libibumad / libibmad. Since it does not use
+// libc, it does not work under ibsim, whose libumad2sim.so LD_PRELOAD intercepts libc calls.
+package umad
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Size of struct ib_user_mad_hdr, which precedes each MAD read from or written to a umad
+	// device, once P_Key index support has been enabled.
+	hdrSize = 64
+
+	// ioctls of <rdma/ib_user_mad.h>, with the generic Linux ioctl encoding (e.g., x86, ARM).
+	ioctlRegisterAgent   = 0xc01c1b01 // _IOWR(0x1b, 1, struct ib_user_mad_reg_req)
+	ioctlUnregisterAgent = 0x40041b02 // _IOW(0x1b, 2, __u32)
+	ioctlEnablePKey      = 0x1b03     // _IO(0x1b, 3)
+
+	// Defaults of libibmad, if Device.Timeout / Device.Retries are zero.
+	DefaultTimeout = time.Second
+	DefaultRetries = 3
+
+	QKeyGSI = 0x80010000 // well-known Q_Key of the general services interface (QP1)
+)
+
+// ErrClosed is returned for MADs which are outstanding when, or sent after, the device is closed.
+var ErrClosed = errors.New("umad device closed")
+
+// Addr is the destination of a MAD.
+type Addr struct {
+	LID  uint16 // destination LID, or the permissive LID for directed route SMPs
+	SL   uint8
+	QPN  uint32 // 0 for SMPs, 1 for GMPs
+	QKey uint32 // zero for SMPs, QKeyGSI for GMPs
+}
+
+// hdr is struct ib_user_mad_hdr. Fields of the address vector are in network byte order, the
+// others are in host byte order.
+type hdr struct {
+	id        uint32 // agent ID
+	status    uint32 // errno, e.g., ETIMEDOUT if no response was received
+	timeoutMs uint32
+	retries   uint32
+	length    uint32
+	addr      Addr
+	pkeyIndex uint16
+}
+
+func (h *hdr) marshal(b []byte) {
+	binary.NativeEndian.PutUint32(b[0:], h.id)
+	binary.NativeEndian.PutUint32(b[4:], h.status)
+	binary.NativeEndian.PutUint32(b[8:], h.timeoutMs)
+	binary.NativeEndian.PutUint32(b[12:], h.retries)
+	binary.NativeEndian.PutUint32(b[16:], h.length)
+	binary.BigEndian.PutUint32(b[20:], h.addr.QPN)
+	binary.BigEndian.PutUint32(b[24:], h.addr.QKey)
+	binary.BigEndian.PutUint16(b[28:], h.addr.LID)
+	b[30] = h.addr.SL
+	// path_bits, grh_present, gid_index, hop_limit, traffic_class, gid, flow_label unused
+	binary.NativeEndian.PutUint16(b[56:], h.pkeyIndex)
+}
+
+func (h *hdr) unmarshal(b []byte) {
+	h.id = binary.NativeEndian.Uint32(b[0:])
+	h.status = binary.NativeEndian.Uint32(b[4:])
+	h.timeoutMs = binary.NativeEndian.Uint32(b[8:])
+	h.retries = binary.NativeEndian.Uint32(b[12:])
+	h.length = binary.NativeEndian.Uint32(b[16:])
+	h.addr.QPN = binary.BigEndian.Uint32(b[20:])
+	h.addr.QKey = binary.BigEndian.Uint32(b[24:])
+	h.addr.LID = binary.BigEndian.Uint16(b[28:])
+	h.addr.SL = b[30]
+	h.pkeyIndex = binary.NativeEndian.Uint16(b[56:])
+}
+
+// regReq is struct ib_user_mad_reg_req.
+type regReq struct {
+	id               uint32
+	methodMask       [4]uint32
+	qpn              uint8
+	mgmtClass        uint8
+	mgmtClassVersion uint8
+	oui              [3]uint8
+	rmppVersion      uint8
+}
+
+// Device is an open umad device of a local CA port, via which requests are sent, and their
+// responses received, for the management classes registered when opening the device. It is safe
+// for concurrent use.
+type Device struct {
+	Timeout time.Duration // per attempt; zero selects DefaultTimeout
+	Retries int           // zero selects DefaultRetries
+
+	dev    io.ReadWriteCloser
+	agents map[uint8]uint32 // agent IDs, keyed by management class
+	tid    atomic.Uint32
+
+	mu      sync.Mutex
+	pending map[uint32]chan []byte // keyed by the low 32 bits of the transaction ID
+	done    chan struct{}          // closed when the device can no longer be read
+	err     error                  // reason for done
+}
+
+// Open opens the umad device of the specified port of a local CA, and registers an agent for each
+// of the specified management classes (e.g., mad.ClassSubnDirectedRoute), via which requests of
+// that class can be sent.
+func Open(caName string, portNum int, classes ...uint8) (*Device, error) {
+	path, err := devicePath(caName, portNum)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioctl(f, ioctlEnablePKey, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: enable P_Key index: %w", path, err)
+	}
+
+	agents := make(map[uint8]uint32, len(classes))
+
+	for _, class := range classes {
+		req := regReq{mgmtClass: class, mgmtClassVersion: 1, qpn: 1}
+
+		// Subnet management classes use QP0.
+		if class == 0x01 || class == 0x81 {
+			req.qpn = 0
+		}
+
+		if err := ioctl(f, ioctlRegisterAgent, uintptr(unsafe.Pointer(&req))); err != nil {
+			unregisterAgents(f, agents)
+			f.Close()
+			return nil, fmt.Errorf("%s: register agent for class %#02x: %w", path, class, err)
+		}
+
+		agents[class] = req.id
+	}
+
+	return newDevice(f, agents), nil
+}
+
+// newDevice returns a Device which reads / writes MADs via dev, with the specified agents already
+// registered.
+func newDevice(dev io.ReadWriteCloser, agents map[uint8]uint32) *Device {
+	d := &Device{
+		dev:     dev,
+		agents:  agents,
+		pending: make(map[uint32]chan []byte),
+		done:    make(chan struct{}),
+	}
+
+	go d.read()
+
+	return d
+}
+
+// Do sends a request MAD to the destination, and returns the response MAD. The transaction ID of
+// the request is assigned by Do. If no response is received after retries, the returned error
+// wraps syscall.ETIMEDOUT.
+func (d *Device) Do(ctx context.Context, req []byte, addr Addr) ([]byte, error) {
+	if len(req) < 24 {
+		return nil, fmt.Errorf("MAD too short: %d bytes", len(req))
+	}
+
+	agent, ok := d.agents[req[1]]
+	if !ok {
+		return nil, fmt.Errorf("no agent registered for class %#02x", req[1])
+	}
+
+	timeout, retries := d.Timeout, d.Retries
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	if retries <= 0 {
+		retries = DefaultRetries
+	}
+
+	// The kernel replaces the high 32 bits of the transaction ID with those of the agent.
+	tid := d.tid.Add(1)
+
+	buf := make([]byte, hdrSize+len(req))
+	h := hdr{
+		id:        agent,
+		timeoutMs: uint32(timeout.Milliseconds()),
+		retries:   uint32(retries),
+		length:    uint32(len(req)),
+		addr:      addr,
+	}
+	h.marshal(buf)
+	copy(buf[hdrSize:], req)
+	binary.BigEndian.PutUint32(buf[hdrSize+12:], tid)
+
+	ch := make(chan []byte, 1)
+
+	d.mu.Lock()
+	if d.err != nil {
+		d.mu.Unlock()
+		return nil, d.err
+	}
+	d.pending[tid] = ch
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+	}()
+
+	if _, err := d.dev.Write(buf); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		var rh hdr
+		rh.unmarshal(resp)
+
+		if rh.status != 0 {
+			return nil, fmt.Errorf("MAD to LID %d: %w", addr.LID, syscall.Errno(rh.status))
+		}
+
+		return resp[hdrSize:], nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.done:
+		return nil, d.err
+	}
+}
+
+// read reads MADs from the device, and dispatches them to the outstanding requests with matching
+// transaction IDs. Unmatched MADs (e.g., responses arriving after their request was abandoned) are
+// discarded.
+func (d *Device) read() {
+	for {
+		buf := make([]byte, hdrSize+256)
+
+		n, err := d.dev.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				err = ErrClosed
+			}
+
+			d.mu.Lock()
+			d.err = err
+			d.mu.Unlock()
+			close(d.done)
+
+			return
+		}
+
+		if n < hdrSize+24 {
+			continue
+		}
+
+		tid := binary.BigEndian.Uint32(buf[hdrSize+12:])
+
+		d.mu.Lock()
+		ch := d.pending[tid]
+		delete(d.pending, tid)
+		d.mu.Unlock()
+
+		if ch != nil {
+			ch <- buf[:n]
+		}
+	}
+}
+
+// Close unregisters the agents and closes the device. Outstanding requests fail with ErrClosed.
+func (d *Device) Close() error {
+	if f, ok := d.dev.(*os.File); ok {
+		unregisterAgents(f, d.agents)
+	}
+
+	err := d.dev.Close()
+	<-d.done
+
+	return err
+}
+
+func unregisterAgents(f *os.File, agents map[uint8]uint32) {
+	for _, id := range agents {
+		id := id
+		ioctl(f, ioctlUnregisterAgent, uintptr(unsafe.Pointer(&id)))
+	}
+}
+
+func ioctl(f *os.File, req, arg uintptr) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, req, arg)
+	}); err != nil {
+		return err
+	}
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package umad
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+func TestGetCAs(t *testing.T) {
+	defer func(orig fs.FS) { sysfs = orig }(sysfs)
+
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s + "\n")} }
+
+	sysfs = fstest.MapFS{
+		"class/infiniband/mlx5_0/node_type":          file("1: CA"),
+		"class/infiniband/mlx5_0/node_guid":          file("7cfe:9003:00a1:b2c4"),
+		"class/infiniband/mlx5_0/sys_image_guid":     file("7cfe:9003:00a1:b2c4"),
+		"class/infiniband/mlx5_0/fw_ver":             file("16.35.2000"),
+		"class/infiniband/mlx5_0/hw_rev":             file("0x0"),
+		"class/infiniband/mlx5_0/ports/1/state":      file("4: ACTIVE"),
+		"class/infiniband/mlx5_0/ports/1/phys_state": file("5: LinkUp"),
+		"class/infiniband/mlx5_0/ports/1/link_layer": file("InfiniBand"),
+		"class/infiniband/mlx5_0/ports/1/lid":        file("0x5"),
+		"class/infiniband/mlx5_0/ports/1/sm_lid":     file("0x1"),
+		"class/infiniband/mlx5_0/ports/1/sm_sl":      file("0"),
+		"class/infiniband/mlx5_0/ports/1/cap_mask":   file("0xa651e848"),
+		"class/infiniband/mlx5_0/ports/1/gids/0":     file("fe80:0000:0000:0000:7cfe:9003:00a1:b2c4"),
+		"class/infiniband/mlx5_0/ports/2/state":      file("1: DOWN"),
+		"class/infiniband/mlx5_0/ports/2/phys_state": file("3: Disabled"),
+		"class/infiniband/mlx5_0/ports/2/link_layer": file("Ethernet"),
+		"class/infiniband_mad/abi_version":           file("5"),
+		"class/infiniband_mad/umad0/ibdev":           file("mlx5_0"),
+		"class/infiniband_mad/umad0/port":            file("1"),
+		"class/infiniband_mad/umad1/ibdev":           file("mlx5_0"),
+		"class/infiniband_mad/umad1/port":            file("2"),
+	}
+
+	cas, err := GetCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []CA{{
+		Name:       "mlx5_0",
+		Type:       "1: CA",
+		NodeGUID:   0x7cfe900300a1b2c4,
+		SystemGUID: 0x7cfe900300a1b2c4,
+		FWVersion:  "16.35.2000",
+		HWVersion:  "0x0",
+		Ports: []Port{
+			{
+				Num: 1, State: 4, PhysState: 5, LinkLayer: "InfiniBand", LID: 5, SMLID: 1,
+				CapMask: 0xa651e848, GIDPrefix: 0xfe80000000000000, PortGUID: 0x7cfe900300a1b2c4,
+			},
+			{Num: 2, State: 1, PhysState: 3, LinkLayer: "Ethernet"},
+		},
+	}}
+
+	if !reflect.DeepEqual(cas, want) {
+		t.Fatalf("got %+v\nwant %+v", cas, want)
+	}
+
+	if path, err := devicePath("mlx5_0", 2); err != nil || path != "/dev/infiniband/umad1" {
+		t.Fatalf("got %q, %v", path, err)
+	}
+
+	if _, err := devicePath("mlx5_1", 1); err == nil {
+		t.Fatal("no error for nonexistent CA")
+	}
+}
+
+// fakeDevice responds to each MAD written to it by returning it as a GetResp, or with status
+// ETIMEDOUT if it is addressed to LID 0xdead.
+type fakeDevice struct {
+	mu     sync.Mutex
+	closed bool
+	resp   chan []byte
+}
+
+func (f *fakeDevice) Write(b []byte) (int, error) {
+	var h hdr
+	h.unmarshal(b)
+
+	resp := append([]byte(nil), b...)
+
+	if h.addr.LID == 0xdead {
+		h.status = uint32(syscall.ETIMEDOUT)
+	} else {
+		resp[hdrSize+3] = 0x81 // GetResp
+	}
+
+	h.marshal(resp)
+
+	go func() { f.resp <- resp }()
+
+	return len(b), nil
+}
+
+func (f *fakeDevice) Read(b []byte) (int, error) {
+	resp, ok := <-f.resp
+	if !ok {
+		return 0, io.ErrClosedPipe
+	}
+
+	return copy(b, resp), nil
+}
+
+func (f *fakeDevice) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.closed {
+		f.closed = true
+		close(f.resp)
+	}
+
+	return nil
+}
+
+func TestDeviceDo(t *testing.T) {
+	d := newDevice(&fakeDevice{resp: make(chan []byte)}, map[uint8]uint32{0x81: 7})
+
+	req := make([]byte, 256)
+	req[1] = 0x81 // directed route SMP
+	req[3] = 0x01 // Get
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			resp, err := d.Do(context.Background(), req, Addr{LID: 0xffff})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if len(resp) != 256 || resp[3] != 0x81 {
+				t.Errorf("unexpected response: %x", resp[:24])
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if _, err := d.Do(context.Background(), req, Addr{LID: 0xdead}); !errors.Is(err, syscall.ETIMEDOUT) {
+		t.Fatalf("got %v, want ETIMEDOUT", err)
+	}
+
+	req[1] = 0x04 // PerfMgt, for which no agent is registered
+	if _, err := d.Do(context.Background(), req, Addr{LID: 1, QPN: 1, QKey: QKeyGSI}); err == nil {
+		t.Fatal("no error for unregistered class")
+	}
+
+	d.Close()
+
+	req[1] = 0x81
+	if _, err := d.Do(context.Background(), req, Addr{LID: 0xffff}); err == nil {
+		t.Fatal("no error after close")
+	}
+}
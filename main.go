@@ -10,10 +10,15 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -21,26 +26,89 @@ import (
 
 	"github.com/dswarbrick/fabricmon/config"
 	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/diags"
+	"github.com/dswarbrick/fabricmon/infiniband/ibsim"
+	"github.com/dswarbrick/fabricmon/infiniband/snapshot"
+	"github.com/dswarbrick/fabricmon/infiniband/synth"
+	"github.com/dswarbrick/fabricmon/scheduler"
+	"github.com/dswarbrick/fabricmon/status"
+	"github.com/dswarbrick/fabricmon/systemd"
 	"github.com/dswarbrick/fabricmon/version"
 	"github.com/dswarbrick/fabricmon/writer"
 	"github.com/dswarbrick/fabricmon/writer/forcegraph"
+	"github.com/dswarbrick/fabricmon/writer/graphml"
+	"github.com/dswarbrick/fabricmon/writer/graphviz"
+	"github.com/dswarbrick/fabricmon/writer/ibsimnet"
 	"github.com/dswarbrick/fabricmon/writer/influxdb"
+	nodenamemapwriter "github.com/dswarbrick/fabricmon/writer/nodenamemap"
+	"github.com/dswarbrick/fabricmon/writer/prometheus"
+	snapshotwriter "github.com/dswarbrick/fabricmon/writer/snapshot"
 )
 
 // router duplicates a Fabric struct received via channel and outputs it to multiple receiver
-// channels.
-func router(input chan infiniband.Fabric, writers []writer.FabricWriter) {
-	outputs := make([]chan infiniband.Fabric, len(writers))
+// channels. Writers are keyed by a string describing their configuration. A new set of writers may
+// be sent via the updates channel, whereupon writers whose key is absent from the new set are
+// stopped, and writers with new keys are started. Writers with unchanged keys continue to run,
+// retaining any state. The router returns once the input channel has been closed and all writers
+// have returned.
+func router(input chan infiniband.Fabric, writers map[string]writer.FabricWriter, updates chan map[string]writer.FabricWriter) {
+	var wg sync.WaitGroup
 
-	// Create output channels for workers, and start worker goroutine
-	for i, w := range writers {
-		outputs[i] = make(chan infiniband.Fabric)
-		go w.Receiver(outputs[i])
+	outputs := make(map[string]chan infiniband.Fabric)
+
+	// Create output channels for workers, and start worker goroutines
+	start := func(writers map[string]writer.FabricWriter) {
+		for key, w := range writers {
+			if _, ok := outputs[key]; ok {
+				continue
+			}
+
+			c := make(chan infiniband.Fabric)
+			outputs[key] = c
+
+			// Record the writer's stats under its key, and forget them once it has stopped.
+			if n, ok := w.(interface{ SetName(string) }); ok {
+				n.SetName(key)
+			}
+
+			wg.Add(1)
+			go func(key string, w writer.FabricWriter) {
+				defer wg.Done()
+				defer writer.DeleteStats(key)
+				w.Receiver(c)
+			}(key, w)
+		}
 	}
 
-	for fabric := range input {
-		for _, c := range outputs {
-			c <- fabric
+	start(writers)
+
+Loop:
+	for {
+		select {
+		case fabric, ok := <-input:
+			if !ok {
+				break Loop
+			}
+
+			for _, c := range outputs {
+				c <- fabric
+			}
+		case writers := <-updates:
+			var stopped int
+
+			for key, c := range outputs {
+				if _, ok := writers[key]; !ok {
+					close(c)
+					delete(outputs, key)
+					stopped++
+				}
+			}
+
+			started := len(outputs)
+			start(writers)
+
+			slog.Info("writers updated",
+				"started", len(outputs)-started, "stopped", stopped, "total", len(outputs))
 		}
 	}
 
@@ -49,16 +117,452 @@ func router(input chan infiniband.Fabric, writers []writer.FabricWriter) {
 		close(c)
 	}
 
+	wg.Wait()
+
 	slog.Debug("Router input channel closed. Exiting function.")
 }
 
+// topologyWriters returns a writer for each of the specified topology formats.
+func topologyWriters(formats []string, outputDir string) map[string]writer.FabricWriter {
+	writers := make(map[string]writer.FabricWriter, len(formats))
+
+	for _, f := range formats {
+		key := fmt.Sprintf("topology %s %s", f, outputDir)
+
+		switch f {
+		case "json":
+			writers[key] = &forcegraph.ForceGraphWriter{OutputDir: outputDir}
+		case "dot":
+			writers[key] = &graphviz.GraphvizWriter{OutputDir: outputDir}
+		case "graphml":
+			writers[key] = &graphml.GraphMLWriter{OutputDir: outputDir}
+		case "ibsim":
+			writers[key] = &ibsimnet.IbsimNetWriter{OutputDir: outputDir}
+		}
+	}
+
+	return writers
+}
+
+// configureWriters returns the writers enabled in the config, keyed by their configuration.
+func configureWriters(conf *config.FabricmonConf) map[string]writer.FabricWriter {
+	writers := make(map[string]writer.FabricWriter)
+
+	if conf.Topology.Enabled {
+		for key, w := range topologyWriters(conf.Topology.Formats, conf.Topology.OutputDir) {
+			writers[key] = w
+		}
+	}
+
+	if conf.Textfile.Enabled {
+		writers["textfile "+conf.Textfile.OutputDir] = &prometheus.TextfileWriter{OutputDir: conf.Textfile.OutputDir}
+	}
+
+	if conf.Snapshot.Enabled {
+		writers["snapshot "+conf.Snapshot.OutputDir] = &snapshotwriter.SnapshotWriter{OutputDir: conf.Snapshot.OutputDir}
+	}
+
+	if conf.NodeNameMapWriter.Enabled {
+		writers["nodenamemap "+conf.NodeNameMapWriter.File] = &nodenamemapwriter.NodeNameMapWriter{
+			File:      conf.NodeNameMapWriter.File,
+			Templates: nameTemplates(conf),
+		}
+	}
+
+	for _, c := range conf.InfluxDB {
+		writers[influxDBKey(c)] = influxdb.NewInfluxDBWriter(c)
+	}
+
+	return writers
+}
+
+// influxDBKey returns the key of an InfluxDB writer, which identifies its configuration without
+// revealing its password. Since the key includes a hash of the password, changing the password
+// restarts the writer.
+func influxDBKey(c config.InfluxDBConf) string {
+	key := fmt.Sprintf("influxdb %s db=%s user=%s rp=%s timeout=%s", c.URL, c.Database, c.Username, c.RetentionPolicy, c.Timeout)
+
+	if c.Password != "" {
+		sum := sha256.Sum256([]byte(c.Password))
+		key += fmt.Sprintf(" password=%x", sum[:4])
+	}
+
+	return key
+}
+
+// reloadConfig reads and validates the config file. If it is invalid, the error is logged and nil
+// is returned, so that the daemon continues with its current config.
+func reloadConfig(path string, logLevel *slog.LevelVar) *config.FabricmonConf {
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Error("cannot reload config", "err", err)
+		return nil
+	}
+
+	defer f.Close()
+
+	conf, err := config.ReadConfig(f)
+	if err != nil {
+		slog.Error("invalid config, keeping current config", "err", err)
+		return nil
+	}
+
+	logLevel.Set(conf.Logging.LogLevel)
+
+	return conf
+}
+
+// checkSourcePorts warns about configured source ports which do not exist, since they would silently
+// never be swept from.
+func checkSourcePorts(hcas []infiniband.HCA, conf *config.FabricmonConf) {
+	for _, p := range conf.Discovery.Ports {
+		found := false
+
+		for _, hca := range hcas {
+			if hca.Name == p.CA && (p.Port == 0 || slices.Contains(hca.Ports(), p.Port)) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			slog.Warn("discovery port not found", "port", p.String())
+		}
+	}
+}
+
+// nodeNameMap loads the configured node name maps, if any. Sources which cannot be read are logged
+// and skipped, since remapping node descriptions is not essential.
+func nodeNameMap(conf *config.FabricmonConf) *infiniband.NodeNameMap {
+	if len(conf.NodeNameMaps) == 0 {
+		return nil
+	}
+
+	m, err := infiniband.LoadNodeNameMap(infiniband.NodeNameMapConfig{
+		Sources: conf.NodeNameMaps,
+		Refresh: conf.NodeNameMapRefresh,
+		Logger:  slog.Default(),
+	})
+	if err != nil {
+		slog.Warn("cannot load node name map", "err", err)
+	}
+
+	return m
+}
+
+// nameTemplates returns the configured naming templates of the node name map writer, or the default
+// templates if none are configured. The templates have already been validated with the config.
+func nameTemplates(conf *config.FabricmonConf) infiniband.NameTemplates {
+	templates := conf.NodeNameMapWriter.Templates
+	if len(templates) == 0 {
+		templates = infiniband.DefaultNameTemplates
+	}
+
+	tmpl, err := infiniband.ParseNameTemplates(templates)
+	if err != nil {
+		slog.Error("invalid node name templates", "err", err)
+	}
+
+	return tmpl
+}
+
+// syntheticSource returns a source of a synthetic fabric of the specified topology.
+func syntheticSource(topology string) (infiniband.Source, error) {
+	spec, err := synth.ParseSpec(topology)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := synth.NewSource(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("generated synthetic fabric", "topology", spec.String())
+
+	return src, nil
+}
+
+// sweepContext returns a context for a sweep, which expires after the configured sweep timeout.
+func sweepContext(ctx context.Context, conf *config.FabricmonConf) (context.Context, context.CancelFunc) {
+	if conf.SweepTimeout > 0 {
+		return context.WithTimeout(ctx, conf.SweepTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// sweepConfig returns the sweep parameters of the config, with the specified counter reset
+// threshold. Each call returns a new query limiter, which limits the queries in flight of the
+// concurrent sweeps of all ports by a single Sweep. Since the daemon never runs sweeps
+// concurrently, this also limits the queries in flight of the daemon.
+func sweepConfig(conf *config.FabricmonConf, resetThreshold uint) infiniband.SweepConfig {
+	cfg := infiniband.SweepConfig{
+		Mkey:           conf.Mkey,
+		ResetThreshold: resetThreshold,
+		Workers:        conf.Collector.Workers,
+		Limiter:        infiniband.NewQueryLimiter(conf.Collector.MaxInFlight),
+		MaxHops:        conf.Discovery.MaxHops,
+		MaxSMPs:        conf.Discovery.MaxSMPs,
+		MlxEPI:         conf.Discovery.MlxEPI,
+		Timeout:        conf.Discovery.Timeout,
+		Retries:        conf.Discovery.Retries,
+	}
+
+	for _, p := range conf.Discovery.Ports {
+		cfg.Ports = append(cfg.Ports, infiniband.SourcePort{CA: p.CA, Port: p.Port, Mkey: p.Mkey})
+	}
+
+	return cfg
+}
+
+// discover sweeps all fabrics of the source, sending them to output, and records any discovery
+// failures in the tracker, returning the error of the sweep. Unless rediscover is true, only
+// counters are collected, reusing the topology of the previous sweep.
+func discover(ctx context.Context, src infiniband.Source, output chan infiniband.Fabric, conf *config.FabricmonConf, tracker *status.Tracker, rediscover bool) error {
+	ctx, cancel := sweepContext(ctx, conf)
+	defer cancel()
+
+	err := src.Sweep(ctx, output, sweepConfig(conf, conf.ResetThreshold), rediscover)
+	if err == nil {
+		return nil
+	}
+
+	// The error joins an error for each HCA port via which a subnet could not be swept.
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+
+	for _, err := range errs {
+		var serr *infiniband.SweepError
+		if errors.As(err, &serr) {
+			tracker.DiscoveryFailed(serr.CAName, err)
+		}
+	}
+
+	return err
+}
+
+// schedules returns the schedules of topology discovery and counter collection.
+func schedules(conf *config.FabricmonConf) (scheduler.Schedule, scheduler.Schedule) {
+	topology := scheduler.Schedule{Interval: conf.TopologyInterval(), Jitter: conf.PollJitter}
+	counters := scheduler.Schedule{Interval: conf.PollInterval, Jitter: conf.PollJitter}
+
+	if conf.MaxPollInterval != 0 {
+		topology.MaxInterval = max(conf.MaxPollInterval, topology.Interval)
+		counters.MaxInterval = conf.MaxPollInterval
+	}
+
+	return topology, counters
+}
+
+// serveStatus serves the status endpoint until the context is cancelled.
+func serveStatus(ctx context.Context, addr string, tracker *status.Tracker) {
+	mux := http.NewServeMux()
+	mux.Handle("/status", tracker)
+	mux.Handle("/healthz", tracker.HealthHandler(false))
+	mux.Handle("/readyz", tracker.HealthHandler(true))
+
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("serving status endpoint", "address", addr)
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("status endpoint failed", "err", err)
+	}
+}
+
+// notify sends a state notification to systemd, if running as a systemd notify service.
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		slog.Warn("cannot notify systemd", "state", state, "err", err)
+	}
+}
+
+// maxSweepAge returns the maximum age of the last successful sweep before FabricMon is considered
+// unhealthy.
+func maxSweepAge(conf *config.FabricmonConf) time.Duration {
+	return time.Duration(conf.Status.MaxSweepAge) * conf.PollInterval
+}
+
+// runDaemon runs the FabricMon daemon, which sweeps all fabrics of the source every poll interval and sends the
+// discovered fabrics to the configured writers, until it receives SIGINT or SIGTERM. The topology is
+// rediscovered every topology interval, and reused for collecting counters in between. Upon SIGHUP,
+// the config file is reloaded, and changes are applied without restarting the daemon. A sweep in
+// progress is cancelled when the context is cancelled.
+func runDaemon(ctx context.Context, src infiniband.Source, conf *config.FabricmonConf, configPath string, logLevel *slog.LevelVar, daemonize bool) {
+	tracker := status.NewTracker()
+	tracker.SetMaxSweepAge(maxSweepAge(conf))
+
+	if !daemonize {
+		discover(ctx, src, nil, conf, tracker, true)
+		return
+	}
+
+	// The status endpoint's listen address cannot be changed by reloading the config.
+	if conf.Status.ListenAddress != "" {
+		go serveStatus(ctx, conf.Status.ListenAddress, tracker)
+	}
+
+	// The watchdog is kicked by the polling loop, which is blocked while a sweep runs, so that it
+	// expires if a sweep hangs (e.g., in a cgo call).
+	var watchdog <-chan time.Time
+
+	if wd := systemd.WatchdogInterval(); wd > 0 {
+		ticker := time.NewTicker(wd / 2)
+		defer ticker.Stop()
+
+		watchdog = ticker.C
+	}
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, unix.SIGHUP)
+
+	splitter := make(chan infiniband.Fabric)
+	updates := make(chan map[string]writer.FabricWriter)
+	routerDone := make(chan struct{})
+
+	// The tracker is not configurable, and is always kept across config reloads.
+	writers := configureWriters(conf)
+	writers["status"] = tracker
+
+	go func() {
+		router(splitter, writers, updates)
+		close(routerDone)
+	}()
+
+	topologySchedule, countersSchedule := schedules(conf)
+
+	// Error of the last sweep, and whether readiness has been signalled.
+	var (
+		sweepErr error
+		ready    bool
+	)
+
+	// Topology discovery takes precedence, since it also collects counters.
+	sched := scheduler.New(
+		&scheduler.Job{
+			Name:     "topology",
+			Schedule: topologySchedule,
+			Run:      func() { sweepErr = discover(ctx, src, splitter, conf, tracker, true) },
+		},
+		&scheduler.Job{
+			Name:     "counters",
+			Schedule: countersSchedule,
+			Run:      func() { sweepErr = discover(ctx, src, splitter, conf, tracker, false) },
+		},
+	)
+	sched.OnMissed = tracker.IntervalsMissed
+
+	// Readiness is only signalled once a sweep has succeeded, so that systemd fails the start of
+	// a daemon which cannot sweep (after TimeoutStartSec), rather than deeming it ready.
+	runDue := func() {
+		sched.RunDue()
+
+		if !ready && sweepErr == nil {
+			notify(systemd.Ready)
+			ready = true
+		}
+	}
+
+	// First sweep.
+	runDue()
+
+Loop:
+	// Loop indefinitely, running sweeps when they are due.
+	for {
+		select {
+		case <-time.After(time.Until(sched.Next())):
+			runDue()
+		case <-watchdog:
+			notify(systemd.Watchdog)
+		case <-hupChan:
+			slog.Info("reloading config", "config", configPath)
+
+			newConf := reloadConfig(configPath, logLevel)
+			if newConf == nil {
+				continue
+			}
+
+			if client, ok := src.(*infiniband.Client); ok {
+				checkSourcePorts(client.HCAs(), newConf)
+
+				if !slices.Equal(newConf.NodeNameMaps, conf.NodeNameMaps) || newConf.NodeNameMapRefresh != conf.NodeNameMapRefresh {
+					client.SetNodeNameMap(nodeNameMap(newConf)).Close()
+				}
+			}
+
+			topologySchedule, countersSchedule := schedules(newConf)
+			sched.SetSchedule("topology", topologySchedule)
+			sched.SetSchedule("counters", countersSchedule)
+
+			tracker.SetMaxSweepAge(maxSweepAge(newConf))
+
+			writers := configureWriters(newConf)
+			writers["status"] = tracker
+
+			updates <- writers
+			conf = newConf
+		case <-ctx.Done():
+			slog.Debug("shutdown received in polling loop")
+			break Loop
+		}
+	}
+
+	notify(systemd.Stopping)
+
+	close(splitter)
+	<-routerDone
+}
+
 func main() {
 	var (
 		configFile = kingpin.Flag("config", "Path to config file.").Default("fabricmon.yml").File()
 		daemonize  = kingpin.Flag("daemonize", "Run forever, fetching counters periodically.").Default("true").Bool()
+		output     = kingpin.Flag("output", "Output format of run-once commands.").Short('o').Default("table").Enum("table", "json", "yaml")
+		synthetic  = kingpin.Flag("synthetic", "Generate a synthetic fabric of the specified topology (e.g. fattree:k=4), instead of sweeping local HCAs.").String()
+		ibsimNet   = kingpin.Flag("ibsim-net", "Read the fabric from the specified ibsim network file, instead of sweeping local HCAs.").String()
+		ibnetdisc  = kingpin.Flag("ibnetdiscover", "Read the fabric from the specified ibnetdiscover output, instead of sweeping local HCAs.").String()
+		perfquery  = kingpin.Flag("perfquery", "Read the counters of the --ibnetdiscover fabric from the specified perfquery (-x) output (repeatable).").Strings()
+
+		daemonCmd = kingpin.Command("daemon", "Run the FabricMon daemon (default).").Default()
+
+		discoverCmd = kingpin.Command("discover", "Perform a single sweep and print the fabric topology.")
+
+		nodesCmd = kingpin.Command("nodes", "Perform a single sweep and print the nodes in the fabric.")
+
+		countersCmd  = kingpin.Command("counters", "Query the counters of a node's port(s). Counters are never reset.")
+		countersGUID = countersCmd.Flag("guid", "GUID of node to query.").Required().String()
+		countersPort = countersCmd.Flag("port", "Port number to query (default: all ports).").Default("-1").Int()
+
+		sminfoCmd = kingpin.Command("sminfo", "Query the subnet manager of each fabric.")
+
+		collectCmd    = kingpin.Command("collect", "Perform a single sweep and print all counters, e.g. for a Telegraf exec input.")
+		collectFormat = collectCmd.Flag("format", "Metrics format: InfluxDB line protocol, or Prometheus text exposition format.").Default("influx").Enum("influx", "prometheus")
+
+		exportCmd    = kingpin.Command("export", "Perform a single sweep and write the fabric topology to a file.")
+		exportFormat = exportCmd.Flag("format", "Topology file format.").Default("dot").Enum("json", "dot", "graphml", "ibsim")
+		exportDir    = exportCmd.Flag("dir", "Output directory.").Default(".").ExistingDir()
+
+		replayCmd   = kingpin.Command("replay", "Replay a snapshot file to the configured writers.")
+		replayFile  = replayCmd.Arg("file", "Snapshot file.").Required().ExistingFile()
+		replaySpeed = replayCmd.Flag("speed", "Replay speed, relative to the original (0: as fast as possible).").Default("1").Float64()
+
+		nodeNameMapCmd   = kingpin.Command("node-name-map", "Perform a single sweep and add entries for new nodes to a node name map, named by the configured templates.")
+		nodeNameMapFile  = nodeNameMapCmd.Flag("file", "Node name map file (default: node_name_map_writer.file).").String()
+		nodeNameMapWrite = nodeNameMapCmd.Flag("write", "Update the file, instead of printing the updated map.").Bool()
+
+		configCmd      = kingpin.Command("config", "Configuration commands.")
+		configCheckCmd = configCmd.Command("check", "Validate the config and print the effective configuration, with secrets redacted.")
 	)
 
-	kingpin.Parse()
+	cmd := kingpin.Parse()
 
 	conf, err := config.ReadConfig(*configFile)
 	if err != nil {
@@ -67,23 +571,94 @@ func main() {
 	}
 	(*configFile).Close()
 
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: conf.Logging.LogLevel})))
+	if *synthetic != "" {
+		conf.Source = config.SourceConf{Type: "synthetic", Synthetic: *synthetic}
+	} else if *ibsimNet != "" {
+		conf.Source = config.SourceConf{Type: "ibsim", File: *ibsimNet}
+	} else if *ibnetdisc != "" {
+		conf.Source = config.SourceConf{Type: "ibnetdiscover", File: *ibnetdisc, Counters: *perfquery}
+	}
 
-	// Initialise umad library (also required in order to run under ibsim).
-	if infiniband.UmadInit() < 0 {
-		slog.Error("Error initialising umad library. Exiting.")
-		os.Exit(1)
+	if cmd == configCheckCmd.FullCommand() {
+		if err := config.WriteRedacted(os.Stdout, conf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// Run-once commands log to stderr, to avoid interfering with their output.
+	logOutput := os.Stderr
+	if cmd == daemonCmd.FullCommand() {
+		logOutput = os.Stdout
 	}
 
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(conf.Logging.LogLevel)
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: logLevel})))
+
 	slog.Info("FabricMon " + version.Info())
-	hcas := infiniband.GetCAs()
 
-	if len(hcas) == 0 {
-		slog.Error("No HCAs found in system. Exiting.")
+	var (
+		src  infiniband.Source
+		hcas []infiniband.HCA
+	)
+
+	if conf.Source.Type != "hca" && (cmd == countersCmd.FullCommand() || cmd == sminfoCmd.FullCommand()) {
+		slog.Error("Command requires local HCAs, and cannot be used with a " + conf.Source.Type + " fabric. Exiting.")
 		os.Exit(1)
 	}
 
+	switch {
+	case cmd == replayCmd.FullCommand():
+		// Replays do not depend on the configured source.
+		if src, err = snapshot.NewReplay(*replayFile, *replaySpeed); err != nil {
+			slog.Error("Cannot read snapshot file. Exiting.", "err", err)
+			os.Exit(1)
+		}
+	case conf.Source.Type == "synthetic":
+		if src, err = syntheticSource(conf.Source.Synthetic); err != nil {
+			slog.Error("Cannot generate synthetic fabric. Exiting.", "err", err)
+			os.Exit(1)
+		}
+	case conf.Source.Type == "ibsim":
+		if src, err = ibsim.NewSource(conf.Source.File); err != nil {
+			slog.Error("Cannot read ibsim network file. Exiting.", "err", err)
+			os.Exit(1)
+		}
+	case conf.Source.Type == "ibnetdiscover":
+		if src, err = diags.NewSource(conf.Source.File, conf.Source.Counters); err != nil {
+			slog.Error("Cannot read ibnetdiscover output. Exiting.", "err", err)
+			os.Exit(1)
+		}
+	default:
+		// Initialise umad library (also required in order to run under ibsim).
+		if infiniband.UmadInit() < 0 {
+			slog.Error("Error initialising umad library. Exiting.")
+			os.Exit(1)
+		}
+
+		hcas = infiniband.GetCAs(slog.Default())
+
+		if len(hcas) == 0 {
+			slog.Error("No HCAs found in system. Exiting.")
+			os.Exit(1)
+		}
+
+		checkSourcePorts(hcas, conf)
+
+		client := infiniband.NewClient(hcas,
+			infiniband.WithNodeNameMap(nodeNameMap(conf)),
+			infiniband.WithLogger(slog.Default()),
+		)
+
+		src = client
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Setup signal handler to catch SIGINT, SIGTERM.
 	sigChan := make(chan os.Signal, 1)
@@ -94,54 +669,47 @@ func main() {
 		cancel()
 	}()
 
-	// Initialize empty slice to hold writers
-	writers := make([]writer.FabricWriter, 0)
-
-	if conf.Topology.Enabled {
-		writers = append(writers, &forcegraph.ForceGraphWriter{OutputDir: conf.Topology.OutputDir})
+	switch cmd {
+	case daemonCmd.FullCommand():
+		runDaemon(ctx, src, conf, (*configFile).Name(), logLevel, *daemonize)
+	case discoverCmd.FullCommand():
+		fabrics, serr := sweep(ctx, src, conf, inspectThreshold)
+		err = errors.Join(printFabrics(os.Stdout, *output, fabrics), serr)
+	case nodesCmd.FullCommand():
+		fabrics, serr := sweep(ctx, src, conf, inspectThreshold)
+		err = errors.Join(printNodes(os.Stdout, *output, fabrics), serr)
+	case countersCmd.FullCommand():
+		err = printCounters(os.Stdout, *output, hcas, conf, *countersGUID, *countersPort)
+	case sminfoCmd.FullCommand():
+		err = printSMInfo(os.Stdout, *output, hcas)
+	case collectCmd.FullCommand():
+		err = printMetrics(ctx, os.Stdout, *collectFormat, src, conf)
+	case exportCmd.FullCommand():
+		err = exportTopology(ctx, src, conf, *exportFormat, *exportDir)
+	case replayCmd.FullCommand():
+		err = replay(ctx, src, conf)
+	case nodeNameMapCmd.FullCommand():
+		err = updateNodeNameMap(ctx, os.Stdout, src, conf, *nodeNameMapFile, *nodeNameMapWrite)
 	}
 
-	// First sweep.
-	for _, hca := range hcas {
-		hca.NetDiscover(nil, conf.Mkey, conf.ResetThreshold)
+	if err != nil {
+		slog.Error(err.Error())
 	}
 
-	if *daemonize {
-		for _, c := range conf.InfluxDB {
-			w := influxdb.NewInfluxDBWriter(c)
-			writers = append(writers, w)
-		}
-
-		// FIXME: Move this outside of daemonize if-block
-		splitter := make(chan infiniband.Fabric)
-		go router(splitter, writers)
-
-		ticker := time.NewTicker(time.Duration(conf.PollInterval))
-		defer ticker.Stop()
-
-	Loop:
-		// Loop indefinitely, scanning fabrics every tick.
-		for {
-			select {
-			case <-ticker.C:
-				for _, hca := range hcas {
-					hca.NetDiscover(splitter, conf.Mkey, conf.ResetThreshold)
-				}
-			case <-ctx.Done():
-				slog.Debug("shutdown received in polling loop")
-				break Loop
-			}
-		}
+	slog.Debug("cleaning up")
 
-		close(splitter)
+	if client, ok := src.(*infiniband.Client); ok {
+		client.NodeNameMap().Close()
 	}
 
-	slog.Debug("cleaning up")
-
 	// Free associated memory from pointers in umad_ca_t.ports
 	for _, hca := range hcas {
 		hca.Release()
 	}
 
 	infiniband.UmadDone()
+
+	if err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,225 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/config"
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/fake"
+	"github.com/dswarbrick/fabricmon/status"
+	"github.com/dswarbrick/fabricmon/systemd"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+// countingWriter counts the fabrics it receives, recording a successful write for each.
+type countingWriter struct {
+	writer.Recorder
+
+	mu       sync.Mutex
+	received int
+}
+
+func (w *countingWriter) Receiver(input chan infiniband.Fabric) {
+	for range input {
+		w.mu.Lock()
+		w.received++
+		w.mu.Unlock()
+
+		w.Record("counting", nil)
+	}
+}
+
+// waitForStats waits until the names of the writers with stats are exactly names.
+func waitForStats(t *testing.T, names ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		stats := writer.WriterStats()
+
+		ok := len(stats) == len(names)
+		for _, name := range names {
+			if _, found := stats[name]; !found {
+				ok = false
+			}
+		}
+
+		if ok {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected stats of writers %q, got %v", names, stats)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRouterUpdates(t *testing.T) {
+	a, b, c := &countingWriter{}, &countingWriter{}, &countingWriter{}
+
+	input := make(chan infiniband.Fabric)
+	updates := make(chan map[string]writer.FabricWriter)
+	done := make(chan struct{})
+
+	go func() {
+		router(input, map[string]writer.FabricWriter{"a": a, "b": b}, updates)
+		close(done)
+	}()
+
+	input <- infiniband.Fabric{}
+	waitForStats(t, "a", "b")
+
+	// Replace writer b with c. Writer a is unchanged, and must not be restarted (the instance
+	// passed in the update is ignored).
+	updates <- map[string]writer.FabricWriter{"a": &countingWriter{}, "c": c}
+
+	input <- infiniband.Fabric{}
+
+	// The stats of writers are recorded under their key, and are dropped once they stop.
+	waitForStats(t, "a", "c")
+
+	close(input)
+	<-done
+
+	if a.received != 2 || b.received != 1 || c.received != 1 {
+		t.Fatalf("unexpected fabrics received: a=%d, b=%d, c=%d", a.received, b.received, c.received)
+	}
+
+	waitForStats(t)
+}
+
+func TestDiscover(t *testing.T) {
+	var (
+		a = &fake.Fabric{CAName: "mlx5_0", SourcePort: 1, Nodes: []infiniband.Node{fake.Switch(1, "a", 2)}}
+		b = &fake.Fabric{CAName: "mlx5_1", SourcePort: 1, Nodes: []infiniband.Node{fake.Switch(2, "b", 2)}}
+	)
+
+	b.Script = []fake.Step{{}, {Err: errors.New("unable to open MAD port")}}
+
+	src := fake.NewSource(a, b)
+	tracker := status.NewTracker()
+	w := &countingWriter{}
+
+	input := make(chan infiniband.Fabric)
+	done := make(chan struct{})
+
+	go func() {
+		router(input, map[string]writer.FabricWriter{"status": tracker, "counting": w}, nil)
+		close(done)
+	}()
+
+	conf := &config.FabricmonConf{}
+
+	discover(context.Background(), src, input, conf, tracker, true)
+	discover(context.Background(), src, input, conf, tracker, false)
+
+	close(input)
+	<-done
+
+	if w.received != 3 {
+		t.Fatalf("expected 3 fabrics, got %d", w.received)
+	}
+
+	st := tracker.Status()
+
+	if len(st.Sweeps) != 2 || st.DiscoveryFailures["mlx5_1"] != 1 {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+}
+
+func TestRunDaemonNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	// The first three sweeps fail, so readiness is only signalled after the fourth.
+	errDown := errors.New("unable to open MAD port")
+	f := &fake.Fabric{CAName: "mlx5_0", SourcePort: 1, Nodes: []infiniband.Node{fake.Switch(1, "a", 2)}}
+	f.Script = []fake.Step{{Err: errDown}, {Err: errDown}, {Err: errDown}}
+
+	src := fake.NewSource(f)
+	conf := &config.FabricmonConf{PollInterval: 50 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+
+	go func() {
+		runDaemon(ctx, src, conf, "", &slog.LevelVar{}, true)
+		close(done)
+	}()
+
+	var (
+		watchdogs int
+		buf       = make([]byte, 64)
+	)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch string(buf[:n]) {
+		case systemd.Watchdog:
+			watchdogs++
+		case systemd.Ready:
+			if sweeps := src.Sweeps(); sweeps < 4 {
+				t.Errorf("ready after %d sweeps", sweeps)
+			}
+
+			// The watchdog was kicked between the failed sweeps.
+			if watchdogs == 0 {
+				t.Error("watchdog not kicked before ready")
+			}
+
+			cancel()
+		case systemd.Stopping:
+			<-done
+			return
+		}
+	}
+}
+
+func TestInfluxDBKey(t *testing.T) {
+	c := config.InfluxDBConf{URL: "http://influx:8086", Database: "fabricmon", Username: "fm", Password: "s3cret"}
+
+	key := influxDBKey(c)
+	if strings.Contains(key, "s3cret") {
+		t.Fatalf("key reveals password: %s", key)
+	}
+
+	other := c
+	other.Database = "other"
+
+	changed := c
+	changed.Password = "changed"
+
+	if influxDBKey(other) == key || influxDBKey(changed) == key {
+		t.Errorf("keys of distinct configs are equal: %s", key)
+	}
+}
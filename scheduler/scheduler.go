@@ -0,0 +1,185 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package scheduler implements the scheduling of periodic sweeps. Jobs are run one at a time, so
+// that sweeps never overlap. Intervals which elapse while a job is running are skipped (and
+// reported as missed), rather than causing back-to-back runs. Run times may be randomly delayed by
+// a jitter, to avoid synchronised load from multiple FabricMon instances, and the interval may be
+// backed off when runs take longer than the interval.
+package scheduler
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// Schedule describes when a job is run.
+type Schedule struct {
+	Interval    time.Duration
+	Jitter      time.Duration // maximum random delay added to each run
+	MaxInterval time.Duration // maximum interval when backing off, or zero to disable backoff
+}
+
+// Job is a function which is run periodically.
+type Job struct {
+	Name     string
+	Schedule Schedule
+	Run      func()
+
+	interval time.Duration // effective interval, which may be backed off
+	slot     time.Time     // next scheduled run, excluding jitter
+	due      time.Time     // next scheduled run, including jitter
+	missed   uint64
+}
+
+// Scheduler runs jobs according to their schedules. Jobs are given in order of precedence: when
+// several jobs are due, only the first is run, and the others are deemed to have run too. For
+// example, topology discovery also collects counters, so counter collection need not run at the
+// same time.
+type Scheduler struct {
+	jobs []*Job
+
+	// OnMissed is called when a job has missed intervals because a run took too long.
+	OnMissed func(job string, missed int)
+
+	now    func() time.Time
+	jitter func(max time.Duration) time.Duration
+}
+
+// New returns a Scheduler for the jobs, all of which are due immediately.
+func New(jobs ...*Job) *Scheduler {
+	s := &Scheduler{
+		jobs: jobs,
+		now:  time.Now,
+		jitter: func(max time.Duration) time.Duration {
+			if max <= 0 {
+				return 0
+			}
+			return time.Duration(rand.Int63n(int64(max)))
+		},
+	}
+
+	now := s.now()
+
+	for _, j := range jobs {
+		j.interval = j.Schedule.Interval
+		j.slot = now
+		j.due = now
+	}
+
+	return s
+}
+
+// Next returns the time at which the next job is due.
+func (s *Scheduler) Next() time.Time {
+	var next time.Time
+
+	for _, j := range s.jobs {
+		if next.IsZero() || j.due.Before(next) {
+			next = j.due
+		}
+	}
+
+	return next
+}
+
+// RunDue runs the first due job, if any, and reschedules it along with any other due jobs. Only the
+// interval of the job which ran is backed off (or recovered) according to the duration of its run.
+func (s *Scheduler) RunDue() {
+	var (
+		ran *Job
+		now = s.now()
+	)
+
+	for _, j := range s.jobs {
+		if j.due.After(now) {
+			continue
+		}
+
+		if ran == nil {
+			ran = j
+			j.Run()
+			s.backoff(j, s.now().Sub(now))
+		}
+
+		s.reschedule(j)
+	}
+}
+
+// backoff adjusts the interval of a job after a run which took the specified duration.
+func (s *Scheduler) backoff(j *Job, took time.Duration) {
+	sched := j.Schedule
+
+	if sched.MaxInterval <= sched.Interval {
+		j.interval = sched.Interval
+		return
+	}
+
+	if took >= j.interval && j.interval < sched.MaxInterval {
+		j.interval = min(j.interval*2, sched.MaxInterval)
+		slog.Warn("run took longer than interval, backing off",
+			"job", j.Name, "duration", took, "interval", j.interval)
+	} else if took < j.interval/4 && j.interval > sched.Interval {
+		j.interval = max(j.interval/2, sched.Interval)
+		slog.Info("run duration recovered, reducing interval", "job", j.Name, "interval", j.interval)
+	}
+}
+
+// reschedule schedules the next run of a due job, skipping any intervals which have already
+// elapsed.
+func (s *Scheduler) reschedule(j *Job) {
+	var missed int
+
+	now := s.now()
+	j.slot = j.slot.Add(j.interval)
+
+	// Skip any intervals which have already elapsed.
+	for !j.slot.After(now) {
+		j.slot = j.slot.Add(j.interval)
+		missed++
+	}
+
+	if missed > 0 {
+		j.missed += uint64(missed)
+
+		slog.Warn("skipped missed intervals", "job", j.Name, "missed", missed)
+
+		if s.OnMissed != nil {
+			s.OnMissed(j.Name, missed)
+		}
+	}
+
+	j.due = j.slot.Add(s.jitter(j.Schedule.Jitter))
+}
+
+// SetSchedule changes the schedule of the named job, e.g. upon reloading the config. The next run
+// is rescheduled relative to the last run.
+func (s *Scheduler) SetSchedule(name string, sched Schedule) {
+	for _, j := range s.jobs {
+		if j.Name != name || j.Schedule == sched {
+			continue
+		}
+
+		slog.Info("schedule changed", "job", j.Name, "interval", sched.Interval,
+			"jitter", sched.Jitter, "max_interval", sched.MaxInterval)
+
+		last := j.slot.Add(-j.interval)
+
+		j.Schedule = sched
+		j.interval = sched.Interval
+		j.slot = last.Add(j.interval)
+		j.due = j.slot.Add(s.jitter(sched.Jitter))
+	}
+}
+
+// Missed returns the total number of intervals missed by the named job.
+func (s *Scheduler) Missed(name string) uint64 {
+	for _, j := range s.jobs {
+		if j.Name == name {
+			return j.missed
+		}
+	}
+
+	return 0
+}
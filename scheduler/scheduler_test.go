@@ -0,0 +1,147 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only advances when jobs run.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestScheduler(clock *fakeClock, jobs ...*Job) *Scheduler {
+	s := New()
+	s.now = clock.Now
+	s.jitter = func(time.Duration) time.Duration { return 0 }
+	s.jobs = jobs
+
+	for _, j := range jobs {
+		j.interval = j.Schedule.Interval
+		j.slot = clock.now
+		j.due = clock.now
+	}
+
+	return s
+}
+
+// runUntil runs due jobs until the clock reaches the specified time.
+func runUntil(clock *fakeClock, s *Scheduler, until time.Time) {
+	for next := s.Next(); !next.After(until); next = s.Next() {
+		if next.After(clock.now) {
+			clock.now = next
+		}
+
+		s.RunDue()
+	}
+}
+
+// job returns a job which records its runs, and advances the clock by the specified duration.
+func job(clock *fakeClock, ran *[]string, name string, interval, duration time.Duration) *Job {
+	return &Job{
+		Name:     name,
+		Schedule: Schedule{Interval: interval},
+		Run: func() {
+			*ran = append(*ran, name)
+			clock.now = clock.now.Add(duration)
+		},
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	var ran []string
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	topology := job(clock, &ran, "topology", 30*time.Second, time.Second)
+	counters := job(clock, &ran, "counters", 10*time.Second, time.Second)
+	s := newTestScheduler(clock, topology, counters)
+
+	runUntil(clock, s, time.Unix(60, 0))
+	expected := []string{"topology", "counters", "counters", "topology", "counters", "counters", "topology"}
+
+	if !reflect.DeepEqual(ran, expected) {
+		t.Fatalf("unexpected runs: %v", ran)
+	}
+}
+
+func TestMissedIntervals(t *testing.T) {
+	var (
+		ran      []string
+		reported int
+	)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	slow := job(clock, &ran, "counters", 10*time.Second, 25*time.Second)
+	s := newTestScheduler(clock, slow)
+	s.OnMissed = func(_ string, missed int) { reported += missed }
+
+	s.RunDue()
+
+	// Run took 25s, so the runs due at 10s and 20s are skipped, and the next run is at 30s.
+	if next := s.Next(); next != time.Unix(30, 0) {
+		t.Fatalf("unexpected next run: %v", next)
+	}
+
+	if s.Missed("counters") != 2 || reported != 2 {
+		t.Fatalf("unexpected missed intervals: %d (reported %d)", s.Missed("counters"), reported)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	duration := 15 * time.Second
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	j := &Job{
+		Name:     "counters",
+		Schedule: Schedule{Interval: 10 * time.Second, MaxInterval: time.Minute},
+		Run:      func() { clock.now = clock.now.Add(duration) },
+	}
+	s := newTestScheduler(clock, j)
+
+	s.RunDue()
+
+	if j.interval != 20*time.Second || s.Next() != time.Unix(20, 0) {
+		t.Fatalf("expected backoff to 20s, got interval %v, next %v", j.interval, s.Next())
+	}
+
+	// Runs become fast again.
+	duration = time.Second
+	clock.now = s.Next()
+	s.RunDue()
+
+	if j.interval != 10*time.Second {
+		t.Fatalf("expected interval to recover to 10s, got %v", j.interval)
+	}
+}
+
+func TestBackoffOnlyRanJob(t *testing.T) {
+	var ran []string
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	topology := job(clock, &ran, "topology", 30*time.Second, 35*time.Second)
+	topology.Schedule.MaxInterval = 2 * time.Minute
+	counters := job(clock, &ran, "counters", 10*time.Second, time.Second)
+	counters.Schedule.MaxInterval = time.Minute
+	s := newTestScheduler(clock, topology, counters)
+
+	s.RunDue()
+
+	// Only the slow topology run is backed off. Counters, which were due but did not run, keep
+	// their interval, and skip the intervals elapsed during the topology run.
+	if topology.interval != time.Minute {
+		t.Errorf("expected topology backoff to 1m, got %v", topology.interval)
+	}
+
+	if counters.interval != 10*time.Second || s.Next() != time.Unix(40, 0) || s.Missed("counters") != 3 {
+		t.Errorf("unexpected counters schedule: interval %v, next %v, missed %d",
+			counters.interval, s.Next(), s.Missed("counters"))
+	}
+}
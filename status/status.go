@@ -0,0 +1,269 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package status implements the Tracker, which collects statistics about FabricMon's own sweeps and
+// writers, and serves them as JSON via HTTP.
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/version"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+// NodeErrors holds the number of failed performance management queries of a node.
+type NodeErrors struct {
+	GUID     string `json:"guid"`
+	Failures uint64 `json:"failures"`
+	Timeouts uint64 `json:"timeouts"`
+}
+
+// SweepStatus holds the statistics of the last sweep of a fabric, i.e., via a specific HCA and
+// source port, as well as cumulative totals of all sweeps of that fabric.
+type SweepStatus struct {
+	Hostname   string    `json:"hostname"`
+	CAName     string    `json:"ca"`
+	SourcePort int       `json:"source_port"`
+	Timestamp  time.Time `json:"timestamp"`
+	Duration   float64   `json:"duration_seconds"`
+	Nodes      int       `json:"nodes"`
+	Incomplete bool      `json:"incomplete"`
+
+	SMPs          uint64       `json:"smps"`
+	PMAQueries    uint64       `json:"pma_queries"`
+	CounterResets uint64       `json:"counter_resets"`
+	NodeErrors    []NodeErrors `json:"node_errors,omitempty"`
+
+	Sweeps             uint64 `json:"sweeps_total"`
+	TotalPMAQueries    uint64 `json:"pma_queries_total"`
+	TotalCounterResets uint64 `json:"counter_resets_total"`
+	TotalFailures      uint64 `json:"query_failures_total"`
+	TotalTimeouts      uint64 `json:"query_timeouts_total"`
+}
+
+// Status is a snapshot of FabricMon's status.
+type Status struct {
+	Version           string                  `json:"version"`
+	Started           time.Time               `json:"started"`
+	LastSweep         time.Time               `json:"last_sweep"`
+	Sweeps            []SweepStatus           `json:"sweeps"`
+	DiscoveryFailures map[string]uint64       `json:"discovery_failures,omitempty"`
+	LastError         string                  `json:"last_error,omitempty"`
+	MissedIntervals   map[string]uint64       `json:"missed_intervals,omitempty"`
+	Writers           map[string]writer.Stats `json:"writers"`
+}
+
+// Tracker collects sweep statistics from the fabrics it receives, and discovery failures reported
+// to it. It implements writer.FabricWriter, and http.Handler.
+type Tracker struct {
+	mu                sync.Mutex
+	started           time.Time
+	lastSweep         time.Time // time of the last completely discovered fabric
+	maxSweepAge       time.Duration
+	sweeps            map[string]*SweepStatus
+	discoveryFailures map[string]uint64
+	missedIntervals   map[string]uint64
+	lastError         string
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		started:           time.Now(),
+		sweeps:            make(map[string]*SweepStatus),
+		discoveryFailures: make(map[string]uint64),
+		missedIntervals:   make(map[string]uint64),
+	}
+}
+
+// Receiver records the sweep statistics of each fabric received, until the input channel is closed.
+func (t *Tracker) Receiver(input chan infiniband.Fabric) {
+	for fabric := range input {
+		t.RecordSweep(fabric)
+	}
+}
+
+// RecordSweep records the statistics of the sweep which produced a fabric.
+func (t *Tracker) RecordSweep(fabric infiniband.Fabric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := fmt.Sprintf("%s-%s-p%d", fabric.Hostname, fabric.CAName, fabric.SourcePort)
+
+	s, ok := t.sweeps[key]
+	if !ok {
+		s = &SweepStatus{Hostname: fabric.Hostname, CAName: fabric.CAName, SourcePort: fabric.SourcePort}
+		t.sweeps[key] = s
+	}
+
+	stats := fabric.Stats
+
+	// An incomplete sweep does not count as successful.
+	if !fabric.Incomplete {
+		t.lastSweep = time.Now()
+	}
+
+	s.Timestamp = fabric.Timestamp
+	s.Incomplete = fabric.Incomplete
+	s.Duration = stats.Duration.Seconds()
+	s.Nodes = len(fabric.Nodes)
+	s.SMPs = stats.SMPs
+	s.PMAQueries = stats.PMAQueries
+	s.CounterResets = stats.CounterResets
+	s.NodeErrors = s.NodeErrors[:0]
+
+	for guid, e := range stats.NodeErrors {
+		s.NodeErrors = append(s.NodeErrors, NodeErrors{fmt.Sprintf("%016x", guid), e.Failures, e.Timeouts})
+		s.TotalFailures += e.Failures
+		s.TotalTimeouts += e.Timeouts
+	}
+
+	sort.Slice(s.NodeErrors, func(i, j int) bool { return s.NodeErrors[i].GUID < s.NodeErrors[j].GUID })
+
+	s.Sweeps++
+	s.TotalPMAQueries += stats.PMAQueries
+	s.TotalCounterResets += stats.CounterResets
+}
+
+// DiscoveryFailed records a failure to discover the fabric attached to an HCA.
+func (t *Tracker) DiscoveryFailed(caName string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.discoveryFailures[caName]++
+	t.lastError = err.Error()
+}
+
+// IntervalsMissed records intervals of a scheduled job which were skipped, because a previous run
+// took too long.
+func (t *Tracker) IntervalsMissed(job string, missed int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.missedIntervals[job] += uint64(missed)
+}
+
+// Status returns a snapshot of the current status.
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := Status{
+		Version:           version.Info(),
+		Started:           t.started,
+		LastSweep:         t.lastSweep,
+		Sweeps:            make([]SweepStatus, 0, len(t.sweeps)),
+		DiscoveryFailures: make(map[string]uint64, len(t.discoveryFailures)),
+		MissedIntervals:   make(map[string]uint64, len(t.missedIntervals)),
+		LastError:         t.lastError,
+		Writers:           writer.WriterStats(),
+	}
+
+	for _, s := range t.sweeps {
+		sc := *s
+		sc.NodeErrors = append([]NodeErrors(nil), s.NodeErrors...)
+		st.Sweeps = append(st.Sweeps, sc)
+	}
+
+	sort.Slice(st.Sweeps, func(i, j int) bool {
+		a, b := st.Sweeps[i], st.Sweeps[j]
+		if a.CAName != b.CAName {
+			return a.CAName < b.CAName
+		}
+		return a.SourcePort < b.SourcePort
+	})
+
+	for ca, n := range t.discoveryFailures {
+		st.DiscoveryFailures[ca] = n
+	}
+
+	for job, n := range t.missedIntervals {
+		st.MissedIntervals[job] = n
+	}
+
+	return st
+}
+
+// ServeHTTP serves the current status as JSON.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(t.Status())
+}
+
+// SetMaxSweepAge sets the maximum age of the last successful sweep, beyond which FabricMon is
+// considered unhealthy.
+func (t *Tracker) SetMaxSweepAge(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.maxSweepAge = d
+}
+
+// Health returns an error if no fabric has been successfully discovered within the maximum sweep
+// age, or if all writers are failing. Unless ready is true, FabricMon is given the maximum sweep
+// age after starting to complete its first sweep.
+func (t *Tracker) Health(ready bool) error {
+	t.mu.Lock()
+	lastSweep, maxSweepAge, started := t.lastSweep, t.maxSweepAge, t.started
+	t.mu.Unlock()
+
+	if lastSweep.IsZero() {
+		if ready {
+			return errors.New("no sweep has completed yet")
+		}
+
+		lastSweep = started
+	}
+
+	if maxSweepAge > 0 && time.Since(lastSweep) > maxSweepAge {
+		return fmt.Errorf("no successful sweep since %s", lastSweep.Format(time.RFC3339))
+	}
+
+	return writersHealth(writer.WriterStats())
+}
+
+// writersHealth returns an error if all running writers which have written anything are failing,
+// i.e., their last write failed. Stopped writers have no stats, and are not considered.
+func writersHealth(stats map[string]writer.Stats) error {
+	var lastErr string
+
+	for _, s := range stats {
+		if !s.LastFailure.After(s.LastSuccess) {
+			return nil
+		}
+
+		lastErr = s.LastError
+	}
+
+	if lastErr != "" {
+		return fmt.Errorf("all writers are failing, e.g.: %s", lastErr)
+	}
+
+	return nil
+}
+
+// HealthHandler returns a handler which responds with 200 OK if FabricMon is healthy (or ready, if
+// ready is true), or 503 Service Unavailable otherwise.
+func (t *Tracker) HealthHandler(ready bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if err := t.Health(ready); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
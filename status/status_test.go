@@ -0,0 +1,106 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package status
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker()
+
+	fabric := infiniband.Fabric{
+		Hostname:   "host",
+		CAName:     "mlx4_0",
+		SourcePort: 1,
+		Nodes:      make([]infiniband.Node, 3),
+		Stats: infiniband.SweepStats{
+			Duration:      time.Second,
+			PMAQueries:    10,
+			CounterResets: 1,
+			NodeErrors:    map[uint64]infiniband.NodeErrors{0x2: {Failures: 2, Timeouts: 1}},
+		},
+	}
+
+	tr.RecordSweep(fabric)
+	tr.RecordSweep(fabric)
+	tr.DiscoveryFailed("mlx4_0", errors.New("mlx4_0 port 2: unable to open MAD port"))
+
+	st := tr.Status()
+
+	if len(st.Sweeps) != 1 {
+		t.Fatalf("expected 1 sweep status, got %d", len(st.Sweeps))
+	}
+
+	s := st.Sweeps[0]
+
+	if s.Sweeps != 2 || s.Nodes != 3 || s.TotalPMAQueries != 20 || s.TotalFailures != 4 || s.TotalTimeouts != 2 {
+		t.Fatalf("unexpected sweep status: %+v", s)
+	}
+
+	if !reflect.DeepEqual(s.NodeErrors, []NodeErrors{{"0000000000000002", 2, 1}}) {
+		t.Fatalf("unexpected node errors: %+v", s.NodeErrors)
+	}
+
+	if st.DiscoveryFailures["mlx4_0"] != 1 {
+		t.Fatalf("unexpected discovery failures: %v", st.DiscoveryFailures)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	tr := NewTracker()
+	tr.SetMaxSweepAge(time.Hour)
+
+	if tr.Health(false) != nil {
+		t.Fatal("expected healthy during first sweep")
+	}
+
+	if tr.Health(true) == nil {
+		t.Fatal("expected not ready before first sweep")
+	}
+
+	tr.RecordSweep(infiniband.Fabric{Incomplete: true})
+
+	if tr.Health(true) == nil {
+		t.Fatal("expected not ready after incomplete sweep")
+	}
+
+	tr.RecordSweep(infiniband.Fabric{})
+
+	if tr.Health(true) != nil {
+		t.Fatal("expected ready after first sweep")
+	}
+
+	tr.SetMaxSweepAge(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if tr.Health(false) == nil {
+		t.Fatal("expected unhealthy after max sweep age")
+	}
+}
+
+func TestWritersHealth(t *testing.T) {
+	now := time.Now()
+
+	ok := writer.Stats{LastSuccess: now}
+	failing := writer.Stats{LastSuccess: now.Add(-time.Minute), LastFailure: now, LastError: "timeout"}
+
+	if writersHealth(nil) != nil {
+		t.Fatal("expected healthy without writers")
+	}
+
+	if writersHealth(map[string]writer.Stats{"a": ok, "b": failing}) != nil {
+		t.Fatal("expected healthy with one working writer")
+	}
+
+	if writersHealth(map[string]writer.Stats{"a": failing, "b": failing}) == nil {
+		t.Fatal("expected unhealthy with all writers failing")
+	}
+}
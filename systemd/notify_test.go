@@ -0,0 +1,62 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	if ok, err := Notify(Ready); ok || err != nil {
+		t.Fatalf("expected no notification without NOTIFY_SOCKET, got %v, %v", ok, err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "notify")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	if ok, err := Notify(Watchdog); !ok || err != nil {
+		t.Fatalf("notification failed: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != Watchdog {
+		t.Fatalf("unexpected notification: %q", buf[:n])
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	if d := WatchdogInterval(); d != 30*time.Second {
+		t.Fatalf("unexpected watchdog interval: %v", d)
+	}
+
+	// Watchdog enabled for another process.
+	t.Setenv("WATCHDOG_PID", "1")
+
+	if d := WatchdogInterval(); d != 0 {
+		t.Fatalf("unexpected watchdog interval: %v", d)
+	}
+}
@@ -27,6 +27,46 @@ function clearSelection() {
   viewPort.select(".links").selectAll("line").style("opacity", 1);
   viewPort.selectAll(".node").style("opacity", 1);
   d3.selectAll("table.node-info td").text("-");
+  d3.select("#sel_node_ports tbody").selectAll("tr").remove();
+}
+
+// Sum the error counter deltas of a port or link.
+function errorCount(d) {
+  var total = 0;
+
+  for (var name in d.errors)
+    total += d.errors[name];
+
+  return total;
+}
+
+function showPorts(d) {
+  var rows = d3.select("#sel_node_ports tbody").selectAll("tr")
+    .data(d.ports || [], function(p) { return p.port; });
+
+  rows.exit().remove();
+
+  rows = rows.enter().append("tr")
+    .merge(rows)
+      .classed("errors", function(p) { return errorCount(p) > 0; })
+      .attr("title", function(p) {
+        return Object.keys(p.errors || {}).map(function(name) {
+          return name + ": " + p.errors[name];
+        }).join("\n");
+      });
+
+  rows.selectAll("td").remove();
+  rows.append("td").text(function(p) { return p.port; });
+  rows.append("td").text(function(p) { return p.state; });
+  rows.append("td").text(function(p) {
+    return p.link_width ? p.link_width + " " + p.link_speed : "-";
+  });
+  rows.append("td").text(function(p) {
+    return p.remote_desc ? p.remote_desc + " [" + p.remote_port + "]" : "-";
+  });
+  rows.append("td").text(function(p) {
+    return Math.round(Math.max(p.xmit_util || 0, p.rcv_util || 0) * 100) + "%";
+  });
 }
 
 function handleNodeClick(d) {
@@ -47,6 +87,8 @@ function handleNodeClick(d) {
   if (d.vendor_id && d.device_id)
     d3.select("#sel_node_model").text(lookupDevice(d.vendor_id, d.device_id));
 
+  showPorts(d);
+
   // Build array of nodes that are linked to this node
   links.forEach(function (l) {
     if (l.source.index == d.index) connectedNodes.push(l.target.index);
@@ -112,6 +154,7 @@ function changeFabric() {
         .attr("class", function(d) {
           return d.link_speed.toLowerCase();
         })
+        .classed("errors", function(d) { return errorCount(d) > 0; })
         .attr("stroke-width", function(d) {
           switch (d.link_width) {
             case "1X":
@@ -125,6 +168,13 @@ function changeFabric() {
           return 1;
         });
 
+    link.append("title")
+      .text(function(d) {
+        return "port " + d.source_port + " - port " + d.target_port + ", " +
+          d.link_width + " " + d.link_speed + ", " + Math.round((d.util || 0) * 100) + "% util, " +
+          errorCount(d) + " errors";
+      });
+
     var node = g.selectAll(".node")
       .data(graph.nodes)
       .enter().append("g")
@@ -0,0 +1,89 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package writer
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+// FileName returns the name of the file that a writer should use for a fabric, which is unique per
+// FabricMon host, HCA and source port.
+func FileName(fabric infiniband.Fabric, ext string) string {
+	return fmt.Sprintf("%s-%s-p%d.%s", fabric.Hostname, fabric.CAName, fabric.SourcePort, ext)
+}
+
+// WriteFileAtomic calls fn to write to a temporary file in the same directory as destFile, then
+// renames it to destFile, to ensure atomic updates and avoid partial reads by clients. The file
+// keeps the permissions of an existing destFile (or else 0644), and is synced to disk before it
+// replaces destFile.
+func WriteFileAtomic(destFile string, fn func(io.Writer) error) error {
+	var mode fs.FileMode = 0644
+
+	if fi, err := os.Stat(destFile); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(destFile), ".fabricmon")
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tempFile); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	err = tempFile.Chmod(mode)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	if err := os.Rename(tempFile.Name(), destFile); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	return nil
+}
+
+// TopologyReceiver writes each complete fabric received on input to a file in dir, named by FileName
+// with the extension ext, replacing the previous topology of the same HCA and source port. The file
+// is written by fn, and the outcome of each write is recorded by r, under the default name name.
+// Incomplete fabrics are skipped, so that a complete topology is not replaced with a partial one.
+func TopologyReceiver(input chan infiniband.Fabric, r *Recorder, dir, ext, name string, fn func(io.Writer, infiniband.Fabric) error) {
+	for fabric := range input {
+		if fabric.Incomplete {
+			slog.Warn("not writing topology of incomplete fabric", "writer", name, "hca", fabric.CAName, "port", fabric.SourcePort)
+			continue
+		}
+
+		destFile := filepath.Join(dir, FileName(fabric, ext))
+
+		err := WriteFileAtomic(destFile, func(w io.Writer) error {
+			return fn(w, fabric)
+		})
+		r.Record(name, err)
+
+		if err != nil {
+			slog.Error("cannot write topology", "writer", name, "file", destFile, "err", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package writer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.txt")
+
+	write := func(content string) {
+		if err := WriteFileAtomic(path, func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("first")
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected new file: %v, %v", fi, err)
+	}
+
+	// The permissions of an existing file are kept.
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	write("second")
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected replaced file: %v, %v", fi, err)
+	}
+
+	if b, _ := os.ReadFile(path); string(b) != "second" {
+		t.Errorf("unexpected content %q", b)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files remain: %v", entries)
+	}
+}
+
+func TestTopologyReceiver(t *testing.T) {
+	dir := t.TempDir()
+
+	c := make(chan infiniband.Fabric, 3)
+	c <- infiniband.Fabric{Hostname: "host1", CAName: "mlx5_0", SourcePort: 1, Incomplete: true}
+	c <- infiniband.Fabric{Hostname: "host1", CAName: "mlx5_0", SourcePort: 2}
+	c <- infiniband.Fabric{Hostname: "host1", CAName: "mlx5_1", SourcePort: 1}
+	close(c)
+
+	r := &Recorder{}
+	r.SetName("topology test")
+	defer DeleteStats("topology test")
+
+	TopologyReceiver(c, r, dir, "txt", "test", func(w io.Writer, fabric infiniband.Fabric) error {
+		if fabric.CAName == "mlx5_1" {
+			return errors.New("cannot render")
+		}
+
+		_, err := io.WriteString(w, fabric.CAName)
+		return err
+	})
+
+	// Neither the incomplete fabric, nor the fabric which failed to render, are written.
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || entries[0].Name() != "host1-mlx5_0-p2.txt" {
+		t.Fatalf("unexpected files: %v", entries)
+	}
+
+	if s := WriterStats()["topology test"]; s.Successes != 1 || s.Failures != 1 || s.LastError != "cannot render" {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
@@ -8,26 +8,47 @@ package forcegraph
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
-	"os"
 	"path/filepath"
 
 	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer"
 )
 
 type d3Node struct {
-	ID       string `json:"id"`
-	Desc     string `json:"desc"`
-	NodeType int    `json:"nodetype"`
-	VendorID uint   `json:"vendor_id"`
-	DeviceID uint   `json:"device_id"`
+	ID       string   `json:"id"`
+	Desc     string   `json:"desc"`
+	NodeType int      `json:"nodetype"`
+	VendorID uint     `json:"vendor_id"`
+	DeviceID uint     `json:"device_id"`
+	Ports    []d3Port `json:"ports,omitempty"`
+}
+
+type d3Port struct {
+	Port       int               `json:"port"`
+	State      string            `json:"state,omitempty"`
+	PhysState  string            `json:"phys_state,omitempty"`
+	Width      string            `json:"link_width,omitempty"`
+	Speed      string            `json:"link_speed,omitempty"`
+	RemoteID   string            `json:"remote_id,omitempty"`
+	RemotePort int               `json:"remote_port,omitempty"`
+	RemoteDesc string            `json:"remote_desc,omitempty"`
+	Errors     map[string]uint64 `json:"errors,omitempty"`
+	XmitUtil   float64           `json:"xmit_util,omitempty"`
+	RcvUtil    float64           `json:"rcv_util,omitempty"`
 }
 
 type d3Link struct {
-	Source string `json:"source"`
-	Target string `json:"target"`
-	Width  string `json:"link_width"`
-	Speed  string `json:"link_speed"`
+	Source     string            `json:"source"`
+	Target     string            `json:"target"`
+	SourcePort int               `json:"source_port"`
+	TargetPort int               `json:"target_port"`
+	Width      string            `json:"link_width"`
+	Speed      string            `json:"link_speed"`
+	State      string            `json:"state"`
+	Errors     map[string]uint64 `json:"errors,omitempty"`
+	Util       float64           `json:"util,omitempty"`
 }
 
 type d3Topology struct {
@@ -35,17 +56,50 @@ type d3Topology struct {
 	Links []d3Link `json:"links"`
 }
 
+// portKey uniquely identifies a port within a fabric.
+type portKey struct {
+	guid uint64
+	port int
+}
+
+// portSample holds the counters of a port from a previous sweep, for calculating deltas.
+type portSample struct {
+	counters infiniband.Counters
+}
+
 type ForceGraphWriter struct {
+	writer.Recorder
+
 	OutputDir string
+
+	// Counter samples from the previous sweep of each fabric, keyed by output file name.
+	history map[string]map[portKey]portSample
 }
 
 // TODO: Rename this to something more descriptive (and which is not so easily confused with method
 // receivers).
 func (fg *ForceGraphWriter) Receiver(input chan infiniband.Fabric) {
+	if fg.history == nil {
+		fg.history = make(map[string]map[portKey]portSample)
+	}
+
 	for fabric := range input {
+		// Do not replace a complete topology with a partial one, nor discard the counter samples of
+		// nodes which were not walked.
+		if fabric.Incomplete {
+			slog.Warn("not writing force graph topology of incomplete fabric", "hca", fabric.CAName, "port", fabric.SourcePort)
+			continue
+		}
+
+		destFile := writer.FileName(fabric, "json")
+		topo, samples := buildTopology(fabric, fg.history[destFile])
+		fg.history[destFile] = samples
 
 		if fg.OutputDir != "" {
-			if err := writeTopology(fg.OutputDir, fabric); err != nil {
+			err := writeTopology(filepath.Join(fg.OutputDir, destFile), topo)
+			fg.Record("forcegraph", err)
+
+			if err != nil {
 				slog.Error("cannot marshal fabric to force graph topology", "err", err)
 			}
 		}
@@ -53,11 +107,15 @@ func (fg *ForceGraphWriter) Receiver(input chan infiniband.Fabric) {
 }
 
 // buildTopology transforms the internal representation of InfiniBand nodes into d3.js nodes and
-// links.
-func buildTopology(nodes []infiniband.Node) d3Topology {
+// links. Error counter deltas and link utilisation are calculated relative to the samples from the
+// previous sweep, and the samples from this sweep are returned for use in the next call.
+// Links between two switches are reported by both switches, but are only emitted once.
+func buildTopology(fabric infiniband.Fabric, prev map[portKey]portSample) (d3Topology, map[portKey]portSample) {
 	topo := d3Topology{}
+	samples := make(map[portKey]portSample)
+	links := make(map[[2]portKey]int)
 
-	for _, node := range nodes {
+	for _, node := range fabric.Nodes {
 		d3n := d3Node{
 			ID:       fmt.Sprintf("%016x", node.GUID),
 			NodeType: node.NodeType,
@@ -66,48 +124,146 @@ func buildTopology(nodes []infiniband.Node) d3Topology {
 			DeviceID: node.DeviceID,
 		}
 
-		topo.Nodes = append(topo.Nodes, d3n)
+		for portNum, port := range node.Ports {
+			// Unpopulated port (e.g., port zero of non-switch nodes).
+			if port.State == "" {
+				continue
+			}
+
+			key := portKey{node.GUID, portNum}
+			d3p := d3Port{
+				Port:      portNum,
+				State:     port.State,
+				PhysState: port.PhysState,
+				Width:     port.LinkWidth,
+				Speed:     port.LinkSpeed,
+			}
+
+			if !port.Counters.Empty() {
+				sample := portSample{counters: port.Counters}
+				samples[key] = sample
+
+				if p, ok := prev[key]; ok {
+					d3p.Errors, d3p.XmitUtil, d3p.RcvUtil = portDeltas(port, sample, p)
+				}
+			}
 
-		for _, port := range node.Ports {
 			if port.RemoteGUID != 0 {
-				topo.Links = append(topo.Links, d3Link{
-					Source: fmt.Sprintf("%016x", node.GUID),
-					Target: fmt.Sprintf("%016x", port.RemoteGUID),
-					Width:  port.LinkWidth,
-					Speed:  port.LinkSpeed,
-				})
+				d3p.RemoteID = fmt.Sprintf("%016x", port.RemoteGUID)
+				d3p.RemotePort = port.RemotePort
+				d3p.RemoteDesc = port.RemoteNodeDesc
+
+				remote := portKey{port.RemoteGUID, port.RemotePort}
+				linkKey := [2]portKey{key, remote}
+				if remote.guid < key.guid || (remote.guid == key.guid && remote.port < key.port) {
+					linkKey = [2]portKey{remote, key}
+				}
+
+				if i, ok := links[linkKey]; ok {
+					// Link already emitted from the remote end; merge this end's counters.
+					link := &topo.Links[i]
+					link.Errors = mergeErrors(link.Errors, d3p.Errors)
+					link.Util = max(link.Util, d3p.XmitUtil, d3p.RcvUtil)
+				} else {
+					links[linkKey] = len(topo.Links)
+					topo.Links = append(topo.Links, d3Link{
+						Source:     d3n.ID,
+						Target:     d3p.RemoteID,
+						SourcePort: portNum,
+						TargetPort: port.RemotePort,
+						Width:      port.LinkWidth,
+						Speed:      port.LinkSpeed,
+						State:      port.State,
+						Errors:     mergeErrors(nil, d3p.Errors),
+						Util:       max(d3p.XmitUtil, d3p.RcvUtil),
+					})
+				}
 			}
+
+			d3n.Ports = append(d3n.Ports, d3p)
 		}
+
+		topo.Nodes = append(topo.Nodes, d3n)
 	}
 
-	return topo
+	return topo, samples
 }
 
-// writeTopology writes a d3.js force graph JSON object file.
-func writeTopology(outputDir string, fabric infiniband.Fabric) error {
-	// Write d3.js topology to a temporary file, then rename it to target file, to ensure atomic
-	// updates and avoid partial reads by clients.
-	tempFile, err := os.CreateTemp(outputDir, ".fabricmon")
-	if err != nil {
-		return err
-	}
+// portDeltas calculates the error counter deltas between two samples of a port's counters, as well
+// as the transmit and receive utilisation of the link, expressed as a fraction of its data rate.
+func portDeltas(port infiniband.Port, cur, prev portSample) (map[string]uint64, float64, float64) {
+	var xmitUtil, rcvUtil float64
+
+	errors := make(map[string]uint64)
+	elapsed := cur.counters.Timestamp.Sub(prev.counters.Timestamp).Seconds()
+	rate := float64(infiniband.LinkDataRate(port.LinkWidth, port.LinkSpeed))
+
+	for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+		v, ok := cur.counters.Get(id)
+		if !ok {
+			continue
+		}
+
+		prevValue, ok := prev.counters.Get(id)
+		if !ok {
+			continue
+		}
+
+		switch id {
+		case infiniband.PortXmitData, infiniband.PortRcvData:
+			if elapsed <= 0 || rate == 0 {
+				continue
+			}
+
+			// Data counters indicate octets divided by four.
+			util := float64(counterDelta(v, prevValue)*id.Info().Scale) * 8 / elapsed / rate
+
+			if id == infiniband.PortXmitData {
+				xmitUtil = util
+			} else {
+				rcvUtil = util
+			}
+		case infiniband.PortXmitWait:
+			// PortXmitWait is a congestion indicator, not an error counter.
+		default:
+			if id.Info().Extended {
+				continue // packet counters
+			}
 
-	enc := json.NewEncoder(tempFile)
-	if err := enc.Encode(buildTopology(fabric.Nodes)); err != nil {
-		tempFile.Close()
-		os.Remove(tempFile.Name())
-		return err
+			if d := counterDelta(v, prevValue); d > 0 {
+				errors[id.String()] = d
+			}
+		}
 	}
 
-	tempFile.Chmod(0644)
-	tempFile.Close()
+	return errors, xmitUtil, rcvUtil
+}
+
+// counterDelta returns the difference between two samples of a counter. A counter which has gone
+// backwards is assumed to have been reset, and to have counted up from zero since.
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
 
-	destFile := fmt.Sprintf("%s-%s-p%d.json", fabric.Hostname, fabric.CAName, fabric.SourcePort)
+	return cur - prev
+}
 
-	if err := os.Rename(tempFile.Name(), filepath.Join(outputDir, destFile)); err != nil {
-		os.Remove(tempFile.Name())
-		return err
+// mergeErrors adds the error counter deltas in src to dst, allocating dst if necessary.
+func mergeErrors(dst, src map[string]uint64) map[string]uint64 {
+	for name, delta := range src {
+		if dst == nil {
+			dst = make(map[string]uint64)
+		}
+		dst[name] += delta
 	}
 
-	return nil
+	return dst
+}
+
+// writeTopology writes a d3.js force graph JSON object file.
+func writeTopology(destFile string, topo d3Topology) error {
+	return writer.WriteFileAtomic(destFile, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(topo)
+	})
 }
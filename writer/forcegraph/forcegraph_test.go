@@ -0,0 +1,82 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package forcegraph
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+func TestBuildTopology(t *testing.T) {
+	makeFabric := func(ts time.Time, symErrs uint32, xmitBytes uint64) infiniband.Fabric {
+		port := func(remoteGUID uint64, remotePort int) infiniband.Port {
+			p := infiniband.Port{
+				RemoteGUID: remoteGUID,
+				RemotePort: remotePort,
+				State:      "Active",
+				PhysState:  "LinkUp",
+				LinkWidth:  "4X",
+				LinkSpeed:  "QDR",
+			}
+
+			p.Counters.Set(infiniband.SymbolErrorCounter, uint64(symErrs))
+			p.Counters.Set(infiniband.PortXmitData, xmitBytes/4)
+			p.Counters.Timestamp = ts
+
+			return p
+		}
+
+		return infiniband.Fabric{
+			Timestamp: ts,
+			Nodes: []infiniband.Node{
+				{GUID: 1, NodeType: infiniband.IB_NODE_SWITCH, Ports: []infiniband.Port{{}, {}, port(2, 3)}},
+				{GUID: 2, NodeType: infiniband.IB_NODE_SWITCH, Ports: []infiniband.Port{{}, {}, {}, port(1, 2)}},
+			},
+		}
+	}
+
+	start := time.Now()
+
+	topo, samples := buildTopology(makeFabric(start, 10, 0), nil)
+
+	if len(topo.Links) != 1 {
+		t.Fatalf("expected 1 deduplicated link, got %d", len(topo.Links))
+	}
+
+	link := topo.Links[0]
+	if link.SourcePort != 2 || link.TargetPort != 3 || link.Errors != nil || link.Util != 0 {
+		t.Fatalf("unexpected link on first sweep: %+v", link)
+	}
+
+	if len(topo.Nodes[0].Ports) != 1 || topo.Nodes[0].Ports[0].RemotePort != 3 {
+		t.Fatalf("unexpected port table: %+v", topo.Nodes[0].Ports)
+	}
+
+	// Second sweep, one second later, with 8 Gbit transmitted on each port (i.e., 25% of a 4X QDR
+	// link), and five new symbol errors on each end of the link.
+	topo, _ = buildTopology(makeFabric(start.Add(time.Second), 15, 1e9), samples)
+	link = topo.Links[0]
+
+	if !reflect.DeepEqual(link.Errors, map[string]uint64{"SymbolErrorCounter": 10}) {
+		t.Fatalf("unexpected link errors: %v", link.Errors)
+	}
+
+	if link.Util != 0.25 {
+		t.Fatalf("unexpected link utilisation: %v", link.Util)
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	if counterDelta(15, 10) != 5 {
+		t.Fail()
+	}
+
+	// Counter reset since previous sample
+	if counterDelta(3, 10) != 3 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package graphml implements the GraphMLWriter, which writes the fabric topology and port counters
+// to a GraphML file, suitable for loading into graph editors and analysis tools such as yEd or
+// Gephi.
+package graphml
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+type gmlKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type gmlData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type gmlNode struct {
+	ID   string    `xml:"id,attr"`
+	Data []gmlData `xml:"data"`
+}
+
+type gmlEdge struct {
+	ID     string    `xml:"id,attr"`
+	Source string    `xml:"source,attr"`
+	Target string    `xml:"target,attr"`
+	Data   []gmlData `xml:"data"`
+}
+
+type gmlGraph struct {
+	ID          string    `xml:"id,attr"`
+	EdgeDefault string    `xml:"edgedefault,attr"`
+	Nodes       []gmlNode `xml:"node"`
+	Edges       []gmlEdge `xml:"edge"`
+}
+
+type gmlDocument struct {
+	XMLName xml.Name `xml:"http://graphml.graphdrawing.org/xmlns graphml"`
+	Keys    []gmlKey `xml:"key"`
+	Graph   gmlGraph `xml:"graph"`
+}
+
+// Node and edge attributes, other than counters.
+var attrKeys = []gmlKey{
+	{"guid", "node", "guid", "string"},
+	{"system_guid", "node", "system_guid", "string"},
+	{"desc", "node", "desc", "string"},
+	{"type", "node", "type", "string"},
+	{"vendor_id", "node", "vendor_id", "int"},
+	{"device_id", "node", "device_id", "int"},
+	{"source_port", "edge", "source_port", "int"},
+	{"target_port", "edge", "target_port", "int"},
+	{"link_width", "edge", "link_width", "string"},
+	{"link_speed", "edge", "link_speed", "string"},
+	{"state", "edge", "state", "string"},
+}
+
+type GraphMLWriter struct {
+	writer.Recorder
+
+	OutputDir string
+}
+
+// Receiver writes each complete fabric received to a GraphML file in OutputDir, replacing the
+// previous topology of the same HCA and source port.
+func (g *GraphMLWriter) Receiver(input chan infiniband.Fabric) {
+	writer.TopologyReceiver(input, &g.Recorder, g.OutputDir, "graphml", "graphml", writeGraphML)
+}
+
+// counterKeys returns the GraphML keys for the counters of both ends of an edge, sorted by name.
+func counterKeys() []gmlKey {
+	var names []string
+
+	for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+		names = append(names, id.String())
+	}
+
+	sort.Strings(names)
+
+	keys := make([]gmlKey, 0, len(names)*2)
+	for _, end := range []string{"source_", "target_"} {
+		for _, name := range names {
+			keys = append(keys, gmlKey{end + name, "edge", end + name, "long"})
+		}
+	}
+
+	return keys
+}
+
+// counterData returns the counters of a port as GraphML data elements, sorted by key.
+func counterData(prefix string, port *infiniband.Port) []gmlData {
+	var data []gmlData
+
+	for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+		// GraphML long is a signed 64-bit integer, so larger values are omitted rather than
+		// wrapped.
+		if v, ok := port.Counters.Get(id); ok && v <= math.MaxInt64 {
+			data = append(data, gmlData{prefix + id.String(), strconv.FormatUint(v, 10)})
+		}
+	}
+
+	sort.Slice(data, func(i, j int) bool { return data[i].Key < data[j].Key })
+
+	return data
+}
+
+// nmtoken returns s as an XML NMTOKEN (as required of GraphML IDs), with characters other than ASCII
+// letters, digits, '.', '-' and '_' replaced by '_'.
+func nmtoken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+
+		return '_'
+	}, s)
+}
+
+// writeGraphML renders a fabric as an undirected GraphML graph. Nodes are identified by their GUID,
+// and edges carry the counters of the ports at both ends, where available.
+func writeGraphML(w io.Writer, fabric infiniband.Fabric) error {
+	doc := gmlDocument{
+		Keys: append(append([]gmlKey{}, attrKeys...), counterKeys()...),
+		Graph: gmlGraph{
+			ID:          nmtoken(fmt.Sprintf("%s_%s_p%d", fabric.Hostname, fabric.CAName, fabric.SourcePort)),
+			EdgeDefault: "undirected",
+		},
+	}
+
+	nodes := make(map[uint64]*infiniband.Node, len(fabric.Nodes))
+
+	for i, node := range fabric.Nodes {
+		nodes[node.GUID] = &fabric.Nodes[i]
+
+		doc.Graph.Nodes = append(doc.Graph.Nodes, gmlNode{
+			ID: fmt.Sprintf("%016x", node.GUID),
+			Data: []gmlData{
+				{"guid", fmt.Sprintf("%#016x", node.GUID)},
+				{"system_guid", fmt.Sprintf("%#016x", node.SystemGUID)},
+				{"desc", node.NodeDesc},
+				{"type", infiniband.NodeTypeToStr(node.NodeType)},
+				{"vendor_id", strconv.FormatUint(uint64(node.VendorID), 10)},
+				{"device_id", strconv.FormatUint(uint64(node.DeviceID), 10)},
+			},
+		})
+	}
+
+	for i, link := range fabric.Links() {
+		port := nodes[link.LocalGUID].Port(link.LocalPort)
+
+		edge := gmlEdge{
+			ID:     fmt.Sprintf("e%d", i),
+			Source: fmt.Sprintf("%016x", link.LocalGUID),
+			Target: fmt.Sprintf("%016x", link.RemoteGUID),
+			Data: []gmlData{
+				{"source_port", strconv.Itoa(link.LocalPort)},
+				{"target_port", strconv.Itoa(link.RemotePort)},
+				{"link_width", port.LinkWidth},
+				{"link_speed", port.LinkSpeed},
+				{"state", port.State},
+			},
+		}
+
+		edge.Data = append(edge.Data, counterData("source_", port)...)
+
+		if remote, ok := nodes[link.RemoteGUID]; ok {
+			if rp := remote.Port(link.RemotePort); rp != nil {
+				edge.Data = append(edge.Data, counterData("target_", rp)...)
+			}
+		}
+
+		doc.Graph.Edges = append(doc.Graph.Edges, edge)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
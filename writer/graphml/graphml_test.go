@@ -0,0 +1,90 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package graphml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+func TestWriteGraphML(t *testing.T) {
+	port := func(remoteGUID uint64, remotePort int, xmitData uint64) infiniband.Port {
+		p := infiniband.Port{RemoteGUID: remoteGUID, RemotePort: remotePort, State: "Active", LinkWidth: "4X", LinkSpeed: "EDR"}
+		p.Counters.Set(infiniband.SymbolErrorCounter, 7)
+		p.Counters.Set(infiniband.PortXmitData, xmitData)
+
+		return p
+	}
+
+	fabric := infiniband.Fabric{
+		Hostname:   "host1",
+		CAName:     "mlx5_0",
+		SourcePort: 1,
+		Nodes: []infiniband.Node{
+			{GUID: 0x1, SystemGUID: 0x100, NodeType: infiniband.IB_NODE_SWITCH, NodeDesc: "leaf <1> & co",
+				VendorID: 0x2c9, Ports: []infiniband.Port{{}, port(0x2, 1, 1<<63+5)}},
+			{GUID: 0x2, NodeType: infiniband.IB_NODE_CA, NodeDesc: "host1 HCA-1",
+				Ports: []infiniband.Port{{}, port(0x1, 1, 42)}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeGraphML(&buf, fabric); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc gmlDocument
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("cannot parse output: %v\n%s", err, buf.String())
+	}
+
+	if doc.Graph.ID != "host1_mlx5_0_p1" || doc.Graph.EdgeDefault != "undirected" {
+		t.Errorf("unexpected graph: %q, %q", doc.Graph.ID, doc.Graph.EdgeDefault)
+	}
+
+	if len(doc.Keys) != len(attrKeys)+2*int(infiniband.NumCounters) {
+		t.Errorf("unexpected number of keys: %d", len(doc.Keys))
+	}
+
+	wantNode := gmlNode{
+		ID: "0000000000000001",
+		Data: []gmlData{
+			{"guid", "0x0000000000000001"},
+			{"system_guid", "0x0000000000000100"},
+			{"desc", "leaf <1> & co"},
+			{"type", "Switch"},
+			{"vendor_id", "713"},
+			{"device_id", "0"},
+		},
+	}
+
+	if len(doc.Graph.Nodes) != 2 || !reflect.DeepEqual(doc.Graph.Nodes[0], wantNode) {
+		t.Errorf("unexpected nodes: %+v", doc.Graph.Nodes)
+	}
+
+	// The source PortXmitData counter exceeds the range of a GraphML long, and is omitted.
+	wantEdge := gmlEdge{
+		ID:     "e0",
+		Source: "0000000000000001",
+		Target: "0000000000000002",
+		Data: []gmlData{
+			{"source_port", "1"},
+			{"target_port", "1"},
+			{"link_width", "4X"},
+			{"link_speed", "EDR"},
+			{"state", "Active"},
+			{"source_SymbolErrorCounter", "7"},
+			{"target_PortXmitData", "42"},
+			{"target_SymbolErrorCounter", "7"},
+		},
+	}
+
+	if len(doc.Graph.Edges) != 1 || !reflect.DeepEqual(doc.Graph.Edges[0], wantEdge) {
+		t.Errorf("unexpected edges: %+v", doc.Graph.Edges)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package graphviz implements the GraphvizWriter, which writes the fabric topology to a Graphviz
+// DOT file, suitable for rendering printable diagrams with tools such as dot(1) or neato(1).
+package graphviz
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type GraphvizWriter struct {
+	writer.Recorder
+
+	OutputDir string
+}
+
+// Receiver writes each complete fabric received to a DOT file in OutputDir, replacing the previous
+// topology of the same HCA and source port.
+func (g *GraphvizWriter) Receiver(input chan infiniband.Fabric) {
+	writer.TopologyReceiver(input, &g.Recorder, g.OutputDir, "dot", "graphviz", writeDOT)
+}
+
+// quote returns s as a double-quoted DOT ID.
+func quote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+func nodeID(guid uint64) string {
+	return quote(fmt.Sprintf("%016x", guid))
+}
+
+// writeNode writes a DOT node statement, with the specified indentation.
+func writeNode(w io.Writer, indent string, node *infiniband.Node) {
+	var shape string
+
+	switch node.NodeType {
+	case infiniband.IB_NODE_SWITCH:
+		shape = "box"
+	case infiniband.IB_NODE_ROUTER:
+		shape = "diamond"
+	default:
+		shape = "ellipse"
+	}
+
+	fmt.Fprintf(w, "%s%s [label=%s, shape=%s];\n", indent, nodeID(node.GUID),
+		quote(fmt.Sprintf("%s\n%#016x", node.NodeDesc, node.GUID)), shape)
+}
+
+// writeDOT renders a fabric as an undirected Graphviz graph. Switches which share a system image
+// GUID (e.g., the leaf and spine ASICs of a director switch) are grouped in a cluster subgraph.
+// Edges are labelled with the port number at each end, and the link width and speed.
+func writeDOT(w io.Writer, fabric infiniband.Fabric) error {
+	bw := bufio.NewWriter(w)
+
+	// Group switches by system image GUID, preserving discovery order.
+	var systems []uint64
+	chassis := make(map[uint64][]*infiniband.Node)
+
+	for i := range fabric.Nodes {
+		node := &fabric.Nodes[i]
+		if node.NodeType != infiniband.IB_NODE_SWITCH || node.SystemGUID == 0 {
+			continue
+		}
+
+		if _, ok := chassis[node.SystemGUID]; !ok {
+			systems = append(systems, node.SystemGUID)
+		}
+
+		chassis[node.SystemGUID] = append(chassis[node.SystemGUID], node)
+	}
+
+	fmt.Fprintf(bw, "// FabricMon topology from %s %s port %d, discovered %s\n",
+		fabric.Hostname, fabric.CAName, fabric.SourcePort, fabric.Timestamp.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(bw, "graph %s {\n",
+		quote(fmt.Sprintf("%s %s port %d", fabric.Hostname, fabric.CAName, fabric.SourcePort)))
+	fmt.Fprintln(bw, "\tgraph [overlap=false, splines=true];")
+	fmt.Fprintln(bw, "\tnode [fontsize=10];")
+	fmt.Fprintln(bw, "\tedge [fontsize=8];")
+
+	clustered := make(map[uint64]bool)
+
+	for _, sysGUID := range systems {
+		members := chassis[sysGUID]
+		if len(members) < 2 {
+			continue
+		}
+
+		fmt.Fprintf(bw, "\n\tsubgraph %s {\n", quote(fmt.Sprintf("cluster_%016x", sysGUID)))
+		fmt.Fprintf(bw, "\t\tlabel=%s;\n", quote(fmt.Sprintf("system %#016x", sysGUID)))
+
+		for _, node := range members {
+			writeNode(bw, "\t\t", node)
+			clustered[node.GUID] = true
+		}
+
+		fmt.Fprintln(bw, "\t}")
+	}
+
+	fmt.Fprintln(bw)
+
+	for i := range fabric.Nodes {
+		if !clustered[fabric.Nodes[i].GUID] {
+			writeNode(bw, "\t", &fabric.Nodes[i])
+		}
+	}
+
+	fmt.Fprintln(bw)
+
+	nodes := make(map[uint64]*infiniband.Node, len(fabric.Nodes))
+	for i := range fabric.Nodes {
+		nodes[fabric.Nodes[i].GUID] = &fabric.Nodes[i]
+	}
+
+	for _, link := range fabric.Links() {
+		port := nodes[link.LocalGUID].Port(link.LocalPort)
+
+		fmt.Fprintf(bw, "\t%s -- %s [taillabel=%s, headlabel=%s, label=%s];\n",
+			nodeID(link.LocalGUID), nodeID(link.RemoteGUID),
+			quote(fmt.Sprint(link.LocalPort)), quote(fmt.Sprint(link.RemotePort)),
+			quote(strings.TrimSpace(port.LinkWidth+" "+port.LinkSpeed)))
+	}
+
+	fmt.Fprintln(bw, "}")
+
+	return bw.Flush()
+}
@@ -0,0 +1,61 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package graphviz
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+)
+
+func TestWriteDOT(t *testing.T) {
+	port := func(remoteGUID uint64, remotePort int) infiniband.Port {
+		return infiniband.Port{RemoteGUID: remoteGUID, RemotePort: remotePort, LinkWidth: "4X", LinkSpeed: "EDR"}
+	}
+
+	fabric := infiniband.Fabric{
+		Hostname:   "host1",
+		CAName:     "mlx5_0",
+		SourcePort: 1,
+		Timestamp:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Nodes: []infiniband.Node{
+			{GUID: 0x1, SystemGUID: 0x100, NodeType: infiniband.IB_NODE_SWITCH, NodeDesc: "leaf",
+				Ports: []infiniband.Port{{}, port(0x2, 1), port(0x3, 1)}},
+			{GUID: 0x2, SystemGUID: 0x100, NodeType: infiniband.IB_NODE_SWITCH, NodeDesc: "spine",
+				Ports: []infiniband.Port{{}, port(0x1, 1)}},
+			{GUID: 0x3, NodeType: infiniband.IB_NODE_CA, NodeDesc: `host1 "HCA" C:\mlx5_0`,
+				Ports: []infiniband.Port{{}, port(0x1, 2)}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeDOT(&buf, fabric); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `// FabricMon topology from host1 mlx5_0 port 1, discovered 2020-01-02 03:04:05 UTC
+graph "host1 mlx5_0 port 1" {
+	graph [overlap=false, splines=true];
+	node [fontsize=10];
+	edge [fontsize=8];
+
+	subgraph "cluster_0000000000000100" {
+		label="system 0x0000000000000100";
+		"0000000000000001" [label="leaf\n0x0000000000000001", shape=box];
+		"0000000000000002" [label="spine\n0x0000000000000002", shape=box];
+	}
+
+	"0000000000000003" [label="host1 \"HCA\" C:\\mlx5_0\n0x0000000000000003", shape=ellipse];
+
+	"0000000000000001" -- "0000000000000002" [taillabel="1", headlabel="1", label="4X EDR"];
+	"0000000000000001" -- "0000000000000003" [taillabel="2", headlabel="1", label="4X EDR"];
+}
+`
+
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected output:\n%s", got)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package ibsimnet implements the IbsimNetWriter, which writes the fabric topology to an ibsim
+// network file, so that a production fabric can be reproduced offline, with ibsim or FabricMon's
+// ibsim source.
+package ibsimnet
+
+import (
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/ibsim"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+// IbsimNetWriter writes the topology of each complete fabric to an ibsim network file in
+// OutputDir.
+type IbsimNetWriter struct {
+	writer.Recorder
+
+	OutputDir string
+}
+
+// Receiver writes each complete fabric received to an ibsim network file in OutputDir, replacing the
+// previous topology of the same HCA and source port.
+func (w *IbsimNetWriter) Receiver(input chan infiniband.Fabric) {
+	writer.TopologyReceiver(input, &w.Recorder, w.OutputDir, "net", "ibsimnet", ibsim.Write)
+}
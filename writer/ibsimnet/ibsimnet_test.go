@@ -0,0 +1,59 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package ibsimnet
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/ibsim"
+)
+
+func TestReceiverRoundTrip(t *testing.T) {
+	f, err := os.Open("../../ibsim.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	nodes, err := ibsim.Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	c := make(chan infiniband.Fabric, 2)
+	c <- infiniband.Fabric{Hostname: "host1", CAName: "mlx5_0", SourcePort: 1, Nodes: nodes}
+	c <- infiniband.Fabric{Hostname: "host1", CAName: "mlx5_0", SourcePort: 2, Nodes: nodes[:1], Incomplete: true}
+	close(c)
+
+	w := &IbsimNetWriter{OutputDir: dir}
+	w.Receiver(c)
+
+	// The incomplete fabric is not written.
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("unexpected files: %v", entries)
+	}
+
+	out, err := os.Open(filepath.Join(dir, "host1-mlx5_0-p1.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer out.Close()
+
+	again, err := ibsim.Read(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(nodes, again) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", nodes, again)
+	}
+}
@@ -7,6 +7,7 @@ package influxdb
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
 	"strconv"
 	"time"
@@ -15,14 +16,22 @@ import (
 
 	"github.com/dswarbrick/fabricmon/config"
 	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer"
 )
 
 const (
 	// TODO: Consider making this configurable
 	measurementName = "fabricmon_counters"
+
+	// Measurements for monitoring FabricMon itself.
+	sweepMeasurement      = "fabricmon_sweep"
+	nodeErrorsMeasurement = "fabricmon_node_errors"
+	writerMeasurement     = "fabricmon_writer"
 )
 
 type InfluxDBWriter struct {
+	writer.Recorder
+
 	config config.InfluxDBConf
 }
 
@@ -55,6 +64,8 @@ func (w *InfluxDBWriter) Receiver(input chan infiniband.Fabric) {
 		slog.Info("InfluxDB ping reply", "version", version, "rtt", rtt)
 	}
 
+	name := "influxdb " + w.config.URL
+
 	// Loop indefinitely until input chan closed.
 	for fabric := range input {
 		if batch, err := w.makeBatch(fabric); err == nil {
@@ -63,10 +74,14 @@ func (w *InfluxDBWriter) Receiver(input chan infiniband.Fabric) {
 				"port", fabric.SourcePort,
 				"points", len(batch.Points()))
 
-			if err := c.Write(batch); err != nil {
+			err := c.Write(batch)
+			w.Record(name, err)
+
+			if err != nil {
 				slog.Error("InfluxDB batch write error", "err", err)
 			}
 		} else {
+			w.Record(name, err)
 			slog.Error("InfluxDB batch creation error", "err", err)
 		}
 	}
@@ -86,14 +101,38 @@ func (w *InfluxDBWriter) makeBatch(fabric infiniband.Fabric) (client.BatchPoints
 		return batch, err
 	}
 
+	now := time.Now()
+
+	batch.AddPoints(makePoints(fabric, now))
+	batch.AddPoints(writerPoints(fabric.Hostname, writer.WriterStats(), now))
+
+	return batch, nil
+}
+
+// WriteLineProtocol writes the counters of a fabric to w in InfluxDB line protocol, e.g. for
+// consumption by a Telegraf exec input.
+func WriteLineProtocol(w io.Writer, fabric infiniband.Fabric) error {
+	for _, point := range makePoints(fabric, fabric.Timestamp) {
+		if _, err := fmt.Fprintln(w, point.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makePoints creates a point for each counter of each switch port in a fabric, as well as points
+// for the statistics of the sweep which produced the fabric.
+func makePoints(fabric infiniband.Fabric, now time.Time) []*client.Point {
 	tags := map[string]string{
 		"host":     fabric.Hostname,
 		"hca":      fabric.CAName,
 		"src_port": strconv.Itoa(fabric.SourcePort),
 	}
 
+	points := sweepPoints(fabric.Stats, fabric.Incomplete, tags, now)
+
 	fields := map[string]interface{}{}
-	now := time.Now()
 
 	for _, node := range fabric.Nodes {
 		if node.NodeType != infiniband.IB_NODE_SWITCH {
@@ -114,29 +153,91 @@ func (w *InfluxDBWriter) makeBatch(fabric infiniband.Fabric) (client.BatchPoints
 				delete(tags, "remote_node_desc")
 			}
 
-			for counter, value := range port.Counters {
-				switch v := value.(type) {
-				case uint32:
-					tags["counter"] = infiniband.StdCounterMap[counter].Name
-					fields["value"] = int64(v)
-				case uint64:
-					tags["counter"] = infiniband.ExtCounterMap[counter].Name
-					// InfluxDB Client docs erroneously claim that "uint64 data type is supported
-					// if your server is version 1.4.0 or greater."
-					// In fact, it has been decided that InfluxDB 1.x will never support uint64:
-					// https://github.com/influxdata/influxdb/pull/8923
-					// Workaround is to convert to int64 (i.e., truncate to 63 bits).
-					fields["value"] = int64(v & 0x7fffffffffffffff)
-				default:
+			for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+				v, ok := port.Counters.Get(id)
+				if !ok {
 					continue
 				}
 
-				if point, err := client.NewPoint(measurementName, tags, fields, now); err == nil {
-					batch.AddPoint(point)
+				tags["counter"] = id.String()
+				// InfluxDB Client docs erroneously claim that "uint64 data type is supported
+				// if your server is version 1.4.0 or greater."
+				// In fact, it has been decided that InfluxDB 1.x will never support uint64:
+				// https://github.com/influxdata/influxdb/pull/8923
+				// Workaround is to convert to int64 (i.e., truncate to 63 bits).
+				fields["value"] = int64(v & 0x7fffffffffffffff)
+
+				// Points are timestamped with the time at which the port's counters were read.
+				if point, err := client.NewPoint(measurementName, tags, fields, port.Counters.Timestamp); err == nil {
+					points = append(points, point)
 				}
 			}
 		}
 	}
 
-	return batch, nil
+	return points
+}
+
+// sweepPoints creates a point for the statistics of a sweep, and a point for each node which had
+// failed queries.
+func sweepPoints(stats infiniband.SweepStats, incomplete bool, tags map[string]string, now time.Time) []*client.Point {
+	var (
+		points             []*client.Point
+		failures, timeouts uint64
+	)
+
+	nodeTags := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		nodeTags[k] = v
+	}
+
+	for guid, e := range stats.NodeErrors {
+		failures += e.Failures
+		timeouts += e.Timeouts
+
+		nodeTags["guid"] = fmt.Sprintf("%016x", guid)
+		fields := map[string]interface{}{
+			"failures": int64(e.Failures),
+			"timeouts": int64(e.Timeouts),
+		}
+
+		if point, err := client.NewPoint(nodeErrorsMeasurement, nodeTags, fields, now); err == nil {
+			points = append(points, point)
+		}
+	}
+
+	fields := map[string]interface{}{
+		"duration":       stats.Duration.Seconds(),
+		"smps":           int64(stats.SMPs),
+		"pma_queries":    int64(stats.PMAQueries),
+		"counter_resets": int64(stats.CounterResets),
+		"query_failures": int64(failures),
+		"query_timeouts": int64(timeouts),
+		"incomplete":     incomplete,
+	}
+
+	if point, err := client.NewPoint(sweepMeasurement, tags, fields, now); err == nil {
+		points = append([]*client.Point{point}, points...)
+	}
+
+	return points
+}
+
+// writerPoints creates a point for the cumulative write statistics of each writer.
+func writerPoints(host string, stats map[string]writer.Stats, now time.Time) []*client.Point {
+	var points []*client.Point
+
+	for name, s := range stats {
+		tags := map[string]string{"host": host, "writer": name}
+		fields := map[string]interface{}{
+			"successes": int64(s.Successes),
+			"failures":  int64(s.Failures),
+		}
+
+		if point, err := client.NewPoint(writerMeasurement, tags, fields, now); err == nil {
+			points = append(points, point)
+		}
+	}
+
+	return points
 }
@@ -0,0 +1,23 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package influxdb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/writer/writertest"
+)
+
+func TestWriteLineProtocol(t *testing.T) {
+	for _, fabric := range writertest.SweepTwoFabrics(t) {
+		var buf bytes.Buffer
+
+		if err := WriteLineProtocol(&buf, fabric); err != nil {
+			t.Fatal(err)
+		}
+
+		writertest.CheckGolden(t, fabric.CAName+".txt", buf.Bytes())
+	}
+}
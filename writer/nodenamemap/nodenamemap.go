@@ -0,0 +1,120 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package nodenamemap implements the NodeNameMapWriter, which maintains a node name map file of the
+// discovered nodes, so that new switches are named without hand-editing the map.
+package nodenamemap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+// NodeNameMapWriter adds entries for newly discovered nodes to a node name map file, named by
+// Templates, and warns about entries whose nodes have gone missing. Since the nodes of a file may
+// span several fabrics, the most recent fabric of each source port of the latest sweep is
+// considered.
+type NodeNameMapWriter struct {
+	writer.Recorder
+
+	File      string
+	Templates infiniband.NameTemplates
+}
+
+// Receiver updates File with the nodes of each fabric received, along with those of the other
+// source ports of the same sweep. A sweep yields at most one fabric per source port, so a fabric
+// of a source port which has already been received marks the start of the next sweep, whereupon
+// the fabrics of source ports absent from the previous sweep are dropped.
+func (w *NodeNameMapWriter) Receiver(input chan infiniband.Fabric) {
+	var lastMissing []uint64
+
+	fabrics := make(map[string]infiniband.Fabric)
+	swept := make(map[string]bool)
+
+	for fabric := range input {
+		key := fmt.Sprintf("%s-p%d", fabric.CAName, fabric.SourcePort)
+
+		if swept[key] {
+			for k := range fabrics {
+				if !swept[k] {
+					delete(fabrics, k)
+				}
+			}
+
+			clear(swept)
+		}
+
+		swept[key] = true
+		fabrics[key] = fabric
+
+		all := make([]infiniband.Fabric, 0, len(fabrics))
+		for _, f := range fabrics {
+			all = append(all, f)
+		}
+
+		update, err := UpdateFile(w.File, all, w.Templates)
+		w.Record("nodenamemap", err)
+
+		if err != nil {
+			slog.Error("cannot update node name map", "file", w.File, "err", err)
+			continue
+		}
+
+		// Missing nodes are only logged when they change, rather than after every sweep.
+		logged := *update
+		if slices.Equal(update.Missing, lastMissing) {
+			logged.Missing = nil
+		}
+
+		lastMissing = update.Missing
+
+		Log(w.File, &logged)
+	}
+}
+
+// UpdateFile updates a node name map file from the fabrics (see infiniband.UpdateNodeNameMap). The
+// file is atomically replaced, and only if entries are added. A file which does not exist is
+// created.
+func UpdateFile(path string, fabrics []infiniband.Fabric, tmpl infiniband.NameTemplates) (*infiniband.NodeNameMapUpdate, error) {
+	existing, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	update, err := infiniband.UpdateNodeNameMap(bytes.NewReader(existing), &buf, fabrics, tmpl, time.Now())
+	if err != nil || len(update.Added) == 0 {
+		return update, err
+	}
+
+	err = writer.WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+
+	return update, err
+}
+
+// Log logs the entries added by an update of a node name map file, and its entries whose nodes are
+// missing from the fabrics.
+func Log(path string, update *infiniband.NodeNameMapUpdate) {
+	for _, p := range update.Added {
+		slog.Info("adding node to node name map", "file", path, "node_guid", fmt.Sprintf("%#016x", p.GUID),
+			"node_desc", p.NodeDesc, "role", p.Role, "name", p.Name)
+	}
+
+	for _, guid := range update.Missing {
+		slog.Warn("node of node name map missing from fabric", "file", path, "node_guid", fmt.Sprintf("%#016x", guid))
+	}
+}
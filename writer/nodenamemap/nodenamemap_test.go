@@ -0,0 +1,62 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package nodenamemap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/fake"
+)
+
+func TestReceiverMissing(t *testing.T) {
+	var logs bytes.Buffer
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	path := filepath.Join(t.TempDir(), "node-name-map")
+	if err := os.WriteFile(path, []byte("0x0000000000000001\tsw1\n0x0000000000000002\tsw2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		a = &fake.Fabric{CAName: "mlx5_0", SourcePort: 1, Nodes: []infiniband.Node{fake.Switch(1, "sw1", 2)}}
+		b = &fake.Fabric{CAName: "mlx5_1", SourcePort: 1, Nodes: []infiniband.Node{fake.Switch(2, "sw2", 2)}}
+	)
+
+	// The fabric of mlx5_1 fails to be discovered in sweeps 1-3 and 5 onwards.
+	fail := fake.Step{Err: errors.New("unable to open MAD port")}
+	b.Script = []fake.Step{{}, fail, fail, fail, {}, fail, fail}
+
+	src := fake.NewSource(a, b)
+	c := make(chan infiniband.Fabric, 2*len(b.Script))
+
+	for range b.Script {
+		src.Sweep(context.Background(), c, infiniband.SweepConfig{}, false)
+	}
+
+	close(c)
+
+	w := &NodeNameMapWriter{File: path}
+	w.Receiver(c)
+
+	// sw2 is missing while only the fabric of mlx5_0 of the first sweep has been received, and
+	// again once the fabric of mlx5_1 has been dropped in sweep 2 and sweep 6. In between, it is
+	// only logged once, and the fabric of mlx5_1 of sweep 4 clears it.
+	if n := strings.Count(logs.String(), "node of node name map missing from fabric"); n != 3 {
+		t.Fatalf("expected missing node to be logged 3 times, got %d:\n%s", n, logs.String())
+	}
+
+	if strings.Contains(logs.String(), "node_guid=0x0000000000000001") {
+		t.Errorf("sw1 unexpectedly missing:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package prometheus implements encoding of InfiniBand performance counters in the Prometheus text
+// exposition format, and the TextfileWriter, which writes them to files for node_exporter's textfile
+// collector.
+//
+// Each counter is exposed as a separate metric family, named after the InfiniBand counter, e.g.
+// SymbolErrorCounter is exposed as fabricmon_symbol_error_counter_total. Labels correspond to the
+// tags used by the InfluxDB writer.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+const namespace = "fabricmon"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// TextfileWriter writes a .prom file per HCA and source port, for node_exporter's textfile
+// collector. Files are written atomically, so that the collector never reads a partial file.
+type TextfileWriter struct {
+	writer.Recorder
+
+	OutputDir string
+}
+
+// Receiver writes the counters and sweep statistics of each fabric received to a .prom file in
+// OutputDir, along with the writer statistics of FabricMon.
+func (t *TextfileWriter) Receiver(input chan infiniband.Fabric) {
+	for fabric := range input {
+		// The temporary file does not have a .prom suffix, and will be ignored by the collector.
+		destFile := filepath.Join(t.OutputDir, writer.FileName(fabric, "prom"))
+
+		err := writer.WriteFileAtomic(destFile, func(w io.Writer) error {
+			return WriteText(w, fabric)
+		})
+		t.Record("textfile", err)
+
+		if err != nil {
+			slog.Error("cannot write Prometheus textfile", "err", err)
+		}
+
+		// Writer stats are not specific to a fabric, and are written to a separate file, to
+		// avoid duplicate series across files.
+		destFile = filepath.Join(t.OutputDir, "fabricmon-writers.prom")
+
+		err = writer.WriteFileAtomic(destFile, func(w io.Writer) error {
+			return WriteWriterStats(w, writer.WriterStats())
+		})
+
+		if err != nil {
+			slog.Error("cannot write Prometheus textfile", "err", err)
+		}
+	}
+}
+
+type sample struct {
+	labels string
+	value  uint64
+}
+
+// gaugeSample is a sample of a gauge, which may have a fractional value.
+type gaugeSample struct {
+	labels string
+	value  float64
+}
+
+// writeGauge writes a gauge metric family.
+func writeGauge(w io.Writer, name, help string, samples []gaugeSample) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n", namespace, name, help)
+	fmt.Fprintf(w, "# TYPE %s_%s gauge\n", namespace, name)
+
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s_%s%s %s\n", namespace, name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+// writeSweepStats writes the timestamp and statistics of the sweep of each fabric as gauges.
+func writeSweepStats(w io.Writer, fabrics []infiniband.Fabric) {
+	var timestamp, duration, incomplete, smps, pmaQueries, resets, failures, timeouts []gaugeSample
+
+	for _, fabric := range fabrics {
+		srcPort := strconv.Itoa(fabric.SourcePort)
+		labels := formatLabels("host", fabric.Hostname, "hca", fabric.CAName, "src_port", srcPort)
+		stats := fabric.Stats
+
+		timestamp = append(timestamp, gaugeSample{labels, float64(fabric.Timestamp.Unix())})
+		duration = append(duration, gaugeSample{labels, stats.Duration.Seconds()})
+
+		var v float64
+		if fabric.Incomplete {
+			v = 1
+		}
+		incomplete = append(incomplete, gaugeSample{labels, v})
+		smps = append(smps, gaugeSample{labels, float64(stats.SMPs)})
+		pmaQueries = append(pmaQueries, gaugeSample{labels, float64(stats.PMAQueries)})
+		resets = append(resets, gaugeSample{labels, float64(stats.CounterResets)})
+
+		guids := make([]uint64, 0, len(stats.NodeErrors))
+		for guid := range stats.NodeErrors {
+			guids = append(guids, guid)
+		}
+		sort.Slice(guids, func(i, j int) bool { return guids[i] < guids[j] })
+
+		for _, guid := range guids {
+			nodeLabels := formatLabels("host", fabric.Hostname, "hca", fabric.CAName, "src_port", srcPort,
+				"guid", fmt.Sprintf("%016x", guid))
+
+			failures = append(failures, gaugeSample{nodeLabels, float64(stats.NodeErrors[guid].Failures)})
+			timeouts = append(timeouts, gaugeSample{nodeLabels, float64(stats.NodeErrors[guid].Timeouts)})
+		}
+	}
+
+	writeGauge(w, "sweep_timestamp_seconds", "Time at which the fabric discovery completed.", timestamp)
+	writeGauge(w, "sweep_duration_seconds", "Duration of the last fabric discovery and counter collection.", duration)
+	writeGauge(w, "sweep_incomplete", "Whether the last sweep was cancelled or timed out before all nodes were walked.", incomplete)
+	writeGauge(w, "sweep_smps", "Estimated number of SMPs sent during the last fabric discovery.", smps)
+	writeGauge(w, "sweep_pma_queries", "Number of performance management queries during the last sweep.", pmaQueries)
+	writeGauge(w, "sweep_counter_resets", "Number of counter resets issued during the last sweep.", resets)
+	writeGauge(w, "sweep_node_query_failures", "Number of failed performance management queries of a node during the last sweep.", failures)
+	writeGauge(w, "sweep_node_query_timeouts", "Number of timed out performance management queries of a node during the last sweep.", timeouts)
+}
+
+// WriteWriterStats writes the cumulative write statistics of FabricMon's writers to w in the
+// Prometheus text exposition format.
+func WriteWriterStats(w io.Writer, stats map[string]writer.Stats) error {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP %s_writer_writes_total Number of writes by a writer, by result.\n", namespace)
+	fmt.Fprintf(bw, "# TYPE %s_writer_writes_total counter\n", namespace)
+
+	for _, name := range names {
+		fmt.Fprintf(bw, "%s_writer_writes_total%s %d\n", namespace,
+			formatLabels("writer", name, "result", "success"), stats[name].Successes)
+		fmt.Fprintf(bw, "%s_writer_writes_total%s %d\n", namespace,
+			formatLabels("writer", name, "result", "failure"), stats[name].Failures)
+	}
+
+	var lastSuccess []gaugeSample
+
+	for _, name := range names {
+		if t := stats[name].LastSuccess; !t.IsZero() {
+			lastSuccess = append(lastSuccess, gaugeSample{formatLabels("writer", name), float64(t.Unix())})
+		}
+	}
+
+	writeGauge(bw, "writer_last_success_timestamp_seconds", "Time of the last successful write by a writer.", lastSuccess)
+
+	return bw.Flush()
+}
+
+// MetricName converts an InfiniBand counter name to a Prometheus metric name, e.g.
+// "PortXmitData" becomes "fabricmon_port_xmit_data_total".
+func MetricName(counter string) string {
+	var b strings.Builder
+
+	b.WriteString(namespace + "_")
+
+	runes := []rune(counter)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && !unicode.IsUpper(runes[i-1]) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	b.WriteString("_total")
+
+	return b.String()
+}
+
+// formatLabels formats label name-value pairs as a Prometheus label set.
+func formatLabels(pairs ...string) string {
+	var b strings.Builder
+
+	b.WriteByte('{')
+
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// WriteText writes the counters of each switch port in the fabrics, and the statistics of the sweeps
+// which produced them, to w in the Prometheus text exposition format. Samples of all fabrics are
+// grouped by metric family, so that the output is a valid exposition even when it comprises
+// multiple fabrics.
+func WriteText(w io.Writer, fabrics ...infiniband.Fabric) error {
+	families := make(map[string][]sample)
+	help := make(map[string]string)
+
+	bw := bufio.NewWriter(w)
+
+	writeSweepStats(bw, fabrics)
+
+	for _, fabric := range fabrics {
+		srcPort := strconv.Itoa(fabric.SourcePort)
+
+		for _, node := range fabric.Nodes {
+			if node.NodeType != infiniband.IB_NODE_SWITCH {
+				continue
+			}
+
+			guid := fmt.Sprintf("%016x", node.GUID)
+
+			for portNum, port := range node.Ports {
+				var remoteGUID string
+
+				if port.RemoteGUID != 0 {
+					remoteGUID = fmt.Sprintf("%016x", port.RemoteGUID)
+				}
+
+				labels := formatLabels(
+					"host", fabric.Hostname,
+					"hca", fabric.CAName,
+					"src_port", srcPort,
+					"guid", guid,
+					"node_desc", node.NodeDesc,
+					"port", strconv.Itoa(portNum),
+					"remote_guid", remoteGUID,
+					"remote_node_desc", port.RemoteNodeDesc)
+
+				for id := infiniband.CounterID(0); id < infiniband.NumCounters; id++ {
+					v, ok := port.Counters.Get(id)
+					if !ok {
+						continue
+					}
+
+					info := id.Info()
+					metric := MetricName(info.Name)
+					families[metric] = append(families[metric], sample{labels, v})
+
+					if _, ok := help[metric]; !ok {
+						help[metric] = "InfiniBand " + info.Name + " port counter"
+						if info.Scale != 1 {
+							help[metric] += fmt.Sprintf(" (%s divided by %d)", info.Unit, info.Scale)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	metrics := make([]string, 0, len(families))
+	for metric := range families {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	for _, metric := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s.\n", metric, help[metric])
+		fmt.Fprintf(bw, "# TYPE %s counter\n", metric)
+
+		for _, s := range families[metric] {
+			fmt.Fprintf(bw, "%s%s %d\n", metric, s.labels, s.value)
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,93 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package prometheus
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/writer/writertest"
+)
+
+func TestMetricName(t *testing.T) {
+	names := map[string]string{
+		"SymbolErrorCounter":           "fabricmon_symbol_error_counter_total",
+		"PortXmitData":                 "fabricmon_port_xmit_data_total",
+		"VL15Dropped":                  "fabricmon_vl15_dropped_total",
+		"ExcessiveBufferOverrunErrors": "fabricmon_excessive_buffer_overrun_errors_total",
+	}
+
+	for counter, expected := range names {
+		if metric := MetricName(counter); metric != expected {
+			t.Errorf("MetricName(%q) = %q, expected %q", counter, metric, expected)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	if l := formatLabels("a", "1", "b", `x"y\z`); l != `{a="1",b="x\"y\\z"}` {
+		t.Fatalf("unexpected label set: %s", l)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Samples of both fabrics are grouped into a single family per metric.
+	if err := WriteText(&buf, writertest.SweepTwoFabrics(t)...); err != nil {
+		t.Fatal(err)
+	}
+
+	writertest.CheckGolden(t, "fabrics.prom", buf.Bytes())
+}
+
+func TestTextfileWriter(t *testing.T) {
+	dir := t.TempDir()
+	fabrics := writertest.SweepTwoFabrics(t)
+
+	c := make(chan infiniband.Fabric, len(fabrics))
+	for _, f := range fabrics {
+		c <- f
+	}
+
+	close(c)
+
+	tw := &TextfileWriter{OutputDir: dir}
+	tw.Receiver(c)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	// No temporary files remain.
+	want := []string{"fabricmon-writers.prom", "fmhost-mlx5_0-p1.prom", "fmhost-mlx5_1-p2.prom"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("unexpected files: %v", names)
+	}
+
+	for i, f := range fabrics {
+		var buf bytes.Buffer
+		if err := WriteText(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+
+		if b, _ := os.ReadFile(filepath.Join(dir, want[i+1])); !bytes.Equal(b, buf.Bytes()) {
+			t.Errorf("unexpected content of %s:\n%s", want[i+1], b)
+		}
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(dir, want[0])); !bytes.Contains(b, []byte(`fabricmon_writer_writes_total{writer="textfile",result="success"} `)) {
+		t.Errorf("unexpected writer stats:\n%s", b)
+	}
+}
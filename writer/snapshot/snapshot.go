@@ -0,0 +1,106 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package snapshot implements the SnapshotWriter, which records every fabric received to a
+// snapshot file, so that it can later be replayed with the replay command.
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	snap "github.com/dswarbrick/fabricmon/infiniband/snapshot"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+// SnapshotWriter records fabrics to a new snapshot file in OutputDir, named after the hostname and
+// the time of the first fabric, which is completed when the writer stops (e.g., when FabricMon
+// exits, or the writer is reconfigured). If a fabric cannot be written, the file is abandoned (its
+// fabrics written so far remain replayable), and the next fabric is recorded to a new file.
+type SnapshotWriter struct {
+	writer.Recorder
+
+	OutputDir string
+
+	// createFile creates a snapshot file. It defaults to creating a file exclusively, and may be
+	// replaced in tests.
+	createFile func(path string) (io.WriteCloser, error)
+}
+
+func (s *SnapshotWriter) Receiver(input chan infiniband.Fabric) {
+	var (
+		f   io.WriteCloser
+		enc *snap.Encoder
+	)
+
+	for fabric := range input {
+		if enc == nil {
+			var (
+				path string
+				err  error
+			)
+
+			if f, enc, path, err = s.create(fabric); err != nil {
+				s.Record("snapshot", err)
+				slog.Error("cannot create snapshot file", "err", err)
+				continue
+			}
+
+			slog.Info("recording snapshots", "file", path)
+		}
+
+		// Flush after every fabric, so that the file can be replayed while it is being recorded.
+		err := enc.Encode(fabric)
+		if err == nil {
+			err = enc.Flush()
+		}
+
+		s.Record("snapshot", err)
+
+		if err != nil {
+			// The compressed stream cannot be continued after a failed write.
+			slog.Error("cannot write snapshot, starting a new file", "err", err)
+			f.Close()
+			f, enc = nil, nil
+		}
+	}
+
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			slog.Error("cannot complete snapshot file", "err", err)
+		}
+
+		f.Close()
+	}
+}
+
+// create creates a new snapshot file, named after the first fabric to be recorded, and returns it
+// along with its encoder and path.
+func (s *SnapshotWriter) create(fabric infiniband.Fabric) (io.WriteCloser, *snap.Encoder, string, error) {
+	name := fmt.Sprintf("%s-%s.%s", fabric.Hostname, fabric.Timestamp.UTC().Format("20060102T150405Z"), snap.FileExt)
+	path := filepath.Join(s.OutputDir, name)
+
+	createFile := s.createFile
+	if createFile == nil {
+		createFile = func(path string) (io.WriteCloser, error) {
+			return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		}
+	}
+
+	f, err := createFile(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	enc, err := snap.NewEncoder(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, "", err
+	}
+
+	return f, enc, path, nil
+}
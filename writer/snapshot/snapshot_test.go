@@ -0,0 +1,115 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	snap "github.com/dswarbrick/fabricmon/infiniband/snapshot"
+	"github.com/dswarbrick/fabricmon/writer"
+)
+
+// failingFile is a file whose writes fail while fail is set.
+type failingFile struct {
+	*os.File
+	fail *atomic.Bool
+}
+
+func (f failingFile) Write(p []byte) (int, error) {
+	if f.fail.Load() {
+		return 0, errors.New("disk full")
+	}
+
+	return f.File.Write(p)
+}
+
+// replayed returns the timestamps of the fabrics of a snapshot file.
+func replayed(t *testing.T, path string) []time.Time {
+	t.Helper()
+
+	r, err := snap.NewReplay(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	var ts []time.Time
+
+	c := make(chan infiniband.Fabric, 1)
+
+	for {
+		if err := r.Sweep(context.Background(), c, infiniband.SweepConfig{}, false); err == io.EOF {
+			return ts
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		ts = append(ts, (<-c).Timestamp)
+	}
+}
+
+func TestSnapshotWriterError(t *testing.T) {
+	var fail atomic.Bool
+
+	dir := t.TempDir()
+	w := &SnapshotWriter{
+		OutputDir: dir,
+		createFile: func(path string) (io.WriteCloser, error) {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			return failingFile{f, &fail}, err
+		},
+	}
+
+	input := make(chan infiniband.Fabric)
+	done := make(chan struct{})
+
+	go func() {
+		w.Receiver(input)
+		close(done)
+	}()
+
+	// send sends a fabric, and waits until the writer has recorded its write.
+	send := func(sec int64) {
+		s := writer.WriterStats()["snapshot"]
+		input <- infiniband.Fabric{Hostname: "host1", CAName: "mlx5_0", SourcePort: 1, Timestamp: time.Unix(sec, 0)}
+
+		for n := s.Successes + s.Failures; ; time.Sleep(time.Millisecond) {
+			if s := writer.WriterStats()["snapshot"]; s.Successes+s.Failures > n {
+				return
+			}
+		}
+	}
+
+	// The second fabric cannot be written, so the third is recorded to a new file.
+	send(1)
+	fail.Store(true)
+	send(2)
+	fail.Store(false)
+	send(3)
+	send(4)
+	close(input)
+	<-done
+
+	files, err := filepath.Glob(filepath.Join(dir, "*."+snap.FileExt))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("unexpected snapshot files: %v, %v", files, err)
+	}
+
+	if ts := replayed(t, files[0]); len(ts) != 1 || ts[0].Unix() != 1 {
+		t.Errorf("unexpected fabrics in abandoned file: %v", ts)
+	}
+
+	if ts := replayed(t, files[1]); len(ts) != 2 || ts[0].Unix() != 3 || ts[1].Unix() != 4 {
+		t.Errorf("unexpected fabrics in new file: %v", ts)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package writer
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats holds the outcomes of a writer's writes, for monitoring FabricMon itself.
+type Stats struct {
+	Successes   uint64    `json:"successes"`
+	Failures    uint64    `json:"failures"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = make(map[string]*Stats)
+)
+
+// Recorder records the outcomes of a writer's writes under the name assigned to the writer. Writers
+// embed a Recorder so that the router can name them after their key, which keeps the stats of
+// several instances of the same writer type apart.
+type Recorder struct {
+	name string
+}
+
+// SetName sets the name under which the writer's writes are recorded. It must be called before the
+// writer's Receiver is started.
+func (r *Recorder) SetName(name string) {
+	r.name = name
+}
+
+// Record records the outcome of a write by the writer. If the writer has not been named, e.g. when
+// it is run outside of the router, the outcome is recorded under def.
+func (r *Recorder) Record(def string, err error) {
+	name := r.name
+	if name == "" {
+		name = def
+	}
+
+	RecordWrite(name, err)
+}
+
+// RecordWrite records the outcome of a write by the named writer. Writers of the same type should
+// use distinct names if there may be several instances of them, e.g. one per InfluxDB URL.
+func RecordWrite(name string, err error) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	s, ok := stats[name]
+	if !ok {
+		s = &Stats{}
+		stats[name] = s
+	}
+
+	if err == nil {
+		s.Successes++
+		s.LastSuccess = time.Now()
+	} else {
+		s.Failures++
+		s.LastFailure = time.Now()
+		s.LastError = err.Error()
+	}
+}
+
+// DeleteStats deletes the stats of the named writer. It is called once a writer has stopped, so that
+// its stats are neither reported nor considered in health checks any longer.
+func DeleteStats(name string) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	delete(stats, name)
+}
+
+// WriterStats returns a copy of the stats of all writers which have recorded writes, keyed by
+// writer name.
+func WriterStats() map[string]Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	m := make(map[string]Stats, len(stats))
+	for name, s := range stats {
+		m[name] = *s
+	}
+
+	return m
+}
@@ -0,0 +1,66 @@
+// Copyright 2017-20 Daniel Swarbrick. All rights reserved.
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package writertest provides helpers for tests of writers, which compare their output for the
+// fabrics of fake.TwoFabrics with golden files.
+package writertest
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dswarbrick/fabricmon/infiniband"
+	"github.com/dswarbrick/fabricmon/infiniband/fake"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// SweepTwoFabrics sweeps the fabrics of fake.TwoFabrics once, and returns the swept fabrics. With a
+// reset threshold of zero, the (non-extended) counters of the first fabric are reset after they
+// are read.
+func SweepTwoFabrics(tb testing.TB) []infiniband.Fabric {
+	tb.Helper()
+
+	src := fake.TwoFabrics()
+	c := make(chan infiniband.Fabric, 2)
+
+	if err := src.Sweep(context.Background(), c, infiniband.SweepConfig{}, true); err != nil {
+		tb.Fatal(err)
+	}
+
+	close(c)
+
+	var fabrics []infiniband.Fabric
+	for f := range c {
+		fabrics = append(fabrics, f)
+	}
+
+	return fabrics
+}
+
+// CheckGolden compares output with the named golden file in testdata, or updates the golden file
+// if the -update flag is set.
+func CheckGolden(tb testing.TB, name string, got []byte) {
+	tb.Helper()
+
+	path := filepath.Join("testdata", name)
+
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		tb.Errorf("output differs from %s:\n%s", path, got)
+	}
+}